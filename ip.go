@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
@@ -387,6 +388,17 @@ type UdpBufferSettings struct {
 	// the number of open sockets per user
 	// uses an lru cleanup where new sockets over the limit close old sockets
 	UserLimit int
+	// bind each socket to the source ip of its packets, which must be a local address
+	// this lets the packet source choose the egress address of a host with multiple addresses
+	BindSourceIp bool
+	// set the dscp of the first packet of each flow on its socket (ip tos or ipv6 traffic class),
+	// so that the marks of the packet source reach the wire. The ecn field is left to the os.
+	SetTrafficClass bool
+	// deliver the icmp errors received by each socket (e.g. port unreachable or fragmentation needed)
+	// to the packet source, embedding the header of the packet that caused the error
+	// the default is off. This is only supported on linux (`IP_RECVERR`),
+	// and is ignored on other platforms (see `socketIcmpErrorsSupported`)
+	ReceiveIcmpErrors bool
 }
 
 type Udp4Buffer struct {
@@ -415,6 +427,7 @@ func (self *Udp4Buffer) send(source TransferPath, provideMode protocol.ProvideMo
 		source,
 		provideMode,
 		4,
+		ipv4.TOS,
 		udp,
 		timeout,
 	)
@@ -446,6 +459,7 @@ func (self *Udp6Buffer) send(source TransferPath, provideMode protocol.ProvideMo
 		source,
 		provideMode,
 		6,
+		ipv6.TrafficClass,
 		udp,
 		timeout,
 	)
@@ -483,6 +497,7 @@ func (self *UdpBuffer[BufferId]) udpSend(
 	source TransferPath,
 	provideMode protocol.ProvideMode,
 	ipVersion int,
+	trafficClass uint8,
 	udp *layers.UDP,
 	timeout time.Duration,
 ) (bool, error) {
@@ -535,6 +550,7 @@ func (self *UdpBuffer[BufferId]) udpSend(
 			udp.SrcPort,
 			destinationIp,
 			udp.DstPort,
+			trafficClass,
 			self.udpBufferSettings,
 		)
 		self.sequences[bufferId] = sequence
@@ -588,6 +604,7 @@ func NewUdpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
 	ipVersion int,
 	sourceIp net.IP, sourcePort layers.UDPPort,
 	destinationIp net.IP, destinationPort layers.UDPPort,
+	trafficClass uint8,
 	udpBufferSettings *UdpBufferSettings) *UdpSequence {
 	cancelCtx, cancel := context.WithCancel(ctx)
 	streamState := StreamState{
@@ -597,6 +614,7 @@ func NewUdpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
 		sourcePort:      sourcePort,
 		destinationIp:   destinationIp,
 		destinationPort: destinationPort,
+		trafficClass:    trafficClass,
 		userLimited:     *newUserLimited(),
 	}
 	return &UdpSequence{
@@ -650,6 +668,73 @@ func (self *UdpSequence) send(sendItem *UdpSendItem, timeout time.Duration) (boo
 	}
 }
 
+// sets the dscp of `trafficClass` on a socket
+// a failure is logged and does not fail the dial, since the packets are still delivered without the mark
+func trafficClassOption(trafficClass uint8) func(fd SocketHandle, ipv6 bool) {
+	return func(fd SocketHandle, ipv6 bool) {
+		if dscp := trafficClass &^ 0x03; dscp != 0 {
+			if err := setSocketTrafficClass(fd, ipv6, dscp); err != nil {
+				glog.Infof("[init]set traffic class error = %s\n", err)
+			}
+		}
+	}
+}
+
+// queues the icmp errors received by a socket, see `UdpBufferSettings.ReceiveIcmpErrors`
+// a failure is logged and does not fail the dial
+func recvErrOption(fd SocketHandle, ipv6 bool) {
+	if err := setSocketRecvErr(fd, ipv6); err != nil {
+		glog.Infof("[init]receive icmp errors error = %s\n", err)
+	}
+}
+
+// returns a `net.Dialer` control that calls the `setOptions` on the socket
+func socketControl(setOptions ...func(fd SocketHandle, ipv6 bool)) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		ipv6 := strings.HasSuffix(network, "6")
+		err := c.Control(func(fd uintptr) {
+			for _, setOption := range setOptions {
+				setOption(SocketHandle(fd), ipv6)
+			}
+		})
+		if err != nil {
+			glog.Infof("[init]socket control error = %s\n", err)
+		}
+		return nil
+	}
+}
+
+// an icmp error received by a socket, see `UdpBufferSettings.ReceiveIcmpErrors`
+type socketIcmpError struct {
+	icmpType uint8
+	icmpCode uint8
+	// the type specific info, e.g. the next hop mtu
+	info uint32
+	// the sender of the error, or nil if unknown
+	offender net.IP
+	// the payload of the datagram that caused the error
+	payload []byte
+}
+
+func dialUdp(sourceIp net.IP, trafficClass uint8, address string, udpBufferSettings *UdpBufferSettings) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	setOptions := []func(fd SocketHandle, ipv6 bool){}
+	if udpBufferSettings.SetTrafficClass {
+		setOptions = append(setOptions, trafficClassOption(trafficClass))
+	}
+	if udpBufferSettings.ReceiveIcmpErrors && socketIcmpErrorsSupported {
+		setOptions = append(setOptions, recvErrOption)
+	}
+	if 0 < len(setOptions) {
+		dialer.Control = socketControl(setOptions...)
+	}
+	if udpBufferSettings.BindSourceIp {
+		// the os picks the port
+		dialer.LocalAddr = &net.UDPAddr{IP: sourceIp}
+	}
+	return dialer.Dial("udp", address)
+}
+
 func (self *UdpSequence) Run() {
 	defer self.cancel()
 
@@ -658,10 +743,7 @@ func (self *UdpSequence) Run() {
 	}
 
 	glog.V(2).Infof("[init]udp connect\n")
-	socket, err := net.Dial(
-		"udp",
-		self.DestinationAuthority(),
-	)
+	socket, err := dialUdp(self.sourceIp, self.trafficClass, self.DestinationAuthority(), self.udpBufferSettings)
 	if err != nil {
 		glog.Infof("[init]udp connect error = %s\n", err)
 		return
@@ -708,7 +790,10 @@ func (self *UdpSequence) Run() {
 			}
 
 			if err != nil {
-				if err == io.EOF {
+				if self.udpBufferSettings.ReceiveIcmpErrors && self.receiveIcmpErrors(socket, err) {
+					// the error was received by the socket, which is still open
+					continue
+				} else if err == io.EOF {
 					return
 				} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					glog.Infof("[f%d]timeout\n", forwardIter)
@@ -734,6 +819,21 @@ func (self *UdpSequence) Run() {
 
 				payload := sendItem.udp.Payload
 
+				if len(payload) == 0 {
+					// an empty datagram, e.g. a keepalive of the flow
+					socket.SetWriteDeadline(writeEndTime)
+					_, err := socket.Write(payload)
+					if err == nil {
+						glog.V(2).Infof("[f%d]udp forward empty\n", sendIter)
+						self.UpdateLastActivityTime()
+					} else {
+						glog.Infof("[f%d]udp forward empty error = %s", sendIter, err)
+						if !self.udpBufferSettings.ReceiveIcmpErrors || !self.receiveIcmpErrors(socket, err) {
+							return
+						}
+					}
+				}
+
 				for i := 0; i < len(payload); {
 					select {
 					case <-self.ctx.Done():
@@ -759,7 +859,10 @@ func (self *UdpSequence) Run() {
 					}
 
 					if err != nil {
-						if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+						if self.udpBufferSettings.ReceiveIcmpErrors && self.receiveIcmpErrors(socket, err) {
+							// the error was received by the socket, which is still open. Drop the payload.
+							break
+						} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 							return
 						} else {
 							// some other error
@@ -782,6 +885,45 @@ func (self *UdpSequence) Run() {
 	}
 }
 
+// delivers the icmp errors queued on the socket to the source
+// returns true if `err` is an error of the socket, which the os reports for an icmp error it received
+func (self *UdpSequence) receiveIcmpErrors(socket net.Conn, err error) bool {
+	if !socketIcmpErrorsSupported {
+		return false
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	syscallConn, ok := socket.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rawConn, rawErr := syscallConn.SyscallConn()
+	if rawErr != nil {
+		return false
+	}
+
+	icmpErrors, readErr := readSocketIcmpErrors(rawConn, self.udpBufferSettings.ReadBufferByteCount)
+	if readErr != nil {
+		glog.Infof("[f]udp receive icmp errors error = %s\n", readErr)
+	}
+	ipProtocol := IpProtocolIcmp
+	if self.ipVersion == 6 {
+		ipProtocol = IpProtocolIcmpv6
+	}
+	for _, icmpError := range icmpErrors {
+		packet, packetErr := self.IcmpErrorPacket(icmpError)
+		if packetErr != nil {
+			glog.Infof("[f]udp receive icmp error packet error = %s\n", packetErr)
+			continue
+		}
+		glog.V(1).Infof("[f]udp receive icmp error %d/%d\n", icmpError.icmpType, icmpError.icmpCode)
+		self.receiveCallback(self.source, ipProtocol, packet)
+	}
+	return true
+}
+
 func (self *UdpSequence) Cancel() {
 	self.cancel()
 }
@@ -803,6 +945,8 @@ type StreamState struct {
 	sourcePort      layers.UDPPort
 	destinationIp   net.IP
 	destinationPort layers.UDPPort
+	// of the first packet
+	trafficClass uint8
 
 	userLimited
 }
@@ -910,6 +1054,106 @@ func (self *StreamState) DataPackets(payload []byte, n int, mtu int) ([][]byte,
 	}
 }
 
+// the ip packet of an icmp error received by the socket, to the source
+// the error embeds the header of the packet that caused it, as sent by the source
+func (self *StreamState) IcmpErrorPacket(icmpError *socketIcmpError) ([]byte, error) {
+	options := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+
+	// the packet that caused the error
+	var sentIp gopacket.NetworkLayer
+	switch self.ipVersion {
+	case 4:
+		sentIp = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			SrcIP:    self.sourceIp,
+			DstIP:    self.destinationIp,
+			Protocol: layers.IPProtocolUDP,
+		}
+	case 6:
+		sentIp = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			SrcIP:      self.sourceIp,
+			DstIP:      self.destinationIp,
+			NextHeader: layers.IPProtocolUDP,
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown ip version %d.", self.ipVersion))
+	}
+	sentUdp := layers.UDP{
+		SrcPort: self.sourcePort,
+		DstPort: self.destinationPort,
+	}
+	sentUdp.SetNetworkLayerForChecksum(sentIp)
+	sentBuffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(sentBuffer, options,
+		sentIp.(gopacket.SerializableLayer),
+		&sentUdp,
+		gopacket.Payload(icmpError.payload),
+	)
+	if err != nil {
+		return nil, err
+	}
+	sent := sentBuffer.Bytes()
+
+	sourceIp := icmpError.offender
+	if sourceIp == nil || sourceIp.IsUnspecified() {
+		sourceIp = self.destinationIp
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	switch self.ipVersion {
+	case 4:
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			SrcIP:    sourceIp,
+			DstIP:    self.sourceIp,
+			Protocol: layers.IPProtocolICMPv4,
+		}
+		icmp := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(icmpError.icmpType, icmpError.icmpCode),
+		}
+		if icmpError.icmpType == layers.ICMPv4TypeDestinationUnreachable && icmpError.icmpCode == layers.ICMPv4CodeFragmentationNeeded {
+			// the next hop mtu
+			icmp.Seq = uint16(icmpError.info)
+		}
+		// the ip header and the first 8 bytes of the payload (rfc 792)
+		embedded := sent[0:min(len(sent), Ipv4HeaderSizeWithoutExtensions+UdpHeaderSize)]
+		err = gopacket.SerializeLayers(buffer, options, ip, icmp, gopacket.Payload(embedded))
+	case 6:
+		ip := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			SrcIP:      sourceIp,
+			DstIP:      self.sourceIp,
+			NextHeader: layers.IPProtocolICMPv6,
+		}
+		icmp := &layers.ICMPv6{
+			TypeCode: layers.CreateICMPv6TypeCode(icmpError.icmpType, icmpError.icmpCode),
+		}
+		icmp.SetNetworkLayerForChecksum(ip)
+		// the second word of the header is the mtu of packet too big, or the pointer of parameter problem
+		restOfHeader := uint32(0)
+		switch icmpError.icmpType {
+		case layers.ICMPv6TypePacketTooBig, layers.ICMPv6TypeParameterProblem:
+			restOfHeader = icmpError.info
+		}
+		// as much of the packet as fits in the minimum ipv6 mtu (rfc 4443)
+		embedded := binary.BigEndian.AppendUint32(nil, restOfHeader)
+		embedded = append(embedded, sent[0:min(len(sent), 1280-Ipv6HeaderSize-8)]...)
+		err = gopacket.SerializeLayers(buffer, options, ip, icmp, gopacket.Payload(embedded))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
 type TcpBufferSettings struct {
 	ConnectTimeout     time.Duration
 	ReadTimeout        time.Duration
@@ -929,6 +1173,13 @@ type TcpBufferSettings struct {
 	// the number of open sockets per user
 	// uses an lru cleanup where new sockets over the limit close old sockets
 	UserLimit int
+	// the interval of the keepalives of idle sockets, which keep the mappings of the NATs on the way
+	// 0 uses the default of `net.Dialer`, and a negative value disables keepalives
+	KeepAlivePeriod time.Duration
+	// see `UdpBufferSettings.BindSourceIp`
+	BindSourceIp bool
+	// see `UdpBufferSettings.SetTrafficClass`
+	SetTrafficClass bool
 }
 
 type Tcp4Buffer struct {
@@ -957,6 +1208,7 @@ func (self *Tcp4Buffer) send(source TransferPath, provideMode protocol.ProvideMo
 		source,
 		provideMode,
 		4,
+		ipv4.TOS,
 		tcp,
 		timeout,
 	)
@@ -988,6 +1240,7 @@ func (self *Tcp6Buffer) send(source TransferPath, provideMode protocol.ProvideMo
 		source,
 		provideMode,
 		6,
+		ipv6.TrafficClass,
 		tcp,
 		timeout,
 	)
@@ -1025,6 +1278,7 @@ func (self *TcpBuffer[BufferId]) tcpSend(
 	source TransferPath,
 	provideMode protocol.ProvideMode,
 	ipVersion int,
+	trafficClass uint8,
 	tcp *layers.TCP,
 	timeout time.Duration,
 ) (bool, error) {
@@ -1082,6 +1336,7 @@ func (self *TcpBuffer[BufferId]) tcpSend(
 			tcp.SrcPort,
 			destinationIp,
 			tcp.DstPort,
+			trafficClass,
 			self.tcpBufferSettings,
 		)
 		self.sequences[bufferId] = sequence
@@ -1115,6 +1370,22 @@ func (self *TcpBuffer[BufferId]) tcpSend(
 	}
 }
 
+// the dialer sets the keepalive on the socket with `SetKeepAlive` and `SetKeepAlivePeriod`
+func dialTcp(sourceIp net.IP, trafficClass uint8, address string, tcpBufferSettings *TcpBufferSettings) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   tcpBufferSettings.ConnectTimeout,
+		KeepAlive: tcpBufferSettings.KeepAlivePeriod,
+	}
+	if tcpBufferSettings.SetTrafficClass {
+		dialer.Control = socketControl(trafficClassOption(trafficClass))
+	}
+	if tcpBufferSettings.BindSourceIp {
+		// the os picks the port
+		dialer.LocalAddr = &net.TCPAddr{IP: sourceIp}
+	}
+	return dialer.Dial("tcp", address)
+}
+
 /*
 ** Important implementation note **
 In this implementation, packet flow from the UNAT to the source
@@ -1143,6 +1414,7 @@ func NewTcpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
 	ipVersion int,
 	sourceIp net.IP, sourcePort layers.TCPPort,
 	destinationIp net.IP, destinationPort layers.TCPPort,
+	trafficClass uint8,
 	tcpBufferSettings *TcpBufferSettings) *TcpSequence {
 	cancelCtx, cancel := context.WithCancel(ctx)
 
@@ -1153,6 +1425,7 @@ func NewTcpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
 		sourcePort:      sourcePort,
 		destinationIp:   destinationIp,
 		destinationPort: destinationPort,
+		trafficClass:    trafficClass,
 		// the window size starts at the fixed value
 		enableWindowScale: false,
 		windowSize:        tcpBufferSettings.WindowSize,
@@ -1318,11 +1591,7 @@ func (self *TcpSequence) Run() {
 	}
 
 	glog.V(2).Infof("[init]tcp connect\n")
-	socket, err := net.DialTimeout(
-		"tcp",
-		self.DestinationAuthority(),
-		self.tcpBufferSettings.ConnectTimeout,
-	)
+	socket, err := dialTcp(self.sourceIp, self.trafficClass, self.DestinationAuthority(), self.tcpBufferSettings)
 	if err != nil {
 		glog.Infof("[init]tcp connect error = %s\n", err)
 		return
@@ -1695,6 +1964,8 @@ type ConnectionState struct {
 	sourcePort      layers.TCPPort
 	destinationIp   net.IP
 	destinationPort layers.TCPPort
+	// of the syn
+	trafficClass uint8
 
 	mutex sync.Mutex
 
@@ -2406,8 +2677,61 @@ const (
 	IpProtocolUnknown IpProtocol = 0
 	IpProtocolTcp     IpProtocol = 1
 	IpProtocolUdp     IpProtocol = 2
+	IpProtocolIcmp    IpProtocol = 3
+	IpProtocolIcmpv6  IpProtocol = 4
 )
 
+// maps a gopacket ip protocol to the `IpProtocol`,
+// or `IpProtocolUnknown` if the protocol is not supported
+func IpProtocolFromLayers(protocol layers.IPProtocol) IpProtocol {
+	switch protocol {
+	case layers.IPProtocolTCP:
+		return IpProtocolTcp
+	case layers.IPProtocolUDP:
+		return IpProtocolUdp
+	case layers.IPProtocolICMPv4:
+		return IpProtocolIcmp
+	case layers.IPProtocolICMPv6:
+		return IpProtocolIcmpv6
+	default:
+		return IpProtocolUnknown
+	}
+}
+
+// maps a decoded gopacket transport or icmp layer to the `IpProtocol`,
+// or `IpProtocolUnknown` for other layers
+func IpProtocolFromLayer(layer gopacket.Layer) IpProtocol {
+	switch layer.(type) {
+	case *layers.TCP:
+		return IpProtocolTcp
+	case *layers.UDP:
+		return IpProtocolUdp
+	case *layers.ICMPv4:
+		return IpProtocolIcmp
+	case *layers.ICMPv6:
+		return IpProtocolIcmpv6
+	default:
+		return IpProtocolUnknown
+	}
+}
+
+// maps the `IpProtocol` to the gopacket ip protocol,
+// or false for `IpProtocolUnknown`
+func (self IpProtocol) LayersProtocol() (layers.IPProtocol, bool) {
+	switch self {
+	case IpProtocolTcp:
+		return layers.IPProtocolTCP, true
+	case IpProtocolUdp:
+		return layers.IPProtocolUDP, true
+	case IpProtocolIcmp:
+		return layers.IPProtocolICMPv4, true
+	case IpProtocolIcmpv6:
+		return layers.IPProtocolICMPv6, true
+	default:
+		return 0, false
+	}
+}
+
 type IpPath struct {
 	Version         int
 	Protocol        IpProtocol
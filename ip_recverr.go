@@ -0,0 +1,20 @@
+//go:build !linux
+
+package connect
+
+import (
+	"errors"
+	"syscall"
+)
+
+// the icmp errors of a socket are only read on linux (`IP_RECVERR`)
+// elsewhere `UdpBufferSettings.ReceiveIcmpErrors` is ignored, and these are not called
+const socketIcmpErrorsSupported = false
+
+func setSocketRecvErr(fd SocketHandle, ipv6 bool) error {
+	return errors.New("Icmp errors are not supported on this platform.")
+}
+
+func readSocketIcmpErrors(c syscall.RawConn, payloadByteCount int) ([]*socketIcmpError, error) {
+	return []*socketIcmpError{}, nil
+}
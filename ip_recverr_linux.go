@@ -0,0 +1,102 @@
+package connect
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// see `UdpBufferSettings.ReceiveIcmpErrors`
+const socketIcmpErrorsSupported = true
+
+// size of `struct sock_extended_err`
+const sockExtendedErrSize = 16
+
+const (
+	soEeOriginIcmp  = 2
+	soEeOriginIcmp6 = 3
+)
+
+// queues the icmp errors received by the socket, see `readSocketIcmpErrors`
+func setSocketRecvErr(fd SocketHandle, ipv6 bool) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+}
+
+// reads the icmp errors queued on the socket without blocking
+// each error has the payload of the datagram that caused it, up to `payloadByteCount`
+func readSocketIcmpErrors(c syscall.RawConn, payloadByteCount int) ([]*socketIcmpError, error) {
+	icmpErrors := []*socketIcmpError{}
+	var readErr error
+
+	buffer := make([]byte, payloadByteCount)
+	oob := make([]byte, syscall.CmsgSpace(sockExtendedErrSize+syscall.SizeofSockaddrInet6))
+	err := c.Read(func(fd uintptr) bool {
+		for {
+			n, oobn, _, _, err := syscall.Recvmsg(int(fd), buffer, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if err != nil {
+				if err != syscall.EAGAIN {
+					readErr = err
+				}
+				// the queue is empty
+				return true
+			}
+			messages, err := syscall.ParseSocketControlMessage(oob[0:oobn])
+			if err != nil {
+				readErr = err
+				return true
+			}
+			for _, message := range messages {
+				if icmpError, ok := parseSockExtendedErr(message); ok {
+					icmpError.payload = append([]byte(nil), buffer[0:n]...)
+					icmpErrors = append(icmpErrors, icmpError)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return icmpErrors, err
+	}
+	return icmpErrors, readErr
+}
+
+// parses a `struct sock_extended_err` followed by the address of the sender (`SO_EE_OFFENDER`)
+// errors that did not come from an icmp message, e.g. a local mtu error, are skipped
+func parseSockExtendedErr(message syscall.SocketControlMessage) (*socketIcmpError, bool) {
+	switch {
+	case message.Header.Level == syscall.SOL_IP && message.Header.Type == syscall.IP_RECVERR:
+	case message.Header.Level == syscall.SOL_IPV6 && message.Header.Type == syscall.IPV6_RECVERR:
+	default:
+		return nil, false
+	}
+	data := message.Data
+	if len(data) < sockExtendedErrSize {
+		return nil, false
+	}
+	switch origin := data[4]; origin {
+	case soEeOriginIcmp, soEeOriginIcmp6:
+	default:
+		return nil, false
+	}
+	icmpError := &socketIcmpError{
+		icmpType: data[5],
+		icmpCode: data[6],
+		info:     binary.NativeEndian.Uint32(data[8:12]),
+	}
+	offender := data[sockExtendedErrSize:]
+	if 2 <= len(offender) {
+		switch binary.NativeEndian.Uint16(offender[0:2]) {
+		case syscall.AF_INET:
+			if syscall.SizeofSockaddrInet4 <= len(offender) {
+				icmpError.offender = net.IP(append([]byte(nil), offender[4:8]...))
+			}
+		case syscall.AF_INET6:
+			if syscall.SizeofSockaddrInet6 <= len(offender) {
+				icmpError.offender = net.IP(append([]byte(nil), offender[8:24]...))
+			}
+		}
+	}
+	return icmpError, true
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package connect
+
+import (
+	"syscall"
+)
+
+func setSocketTrafficClass(fd SocketHandle, ipv6 bool, trafficClass uint8) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, int(trafficClass))
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, int(trafficClass))
+}
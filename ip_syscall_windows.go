@@ -0,0 +1,13 @@
+package connect
+
+import (
+	"syscall"
+)
+
+func setSocketTrafficClass(fd SocketHandle, ipv6 bool, trafficClass uint8) error {
+	if ipv6 {
+		// windows only marks ipv6 packets with a qos policy, not a socket option
+		return nil
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, int(trafficClass))
+}
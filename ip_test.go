@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"net"
 	"reflect"
+	"runtime"
+	"syscall"
 	"testing"
 	"time"
 
@@ -141,6 +143,30 @@ func TestTcp6Path(t *testing.T) {
 	}, ip6Path)
 }
 
+func TestIpProtocolLayers(t *testing.T) {
+	for ipProtocol, layersProtocol := range map[IpProtocol]layers.IPProtocol{
+		IpProtocolTcp:    layers.IPProtocolTCP,
+		IpProtocolUdp:    layers.IPProtocolUDP,
+		IpProtocolIcmp:   layers.IPProtocolICMPv4,
+		IpProtocolIcmpv6: layers.IPProtocolICMPv6,
+	} {
+		p, ok := ipProtocol.LayersProtocol()
+		assert.Equal(t, true, ok)
+		assert.Equal(t, layersProtocol, p)
+		assert.Equal(t, ipProtocol, IpProtocolFromLayers(layersProtocol))
+	}
+
+	_, ok := IpProtocolUnknown.LayersProtocol()
+	assert.Equal(t, false, ok)
+	assert.Equal(t, IpProtocolUnknown, IpProtocolFromLayers(layers.IPProtocolGRE))
+
+	assert.Equal(t, IpProtocolTcp, IpProtocolFromLayer(&layers.TCP{}))
+	assert.Equal(t, IpProtocolUdp, IpProtocolFromLayer(&layers.UDP{}))
+	assert.Equal(t, IpProtocolIcmp, IpProtocolFromLayer(&layers.ICMPv4{}))
+	assert.Equal(t, IpProtocolIcmpv6, IpProtocolFromLayer(&layers.ICMPv6{}))
+	assert.Equal(t, IpProtocolUnknown, IpProtocolFromLayer(&layers.IPv4{}))
+}
+
 func udp4Packet(s int, i int, j int, k int) (packet []byte, payload []byte) {
 	payload = make([]byte, 4)
 	binary.LittleEndian.PutUint32(payload, uint32(s))
@@ -592,3 +618,257 @@ func testClient[P comparable](
 		}
 	}
 }
+
+func TestDialTcpKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+
+	keepAlive := func(keepAlivePeriod time.Duration) int {
+		tcpBufferSettings := DefaultTcpBufferSettings()
+		tcpBufferSettings.KeepAlivePeriod = keepAlivePeriod
+		socket, err := dialTcp(nil, 0, listener.Addr().String(), tcpBufferSettings)
+		assert.Equal(t, err, nil)
+		defer socket.Close()
+
+		rawConn, err := socket.(*net.TCPConn).SyscallConn()
+		assert.Equal(t, err, nil)
+		var value int
+		var valueErr error
+		err = rawConn.Control(func(fd uintptr) {
+			value, valueErr = syscall.GetsockoptInt(SocketHandle(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, valueErr, nil)
+		return value
+	}
+
+	assert.NotEqual(t, 0, keepAlive(5*time.Second))
+	assert.Equal(t, 0, keepAlive(-1))
+}
+
+func TestDialBindSourceIp(t *testing.T) {
+	// linux routes all of 127.0.0.0/8 to the loopback interface, other platforms may only have 127.0.0.1
+	sourceIp := net.ParseIP("127.0.0.2")
+	if probe, err := net.ListenPacket("udp", net.JoinHostPort(sourceIp.String(), "0")); err != nil {
+		t.Skipf("%s is not a local address", sourceIp)
+	} else {
+		probe.Close()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+	packetListener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer packetListener.Close()
+
+	for _, bindSourceIp := range []bool{true, false} {
+		expectedIp := net.ParseIP("127.0.0.1")
+		if bindSourceIp {
+			expectedIp = sourceIp
+		}
+
+		tcpBufferSettings := DefaultTcpBufferSettings()
+		tcpBufferSettings.BindSourceIp = bindSourceIp
+		socket, err := dialTcp(sourceIp, 0, listener.Addr().String(), tcpBufferSettings)
+		assert.Equal(t, err, nil)
+		conn, err := listener.Accept()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, expectedIp.String(), conn.RemoteAddr().(*net.TCPAddr).IP.String())
+		conn.Close()
+		socket.Close()
+
+		udpBufferSettings := DefaultUdpBufferSettings()
+		udpBufferSettings.BindSourceIp = bindSourceIp
+		socket, err = dialUdp(sourceIp, 0, packetListener.LocalAddr().String(), udpBufferSettings)
+		assert.Equal(t, err, nil)
+		_, err = socket.Write([]byte("hello"))
+		assert.Equal(t, err, nil)
+		buffer := make([]byte, 16)
+		packetListener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, addr, err := packetListener.ReadFrom(buffer)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, expectedIp.String(), addr.(*net.UDPAddr).IP.String())
+		socket.Close()
+	}
+}
+
+func TestDialTrafficClass(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+
+	tos := func(socket net.Conn) int {
+		rawConn, err := socket.(syscall.Conn).SyscallConn()
+		assert.Equal(t, err, nil)
+		var value int
+		var valueErr error
+		err = rawConn.Control(func(fd uintptr) {
+			value, valueErr = syscall.GetsockoptInt(SocketHandle(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+		})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, valueErr, nil)
+		return value
+	}
+
+	// expedited forwarding with ect(0). The ecn field is not set on the socket.
+	trafficClass := uint8(46<<2 | 0x02)
+	for _, setTrafficClass := range []bool{true, false} {
+		expectedTos := 0
+		if setTrafficClass {
+			expectedTos = 46 << 2
+		}
+
+		tcpBufferSettings := DefaultTcpBufferSettings()
+		tcpBufferSettings.SetTrafficClass = setTrafficClass
+		socket, err := dialTcp(nil, trafficClass, listener.Addr().String(), tcpBufferSettings)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, expectedTos, tos(socket))
+		socket.Close()
+
+		udpBufferSettings := DefaultUdpBufferSettings()
+		udpBufferSettings.SetTrafficClass = setTrafficClass
+		socket, err = dialUdp(nil, trafficClass, "127.0.0.1:9", udpBufferSettings)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, expectedTos, tos(socket))
+		socket.Close()
+	}
+}
+
+func TestUdpReceiveIcmpErrorsSetting(t *testing.T) {
+	// off by default
+	assert.Equal(t, false, DefaultUdpBufferSettings().ReceiveIcmpErrors)
+	assert.Equal(t, runtime.GOOS == "linux", socketIcmpErrorsSupported)
+
+	// the setting is ignored where not supported, and the dial succeeds on every platform
+	udpBufferSettings := DefaultUdpBufferSettings()
+	udpBufferSettings.ReceiveIcmpErrors = true
+	socket, err := dialUdp(nil, 0, "127.0.0.1:9", udpBufferSettings)
+	assert.Equal(t, err, nil)
+	socket.Close()
+}
+
+func TestLocalUserNatUdpIcmpError(t *testing.T) {
+	if !socketIcmpErrorsSupported {
+		t.Skipf("icmp errors are not received on %s", runtime.GOOS)
+	}
+
+	// a closed port, which the os answers with port unreachable
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	destinationIp := net.ParseIP("127.0.0.1").To4()
+	destinationPort := layers.UDPPort(probe.LocalAddr().(*net.UDPAddr).Port)
+	probe.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultLocalUserNatSettings()
+	settings.UdpBufferSettings.ReceiveIcmpErrors = true
+	localUserNat := NewLocalUserNat(ctx, "test", settings)
+	defer localUserNat.Close()
+
+	receivePackets := make(chan []byte, 16)
+	localUserNat.AddReceivePacketCallback(func(source TransferPath, ipProtocol IpProtocol, packet []byte) {
+		assert.Equal(t, IpProtocolIcmp, ipProtocol)
+		receivePackets <- packet
+	})
+
+	sourceIp := net.ParseIP("72.0.0.1").To4()
+	sourcePort := layers.UDPPort(40000)
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    sourceIp,
+		DstIP:    destinationIp,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{
+		SrcPort: sourcePort,
+		DstPort: destinationPort,
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	options := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, options, ip, udp, gopacket.Payload([]byte("hello")))
+	assert.Equal(t, err, nil)
+
+	source := TransferPath{}
+	assert.Equal(t, true, localUserNat.SendPacket(source, protocol.ProvideMode_Network, buffer.Bytes(), -1))
+
+	select {
+	case packet := <-receivePackets:
+		reply := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+		replyIp := reply.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		assert.Equal(t, destinationIp.String(), replyIp.SrcIP.String())
+		assert.Equal(t, sourceIp.String(), replyIp.DstIP.String())
+		icmp := reply.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		assert.Equal(t, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort), icmp.TypeCode)
+
+		// the embedded header is the packet as sent by the source
+		embedded := gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+		embeddedIp := embedded.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		assert.Equal(t, sourceIp.String(), embeddedIp.SrcIP.String())
+		assert.Equal(t, destinationIp.String(), embeddedIp.DstIP.String())
+		embeddedUdp := embedded.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		assert.Equal(t, sourcePort, embeddedUdp.SrcPort)
+		assert.Equal(t, destinationPort, embeddedUdp.DstPort)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no icmp error")
+	}
+}
+
+func TestLocalUserNatUdpEmptyDatagram(t *testing.T) {
+	listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+	destinationIp := net.ParseIP("127.0.0.1").To4()
+	destinationPort := layers.UDPPort(listener.LocalAddr().(*net.UDPAddr).Port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	localUserNat := NewLocalUserNatWithDefaults(ctx, "test")
+	defer localUserNat.Close()
+
+	sourceIp := net.ParseIP("72.0.0.1").To4()
+	sourcePort := layers.UDPPort(40000)
+	source := TransferPath{}
+	for _, payload := range [][]byte{[]byte("hello"), {}} {
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			SrcIP:    sourceIp,
+			DstIP:    destinationIp,
+			Protocol: layers.IPProtocolUDP,
+		}
+		udp := &layers.UDP{
+			SrcPort: sourcePort,
+			DstPort: destinationPort,
+		}
+		udp.SetNetworkLayerForChecksum(ip)
+		options := gopacket.SerializeOptions{
+			ComputeChecksums: true,
+			FixLengths:       true,
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		err = gopacket.SerializeLayers(buffer, options, ip, udp, gopacket.Payload(payload))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, true, localUserNat.SendPacket(source, protocol.ProvideMode_Network, buffer.Bytes(), -1))
+	}
+
+	// the empty datagram is sent on the socket of the flow
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := listener.ReadFrom(buffer)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, "hello", string(buffer[:n]))
+	n, emptyAddr, err := listener.ReadFrom(buffer)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, addr.String(), emptyAddr.String())
+}
@@ -61,6 +61,30 @@ func (c *Client) getNextAllowedIP(deviceName string, ipVersion IPVersion) (strin
 	return "", ErrorAIPsNoAvailableIP
 }
 
+// checkDefaultRouteAllowedIPs checks that no peer in the config has a default route (0.0.0.0/0 or ::/0) as an allowed IP,
+// since such a peer silently captures all traffic of the device.
+//
+// Returns an error naming the peer and the prefix which can be checked using errors.Is(err, ErrorAIPsDefaultRoute).
+// Returns an error if an allowed IP has a nil or non-canonical mask which can be checked using errors.Is(err, ErrInvalidAddress).
+func checkDefaultRouteAllowedIPs(cfg wgtypes.Config) error {
+	for _, peer := range cfg.Peers {
+		if peer.Remove {
+			continue
+		}
+		for _, allowedIP := range peer.AllowedIPs {
+			// Size returns 0, 0 for an invalid mask, which is not a default route
+			ones, bits := allowedIP.Mask.Size()
+			if bits == 0 {
+				return fmt.Errorf("%w: peer %s has allowed IP %s with an invalid mask", ErrInvalidAddress, peer.PublicKey, allowedIP.String())
+			}
+			if ones == 0 {
+				return fmt.Errorf("%w: peer %s has allowed IP %s", ErrorAIPsDefaultRoute, peer.PublicKey, allowedIP.String())
+			}
+		}
+	}
+	return nil
+}
+
 // filterAddresses filters the addresses based on the IP version.
 // If ipVersion is AllIPs all addresses are returned.
 //
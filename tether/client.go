@@ -11,8 +11,9 @@ import (
 //
 // Based on wgctrl.Client
 type Client struct {
-	devices   map[string]IDevice
-	endpoints map[EndpointType]string
+	devices          map[string]IDevice
+	endpoints        map[EndpointType]string
+	strictAllowedIPs bool
 }
 
 // New creates a new Client without any devices or endpoints.
@@ -64,6 +65,14 @@ func (c *Client) Device(name string) (*wgtypes.Device, error) {
 	return wgDevice, nil
 }
 
+// SetStrictAllowedIPs enables or disables strict mode for configuring devices.
+//
+// In strict mode, configurations that give a peer a default route (0.0.0.0/0 or ::/0) as an allowed IP are rejected,
+// unless the configuration explicitly opts in (see ByWgConfig.AllowDefaultRoute).
+func (c *Client) SetStrictAllowedIPs(strict bool) {
+	c.strictAllowedIPs = strict
+}
+
 // AddDevice adds a new userspace-wireguard device to the client with the provided name.
 // The name of the device must be unique to the other devices on the Client.
 //
@@ -98,12 +107,24 @@ func (c *Client) RemoveDevice(name string) error {
 // If the device specified by name does not exist or the configuration
 // could not be applied, an error is returned.
 // The first error can be checked using errors.Is(err, ErrDeviceNotFound).
+// In strict mode, a configuration with a default route allowed IP returns an error which can be checked using errors.Is(err, ErrorAIPsDefaultRoute).
 func (c *Client) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	return c.configureDevice(name, cfg, false)
+}
+
+// configureDevice configures a device, where allowDefaultRoute opts out of the strict mode check.
+func (c *Client) configureDevice(name string, cfg wgtypes.Config, allowDefaultRoute bool) error {
 	device, ok := c.devices[name]
 	if !ok {
 		return fmt.Errorf("device %s: %w", name, ErrDeviceNotFound)
 	}
 
+	if c.strictAllowedIPs && !allowDefaultRoute {
+		if err := checkDefaultRouteAllowedIPs(cfg); err != nil {
+			return err
+		}
+	}
+
 	return device.IpcSet(&cfg)
 }
 
@@ -2,7 +2,9 @@ package tether
 
 import (
 	"errors"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
 
 	uwgtun "github.com/urnetwork/userwireguard/tun"
@@ -447,6 +449,60 @@ func TestClientConfigureDevice(t *testing.T) {
 	}
 }
 
+func TestClientConfigureDeviceStrictAllowedIPs(t *testing.T) {
+	_, defaultRoute4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, defaultRoute6, _ := net.ParseCIDR("::/0")
+	_, hostRoute, _ := net.ParseCIDR("192.168.90.2/32")
+	invalidMask := &net.IPNet{IP: net.ParseIP("192.168.90.0").To4(), Mask: net.IPMask{255, 0, 255, 0}}
+	config := func(ipnet *net.IPNet) wgtypes.Config {
+		return wgtypes.Config{Peers: []wgtypes.PeerConfig{{AllowedIPs: []net.IPNet{*hostRoute, *ipnet}}}}
+	}
+
+	testCases := []struct {
+		name              string
+		strict            bool
+		allowDefaultRoute bool
+		cfg               wgtypes.Config
+		wantErr           error
+	}{
+		{name: "Default route without strict mode", cfg: config(defaultRoute4)},
+		{name: "IPv4 default route in strict mode", strict: true, cfg: config(defaultRoute4), wantErr: ErrorAIPsDefaultRoute},
+		{name: "IPv6 default route in strict mode", strict: true, cfg: config(defaultRoute6), wantErr: ErrorAIPsDefaultRoute},
+		{name: "Default route in strict mode with opt in", strict: true, allowDefaultRoute: true, cfg: config(defaultRoute4)},
+		{name: "Host route in strict mode", strict: true, cfg: config(hostRoute)},
+		{name: "Invalid mask in strict mode", strict: true, cfg: config(invalidMask), wantErr: ErrInvalidAddress},
+		{
+			name:   "Removed peer with default route in strict mode",
+			strict: true,
+			cfg:    wgtypes.Config{Peers: []wgtypes.PeerConfig{{Remove: true, AllowedIPs: []net.IPNet{*defaultRoute4}}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New()
+			c.SetStrictAllowedIPs(tc.strict)
+			device := &mockDevice{}
+			c.AddDevice("bywg0", device)
+
+			err := c.configureDevice("bywg0", tc.cfg, tc.allowDefaultRoute)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("configureDevice() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr != nil {
+				if errors.Is(err, ErrorAIPsDefaultRoute) && !strings.Contains(err.Error(), "0/0") && !strings.Contains(err.Error(), "::/0") {
+					t.Fatalf("error %q should name the rejected prefix", err)
+				}
+				if device.ipcSetCalled {
+					t.Fatalf("IpcSet should not be called for a rejected config")
+				}
+			} else if !device.ipcSetCalled {
+				t.Fatalf("IpcSet should be called")
+			}
+		})
+	}
+}
+
 func TestClientDevice(t *testing.T) {
 	errorIpcGet := errors.New("ipc get error")
 
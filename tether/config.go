@@ -24,6 +24,8 @@ type ByWgConfig struct {
 	PostDown   []string
 	SaveConfig bool
 	Peers      []wgtypes.PeerConfig
+	// allows peers to have a default route (0.0.0.0/0 or ::/0) as an allowed IP when the client is in strict mode
+	AllowDefaultRoute bool
 }
 
 // GetUpdatedConfig returns the updated config file as a string based on the provided config and device name,
@@ -183,6 +185,8 @@ func parseConfig(configName string, scanner *bufio.Scanner) (config ByWgConfig,
 				config.PostDown = append(config.PostDown, value)
 			case "SaveConfig":
 				config.SaveConfig = stringToBool(value)
+			case "AllowDefaultRoute":
+				config.AllowDefaultRoute = stringToBool(value)
 			}
 		case "peer":
 			switch key {
@@ -265,6 +269,9 @@ func configToString(config ByWgConfig) string {
 	if config.SaveConfig {
 		sb.WriteString("SaveConfig = true\n")
 	}
+	if config.AllowDefaultRoute {
+		sb.WriteString("AllowDefaultRoute = true\n")
+	}
 	for _, cmd := range config.PreUp {
 		sb.WriteString(fmt.Sprintf("PreUp = %s\n", cmd))
 	}
@@ -305,16 +312,25 @@ func getEmptyPeer() wgtypes.PeerConfig {
 }
 
 // convert a list of wgtypes.Peer to a list of wgtypes.PeerConfig.
+//
+// The device reports an unset key as the zero key, so zero preshared keys are omitted
+// and peers with a zero public key are skipped, as WireGuard does.
 func getPeerConfigs(peers []wgtypes.Peer) []wgtypes.PeerConfig {
 	peerConfigs := []wgtypes.PeerConfig{}
 	for _, peer := range peers {
-		peerConfigs = append(peerConfigs, wgtypes.PeerConfig{
+		if peer.PublicKey == (wgtypes.Key{}) {
+			continue
+		}
+		peerConfig := wgtypes.PeerConfig{
 			PublicKey:                   peer.PublicKey,
-			PresharedKey:                &peer.PresharedKey,
 			Endpoint:                    peer.Endpoint,
 			PersistentKeepaliveInterval: &peer.PersistentKeepaliveInterval,
 			AllowedIPs:                  peer.AllowedIPs,
-		})
+		}
+		if peer.PresharedKey != (wgtypes.Key{}) {
+			peerConfig.PresharedKey = &peer.PresharedKey
+		}
+		peerConfigs = append(peerConfigs, peerConfig)
 	}
 	return peerConfigs
 }
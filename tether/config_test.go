@@ -1 +1,34 @@
 package tether
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestGetPeerConfigsZeroKeys(t *testing.T) {
+	var publicKey, presharedKey wgtypes.Key
+	publicKey[0], presharedKey[0] = 1, 2
+	peers := []wgtypes.Peer{
+		{PublicKey: publicKey},
+		{PublicKey: publicKey, PresharedKey: presharedKey},
+		{}, // zero public key
+	}
+
+	peerConfigs := getPeerConfigs(peers)
+	if len(peerConfigs) != 2 {
+		t.Fatalf("getPeerConfigs() returned %d peers, want 2", len(peerConfigs))
+	}
+	if peerConfigs[0].PresharedKey != nil {
+		t.Fatalf("getPeerConfigs() preshared key = %v, want nil", peerConfigs[0].PresharedKey)
+	}
+	if peerConfigs[1].PresharedKey == nil || *peerConfigs[1].PresharedKey != presharedKey {
+		t.Fatalf("getPeerConfigs() preshared key = %v, want %v", peerConfigs[1].PresharedKey, presharedKey)
+	}
+
+	config := configToString(ByWgConfig{Name: "bywg0", PrivateKey: "key", Peers: peerConfigs[:1]})
+	if strings.Contains(config, "PresharedKey") {
+		t.Fatalf("configToString() = %q, want no PresharedKey", config)
+	}
+}
@@ -1,9 +1,11 @@
 package tether
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"os/exec"
+	"sort"
 	"strings"
 
 	"github.com/urnetwork/userwireguard/device"
@@ -64,12 +66,12 @@ func (c *Client) BringUpDevice(deviceName string, bywgConf ByWgConfig) error {
 		return fmt.Errorf("failed to parse private key: %w", err)
 	}
 
-	err = c.ConfigureDevice(deviceName, wgtypes.Config{
+	err = c.configureDevice(deviceName, wgtypes.Config{
 		PrivateKey:   &privateKey,
 		ListenPort:   bywgConf.ListenPort, // if nil it is not applied
 		ReplacePeers: true,
 		Peers:        bywgConf.Peers,
-	})
+	}, bywgConf.AllowDefaultRoute)
 	if err != nil {
 		return fmt.Errorf("failed to configure device: %w", err)
 	}
@@ -295,6 +297,54 @@ Endpoint = %s:%d
 	return newPeer, nil
 }
 
+// SortKey specifies the order of peers returned by PeersSorted.
+type SortKey int
+
+const (
+	SortByLastHandshake SortKey = iota // most recent handshake first
+	SortByReceiveBytes                 // most received bytes first
+	SortByTransmitBytes                // most transmitted bytes first
+	SortByPublicKey                    // ascending public key bytes
+)
+
+// PeersSorted returns the peers of a device ordered by the provided key.
+//
+// Peers that compare equal on the key are ordered by public key so that the order is stable across calls.
+//
+// The function returns an error if the device could not be retrieved or the sort key is unknown.
+func (c *Client) PeersSorted(deviceName string, by SortKey) ([]wgtypes.Peer, error) {
+	device, err := c.Device(deviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var less func(a, b *wgtypes.Peer) bool
+	switch by {
+	case SortByLastHandshake:
+		less = func(a, b *wgtypes.Peer) bool { return a.LastHandshakeTime.After(b.LastHandshakeTime) }
+	case SortByReceiveBytes:
+		less = func(a, b *wgtypes.Peer) bool { return a.ReceiveBytes > b.ReceiveBytes }
+	case SortByTransmitBytes:
+		less = func(a, b *wgtypes.Peer) bool { return a.TransmitBytes > b.TransmitBytes }
+	case SortByPublicKey:
+		less = func(a, b *wgtypes.Peer) bool { return false }
+	default:
+		return nil, fmt.Errorf("unknown sort key %d", by)
+	}
+
+	peers := device.Peers
+	sort.SliceStable(peers, func(i, j int) bool {
+		if less(&peers[i], &peers[j]) {
+			return true
+		}
+		if less(&peers[j], &peers[i]) {
+			return false
+		}
+		return bytes.Compare(peers[i].PublicKey[:], peers[j].PublicKey[:]) < 0
+	})
+	return peers, nil
+}
+
 // ipsString transforms a list of ips to a string where the ips are separated by a ","
 func ipsString(ipnets []net.IPNet) string {
 	ipNetStrings := make([]string, 0, len(ipnets))
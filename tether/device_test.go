@@ -5,6 +5,7 @@ import (
 	"net"
 	"reflect"
 	"testing"
+	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -450,3 +451,63 @@ func TestClient_RemovePeerFromDevice(t *testing.T) {
 		})
 	}
 }
+
+func TestClientPeersSorted(t *testing.T) {
+	key := func(b byte) wgtypes.Key {
+		var k wgtypes.Key
+		k[0] = b
+		return k
+	}
+	now := time.Now()
+	peers := []wgtypes.Peer{
+		{PublicKey: key(3), LastHandshakeTime: now.Add(-time.Minute), ReceiveBytes: 10, TransmitBytes: 300},
+		{PublicKey: key(1), LastHandshakeTime: now, ReceiveBytes: 30, TransmitBytes: 100},
+		{PublicKey: key(4), LastHandshakeTime: now, ReceiveBytes: 10, TransmitBytes: 200},
+		{PublicKey: key(2), ReceiveBytes: 20, TransmitBytes: 200},
+	}
+
+	tests := []struct {
+		name string
+		by   SortKey
+		want []byte // first byte of the public keys in order
+	}{
+		{name: "Last handshake", by: SortByLastHandshake, want: []byte{1, 4, 3, 2}},
+		{name: "Receive bytes", by: SortByReceiveBytes, want: []byte{1, 2, 3, 4}},
+		{name: "Transmit bytes", by: SortByTransmitBytes, want: []byte{3, 2, 4, 1}},
+		{name: "Public key", by: SortByPublicKey, want: []byte{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// repeat to make sure the order does not depend on the input order
+			for i := 0; i < 3; i++ {
+				shuffled := make([]wgtypes.Peer, len(peers))
+				for j := range peers {
+					shuffled[(j+i)%len(peers)] = peers[j]
+				}
+				c := New()
+				c.AddDevice("bywg0", &mockDevice{name: "bywg0", ipcGetPeers: shuffled})
+
+				got, err := c.PeersSorted("bywg0", tt.by)
+				if err != nil {
+					t.Fatalf("PeersSorted() error = %v", err)
+				}
+				gotKeys := make([]byte, 0, len(got))
+				for _, peer := range got {
+					gotKeys = append(gotKeys, peer.PublicKey[0])
+				}
+				if !reflect.DeepEqual(gotKeys, tt.want) {
+					t.Fatalf("PeersSorted() = %v, want %v", gotKeys, tt.want)
+				}
+			}
+		})
+	}
+
+	c := New()
+	if _, err := c.PeersSorted("bywg0", SortByPublicKey); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("PeersSorted() error = %v, want %v", err, ErrDeviceNotFound)
+	}
+	c.AddDevice("bywg0", &mockDevice{name: "bywg0"})
+	if _, err := c.PeersSorted("bywg0", SortKey(100)); err == nil {
+		t.Fatalf("PeersSorted() with unknown sort key should fail")
+	}
+}
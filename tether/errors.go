@@ -11,6 +11,7 @@ import "errors"
 var (
 	ErrorAIPsNoAddressesFound = errors.New("no addresses found")
 	ErrorAIPsNoAvailableIP    = errors.New("no available IP found")
+	ErrorAIPsDefaultRoute     = errors.New("default route allowed IP is not allowed in strict mode")
 )
 
 // used for client devices
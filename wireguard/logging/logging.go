@@ -0,0 +1,193 @@
+// Package logging creates userwireguard loggers that support structured attributes.
+//
+// Any slog.Attr passed as a trailing argument to Verbosef/Errorf is not used to format the message.
+// Instead, the slog adapter attaches it to the record and the text logger appends it as key=value.
+// This keeps the printf-style logger.Logger interface used by the device and tun packages.
+// Other loggers print the attributes as extra arguments, so code that logs to any logger.Logger,
+// such as the tun package, formats its fields into the message instead.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/urnetwork/userwireguard/logger"
+)
+
+// Level is a log level (logger.LogLevelSilent, logger.LogLevelError or logger.LogLevelVerbose)
+// that can be changed at runtime while other goroutines are logging.
+type Level struct {
+	level atomic.Int32
+}
+
+func NewLevel(level int) *Level {
+	l := &Level{}
+	l.SetLevel(level)
+	return l
+}
+
+func (l *Level) Level() int {
+	return int(l.level.Load())
+}
+
+// SetLevel changes the level. Out of range levels are clamped.
+func (l *Level) SetLevel(level int) {
+	l.level.Store(int32(min(max(level, logger.LogLevelSilent), logger.LogLevelVerbose)))
+}
+
+// ParseLevel parses a level from verbose(v)/debug(d), error(e) or silent(s).
+func ParseLevel(level string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "verbose", "debug", "v", "d":
+		return logger.LogLevelVerbose, nil
+	case "error", "e":
+		return logger.LogLevelError, nil
+	case "silent", "s":
+		return logger.LogLevelSilent, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+func LevelString(level int) string {
+	switch level {
+	case logger.LogLevelVerbose:
+		return "verbose"
+	case logger.LogLevelError:
+		return "error"
+	case logger.LogLevelSilent:
+		return "silent"
+	default:
+		return strconv.Itoa(level)
+	}
+}
+
+// NewLogger creates a text logger with the same output as logger.NewLogger.
+func NewLogger(level int, prepend string) *logger.Logger {
+	return NewLoggerWithLevel(NewLevel(level), prepend)
+}
+
+// NewLoggerWithLevel creates a text logger whose level is checked on every call, so it can be changed at runtime.
+func NewLoggerWithLevel(level *Level, prepend string) *logger.Logger {
+	return newTextLogger(os.Stdout, level, prepend)
+}
+
+func newTextLogger(w io.Writer, level *Level, prepend string) *logger.Logger {
+	logf := func(prefix string, minLevel int) func(string, ...any) {
+		printf := log.New(w, prefix+": "+prepend, log.Ldate|log.Ltime).Printf
+		return func(format string, args ...any) {
+			if level.Level() < minLevel {
+				return
+			}
+			printf("%s", formatText(format, args))
+		}
+	}
+	return &logger.Logger{
+		Verbosef: logf("DEBUG", logger.LogLevelVerbose),
+		Errorf:   logf("ERROR", logger.LogLevelError),
+	}
+}
+
+// NewJSONLogger creates a logger that writes one JSON object per line, for log aggregation.
+func NewJSONLogger(level int, prepend string) *logger.Logger {
+	return NewJSONLoggerWithLevel(NewLevel(level), prepend)
+}
+
+// NewJSONLoggerWithLevel creates a logger that writes one JSON object per line with the time, level, message and prefix,
+// and the attributes as additional fields. Its level is checked on every call, so it can be changed at runtime.
+func NewJSONLoggerWithLevel(level *Level, prepend string) *logger.Logger {
+	return newJSONLogger(os.Stdout, level, prepend)
+}
+
+func newJSONLogger(w io.Writer, level *Level, prepend string) *logger.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slogLeveler{level: level}})
+	return NewSlogLogger(slog.New(handler).With("prefix", strings.TrimSpace(prepend)))
+}
+
+// slogLeveler maps a Level to the slog levels used by NewSlogLogger.
+type slogLeveler struct {
+	level *Level
+}
+
+func (l slogLeveler) Level() slog.Level {
+	switch l.level.Level() {
+	case logger.LogLevelVerbose:
+		return slog.LevelDebug
+	case logger.LogLevelError:
+		return slog.LevelError
+	default:
+		// above every level that is logged
+		return slog.LevelError + 1
+	}
+}
+
+// NewSlogLogger creates a logger that writes to l. Verbosef maps to slog.LevelDebug and Errorf to slog.LevelError.
+//
+// Per-component attributes (e.g. the device name) can be attached with l.With(...).
+func NewSlogLogger(l *slog.Logger) *logger.Logger {
+	return &logger.Logger{
+		Verbosef: func(format string, args ...any) {
+			logAttrs(l, slog.LevelDebug, format, args)
+		},
+		Errorf: func(format string, args ...any) {
+			logAttrs(l, slog.LevelError, format, args)
+		},
+	}
+}
+
+func logAttrs(l *slog.Logger, level slog.Level, format string, args []any) {
+	ctx := context.Background()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+	args, attrs := splitAttrs(args)
+	l.LogAttrs(ctx, level, fmt.Sprintf(format, args...), attrs...)
+}
+
+// formatText formats the message and appends the attributes as key=value.
+func formatText(format string, args []any) string {
+	args, attrs := splitAttrs(args)
+	msg := fmt.Sprintf(format, args...)
+	if len(attrs) == 0 {
+		return msg
+	}
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, attr := range attrs {
+		b.WriteByte(' ')
+		b.WriteString(attr.String())
+	}
+	return b.String()
+}
+
+// splitAttrs separates the trailing slog.Attr arguments from the format arguments.
+func splitAttrs(args []any) ([]any, []slog.Attr) {
+	i := len(args)
+	for 0 < i {
+		if _, ok := args[i-1].(slog.Attr); !ok {
+			break
+		}
+		i -= 1
+	}
+	if i == len(args) {
+		return args, nil
+	}
+	attrs := make([]slog.Attr, 0, len(args)-i)
+	for _, arg := range args[i:] {
+		attrs = append(attrs, arg.(slog.Attr))
+	}
+	return args[:i], attrs
+}
+
+// Endpoint is the attribute for a remote ip and port.
+func Endpoint(ip string, port int) slog.Attr {
+	return slog.String("endpoint", net.JoinHostPort(ip, strconv.Itoa(port)))
+}
@@ -0,0 +1,199 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/urnetwork/userwireguard/logger"
+)
+
+func TestSlogLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	l := NewSlogLogger(slog.New(handler).With("device", "wg0"))
+
+	l.Verbosef("received %d bytes", 42, Endpoint("2001:db8::1", 51820))
+	l.Errorf("failed: %v", "boom")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), buf.String())
+	}
+
+	var verbose map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &verbose); err != nil {
+		t.Fatalf("invalid json %q: %v", lines[0], err)
+	}
+	want := map[string]any{
+		"level":    "DEBUG",
+		"msg":      "received 42 bytes",
+		"device":   "wg0",
+		"endpoint": "[2001:db8::1]:51820",
+	}
+	for k, v := range want {
+		if verbose[k] != v {
+			t.Fatalf("%s = %v, want %v", k, verbose[k], v)
+		}
+	}
+
+	var errorLine map[string]any
+	if err := json.Unmarshal([]byte(lines[1]), &errorLine); err != nil {
+		t.Fatalf("invalid json %q: %v", lines[1], err)
+	}
+	if errorLine["level"] != "ERROR" || errorLine["msg"] != "failed: boom" {
+		t.Fatalf("unexpected error line %v", errorLine)
+	}
+}
+
+func TestSlogLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})
+	l := NewSlogLogger(slog.New(handler))
+	l.Verbosef("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("debug message should be filtered, got %q", buf.String())
+	}
+}
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTextLogger(&buf, NewLevel(logger.LogLevelVerbose), "(test) ")
+	l.Verbosef("no entry for %s", "flow", Endpoint("1.2.3.4", 80))
+	if !strings.HasSuffix(buf.String(), "no entry for flow endpoint=1.2.3.4:80\n") {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+	if !strings.HasPrefix(buf.String(), "DEBUG: (test) ") {
+		t.Fatalf("unexpected prefix %q", buf.String())
+	}
+
+	buf.Reset()
+	l = newTextLogger(&buf, NewLevel(logger.LogLevelError), "")
+	l.Verbosef("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("verbose message should be filtered, got %q", buf.String())
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	level := NewLevel(logger.LogLevelVerbose)
+	l := newJSONLogger(&buf, level, "(wg0) ")
+
+	l.Verbosef("no entry for %s", "flow", Endpoint("1.2.3.4", 80))
+	l.Errorf("failed: %v", "boom")
+	level.SetLevel(logger.LogLevelError)
+	l.Verbosef("hidden")
+	l.Errorf("still shown")
+	level.SetLevel(logger.LogLevelSilent)
+	l.Errorf("hidden")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []map[string]any{
+		{"level": "DEBUG", "prefix": "(wg0)", "msg": "no entry for flow", "endpoint": "1.2.3.4:80"},
+		{"level": "ERROR", "prefix": "(wg0)", "msg": "failed: boom"},
+		{"level": "ERROR", "prefix": "(wg0)", "msg": "still shown"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d: %q", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("invalid json %q: %v", line, err)
+		}
+		if _, ok := fields["time"].(string); !ok {
+			t.Fatalf("line %d has no time: %q", i, line)
+		}
+		for k, v := range want[i] {
+			if fields[k] != v {
+				t.Fatalf("line %d: %s = %v, want %v", i, k, fields[k], v)
+			}
+		}
+	}
+}
+
+func TestSplitAttrs(t *testing.T) {
+	args, attrs := splitAttrs([]any{1, slog.Int("a", 1), "x", slog.Int("b", 2), slog.Int("c", 3)})
+	if len(args) != 3 || len(attrs) != 2 {
+		t.Fatalf("got %d args and %d attrs, want 3 and 2", len(args), len(attrs))
+	}
+	if attrs[0].Key != "b" || attrs[1].Key != "c" {
+		t.Fatalf("unexpected attrs %v", attrs)
+	}
+}
+
+func TestLevelRuntimeChange(t *testing.T) {
+	var buf bytes.Buffer
+	level := NewLevel(logger.LogLevelError)
+	l := newTextLogger(&buf, level, "")
+
+	l.Verbosef("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("verbose message should be filtered, got %q", buf.String())
+	}
+	level.SetLevel(logger.LogLevelVerbose)
+	l.Verbosef("shown")
+	if !strings.Contains(buf.String(), "shown") {
+		t.Fatalf("verbose message should be logged after SetLevel, got %q", buf.String())
+	}
+
+	buf.Reset()
+	level.SetLevel(logger.LogLevelSilent)
+	l.Errorf("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("error message should be filtered when silent, got %q", buf.String())
+	}
+
+	level.SetLevel(100)
+	if level.Level() != logger.LogLevelVerbose {
+		t.Fatalf("level should be clamped to verbose, got %d", level.Level())
+	}
+}
+
+func TestLevelConcurrent(t *testing.T) {
+	level := NewLevel(logger.LogLevelError)
+	l := newTextLogger(&lockedWriter{}, level, "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				l.Verbosef("message %d", j)
+				l.Errorf("message %d", j)
+			}
+		}()
+	}
+	for j := 0; j < 1000; j++ {
+		level.SetLevel(j % 3)
+	}
+	wg.Wait()
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []int{logger.LogLevelSilent, logger.LogLevelError, logger.LogLevelVerbose} {
+		parsed, err := ParseLevel(LevelString(level))
+		if err != nil || parsed != level {
+			t.Fatalf("ParseLevel(LevelString(%d)) = %d, %v", level, parsed, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatalf("ParseLevel() should fail for an unknown level")
+	}
+}
+
+type lockedWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
@@ -13,11 +13,15 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
 	"github.com/urnetwork/connect"
 	"github.com/urnetwork/protocol"
@@ -26,85 +30,495 @@ import (
 	"github.com/urnetwork/userwireguard/tun"
 )
 
+// DefaultReceiveQueueSize is the number of packets received from the NAT that can be queued for Read.
+const DefaultReceiveQueueSize = 1024
+
+// DefaultMtu is the MTU of the userspace TUN, the same as the default MTU of a WireGuard device.
+const DefaultMtu = 1420
+
+// OversizePolicy specifies how packets that exceed the MTU are handled.
+type OversizePolicy int
+
+const (
+	// OversizeDrop drops packets that exceed the MTU.
+	OversizeDrop OversizePolicy = iota
+	// OversizeFragment fragments IPv4 packets received from the NAT that exceed the MTU before they are delivered
+	// to clients, unless the don't fragment flag is set. Other packets that exceed the MTU are dropped.
+	// Packets sent by clients are never fragmented: the NAT sends them on sockets, which take whole datagrams.
+	OversizeFragment
+)
+
+// ReceiveQueuePolicy specifies which packet is dropped when a packet is received from the NAT and the receive queue is full.
+type ReceiveQueuePolicy int
+
+const (
+	// ReceiveQueueDropNewest drops the received packet.
+	ReceiveQueueDropNewest ReceiveQueuePolicy = iota
+	// ReceiveQueueDropOldest drops the oldest queued packet to make room for the received packet.
+	ReceiveQueueDropOldest
+)
+
+func DefaultUserspaceTunSettings() *UserspaceTunSettings {
+	return &UserspaceTunSettings{
+		Mtu:                  DefaultMtu,
+		OversizePolicy:       OversizeDrop,
+		NatMode:              NatModeSource,
+		TcpIdleTimeout:       DefaultTcpIdleTimeout,
+		TcpClosingTimeout:    DefaultTcpClosingTimeout,
+		UdpIdleTimeout:       DefaultUdpIdleTimeout,
+		IcmpIdleTimeout:      DefaultIcmpIdleTimeout,
+		NatSweepInterval:     DefaultNatSweepInterval,
+		NatPortRangeStart:    DefaultNatPortRangeStart,
+		NatPortRangeEnd:      DefaultNatPortRangeEnd,
+		NatPortPolicy:        NatPortSequential,
+		NatKeepaliveMaxIdle:  DefaultNatKeepaliveMaxIdle,
+		ReceiveQueueSize:     DefaultReceiveQueueSize,
+		ReceiveQueuePolicy:   ReceiveQueueDropNewest,
+		WriteWorkers:         DefaultWriteWorkers,
+		SendRetries:          DefaultSendRetries,
+		SendRetryBackoff:     DefaultSendRetryBackoff,
+		ACLMode:              ACLDeny,
+		PublicIPSelector:     PublicIPHash{},
+		ProvideMode:          protocol.ProvideMode_Network,
+		TimingSampleRate:     DefaultTimingSampleRate,
+		CloseGracePeriod:     DefaultCloseGracePeriod,
+		NatMissLogLimit:      DefaultNatMissLogLimit,
+		IncrementalChecksums: true,
+		TcpSegmentation:      true,
+	}
+}
+
+type UserspaceTunSettings struct {
+	// maximum size of packets read from or written to the TUN (e.g. 9000 for jumbo frames).
+	// It can be changed at runtime with SetMTU.
+	Mtu int
+	// if set, TCP packets that exceed the MTU, such as the coalesced segments of a device with GSO,
+	// are split into segments that fit the MTU. Other packets that exceed the MTU are handled by OversizePolicy.
+	TcpSegmentation bool
+	OversizePolicy  OversizePolicy
+	// with NatModePassthrough, packets are forwarded without source NAT and the NAT settings below are unused
+	NatMode NatMode
+	// NAT entries are removed after being idle for longer than the timeout of their protocol.
+	// TCP entries use TcpClosingTimeout once the connection was reset or both sides sent a FIN.
+	// The timeouts can be changed at runtime with SetNatIdleTimeouts.
+	TcpIdleTimeout    time.Duration
+	TcpClosingTimeout time.Duration
+	UdpIdleTimeout    time.Duration
+	IcmpIdleTimeout   time.Duration
+	NatSweepInterval  time.Duration
+	// public ports (and ICMP echo identifiers) are allocated from this inclusive range
+	NatPortRangeStart int
+	NatPortRangeEnd   int
+	NatPortPolicy     NatPortPolicy
+	// if positive, a keepalive is sent for established TCP connections and answered UDP flows idle for this interval
+	// (checked every NatSweepInterval), so that the mappings of the NATs on the way are kept.
+	// Keepalives stop once the client was idle for NatKeepaliveMaxIdle. The NAT created by CreateUserspaceTUNWithSettings
+	// sends the keepalives of UDP flows on their sockets, and TCP keepalives every interval on the sockets of connections.
+	NatKeepaliveInterval time.Duration
+	NatKeepaliveMaxIdle  time.Duration
+	// number of packets received from the NAT that can be queued for Read, and if positive, their total size in bytes.
+	// Packets are never delivered with a blocking send, so a stalled reader cannot block the NAT.
+	// The queue holds at most ReceiveQueueBytes, otherwise ReceiveQueueSize packets, which are usually
+	// at most the MTU (about 1.4 MiB with the defaults). See Metrics.ReceiveQueueHighWater to size the queue.
+	ReceiveQueueSize   int
+	ReceiveQueueBytes  int
+	ReceiveQueuePolicy ReceiveQueuePolicy
+	// number of goroutines that process the packets of a batch passed to Write: the goroutine calling Write,
+	// and WriteWorkers-1 goroutines that run until Close.
+	// Packets are distributed by flow, so the packets of a flow are sent in order.
+	WriteWorkers int
+	// packets the NAT did not accept are sent again up to SendRetries times, waiting SendRetryBackoff
+	// before the first retry and twice as long before each next retry.
+	// Packets still not accepted are dropped, see DropStats.SendFailed.
+	SendRetries      int
+	SendRetryBackoff time.Duration
+	// packets sent by clients are dropped by destination, see SetACL (e.g. ACLDeny with PrivatePrefixes).
+	// If ACLReplyProhibited is set, clients are sent an ICMP administratively prohibited for dropped packets.
+	ACLPrefixes        []netip.Prefix
+	ACLMode            ACLMode
+	ACLReplyProhibited bool
+	// bytes sent by each client through the NAT are limited, see SetRateLimit and SetClientRateLimit
+	RateLimit RateLimit
+	// if set, DNS queries sent by clients (TCP and UDP to port 53) are redirected to these resolvers,
+	// and the replies are sent back from the original destination so that clients are unaware of the redirect.
+	// Redirected queries are not checked against the ACL.
+	DNSResolverIPv4 net.IP
+	DNSResolverIPv6 net.IP
+	// additional public IPs to NAT the packets of clients, with the addresses passed to CreateUserspaceTUNWithSettings.
+	// Each client uses one address of the pool of its family, picked by PublicIPSelector. See SetPublicIPs.
+	PublicIPv4s      []net.IP
+	PublicIPv6s      []net.IP
+	PublicIPSelector PublicIPSelector
+	// if set, the NAT binds the socket of each flow to its public IP, so that the flow leaves the host from that address.
+	// All public IPs must then be addresses of the host. Otherwise the host picks the source address of the sockets,
+	// and the packets of every client leave from the same address whatever their public IP in the pool.
+	BindPublicIPs bool
+	// the provide mode passed with the packets sent by clients through the NAT (ProvideMode_Network by default),
+	// the relationship between the clients and the device. ProvideMode_None is not a valid mode to send packets.
+	// The NAT created by CreateUserspaceTUNWithSettings (connect.LocalUserNat) does not restrict destinations
+	// by mode, so whatever the mode, untrusted clients must be restricted with the ACL (e.g. ACLDeny with PrivatePrefixes).
+	ProvideMode protocol.ProvideMode
+	// the stages of 1 in TimingSampleRate packets are timed, see Metrics. 0 disables the timings.
+	TimingSampleRate int
+	// maximum time Close lets the NAT deliver the packets in flight, see Close. 0 stops the NAT immediately.
+	CloseGracePeriod time.Duration
+	// if positive, the first packet of each NAT flow and then 1 in FlowLogSampleRate packets of the flow
+	// are logged (verbose) with the protocol, client endpoint and public endpoint of the flow. 0 disables the flow log.
+	FlowLogSampleRate int
+	// packets received from the NAT without a NAT entry (see NatStats.LookupMisses) are logged (verbose) up to
+	// NatMissLogLimit times per destination port per minute, since unsolicited packets are common.
+	// The first NatMissDumpLimit are logged with a dump of the packet, which helps to diagnose NAT mapping bugs.
+	NatMissLogLimit  int
+	NatMissDumpLimit int
+	// if set, translated packets are rewritten in place and their checksums are adjusted for the rewritten fields,
+	// rather than serialized with checksums computed over the whole packet. Packets that are restructured
+	// (ICMP errors and their embedded packets, redirected DNS queries and their replies) are always serialized.
+	IncrementalChecksums bool
+	// the DSCP of packets sent by clients through the NAT is kept, cleared or rewritten by DscpRemap
+	// (from the codepoint of the client to the codepoint sent), see DscpPolicy. The ECN field is always kept.
+	DscpPolicy DscpPolicy
+	DscpRemap  map[uint8]uint8
+}
+
+// validProvideMode returns true if mode is a known mode that can send packets.
+func validProvideMode(mode protocol.ProvideMode) bool {
+	_, ok := protocol.ProvideMode_name[int32(mode)]
+	return ok && mode != protocol.ProvideMode_None
+}
+
+// publicIPPools returns the public IPs of each family, starting with the address passed to the constructor if any.
+func (settings *UserspaceTunSettings) publicIPPools(publicIPv4 *net.IP, publicIPv6 *net.IP) (publicIPPool, publicIPPool, error) {
+	ipv4s := slices.Clone(settings.PublicIPv4s)
+	if publicIPv4 != nil {
+		ipv4s = slices.Insert(ipv4s, 0, *publicIPv4)
+	}
+	ipv6s := slices.Clone(settings.PublicIPv6s)
+	if publicIPv6 != nil {
+		ipv6s = slices.Insert(ipv6s, 0, *publicIPv6)
+	}
+	v4, err := newPublicIPPool(ipv4s, true)
+	if err != nil {
+		return publicIPPool{}, publicIPPool{}, err
+	}
+	v6, err := newPublicIPPool(ipv6s, false)
+	if err != nil {
+		return publicIPPool{}, publicIPPool{}, err
+	}
+	return v4, v6, nil
+}
+
+func (settings *UserspaceTunSettings) natIdleTimeouts() NatIdleTimeouts {
+	return NatIdleTimeouts{
+		Tcp:        settings.TcpIdleTimeout,
+		TcpClosing: settings.TcpClosingTimeout,
+		Udp:        settings.UdpIdleTimeout,
+		Icmp:       settings.IcmpIdleTimeout,
+	}
+}
+
+// userNat is the part of connect.LocalUserNat used by the TUN.
+type userNat interface {
+	SendPacket(source connect.TransferPath, provideMode protocol.ProvideMode, packet []byte, timeout time.Duration) bool
+	AddReceivePacketCallback(receiveCallback connect.ReceivePacketFunction) func()
+}
+
+// NATKey is the public side of a NAT entry.
+// For ICMP echo, the echo identifier takes the place of the port.
 type NATKey struct {
-	IP   string
-	Port int
+	IP       string
+	Port     int
+	Protocol layers.IPProtocol
 }
 
+// NATValue is the local side of a NAT entry.
 type NATValue struct {
-	IP net.IP
+	IP   net.IP
+	Port int
+	// time the entry was created and last time a packet was sent or received for the entry
+	Created      time.Time
+	LastActivity time.Time
+	// identifies the flow of the entry, since its public and client ports are reused once it expires
+	FlowId uint64
+	// packets and bytes sent by the client (outbound) and received from the NAT (inbound)
+	OutboundPackets uint64
+	OutboundBytes   uint64
+	InboundPackets  uint64
+	InboundBytes    uint64
+	// the public port of the entry is the source port of the client, see NatPortPreserve
+	PortPreserved bool
+
+	// TCP connection state, the entry expires after TcpClosingTimeout once the connection is closed
+	tcpState tcpState
+	// destination of the last DNS query redirected to the resolver, see UserspaceTunSettings.DNSResolverIPv4
+	dnsOriginalDst net.IP
+	// flow of the entry, see UserspaceTunSettings.NatKeepaliveInterval
+	keepalive flowKeepalive
+	// the entry was loaded by LoadNatState and no packet was seen since
+	restored bool
 }
 
 type UserspaceTun struct {
 	closeOnce sync.Once
+	closing   chan struct{}  // closed first by Close, see Close
+	closed    chan struct{}  // closed by Close once the NAT is stopped, before the events channel
+	eventsMu  sync.RWMutex   // eventsMu is held to send on events and to close it
 	events    chan tun.Event // device related events
-	natRcv    chan []byte    // channel to receive packets from NAT
-	log       *logger.Logger
+	natRcv    chan []byte    // channel to receive packets from NAT, never closed so that delivery cannot panic
+	// bytes of the packets in natRcv, and the highest number of packets and bytes in natRcv
+	natRcvBytes          atomic.Int64
+	natRcvHighWater      atomic.Int64
+	natRcvBytesHighWater atomic.Int64
+	log                  *logger.Logger
 
-	writeOpMu sync.Mutex // writeOpMu guards toWrite
+	writeOpMu sync.Mutex // writeOpMu guards toWrite and the write* fields
 	toWrite   []int
+	// per worker packet indexes and per packet results of writeParallel
+	writeShards [][]int
+	writeCounts []int
+	writeErrs   []error
+	// shards of the batch for the write workers, and the shards being processed by the write workers
+	writeJobs chan writeJob
+	writeWg   sync.WaitGroup
+
+	// natTableMu guards the NAT table and public IPs.
+	// The table is not sharded by flow: outbound packets are looked up by client flow (natMappings)
+	// and inbound packets by public port (natTable), and allocating a port, pinning a client to a public IP
+	// and counting the entries of a client need all entries. A lookup holds natTableMu for a few map operations,
+	// and the sweeper holds it for batches of natSweepBatchSize entries.
+	natTableMu      sync.Mutex
+	natTable        map[NATKey]NATValue
+	natMappings     map[natMapping]NATKey // reverse of natTable
+	natNextPort     int
+	natStats        NatStats
+	natIdleTimeouts NatIdleTimeouts
+	publicIPs       struct { // used to NAT outgoing packets
+		v4 publicIPPool
+		v6 publicIPPool
+	}
+	natClients         map[string]natClient        // by client IP
+	natPublicIPEntries map[string]int              // by public IP
+	natAccounting      map[string]ClientAccounting // expired entries by client IP, see FlowAccounting
+	natFlowIds         uint64
+
+	fragmentsMu sync.Mutex                  // fragmentsMu guards fragments
+	fragments   *ip4defrag.IPv4Defragmenter // fragments sent by clients, see reassembleIPv4
+
+	rateLimitMu      sync.Mutex // rateLimitMu guards rateLimit, clientRateLimits, rateLimiters and rateLimitDrops
+	rateLimit        RateLimit
+	clientRateLimits map[string]RateLimit
+	rateLimiters     map[string]*tokenBucket
+	rateLimitDrops   uint64
+
+	natMisses natMissLog
+
+	dscpMarks [dscpCodepoints]uint8 // by the DSCP of outbound packets, see DscpPolicy
+
+	nat         userNat
+	natCancel   context.CancelFunc
+	provideMode protocol.ProvideMode // settings.ProvideMode, passed with every packet sent through the NAT
+
+	settings *UserspaceTunSettings
+	mtu      atomic.Int32 // initially settings.Mtu, see SetMTU
+	// an MTU update event is waiting to be sent, and mtuUpdateMu is held to send it, see notifyMTUUpdate
+	mtuUpdatePending atomic.Bool
+	mtuUpdateMu      sync.Mutex
+	acl              atomic.Pointer[destinationACL]
+
+	packets struct {
+		written     atomic.Uint64
+		sent        atomic.Uint64
+		sendRetries atomic.Uint64
+		segmented   atomic.Uint64
+		received    atomic.Uint64
+		read        atomic.Uint64
+	}
+	timingSamples atomic.Uint64
+	stageTimings  [stageCount]timingHistogram
+
+	drops struct {
+		decodeFailed         atomic.Uint64
+		noIPLayer            atomic.Uint64
+		noTransport          atomic.Uint64
+		unsupportedTransport atomic.Uint64
+		noPublicIP           atomic.Uint64
+		natPortsExhausted    atomic.Uint64
+		noNatEntry           atomic.Uint64
+		serializeFailed      atomic.Uint64
+		sendFailed           atomic.Uint64
+		writeOversize        atomic.Uint64
+		writeTtlExceeded     atomic.Uint64
+		fragmentsExpired     atomic.Uint64
+		readOversize         atomic.Uint64
+		readBufferTooSmall   atomic.Uint64
+		receiveQueueFull     atomic.Uint64
+	}
+}
+
+// DropStats are counters of packets dropped by the TUN.
+// Unless noted, a counter includes the packets of both directions.
+type DropStats struct {
+	// packets whose headers could not be decoded (e.g. truncated)
+	DecodeFailed uint64
+	// packets that are neither IPv4 nor IPv6
+	NoIPLayer uint64
+	// packets that are neither TCP, UDP nor ICMP echo (nor an ICMP error received from the NAT)
+	NoTransport uint64
+	// IPv6 fragments, IPv4 fragments received from the NAT, and ICMP errors that embed an unsupported packet
+	UnsupportedTransport uint64
+	// packets sent by clients of an address family without public IPs
+	NoPublicIP uint64
+	// packets sent by clients that start a flow when all NAT ports are in use
+	NatPortsExhausted uint64
+	// packets received from the NAT without a NAT entry
+	NoNatEntry uint64
+	// translated packets that could not be serialized
+	SerializeFailed uint64
+	// packets sent by clients that the NAT did not accept after the retries
+	SendFailed uint64
+	// packets sent by clients that exceed the MTU and could not be segmented
+	WriteOversize uint64
+	// packets sent by clients whose TTL (or hop limit) expired
+	WriteTtlExceeded uint64
+	// datagrams fragmented by clients whose fragments were not all sent within the reassembly timeout
+	FragmentsExpired uint64
+	// packets received from the NAT that exceed the MTU
+	ReadOversize uint64
+	// packets received from the NAT that are larger than the buffer passed to Read
+	ReadBufferTooSmall uint64
+	// packets received from the NAT (or created by the TUN) that were dropped because the receive queue was full
+	ReceiveQueueFull uint64
+}
+
+// DropStats returns the current counters of dropped packets.
+func (tun *UserspaceTun) DropStats() DropStats {
+	return DropStats{
+		DecodeFailed:         tun.drops.decodeFailed.Load(),
+		NoIPLayer:            tun.drops.noIPLayer.Load(),
+		NoTransport:          tun.drops.noTransport.Load(),
+		UnsupportedTransport: tun.drops.unsupportedTransport.Load(),
+		NoPublicIP:           tun.drops.noPublicIP.Load(),
+		NatPortsExhausted:    tun.drops.natPortsExhausted.Load(),
+		NoNatEntry:           tun.drops.noNatEntry.Load(),
+		SerializeFailed:      tun.drops.serializeFailed.Load(),
+		SendFailed:           tun.drops.sendFailed.Load(),
+		WriteOversize:        tun.drops.writeOversize.Load(),
+		WriteTtlExceeded:     tun.drops.writeTtlExceeded.Load(),
+		FragmentsExpired:     tun.drops.fragmentsExpired.Load(),
+		ReadOversize:         tun.drops.readOversize.Load(),
+		ReadBufferTooSmall:   tun.drops.readBufferTooSmall.Load(),
+		ReceiveQueueFull:     tun.drops.receiveQueueFull.Load(),
+	}
+}
 
-	natTableMu sync.Mutex
-	natTable   map[NATKey]NATValue
+// dropLogSampleRate is the number of drops of a reason per log line, so that a flood of dropped packets
+// (e.g. unroutable replies) does not slow down the TUN with logging.
+const dropLogSampleRate = 1000
 
-	nat       *connect.LocalUserNat
-	natCancel context.CancelFunc
+// drop counts a dropped packet and logs the first drop of the counter and every dropLogSampleRate-th drop after it.
+// The log line has the total number of drops of the counter.
+func (tun *UserspaceTun) drop(counter *atomic.Uint64, format string, args ...any) {
+	if n := counter.Add(1); n%dropLogSampleRate == 1 {
+		tun.log.Verbosef(format+" (%d dropped)", append(args, n)...)
+	}
+}
 
-	publicIP struct { // used to NAT outgoing packets
-		v4 *net.IP
-		v6 *net.IP
+// dropUndecoded counts a packet missing a layer as a decode failure if its headers failed to decode,
+// otherwise with counter.
+func (tun *UserspaceTun) dropUndecoded(packet *decodedPacket, counter *atomic.Uint64, format string, args ...any) {
+	if packet.err != nil {
+		tun.drop(&tun.drops.decodeFailed, format+": %v", append(args, packet.err)...)
+		return
 	}
+	tun.drop(counter, format, args...)
+}
+
+// dropError counts a packet dropped because its translation failed with err.
+func (tun *UserspaceTun) dropError(err error, format string, args ...any) {
+	counter := &tun.drops.decodeFailed
+	switch {
+	case errors.Is(err, errNoPublicIP):
+		counter = &tun.drops.noPublicIP
+	case errors.Is(err, errNatPortsExhausted):
+		counter = &tun.drops.natPortsExhausted
+	case errors.Is(err, errNoNatEntry):
+		counter = &tun.drops.noNatEntry
+	}
+	tun.drop(counter, format, append(args, err)...)
 }
 
 func (tun *UserspaceTun) MTU() int {
-	return 0
+	return int(tun.mtu.Load())
 }
 
 func (tun *UserspaceTun) Events() <-chan tun.Event {
 	return tun.events
 }
 
+// AddEvent sends an event to the device. It blocks until the event is sent or the TUN is closed,
+// in which case the event is discarded.
 func (tun *UserspaceTun) AddEvent(event tun.Event) {
-	tun.events <- event
+	tun.eventsMu.RLock()
+	defer tun.eventsMu.RUnlock()
+	select {
+	case <-tun.closed:
+	default:
+		select {
+		case tun.events <- event:
+		case <-tun.closed:
+		}
+	}
 }
 
 func (tun *UserspaceTun) BatchSize() int {
-	return 1
+	return conn.IdealBatchSize
 }
 
+// Close stops the TUN. It is idempotent and safe to call concurrently with the other methods.
+//
+// The TUN is torn down in order, so that the packets in flight are not lost:
+//  1. Write returns os.ErrClosed, and sends being retried are dropped.
+//  2. The NAT keeps delivering packets for Read until no packet was delivered for closeQuietPeriod,
+//     for at most CloseGracePeriod.
+//  3. The NAT is stopped and its callback removed.
+//  4. Read returns the packets still queued, then os.ErrClosed. Blocked calls of AddEvent return
+//     and the events channel is closed.
+//
+// Close returns after step 4 starts, blocking for up to CloseGracePeriod.
 func (tun *UserspaceTun) Close() error {
 	tun.closeOnce.Do(func() {
-		if tun.events != nil {
-			close(tun.events)
-		}
-		if tun.natRcv != nil {
-			close(tun.natRcv)
-		}
-	})
-	if tun.nat != nil {
+		close(tun.closing)
+		tun.drainNat()
 		tun.natCancel()
-		tun.nat = nil
-		tun.natCancel = nil
-	}
+		close(tun.closed)
+
+		tun.eventsMu.Lock()
+		close(tun.events)
+		tun.eventsMu.Unlock()
+	})
 	return nil
 }
 
 func (tun *UserspaceTun) Write(bufs [][]byte, offset int) (int, error) {
 	tun.writeOpMu.Lock()
 	defer tun.writeOpMu.Unlock()
+	select {
+	case <-tun.closing:
+		return 0, os.ErrClosed
+	default:
+	}
 	var (
 		errs  error
 		total int
 	)
+	if workers := min(tun.settings.WriteWorkers, len(bufs)); 1 < workers {
+		return tun.writeParallel(bufs, offset, workers)
+	}
 	tun.toWrite = tun.toWrite[:0]
 	for i := range bufs {
 		tun.toWrite = append(tun.toWrite, i)
 	}
 	for _, bufsI := range tun.toWrite {
-		packetData := bufs[bufsI][offset:]
-		packet := gopacket.NewPacket(packetData, layers.LayerTypeIPv4, gopacket.Default)
-
-		count, err := tun.processWritePacket(packet)
+		count, err := tun.writePacket(bufs[bufsI][offset:])
 		if err != nil {
 			errs = errors.Join(errs, err)
 		}
@@ -113,206 +527,648 @@ func (tun *UserspaceTun) Write(bufs [][]byte, offset int) (int, error) {
 	return total, errs
 }
 
+// writePacket decodes a packet sent by a client and sends it through the NAT.
+func (tun *UserspaceTun) writePacket(packetData []byte) (int, error) {
+	tun.packets.written.Add(1)
+	timed := tun.sampleTiming()
+	start := startStage(timed)
+	packet := decodePacket(packetData)
+	if ipv4 := packet.Layer(layers.LayerTypeIPv4); ipv4 != nil && isFragment(ipv4.(*layers.IPv4)) {
+		packet.release()
+		datagram, err := tun.reassembleIPv4(packetData)
+		if err != nil {
+			tun.drop(&tun.drops.decodeFailed, "Write: failed to reassemble fragment: %v", err)
+			return 0, fmt.Errorf("failed to reassemble fragment: %w", err)
+		}
+		if datagram == nil {
+			// wait for the other fragments of the datagram
+			return 0, nil
+		}
+		packet = decodePacket(datagram)
+		packet.reassembled = true
+	}
+	defer packet.release()
+	tun.observeStage(stageDecode, start)
+	packet.timed = timed
+	if tun.settings.NatMode == NatModePassthrough {
+		return tun.processWritePassthrough(packet)
+	}
+	return tun.processWritePacket(packet)
+}
+
+// dropTtlExceeded drops a packet sent by clientIP whose TTL (or hop limit) expired,
+// and sends an ICMP time exceeded back to the client from its public IP so that traceroute shows the NAT.
+func (tun *UserspaceTun) dropTtlExceeded(packet []byte, clientIP net.IP) {
+	tun.drops.writeTtlExceeded.Add(1)
+	reply, err := icmpTimeExceeded(packet, tun.replyPublicIP(clientIP))
+	if errors.Is(err, errIcmpErrorNotAllowed) {
+		return
+	}
+	if err != nil {
+		tun.log.Verbosef("Write: failed to create ICMP time exceeded: %v", err)
+		return
+	}
+	tun.deliver(reply)
+}
+
 // processWritePacket modifies the packet and sends it through the NAT.
 // It returns the number of packets sent and an error if any.
-func (tun *UserspaceTun) processWritePacket(packet gopacket.Packet) (int, error) {
+func (tun *UserspaceTun) processWritePacket(packet *decodedPacket) (int, error) {
 	var networkLayer gopacket.NetworkLayer // store either IPv4 or IPv6 layer
-	var localSrcIP NATValue
+	var localSrc NATValue
+	var tcp *layers.TCP
+	var udp *layers.UDP
+	dnsResolver := tun.dnsResolver(packet)
 
 	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
 		// NAT IPv4 packet
 		ipv4 := ipv4Layer.(*layers.IPv4)
-		localSrcIP = NATValue{IP: ipv4.SrcIP}
-		if tun.publicIP.v4 == nil {
-			return 0, errors.New("cannot send IPv4 packet: no public IPv4 address set")
+		localSrc = NATValue{IP: ipv4.SrcIP}
+		if ipv4.TTL <= 1 {
+			tun.dropTtlExceeded(packet.Data(), ipv4.SrcIP)
+			return 0, nil
+		}
+		if dnsResolver == nil && tun.dropDenied(packet.Data(), ipv4.SrcIP, ipv4.DstIP) {
+			return 0, nil
+		}
+		if !tun.allowRateLimit(ipv4.SrcIP, len(packet.Data())) {
+			return 0, nil
 		}
-		ipv4.SrcIP = *tun.publicIP.v4
 		ipv4.TTL -= 1
 		networkLayer = ipv4
 	} else if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
 		// NAT IPv6 packet
 		ipv6 := ipv6Layer.(*layers.IPv6)
-		localSrcIP = NATValue{IP: ipv6.SrcIP}
-		if tun.publicIP.v6 == nil {
-			return 0, errors.New("cannot send IPv6 packet: no public IPv6 address set")
+		localSrc = NATValue{IP: ipv6.SrcIP}
+		if ipv6.HopLimit <= 1 {
+			tun.dropTtlExceeded(packet.Data(), ipv6.SrcIP)
+			return 0, nil
+		}
+		if dnsResolver == nil && tun.dropDenied(packet.Data(), ipv6.SrcIP, ipv6.DstIP) {
+			return 0, nil
+		}
+		if !tun.allowRateLimit(ipv6.SrcIP, len(packet.Data())) {
+			return 0, nil
+		}
+		if packet.ipv6Extensions().fragment() {
+			tun.drop(&tun.drops.unsupportedTransport, "Write: IPv6 fragments are not translated")
+			return 0, fmt.Errorf("IPv6 fragments are not translated")
 		}
-		ipv6.SrcIP = *tun.publicIP.v6
 		ipv6.HopLimit -= 1
 		networkLayer = ipv6
 	} else {
+		tun.dropUndecoded(packet, &tun.drops.noIPLayer, "Write: packet has no IPv4/IPv6 layer")
 		return 0, fmt.Errorf("packet has no IPv4/IPv6 layer")
 	}
 
-	transportLayer := packet.TransportLayer()
-	if transportLayer == nil {
-		return 0, nil // NOTE: ignore packet if no transport layer found (e.g. ICMP)
+	var natProtocol layers.IPProtocol
+	var transportLayers []gopacket.SerializableLayer
+	var setSrcPort func(port int)
+	if transportLayer := packet.TransportLayer(); transportLayer != nil {
+		switch t := transportLayer.(type) {
+		case *layers.TCP:
+			t.SetNetworkLayerForChecksum(networkLayer)
+			localSrc.Port = int(t.SrcPort)
+			tcp = t
+			setSrcPort = func(port int) { t.SrcPort = layers.TCPPort(port) }
+		case *layers.UDP:
+			t.SetNetworkLayerForChecksum(networkLayer)
+			localSrc.Port = int(t.SrcPort)
+			udp = t
+			setSrcPort = func(port int) { t.SrcPort = layers.UDPPort(port) }
+		default:
+			tun.drop(&tun.drops.unsupportedTransport, "Write: unsupported transport layer type: %T", t)
+			return 0, fmt.Errorf("unsupported transport layer type: %T", t)
+		}
+		natProtocol = layerProtocol(transportLayer)
+		transportLayers = []gopacket.SerializableLayer{
+			transportLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(transportLayer.LayerPayload()),
+		}
+	} else if icmpLayers, id, ok := icmpEchoLayers(packet, networkLayer, true); ok {
+		// the echo identifier takes the place of the port
+		localSrc.Port = id
+		natProtocol = layerProtocol(icmpLayers[0].(gopacket.Layer))
+		transportLayers = icmpLayers
+		setSrcPort = func(port int) { setIcmpEchoId(icmpLayers, port) }
+	} else {
+		// NOTE: ignore packet if it is neither TCP, UDP nor an ICMP echo request
+		tun.dropUndecoded(packet, &tun.drops.noTransport, "Write: packet is neither TCP, UDP nor ICMP echo")
+		return 0, nil
 	}
 
-	natKey := NATKey{
-		IP: networkLayer.NetworkFlow().Src().String(),
+	// redirect DNS queries before the NAT, so that the entry restores the original destination of the replies
+	if dnsResolver != nil {
+		localSrc.dnsOriginalDst = redirectDNS(networkLayer, dnsResolver)
+	}
+	if 0 < tun.settings.NatKeepaliveInterval {
+		if tcp != nil {
+			localSrc.keepalive, _ = newTcpKeepalive(networkLayer, tcp)
+		} else if udp != nil {
+			localSrc.keepalive = newUdpKeepalive(networkLayer, udp)
+		}
 	}
 
-	// set source port and update checksum
-	switch t := transportLayer.(type) {
-	case *layers.TCP:
-		t.SetNetworkLayerForChecksum(networkLayer)
-		natKey.Port = int(t.SrcPort)
-	case *layers.UDP:
-		t.SetNetworkLayerForChecksum(networkLayer)
-		natKey.Port = int(t.SrcPort)
-	default:
-		return 0, fmt.Errorf("unsupported transport layer type: %T", t)
+	// translate source address and port, adding a nat entry for new flows
+	start := startStage(packet.timed)
+	natKey, publicIP, flowPackets, err := tun.natUpdateOutbound(natProtocol, localSrc, tcp, len(packet.Data()))
+	tun.observeStage(stageNat, start)
+	if err != nil {
+		tun.dropError(err, "Write: failed to translate packet: %v")
+		return 0, err
 	}
+	tun.logFlow("outbound", natKey, localSrc, flowPackets)
+	switch ip := networkLayer.(type) {
+	case *layers.IPv4:
+		ip.SrcIP = publicIP
+	case *layers.IPv6:
+		ip.SrcIP = publicIP
+	}
+	setSrcPort(natKey.Port)
 
 	// serialize modified packet
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	err := gopacket.SerializeLayers(buffer, options,
-		networkLayer.(gopacket.SerializableLayer),
-		transportLayer.(gopacket.SerializableLayer),
-		gopacket.Payload(transportLayer.LayerPayload()))
+	start = startStage(packet.timed)
+	var modifiedPacket []byte
+	if tun.settings.IncrementalChecksums && dnsResolver == nil {
+		modifiedPacket = rewritePacket(packet.Data(), true, publicIP, natKey.Port)
+	}
+	if modifiedPacket == nil {
+		modifiedPacket, err = serializePacket(append(packet.networkLayers(), transportLayers...)...)
+	}
+	tun.observeStage(stageSerialize, start)
 	if err != nil {
+		tun.drop(&tun.drops.serializeFailed, "Write: failed to serialize modified packet: %v", err)
 		return 0, fmt.Errorf("failed to serialize modified packet: %w", err)
 	}
 
-	// send packet through NAT
-	modifiedPacket := buffer.Bytes()
-	ok := tun.nat.SendPacket(connect.TransferPath{}, protocol.ProvideMode_Network, modifiedPacket, 1*time.Second)
-	if !ok {
-		return 0, errors.New("failed to send packet through NAT")
+	start = startStage(packet.timed)
+	n, err := tun.sendPacket(packet, modifiedPacket)
+	tun.observeStage(stageSend, start)
+	return n, err
+}
+
+// sendPacket marks the DSCP of a translated packet, fits it into the MTU and sends it through the NAT.
+// packet is the packet as sent by the client, which is embedded in ICMP errors.
+// Datagrams reassembled from fragments are not fit into the MTU, since each of their fragments fit.
+// It returns the number of packets sent and an error if any.
+func (tun *UserspaceTun) sendPacket(packet *decodedPacket, modifiedPacket []byte) (int, error) {
+	// mark before the packet is split, so that the segments copy the mark
+	tun.markDscp(modifiedPacket)
+
+	// fit packet into the MTU
+	modifiedPackets := [][]byte{modifiedPacket}
+	if mtu := tun.MTU(); len(modifiedPacket) > mtu && !packet.reassembled {
+		var segmented bool
+		if tun.settings.TcpSegmentation {
+			modifiedPackets, segmented = segmentTcp(modifiedPacket, mtu)
+		}
+		if !segmented {
+			tun.drops.writeOversize.Add(1)
+			tun.replyTooBig(packet.Data(), mtu)
+			return 0, fmt.Errorf("packet of %d bytes exceeds the MTU of %d", len(modifiedPacket), mtu)
+		}
+		tun.packets.segmented.Add(1)
 	}
 
-	// add nat entry
-	tun.natTableMu.Lock()
-	tun.natTable[natKey] = localSrcIP
-	tun.natTableMu.Unlock()
+	// send packet through NAT
+	for _, modifiedPacket := range modifiedPackets {
+		if !tun.sendWithRetry(modifiedPacket) {
+			// NOTE: the packet is dropped like a packet lost on the way, the other packets of the batch are still sent
+			tun.drop(&tun.drops.sendFailed, "Write: failed to send packet through NAT after %d retries", tun.settings.SendRetries)
+			return 0, nil
+		}
+		tun.packets.sent.Add(1)
+	}
 
 	return 1, nil
 }
 
-func (tun *UserspaceTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
-	packetData, ok := <-tun.natRcv
-	if !ok {
-		return 0, os.ErrClosed // channel has been closed
+const (
+	// the NAT is given up to 1s to deliver the packets in flight on Close
+	DefaultCloseGracePeriod = 1 * time.Second
+	// the NAT has delivered the packets in flight once no packet was delivered for this time
+	closeQuietPeriod = 20 * time.Millisecond
+)
+
+// drainNat waits for the NAT to deliver the packets in flight, until no packet was delivered
+// for closeQuietPeriod or CloseGracePeriod expires.
+func (tun *UserspaceTun) drainNat() {
+	deadline := time.Now().Add(tun.settings.CloseGracePeriod)
+	received := tun.packets.received.Load()
+	for {
+		wait := min(closeQuietPeriod, time.Until(deadline))
+		if wait <= 0 {
+			return
+		}
+		time.Sleep(wait)
+		next := tun.packets.received.Load()
+		if next == received {
+			return
+		}
+		received = next
 	}
+}
 
-	readInto := bufs[0][offset:]
-	n := copy(readInto, packetData) // copy packet data into the buffer
+// Read reads up to len(bufs) packets received from the NAT.
+// It blocks until at least one packet is available, then adds the packets already queued without blocking.
+// Once the TUN is closed, it returns the packets still queued, then os.ErrClosed.
+func (tun *UserspaceTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n := 0
+	for n < len(bufs) {
+		var packetData []byte
+		if n == 0 {
+			select {
+			case packetData = <-tun.natRcv:
+			case <-tun.closed:
+				// NOTE: the packets queued before the NAT was stopped are still read
+				select {
+				case packetData = <-tun.natRcv:
+				default:
+					return 0, os.ErrClosed
+				}
+			}
+		} else {
+			select {
+			case packetData = <-tun.natRcv:
+			default:
+				tun.packets.read.Add(uint64(n))
+				return n, nil
+			}
+		}
 
-	if n > len(readInto) {
-		return 0, fmt.Errorf("packet too large for buffer")
-	}
+		tun.natRcvBytes.Add(-int64(len(packetData)))
 
-	sizes[0] = n
-	return 1, nil
+		if mtu := tun.MTU(); len(packetData) > mtu {
+			tun.drops.readOversize.Add(1)
+			tun.log.Verbosef("Read: dropping packet of %d bytes that exceeds the MTU of %d", len(packetData), mtu)
+			continue
+		}
+		// NOTE: check the size before copying, since copy would silently truncate the packet
+		readInto := bufs[n][offset:]
+		if len(packetData) > len(readInto) {
+			tun.drops.readBufferTooSmall.Add(1)
+			tun.log.Verbosef("Read: dropping packet of %d bytes too large for buffer of %d bytes", len(packetData), len(readInto))
+			continue
+		}
+		sizes[n] = copy(readInto, packetData) // copy packet data into the buffer
+		n += 1
+	}
+	tun.packets.read.Add(uint64(n))
+	return n, nil
 }
 
-// CreateTUN creates a Device using userspace sockets.
+// CreateTUN creates a Device using userspace sockets with the default settings.
+//
+// The logger should be created with the logging package so that structured attributes are rendered.
 //
 // TODO: add arguments for UserLocalNat from bringyour/connect.
 func CreateUserspaceTUN(logger *logger.Logger, publicIPv4 *net.IP, publicIPv6 *net.IP) (tun.Device, error) {
-	tun := &UserspaceTun{
-		events:   make(chan tun.Event, 5),
-		toWrite:  make([]int, 0, conn.IdealBatchSize),
-		natTable: make(map[NATKey]NATValue),
-		natRcv:   make(chan []byte),
-		log:      logger,
+	return CreateUserspaceTUNWithSettings(logger, publicIPv4, publicIPv6, DefaultUserspaceTunSettings())
+}
+
+// CreateUserspaceTUNWithSettings creates a Device using userspace sockets.
+//
+// Returns an error if the settings are invalid.
+func CreateUserspaceTUNWithSettings(logger *logger.Logger, publicIPv4 *net.IP, publicIPv6 *net.IP, settings *UserspaceTunSettings) (tun.Device, error) {
+	if err := validateMtu(settings.Mtu); err != nil {
+		return nil, err
+	}
+	if err := settings.natIdleTimeouts().validate(); err != nil {
+		return nil, err
+	}
+	if settings.NatMode != NatModeSource && settings.NatMode != NatModePassthrough {
+		return nil, fmt.Errorf("NAT mode %d invalid", settings.NatMode)
+	}
+	if settings.NatSweepInterval <= 0 {
+		return nil, errors.New("NAT sweep interval must be positive")
+	}
+	if settings.NatPortRangeStart < 1 || settings.NatPortRangeEnd < settings.NatPortRangeStart || 65535 < settings.NatPortRangeEnd {
+		return nil, fmt.Errorf("NAT port range [%d, %d] invalid", settings.NatPortRangeStart, settings.NatPortRangeEnd)
+	}
+	if settings.NatPortPolicy < NatPortSequential || NatPortPreserve < settings.NatPortPolicy {
+		return nil, fmt.Errorf("NAT port policy %d invalid", settings.NatPortPolicy)
+	}
+	if settings.NatKeepaliveInterval < 0 || (0 < settings.NatKeepaliveInterval && settings.NatKeepaliveMaxIdle <= settings.NatKeepaliveInterval) {
+		return nil, errors.New("NAT keepalive interval must not be negative and the max idle must exceed it")
+	}
+	if err := settings.validateDscp(); err != nil {
+		return nil, err
+	}
+	if settings.ReceiveQueueBytes != 0 && settings.ReceiveQueueBytes < maxMtu {
+		// an empty queue must fit any packet, see deliver
+		return nil, fmt.Errorf("receive queue bytes %d must be 0 (unlimited) or at least %d", settings.ReceiveQueueBytes, maxMtu)
+	}
+	if settings.ReceiveQueueSize < 1 {
+		return nil, errors.New("receive queue size must be positive")
+	}
+	if !validProvideMode(settings.ProvideMode) {
+		return nil, fmt.Errorf("provide mode %v invalid", settings.ProvideMode)
+	}
+	if settings.CloseGracePeriod < 0 {
+		return nil, errors.New("close grace period must not be negative")
+	}
+	if settings.NatMissLogLimit < 0 || settings.NatMissDumpLimit < 0 {
+		return nil, errors.New("NAT miss log limits must not be negative")
+	}
+	if settings.FlowLogSampleRate < 0 {
+		return nil, errors.New("flow log sample rate must not be negative")
+	}
+	if settings.TimingSampleRate < 0 {
+		return nil, errors.New("timing sample rate must not be negative")
+	}
+	if settings.SendRetries < 0 || settings.SendRetryBackoff < 0 {
+		return nil, errors.New("send retries and backoff must not be negative")
+	}
+	if settings.WriteWorkers < 1 {
+		return nil, errors.New("write workers must be positive")
+	}
+	if err := validateACL(settings.ACLPrefixes, settings.ACLMode); err != nil {
+		return nil, err
+	}
+	if err := settings.RateLimit.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateDNSResolvers(settings.DNSResolverIPv4, settings.DNSResolverIPv6); err != nil {
+		return nil, err
+	}
+	if _, _, err := settings.publicIPPools(publicIPv4, publicIPv6); err != nil {
+		return nil, err
+	}
+	if settings.PublicIPSelector == nil {
+		return nil, errors.New("public IP selector must be set")
 	}
-	tun.publicIP.v4 = publicIPv4
-	tun.publicIP.v6 = publicIPv6
 
 	clientId := "test-client-id"
 	cancelCtx, cancel := context.WithCancel(context.Background())
-	tun.nat = connect.NewLocalUserNatWithDefaults(
+	nat := connect.NewLocalUserNat(
 		cancelCtx,
 		clientId,
+		settings.localUserNatSettings(),
 	)
+	// the NAT does not forward ICMP echo, which is sent on ICMP sockets instead
+	ping := newPingNat(cancelCtx, nat, settings.BindPublicIPs, settings.IcmpIdleTimeout)
+	return newUserspaceTun(logger, publicIPv4, publicIPv6, settings, ping, cancel), nil
+}
+
+// localUserNatSettings returns the settings of the NAT created by CreateUserspaceTUNWithSettings.
+func (settings *UserspaceTunSettings) localUserNatSettings() *connect.LocalUserNatSettings {
+	natSettings := connect.DefaultLocalUserNatSettings()
+	if 0 < settings.NatKeepaliveInterval {
+		natSettings.TcpBufferSettings.KeepAlivePeriod = settings.NatKeepaliveInterval
+		// the NAT closes the sockets of flows whose remote is silent for the read timeout,
+		// and the keepalives of idle flows are not answered with data
+		natSettings.TcpBufferSettings.ReadTimeout = settings.NatKeepaliveMaxIdle
+		natSettings.TcpBufferSettings.IdleTimeout = settings.NatKeepaliveMaxIdle
+		natSettings.UdpBufferSettings.ReadTimeout = settings.NatKeepaliveMaxIdle
+		natSettings.UdpBufferSettings.IdleTimeout = settings.NatKeepaliveMaxIdle
+	}
+	natSettings.UdpBufferSettings.BindSourceIp = settings.BindPublicIPs
+	natSettings.TcpBufferSettings.BindSourceIp = settings.BindPublicIPs
+	// the NAT marks its sockets with the DSCP of each flow, after DscpPolicy
+	natSettings.UdpBufferSettings.SetTrafficClass = true
+	natSettings.TcpBufferSettings.SetTrafficClass = true
+	// clients learn the path MTU and unreachable destinations of their UDP flows
+	natSettings.UdpBufferSettings.ReceiveIcmpErrors = true
+	return natSettings
+}
+
+func newUserspaceTun(logger *logger.Logger, publicIPv4 *net.IP, publicIPv6 *net.IP, settings *UserspaceTunSettings, nat userNat, cancel context.CancelFunc) *UserspaceTun {
+	tun := &UserspaceTun{
+		closing:     make(chan struct{}),
+		closed:      make(chan struct{}),
+		events:      make(chan tun.Event, 5),
+		toWrite:     make([]int, 0, conn.IdealBatchSize),
+		natTable:    make(map[NATKey]NATValue),
+		natMappings: make(map[natMapping]NATKey),
+		fragments:   ip4defrag.NewIPv4Defragmenter(),
+		natMisses:   natMissLog{ports: make(map[int]int)},
+
+		natIdleTimeouts:    settings.natIdleTimeouts(),
+		natClients:         make(map[string]natClient),
+		natPublicIPEntries: make(map[string]int),
+		natAccounting:      make(map[string]ClientAccounting),
+		rateLimit:          settings.RateLimit,
+		clientRateLimits:   make(map[string]RateLimit),
+		rateLimiters:       make(map[string]*tokenBucket),
+		natNextPort:        settings.NatPortRangeStart,
+		natRcv:             make(chan []byte, settings.ReceiveQueueSize),
+		log:                logger,
+		nat:                nat,
+		provideMode:        settings.ProvideMode,
+		settings:           settings,
+	}
+	tun.publicIPs.v4, tun.publicIPs.v6, _ = settings.publicIPPools(publicIPv4, publicIPv6)
+	tun.dscpMarks = settings.dscpMarks()
+	tun.mtu.Store(int32(settings.Mtu))
+	tun.acl.Store(newDestinationACL(settings.ACLPrefixes, settings.ACLMode))
+
+	if 1 < settings.WriteWorkers {
+		tun.writeJobs = make(chan writeJob)
+		for range settings.WriteWorkers - 1 {
+			go tun.runWriteWorker()
+		}
+	}
+
+	sweepCtx, sweepCancel := context.WithCancel(context.Background())
+	sweepDone := make(chan struct{})
+	go func() {
+		defer close(sweepDone)
+		tun.runNatSweeper(sweepCtx)
+	}()
+
 	removeCallback := tun.nat.AddReceivePacketCallback(tun.natReceive)
 	tun.natCancel = func() {
 		removeCallback()
+		sweepCancel()
+		<-sweepDone
 		cancel()
 	}
 
-	return tun, nil
+	return tun
 }
 
 // natReceive is a callback for tun.nat to receive packets.
 func (tun *UserspaceTun) natReceive(source connect.TransferPath, ipProtocol connect.IpProtocol, packet []byte) {
-	pkt := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+	timed := tun.sampleTiming()
+	start := startStage(timed)
+	pkt := decodePacket(packet)
+	defer pkt.release()
+	tun.observeStage(stageDecode, start)
+	pkt.timed = timed
+	if tun.settings.NatMode == NatModePassthrough {
+		tun.processNatReceivedPassthrough(pkt)
+		return
+	}
 	tun.processNatReceivedPacket(pkt)
 }
 
+// normalizeIP returns a copy of ip in its 4-byte form for IPv4 and its 16-byte form for IPv6.
+// The copy does not alias the packet buffer the IP was decoded from.
+func normalizeIP(ip net.IP) net.IP {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return append(net.IP(nil), ipv4...)
+	}
+	return append(net.IP(nil), ip.To16()...)
+}
+
 // processNatReceivedPacket NATs received packets.
-func (tun *UserspaceTun) processNatReceivedPacket(packet gopacket.Packet) {
+func (tun *UserspaceTun) processNatReceivedPacket(packet *decodedPacket) {
 	var networkLayer gopacket.NetworkLayer // store either IPv4 or IPv6 layer
 
 	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
-		networkLayer = ipv4Layer.(*layers.IPv4)
+		ipv4 := ipv4Layer.(*layers.IPv4)
+		if isFragment(ipv4) {
+			// the NAT receives datagrams on sockets and sends them whole
+			tun.drop(&tun.drops.unsupportedTransport, "NatReceive: IPv4 fragments are not translated")
+			return
+		}
+		networkLayer = ipv4
 	} else if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
+		if packet.ipv6Extensions().fragment() {
+			tun.drop(&tun.drops.unsupportedTransport, "NatReceive: IPv6 fragments are not translated")
+			return
+		}
 		networkLayer = ipv6Layer.(*layers.IPv6)
 	} else {
-		tun.log.Verbosef("NatReceive: packet has no IPv4/IPv6 layer")
+		tun.dropUndecoded(packet, &tun.drops.noIPLayer, "NatReceive: packet has no IPv4/IPv6 layer")
 		return
 	}
 
-	transportLayer := packet.TransportLayer()
-	if transportLayer == nil {
-		return // NOTE: ignore packet if no transport layer found (e.g. ICMP)
-	}
-
 	// compute nat key
 	natKey := NATKey{
 		IP: networkLayer.NetworkFlow().Dst().String(),
 	}
-	switch t := transportLayer.(type) {
-	case *layers.TCP:
-		natKey.Port = int(t.DstPort)
-	case *layers.UDP:
-		natKey.Port = int(t.DstPort)
-	default:
-		tun.log.Verbosef("NatReceive: unsupported transport layer type: %T", t)
+	var transportLayers []gopacket.SerializableLayer
+	var embedded []byte // packet embedded in an ICMP error message
+	var tcp *layers.TCP
+	var srcPort int
+	var setDstPort func(port int)
+	if transportLayer := packet.TransportLayer(); transportLayer != nil {
+		switch t := transportLayer.(type) {
+		case *layers.TCP:
+			t.SetNetworkLayerForChecksum(networkLayer)
+			srcPort = int(t.SrcPort)
+			natKey.Port = int(t.DstPort)
+			tcp = t
+			setDstPort = func(port int) { t.DstPort = layers.TCPPort(port) }
+		case *layers.UDP:
+			t.SetNetworkLayerForChecksum(networkLayer)
+			srcPort = int(t.SrcPort)
+			natKey.Port = int(t.DstPort)
+			setDstPort = func(port int) { t.DstPort = layers.UDPPort(port) }
+		default:
+			tun.drop(&tun.drops.unsupportedTransport, "NatReceive: unsupported transport layer type: %T", t)
+			return
+		}
+		natKey.Protocol = layerProtocol(transportLayer)
+		transportLayers = []gopacket.SerializableLayer{
+			transportLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(transportLayer.LayerPayload()),
+		}
+	} else if icmpLayers, id, ok := icmpEchoLayers(packet, networkLayer, false); ok {
+		natKey.Port = id
+		natKey.Protocol = layerProtocol(icmpLayers[0].(gopacket.Layer))
+		transportLayers = icmpLayers
+		setDstPort = func(port int) { setIcmpEchoId(icmpLayers, port) }
+	} else if icmpLayers, icmpEmbedded, ok := icmpErrorLayers(packet, networkLayer); ok {
+		// errors are matched by the packet that caused them, which was sent through the NAT.
+		// The NAT of CreateUserspaceTUNWithSettings only delivers the errors of UDP flows, and only on Linux.
+		natKey, ok = embeddedNatKey(icmpEmbedded)
+		if !ok {
+			tun.drop(&tun.drops.unsupportedTransport, "NatReceive: unsupported packet embedded in ICMP error")
+			return
+		}
+		transportLayers = icmpLayers
+		embedded = icmpEmbedded
+		setDstPort = func(port int) {}
+	} else {
+		// NOTE: ignore packet if it is neither TCP, UDP nor ICMP
+		tun.dropUndecoded(packet, &tun.drops.noTransport, "NatReceive: packet is neither TCP, UDP nor ICMP")
 		return
 	}
 
 	// find NAT entry
-	localDstIP, found := tun.natTable[natKey]
+	start := startStage(packet.timed)
+	localDst, found := tun.natLookupInbound(natKey, tcp, len(packet.Data()))
+	tun.observeStage(stageNat, start)
 	if !found {
-		tun.log.Verbosef("NatReceive: no NAT entry found for %s:%d", natKey.IP, natKey.Port)
+		tun.dropNatMiss(natKey, packet.Data())
 		return
 	}
+	tun.logFlow("inbound", natKey, localDst, localDst.OutboundPackets+localDst.InboundPackets)
 
 	// modify packet based on NAT entry
 	switch ip := networkLayer.(type) {
 	case *layers.IPv4:
-		ip.DstIP = localDstIP.IP
+		ip.DstIP = localDst.IP
 	case *layers.IPv6:
-		ip.DstIP = localDstIP.IP
+		ip.DstIP = localDst.IP
 	default:
-		tun.log.Verbosef("NatReceive: unsupported network layer type: %T", ip)
+		tun.drop(&tun.drops.noIPLayer, "NatReceive: unsupported network layer type: %T", ip)
 		return
 	}
-
-	// update checksum
-	switch t := transportLayer.(type) {
-	case *layers.TCP:
-		t.SetNetworkLayerForChecksum(networkLayer)
-	case *layers.UDP:
-		t.SetNetworkLayerForChecksum(networkLayer)
-	default:
-		tun.log.Verbosef("NatReceive: unsupported transport layer type: %T", t)
+	setDstPort(localDst.Port)
+	tun.restoreDNS(networkLayer, srcPort, localDst)
+	if embedded != nil && !rewriteEndpoint(embedded, true, localDst.IP, localDst.Port) {
+		tun.drop(&tun.drops.decodeFailed, "NatReceive: failed to rewrite packet embedded in ICMP error")
 		return
 	}
 
 	// serialize modified packet
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	err := gopacket.SerializeLayers(buffer, options, networkLayer.(gopacket.SerializableLayer), transportLayer.(gopacket.SerializableLayer), gopacket.Payload(transportLayer.LayerPayload()))
+	start = startStage(packet.timed)
+	var modifiedPacket []byte
+	var err error
+	if tun.settings.IncrementalChecksums && embedded == nil && localDst.dnsOriginalDst == nil {
+		modifiedPacket = rewritePacket(packet.Data(), false, localDst.IP, localDst.Port)
+	}
+	if modifiedPacket == nil {
+		modifiedPacket, err = serializePacket(append(packet.networkLayers(), transportLayers...)...)
+	}
+	tun.observeStage(stageSerialize, start)
 	if err != nil {
-		tun.log.Verbosef("NatReceive: failed to serialize modified IPv4 packet: %v", err)
+		tun.drop(&tun.drops.serializeFailed, "NatReceive: failed to serialize modified packet: %v", err)
 		return
 	}
 
 	// send modified packet to tun
-	modifiedPacket := buffer.Bytes()
-	tun.natRcv <- modifiedPacket
+	tun.deliverFitted(modifiedPacket)
+}
+
+// deliver queues a packet to be read by the device without blocking.
+// If the receive queue is full, a packet is dropped according to the ReceiveQueuePolicy.
+func (tun *UserspaceTun) deliver(packet []byte) {
+	for {
+		// the bytes are counted before the packet is queued, so that Read never counts them below zero
+		queuedBytes := tun.natRcvBytes.Add(int64(len(packet)))
+		if tun.settings.ReceiveQueueBytes <= 0 || queuedBytes <= int64(tun.settings.ReceiveQueueBytes) {
+			select {
+			case tun.natRcv <- packet:
+				tun.packets.received.Add(1)
+				storeMax(&tun.natRcvHighWater, int64(len(tun.natRcv)))
+				storeMax(&tun.natRcvBytesHighWater, queuedBytes)
+				return
+			default:
+			}
+		}
+		tun.natRcvBytes.Add(-int64(len(packet)))
+		tun.drops.receiveQueueFull.Add(1)
+		if tun.settings.ReceiveQueuePolicy != ReceiveQueueDropOldest {
+			return
+		}
+		select {
+		case dropped := <-tun.natRcv:
+			tun.natRcvBytes.Add(-int64(len(dropped)))
+		default:
+		}
+	}
+}
+
+// storeMax stores n in v if n is greater than the value of v.
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		current := v.Load()
+		if n <= current || v.CompareAndSwap(current, n) {
+			return
+		}
+	}
 }
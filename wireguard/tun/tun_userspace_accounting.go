@@ -0,0 +1,79 @@
+package tun
+
+import (
+	"cmp"
+	"slices"
+)
+
+// ClientAccounting is the traffic of a client through the NAT, of its current and expired flows.
+// The counters only increase, so usage is metered by the difference between two snapshots.
+type ClientAccounting struct {
+	ClientIP string
+	// number of flows (NAT entries) of the client
+	Flows uint64
+	// packets and bytes sent by the client (outbound) and received from the NAT (inbound)
+	OutboundPackets uint64
+	OutboundBytes   uint64
+	InboundPackets  uint64
+	InboundBytes    uint64
+}
+
+func (accounting *ClientAccounting) add(value NATValue) {
+	accounting.Flows += 1
+	accounting.OutboundPackets += value.OutboundPackets
+	accounting.OutboundBytes += value.OutboundBytes
+	accounting.InboundPackets += value.InboundPackets
+	accounting.InboundBytes += value.InboundBytes
+}
+
+// FlowAccounting is a snapshot of the traffic through the NAT by client, see UserspaceTun.FlowAccounting.
+type FlowAccounting struct {
+	// ordered by client IP
+	Clients []ClientAccounting
+	// the current flows, if requested. A flow is identified by its FlowId, since its ports may be reused once it expires.
+	Flows []NATEntry
+}
+
+// FlowAccounting returns the traffic through the NAT of each client and, if flows is set, of each current flow.
+//
+// The counters of a flow are added to its client when its entry expires, so that the totals include the tail of the flow.
+// Clients are kept once seen, which is bounded by the addresses of the peers.
+func (tun *UserspaceTun) FlowAccounting(flows bool) FlowAccounting {
+	var accounting FlowAccounting
+	if flows {
+		accounting.Flows = tun.NATEntries()
+	}
+
+	tun.natTableMu.Lock()
+	clients := make(map[string]ClientAccounting, len(tun.natAccounting))
+	for clientKey, client := range tun.natAccounting {
+		clients[clientKey] = client
+	}
+	for _, value := range tun.natTable {
+		clientKey := value.IP.String()
+		client := clients[clientKey]
+		client.ClientIP = clientKey
+		client.add(value)
+		clients[clientKey] = client
+	}
+	tun.natTableMu.Unlock()
+
+	// NOTE: sort outside of the lock
+	accounting.Clients = make([]ClientAccounting, 0, len(clients))
+	for _, client := range clients {
+		accounting.Clients = append(accounting.Clients, client)
+	}
+	slices.SortFunc(accounting.Clients, func(a ClientAccounting, b ClientAccounting) int {
+		return cmp.Compare(a.ClientIP, b.ClientIP)
+	})
+	return accounting
+}
+
+// natAccountExpired adds the counters of an entry that is removed to its client. natTableMu must be held.
+func (tun *UserspaceTun) natAccountExpired(value NATValue) {
+	clientKey := value.IP.String()
+	client := tun.natAccounting[clientKey]
+	client.ClientIP = clientKey
+	client.add(value)
+	tun.natAccounting[clientKey] = client
+}
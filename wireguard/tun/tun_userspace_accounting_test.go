@@ -0,0 +1,78 @@
+package tun
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestUserspaceTunFlowAccounting(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+	otherLocalIPv4 := net.ParseIP("192.168.90.3").To4()
+	write := func(packet []byte) {
+		t.Helper()
+		if _, err := tun.Write([][]byte{packet}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+
+	// a UDP flow with 3 queries of 38 bytes and 2 replies of 128 bytes, and a TCP SYN of 40 bytes
+	for i := 0; i < 3; i += 1 {
+		write(udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false))
+	}
+	udpPort := sentPort(nat.sent[0])
+	for i := 0; i < 2; i += 1 {
+		nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, udpPort, 100, false))
+		if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+			t.Fatalf("failed to read packet: %v", err)
+		}
+	}
+	write(tcpPacket(t, testLocalIPv4, 40001, testRemoteIPv4, 443, func(tcp *layers.TCP) { tcp.SYN = true }))
+	// another client
+	write(udpPacket(t, otherLocalIPv4, 40000, testRemoteIPv4, 53, 10, false))
+
+	expected := []ClientAccounting{
+		{ClientIP: testLocalIPv4.String(), Flows: 2, OutboundPackets: 4, OutboundBytes: 3*38 + 40, InboundPackets: 2, InboundBytes: 2 * 128},
+		{ClientIP: otherLocalIPv4.String(), Flows: 1, OutboundPackets: 1, OutboundBytes: 38},
+	}
+	accounting := tun.FlowAccounting(true)
+	if !reflect.DeepEqual(accounting.Clients, expected) {
+		t.Fatalf("expected clients %+v, got %+v", expected, accounting.Clients)
+	}
+	flowIds := map[uint64]bool{}
+	for _, flow := range accounting.Flows {
+		flowIds[flow.FlowId] = true
+	}
+	if len(accounting.Flows) != 3 || len(flowIds) != 3 {
+		t.Fatalf("expected 3 flows with distinct ids, got %+v", accounting.Flows)
+	}
+
+	// the counters of the expired UDP flows are kept with their clients
+	tun.sweepNatTable(time.Now().Add(DefaultUdpIdleTimeout))
+	if stats := tun.NatStats(); stats.Entries != 1 {
+		t.Fatalf("expected the UDP flows to expire, got %+v", stats)
+	}
+	if clients := tun.FlowAccounting(false).Clients; !reflect.DeepEqual(clients, expected) {
+		t.Fatalf("expected clients %+v after the flows expired, got %+v", expected, clients)
+	}
+
+	// a new flow on the same ports is a new flow
+	write(udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false))
+	expected[0].Flows, expected[0].OutboundPackets, expected[0].OutboundBytes = 3, 5, 4*38+40
+	accounting = tun.FlowAccounting(true)
+	if !reflect.DeepEqual(accounting.Clients, expected) {
+		t.Fatalf("expected clients %+v, got %+v", expected, accounting.Clients)
+	}
+	for _, flow := range accounting.Flows {
+		if flow.Protocol == layers.IPProtocolUDP && flowIds[flow.FlowId] {
+			t.Fatalf("expected a new flow id, got %+v", flow)
+		}
+	}
+
+	if clients := tun.Metrics().Clients; !reflect.DeepEqual(clients, expected) {
+		t.Fatalf("expected the metrics to report clients %+v, got %+v", expected, clients)
+	}
+}
@@ -0,0 +1,143 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+)
+
+// ACLMode specifies how the destination prefixes of the ACL are used.
+type ACLMode int
+
+const (
+	// ACLDeny drops packets sent to the prefixes.
+	ACLDeny ACLMode = iota
+	// ACLAllow drops packets sent outside of the prefixes.
+	ACLAllow
+)
+
+// PrivatePrefixes are the ranges that are usually denied on an exit server:
+// private (RFC 1918, RFC 4193), shared (RFC 6598), loopback and link-local addresses.
+var PrivatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// ACLDrops are the packets dropped by the ACL since it was set.
+type ACLDrops struct {
+	// packets sent to each prefix (ACLDeny)
+	Prefixes map[netip.Prefix]uint64
+	// packets sent outside of the prefixes (ACLAllow)
+	NotAllowed uint64
+}
+
+// destinationACL is a list of destination prefixes. It is immutable except for its counters,
+// so that it can be replaced at runtime without locking the write path.
+type destinationACL struct {
+	mode            ACLMode
+	prefixes        []netip.Prefix
+	prefixDrops     []atomic.Uint64
+	notAllowedDrops atomic.Uint64
+}
+
+func validateACL(prefixes []netip.Prefix, mode ACLMode) error {
+	if mode != ACLDeny && mode != ACLAllow {
+		return fmt.Errorf("unknown ACL mode %d", mode)
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsValid() {
+			return fmt.Errorf("invalid ACL prefix %v", prefix)
+		}
+	}
+	return nil
+}
+
+func newDestinationACL(prefixes []netip.Prefix, mode ACLMode) *destinationACL {
+	acl := &destinationACL{
+		mode:        mode,
+		prefixes:    slices.Clone(prefixes),
+		prefixDrops: make([]atomic.Uint64, len(prefixes)),
+	}
+	for i, prefix := range acl.prefixes {
+		acl.prefixes[i] = prefix.Masked()
+	}
+	return acl
+}
+
+// denies returns true if packets sent to dst are dropped, and counts the drop.
+// The prefixes are checked in order, so the list is expected to be short.
+func (acl *destinationACL) denies(dst netip.Addr) bool {
+	dst = dst.Unmap()
+	for i, prefix := range acl.prefixes {
+		if prefix.Contains(dst) {
+			if acl.mode == ACLDeny {
+				acl.prefixDrops[i].Add(1)
+				return true
+			}
+			return false
+		}
+	}
+	if acl.mode == ACLAllow {
+		acl.notAllowedDrops.Add(1)
+		return true
+	}
+	return false
+}
+
+// SetACL replaces the destination ACL of the TUN.
+// Existing NAT entries are kept, so flows that are still allowed continue uninterrupted.
+//
+// Returns an error if a prefix is invalid.
+func (tun *UserspaceTun) SetACL(prefixes []netip.Prefix, mode ACLMode) error {
+	if err := validateACL(prefixes, mode); err != nil {
+		return err
+	}
+	tun.acl.Store(newDestinationACL(prefixes, mode))
+	return nil
+}
+
+// ACLDrops returns the counters of the current ACL.
+func (tun *UserspaceTun) ACLDrops() ACLDrops {
+	acl := tun.acl.Load()
+	drops := ACLDrops{
+		Prefixes:   make(map[netip.Prefix]uint64),
+		NotAllowed: acl.notAllowedDrops.Load(),
+	}
+	if acl.mode == ACLDeny {
+		for i, prefix := range acl.prefixes {
+			drops.Prefixes[prefix] += acl.prefixDrops[i].Load()
+		}
+	}
+	return drops
+}
+
+// dropDenied returns true if a packet sent by clientIP to dstIP is denied by the ACL,
+// in which case an ICMP administratively prohibited is sent back to the client from its public IP if enabled.
+func (tun *UserspaceTun) dropDenied(packet []byte, clientIP net.IP, dstIP net.IP) bool {
+	dst, ok := netip.AddrFromSlice(dstIP)
+	if !ok || !tun.acl.Load().denies(dst) {
+		return false
+	}
+	if tun.settings.ACLReplyProhibited {
+		reply, err := icmpProhibited(packet, tun.replyPublicIP(clientIP))
+		if errors.Is(err, errIcmpErrorNotAllowed) {
+			return true
+		}
+		if err != nil {
+			tun.log.Verbosef("Write: failed to create ICMP administratively prohibited: %v", err)
+			return true
+		}
+		tun.deliver(reply)
+	}
+	return true
+}
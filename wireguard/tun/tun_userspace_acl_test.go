@@ -0,0 +1,139 @@
+package tun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestUserspaceTunACLDeny(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.ACLPrefixes = PrivatePrefixes
+	settings.ACLReplyProhibited = true
+	tun, nat := newTestTun(t, settings)
+
+	// allowed destination
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected one packet sent, got %d", len(nat.sent))
+	}
+
+	// denied destination
+	packet := udpPacket(t, testLocalIPv4, 40000, net.ParseIP("10.1.2.3").To4(), 53, 10, false)
+	if _, err := tun.Write([][]byte{packet}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected the packet to 10.1.2.3 to be dropped")
+	}
+	if drops := tun.ACLDrops(); drops.Prefixes[netip.MustParsePrefix("10.0.0.0/8")] != 1 {
+		t.Fatalf("expected 1 drop for 10.0.0.0/8, got %+v", drops)
+	}
+	prohibited, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if typ, code := prohibited[20], prohibited[21]; typ != layers.ICMPv4TypeDestinationUnreachable || code != layers.ICMPv4CodeCommAdminProhibited {
+		t.Fatalf("expected ICMP administratively prohibited, got type %d code %d", typ, code)
+	}
+	if dstIP := net.IP(prohibited[16:20]); !dstIP.Equal(testLocalIPv4) {
+		t.Fatalf("expected ICMP to %v, got %v", testLocalIPv4, dstIP)
+	}
+
+	// denied IPv6 destination
+	publicIPv6 := net.ParseIP("2001:db8::1")
+	if err := tun.SetPublicIPs([]net.IP{testPublicIPv4}, []net.IP{publicIPv6}); err != nil {
+		t.Fatalf("failed to set public IPs: %v", err)
+	}
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("fd00::2"),
+		DstIP:      net.ParseIP("fd12::7"),
+	}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ipv6)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ipv6, udp, gopacket.Payload(make([]byte, 10))); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	if _, err := tun.processWritePacket(decodePacket(buffer.Bytes())); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected the packet to fd12::7 to be dropped")
+	}
+	if drops := tun.ACLDrops(); drops.Prefixes[netip.MustParsePrefix("fc00::/7")] != 1 {
+		t.Fatalf("expected 1 drop for fc00::/7, got %+v", drops)
+	}
+}
+
+func TestUserspaceTunACLAllow(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.ACLPrefixes = []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}
+	settings.ACLMode = ACLAllow
+	tun, nat := newTestTun(t, settings)
+
+	for _, dstIP := range []net.IP{testRemoteIPv4, net.ParseIP("192.0.2.1").To4()} {
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, dstIP, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected only the packet to the allowed prefix to be sent, got %d", len(nat.sent))
+	}
+	if drops := tun.ACLDrops(); drops.NotAllowed != 1 {
+		t.Fatalf("expected 1 not allowed drop, got %+v", drops)
+	}
+}
+
+func TestUserspaceTunSetACL(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+
+	if err := tun.SetACL([]netip.Prefix{{}}, ACLDeny); err == nil {
+		t.Fatalf("expected error for an invalid prefix")
+	}
+
+	// establish a flow
+	request := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)
+	if _, err := tun.Write([][]byte{request}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	publicPort := sentPort(nat.sent[0])
+
+	// the flow continues after denying another prefix
+	if err := tun.SetACL(PrivatePrefixes, ACLDeny); err != nil {
+		t.Fatalf("failed to set ACL: %v", err)
+	}
+	if _, err := tun.Write([][]byte{request}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if len(nat.sent) != 2 || sentPort(nat.sent[1]) != publicPort {
+		t.Fatalf("expected the flow to continue with port %d", publicPort)
+	}
+	go nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, 10, false))
+	if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+
+	// the flow is dropped after denying its destination
+	if err := tun.SetACL([]netip.Prefix{netip.MustParsePrefix("198.51.100.7/32")}, ACLDeny); err != nil {
+		t.Fatalf("failed to set ACL: %v", err)
+	}
+	if _, err := tun.Write([][]byte{request}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if len(nat.sent) != 2 {
+		t.Fatalf("expected the packet to be dropped")
+	}
+	if drops := tun.ACLDrops(); drops.Prefixes[netip.MustParsePrefix("198.51.100.7/32")] != 1 {
+		t.Fatalf("expected 1 drop, got %+v", drops)
+	}
+}
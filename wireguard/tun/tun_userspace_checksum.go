@@ -0,0 +1,46 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// rewritePacket translates a copy of a serialized packet in place: the source of a packet sent by a client
+// (outbound, which also decrements its TTL or hop limit) or the destination of a packet received from the NAT
+// is set to ip and port (or ICMP echo identifier).
+// The checksums are adjusted for the rewritten fields (RFC 1624) instead of being computed over the whole packet
+// as when the decoded layers are serialized, see UserspaceTunSettings.IncrementalChecksums.
+//
+// Returns nil if the packet cannot be rewritten in place, i.e. its length does not match its IP header
+// or its transport header is truncated. The packet is then serialized from its layers.
+func rewritePacket(packet []byte, outbound bool, ip net.IP, port int) []byte {
+	if len(packet) == 0 || len(packet) != ipPacketLength(packet) {
+		return nil
+	}
+	modifiedPacket := append([]byte(nil), packet...)
+	if outbound {
+		decrementHopLimit(modifiedPacket)
+	}
+	if !rewriteEndpoint(modifiedPacket, outbound, ip, port) {
+		return nil
+	}
+	return modifiedPacket
+}
+
+// ipPacketLength returns the length of a serialized IP packet from its header, or 0 if the header is truncated.
+func ipPacketLength(packet []byte) int {
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(packet[2:4]))
+	case 6:
+		if len(packet) < 40 {
+			return 0
+		}
+		return 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,185 @@
+package tun
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/userwireguard/logger"
+)
+
+// randomPacket serializes a TCP, UDP or ICMP echo packet with random fields and full checksums.
+// The destination of an outbound packet is random, the source of an inbound packet is.
+func randomPacket(t *testing.T, r *rand.Rand, ipv6 bool, protocol layers.IPProtocol, srcIP net.IP, dstIP net.IP, srcPort int, dstPort int, echoType uint8) []byte {
+	t.Helper()
+	var networkLayer gopacket.NetworkLayer
+	if ipv6 {
+		networkLayer = &layers.IPv6{
+			Version:      6,
+			TrafficClass: uint8(r.IntN(256)),
+			FlowLabel:    r.Uint32() & 0xfffff,
+			HopLimit:     uint8(2 + r.IntN(254)),
+			NextHeader:   protocol,
+			SrcIP:        srcIP,
+			DstIP:        dstIP,
+		}
+	} else {
+		networkLayer = &layers.IPv4{
+			Version:  4,
+			TOS:      uint8(r.IntN(256)),
+			Id:       uint16(r.Uint32()),
+			Flags:    layers.IPv4DontFragment,
+			TTL:      uint8(2 + r.IntN(254)),
+			Protocol: protocol,
+			SrcIP:    srcIP,
+			DstIP:    dstIP,
+		}
+	}
+	payload := make([]byte, r.IntN(1200))
+	for i := range payload {
+		payload[i] = byte(r.Uint32())
+	}
+
+	var transportLayer gopacket.SerializableLayer
+	switch protocol {
+	case layers.IPProtocolTCP:
+		tcp := &layers.TCP{
+			SrcPort: layers.TCPPort(srcPort),
+			DstPort: layers.TCPPort(dstPort),
+			Seq:     r.Uint32(),
+			Ack:     r.Uint32(),
+			ACK:     true,
+			PSH:     r.IntN(2) == 0,
+			Window:  uint16(r.Uint32()),
+		}
+		tcp.SetNetworkLayerForChecksum(networkLayer)
+		transportLayer = tcp
+	case layers.IPProtocolUDP:
+		udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+		udp.SetNetworkLayerForChecksum(networkLayer)
+		transportLayer = udp
+	case layers.IPProtocolICMPv4:
+		transportLayer = &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(echoType, 0), Id: uint16(srcPort), Seq: uint16(r.Uint32())}
+	case layers.IPProtocolICMPv6:
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(echoType, 0)}
+		icmp.SetNetworkLayerForChecksum(networkLayer)
+		echo := &layers.ICMPv6Echo{Identifier: uint16(srcPort), SeqNumber: uint16(r.Uint32())}
+		buffer := gopacket.NewSerializeBuffer()
+		options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buffer, options, networkLayer.(gopacket.SerializableLayer), icmp, echo, gopacket.Payload(payload)); err != nil {
+			t.Fatalf("failed to serialize packet: %v", err)
+		}
+		return buffer.Bytes()
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, networkLayer.(gopacket.SerializableLayer), transportLayer, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+// TestIncrementalChecksums translates random packets with incremental checksums and with full checksums,
+// which must give the same packets in both directions.
+func TestIncrementalChecksums(t *testing.T) {
+	tuns := [2]*UserspaceTun{}
+	nats := [2]*fakeNat{}
+	for i, incremental := range []bool{true, false} {
+		settings := DefaultUserspaceTunSettings()
+		settings.IncrementalChecksums = incremental
+		nats[i] = &fakeNat{}
+		publicIPv4, publicIPv6 := testPublicIPv4, testPublicIPv6
+		tuns[i] = newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), &publicIPv4, &publicIPv6, settings, nats[i], func() {})
+		t.Cleanup(func() { tuns[i].Close() })
+	}
+
+	r := rand.New(rand.NewPCG(1, 2))
+	randomIP := func(ipv6 bool) net.IP {
+		ip := make(net.IP, 4)
+		if ipv6 {
+			ip = make(net.IP, 16)
+		}
+		for i := range ip {
+			ip[i] = byte(r.Uint32())
+		}
+		// keep the addresses public unicast
+		ip[0] = 0x20
+		return ip
+	}
+	for i := 0; i < 500; i += 1 {
+		ipv6 := r.IntN(2) == 0
+		var protocol layers.IPProtocol
+		var echo bool
+		var echoRequest, echoReply uint8
+		switch r.IntN(3) {
+		case 0:
+			protocol = layers.IPProtocolTCP
+		case 1:
+			protocol = layers.IPProtocolUDP
+		case 2:
+			protocol = layers.IPProtocolICMPv4
+			echo = true
+			echoRequest, echoReply = layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply
+			if ipv6 {
+				protocol = layers.IPProtocolICMPv6
+				echoRequest, echoReply = layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply
+			}
+		}
+		clientIP, remoteIP, publicIP := testLocalIPv4, randomIP(false), testPublicIPv4
+		if ipv6 {
+			clientIP, remoteIP, publicIP = testLocalIPv6, randomIP(true), testPublicIPv6
+		}
+		clientPort, remotePort := 1024+r.IntN(60000), 1+r.IntN(1000)
+		if echo {
+			// the identifier takes the place of both ports
+			remotePort = clientPort
+		}
+
+		request := randomPacket(t, r, ipv6, protocol, clientIP, remoteIP, clientPort, remotePort, echoRequest)
+		for _, tun := range tuns {
+			if _, err := tun.Write([][]byte{request}, 0); err != nil {
+				t.Fatalf("failed to write packet %x: %v", request, err)
+			}
+		}
+		incremental, full := nats[0].sent[len(nats[0].sent)-1], nats[1].sent[len(nats[1].sent)-1]
+		if !bytes.Equal(incremental, full) {
+			t.Fatalf("packet %d translated with incremental checksums differs:\n%x\n%x", i, incremental, full)
+		}
+
+		_, _, _, transport, _ := splitPacket(full)
+		publicPort := int(transport[0])<<8 | int(transport[1])
+		if echo {
+			publicPort = int(transport[4])<<8 | int(transport[5])
+			remotePort = publicPort
+		}
+		reply := randomPacket(t, r, ipv6, protocol, remoteIP, publicIP, remotePort, publicPort, echoReply)
+		var received [2][]byte
+		for j, tun := range tuns {
+			nats[j].receive(reply)
+			packet, err := readPacket(t, tun, DefaultMtu)
+			if err != nil {
+				t.Fatalf("failed to read packet: %v", err)
+			}
+			received[j] = packet
+		}
+		if !bytes.Equal(received[0], received[1]) {
+			t.Fatalf("reply %d translated with incremental checksums differs:\n%x\n%x", i, received[0], received[1])
+		}
+	}
+}
+
+func TestRewritePacketFallback(t *testing.T) {
+	packet := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)
+	if rewritePacket(packet, true, testPublicIPv4, 1024) == nil {
+		t.Fatalf("expected the packet to be rewritten")
+	}
+	// trailing bytes after the IP packet, and truncated packets
+	for _, invalid := range [][]byte{append(packet, 0, 0), packet[:len(packet)-1], packet[:20], nil} {
+		if rewritePacket(invalid, true, testPublicIPv4, 1024) != nil {
+			t.Fatalf("expected the packet %x not to be rewritten", invalid)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package tun
+
+import (
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const dnsPort = 53
+
+func validateDNSResolvers(resolverIPv4 net.IP, resolverIPv6 net.IP) error {
+	if resolverIPv4 != nil && resolverIPv4.To4() == nil {
+		return errors.New("DNS resolver IPv4 is not an IPv4 address")
+	}
+	if resolverIPv6 != nil && (len(resolverIPv6) != net.IPv6len || resolverIPv6.To4() != nil) {
+		return errors.New("DNS resolver IPv6 is not an IPv6 address")
+	}
+	return nil
+}
+
+// dnsResolver returns the resolver that a DNS query sent by a client is redirected to,
+// or nil if the packet is not a DNS query (TCP or UDP to port 53) or no resolver is set for its IP version.
+//
+// Fragmented queries are not redirected.
+func (tun *UserspaceTun) dnsResolver(packet *decodedPacket) net.IP {
+	var dstPort int
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		dstPort = int(t.DstPort)
+	case *layers.UDP:
+		dstPort = int(t.DstPort)
+	default:
+		return nil
+	}
+	if dstPort != dnsPort {
+		return nil
+	}
+	switch packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		return tun.settings.DNSResolverIPv4.To4()
+	case *layers.IPv6:
+		return tun.settings.DNSResolverIPv6
+	default:
+		return nil
+	}
+}
+
+// redirectDNS sets the destination of a DNS query to resolver and returns the original destination,
+// which is restored as the source of the replies.
+func redirectDNS(networkLayer gopacket.NetworkLayer, resolver net.IP) net.IP {
+	var dstIP net.IP
+	switch ip := networkLayer.(type) {
+	case *layers.IPv4:
+		dstIP = normalizeIP(ip.DstIP)
+		ip.DstIP = resolver
+	case *layers.IPv6:
+		dstIP = normalizeIP(ip.DstIP)
+		ip.DstIP = resolver
+	}
+	return dstIP
+}
+
+// restoreDNS sets the source of a DNS reply from the resolver back to the destination of the query,
+// so that the client is unaware of the redirect. Other packets are not changed.
+func (tun *UserspaceTun) restoreDNS(networkLayer gopacket.NetworkLayer, srcPort int, localDst NATValue) {
+	if localDst.dnsOriginalDst == nil || srcPort != dnsPort {
+		return
+	}
+	switch ip := networkLayer.(type) {
+	case *layers.IPv4:
+		if ip.SrcIP.Equal(tun.settings.DNSResolverIPv4) {
+			ip.SrcIP = localDst.dnsOriginalDst
+		}
+	case *layers.IPv6:
+		if ip.SrcIP.Equal(tun.settings.DNSResolverIPv6) {
+			ip.SrcIP = localDst.dnsOriginalDst
+		}
+	}
+}
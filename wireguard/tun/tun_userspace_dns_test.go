@@ -0,0 +1,93 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestUserspaceTunDNSRedirect(t *testing.T) {
+	resolverIPv4 := net.ParseIP("198.51.100.53").To4()
+	clientResolverIPv4 := net.ParseIP("8.8.8.8").To4()
+	settings := DefaultUserspaceTunSettings()
+	settings.DNSResolverIPv4 = resolverIPv4
+	tun, nat := newTestTun(t, settings)
+
+	// the query is sent to the configured resolver
+	query := udpPacket(t, testLocalIPv4, 40000, clientResolverIPv4, 53, 32, false)
+	if _, err := tun.Write([][]byte{query}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	sent := nat.sent[0]
+	if dstIP := net.IP(sent[16:20]); !dstIP.Equal(resolverIPv4) {
+		t.Fatalf("expected query to %v, got %v", resolverIPv4, dstIP)
+	}
+	if !udpChecksumValid(sent) {
+		t.Fatalf("redirected query has an invalid UDP checksum")
+	}
+
+	// the reply from the resolver is sent back from the original destination
+	go nat.receive(udpPacket(t, resolverIPv4, 53, testPublicIPv4, sentPort(sent), 64, false))
+	reply, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if srcIP := net.IP(reply[12:16]); !srcIP.Equal(clientResolverIPv4) {
+		t.Fatalf("expected reply from %v, got %v", clientResolverIPv4, srcIP)
+	}
+	if dstIP := net.IP(reply[16:20]); !dstIP.Equal(testLocalIPv4) {
+		t.Fatalf("expected reply to %v, got %v", testLocalIPv4, dstIP)
+	}
+	if !udpChecksumValid(reply) {
+		t.Fatalf("restored reply has an invalid UDP checksum")
+	}
+
+	// other traffic is not redirected
+	nat.sent = nil
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40001, testRemoteIPv4, 443, 32, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if dstIP := net.IP(nat.sent[0][16:20]); !dstIP.Equal(testRemoteIPv4) {
+		t.Fatalf("expected packet to %v, got %v", testRemoteIPv4, dstIP)
+	}
+}
+
+func TestUserspaceTunDNSRedirectIPv6(t *testing.T) {
+	resolverIPv6 := net.ParseIP("2001:db8:53::53")
+	clientResolverIPv6 := net.ParseIP("2001:4860:4860::8888")
+	localIPv6 := net.ParseIP("fd00::2")
+	settings := DefaultUserspaceTunSettings()
+	settings.DNSResolverIPv6 = resolverIPv6
+	tun, nat := newTestTun(t, settings)
+	publicIPv6 := net.ParseIP("2001:db8::1")
+	if err := tun.SetPublicIPs([]net.IP{testPublicIPv4}, []net.IP{publicIPv6}); err != nil {
+		t.Fatalf("failed to set public IPs: %v", err)
+	}
+
+	if _, err := tun.Write([][]byte{udpv6Packet(t, localIPv6, 40000, clientResolverIPv6, 53, []byte("query"))}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	sent := nat.sent[0]
+	if dstIP := net.IP(sent[24:40]); !dstIP.Equal(resolverIPv6) {
+		t.Fatalf("expected query to %v, got %v", resolverIPv6, dstIP)
+	}
+
+	publicPort := int(binary.BigEndian.Uint16(sent[40:42]))
+	go nat.receive(udpv6Packet(t, resolverIPv6, 53, publicIPv6, publicPort, []byte("answer")))
+	received, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	packet := gopacket.NewPacket(received, layers.LayerTypeIPv6, gopacket.Default)
+	ipv6 := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ipv6.SrcIP.Equal(clientResolverIPv6) || !ipv6.DstIP.Equal(localIPv6) {
+		t.Fatalf("expected reply from %v to %v, got %v to %v", clientResolverIPv6, localIPv6, ipv6.SrcIP, ipv6.DstIP)
+	}
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || !bytes.Equal(udp.LayerPayload(), []byte("answer")) {
+		t.Fatalf("expected the answer to be preserved")
+	}
+}
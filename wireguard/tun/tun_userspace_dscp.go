@@ -0,0 +1,95 @@
+package tun
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DscpPolicy specifies how the DSCP of packets sent by clients through the NAT is marked.
+// The DSCP is the upper 6 bits of the IPv4 TOS and of the IPv6 traffic class. The lower 2 bits,
+// the ECN field (RFC 3168), are always kept, so that ECT and CE marks pass the NAT in both directions.
+// Packets received from the NAT are delivered to clients with their DSCP and ECN unchanged.
+//
+// The NAT of CreateUserspaceTUNWithSettings sends the payloads on sockets, so the marked DSCP of the first
+// packet of a flow is set on its socket (IP_TOS or IPV6_TCLASS) and applies to the whole flow.
+// The ECN field of the sent packets is set by the OS. Windows does not mark IPv6 sockets.
+type DscpPolicy int
+
+const (
+	// DscpPreserve keeps the DSCP set by clients.
+	DscpPreserve DscpPolicy = iota
+	// DscpBleach clears the DSCP (to the default class), which keeps untrusted clients
+	// from claiming a priority on the networks past the NAT.
+	DscpBleach
+	// DscpRemap rewrites the DSCP by DscpRemap. Codepoints not in DscpRemap are kept.
+	DscpRemap
+)
+
+const (
+	dscpCodepoints = 64
+	ecnMask        = 0x03
+)
+
+// validateDscp returns an error if the DSCP policy or remap table is invalid.
+func (settings *UserspaceTunSettings) validateDscp() error {
+	if settings.DscpPolicy < DscpPreserve || DscpRemap < settings.DscpPolicy {
+		return fmt.Errorf("DSCP policy %d invalid", settings.DscpPolicy)
+	}
+	for dscp, mark := range settings.DscpRemap {
+		if dscpCodepoints <= dscp || dscpCodepoints <= mark {
+			return fmt.Errorf("DSCP remap %d to %d invalid", dscp, mark)
+		}
+	}
+	return nil
+}
+
+// dscpMarks returns the DSCP that outbound packets are marked with by their DSCP.
+func (settings *UserspaceTunSettings) dscpMarks() [dscpCodepoints]uint8 {
+	var marks [dscpCodepoints]uint8
+	if settings.DscpPolicy == DscpBleach {
+		return marks
+	}
+	for dscp := range marks {
+		marks[dscp] = uint8(dscp)
+	}
+	if settings.DscpPolicy == DscpRemap {
+		for dscp, mark := range settings.DscpRemap {
+			marks[dscp] = mark
+		}
+	}
+	return marks
+}
+
+// markDscp rewrites the DSCP of a translated packet sent by a client by DscpPolicy, keeping the ECN field.
+// The IPv4 header checksum is adjusted. The IPv6 traffic class is not covered by a checksum.
+func (tun *UserspaceTun) markDscp(packet []byte) {
+	if tun.settings.DscpPolicy == DscpPreserve || len(packet) < 2 {
+		return
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return
+		}
+		dscp := packet[1] >> 2
+		mark := tun.dscpMarks[dscp]
+		if mark == dscp {
+			return
+		}
+		old := [2]byte{packet[0], packet[1]}
+		packet[1] = mark<<2 | packet[1]&ecnMask
+		checksum := binary.BigEndian.Uint16(packet[10:12])
+		binary.BigEndian.PutUint16(packet[10:12], checksumAdjust(checksum, old[:], packet[0:2]))
+	case 6:
+		// the traffic class is between the version and the flow label
+		trafficClass := packet[0]<<4 | packet[1]>>4
+		dscp := trafficClass >> 2
+		mark := tun.dscpMarks[dscp]
+		if mark == dscp {
+			return
+		}
+		trafficClass = mark<<2 | trafficClass&ecnMask
+		packet[0] = packet[0]&0xf0 | trafficClass>>4
+		packet[1] = trafficClass<<4 | packet[1]&0x0f
+	}
+}
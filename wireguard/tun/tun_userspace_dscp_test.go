@@ -0,0 +1,132 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/userwireguard/logger"
+)
+
+const (
+	ecnEct1 = 0x01
+	ecnEct0 = 0x02
+	ecnCe   = 0x03
+	// expedited forwarding
+	dscpEf = 46
+)
+
+// trafficClassPacket serializes an IPv4 or IPv6 UDP packet with a TOS or traffic class.
+func trafficClassPacket(t *testing.T, srcIP net.IP, srcPort int, dstIP net.IP, dstPort int, trafficClass uint8) []byte {
+	t.Helper()
+	var networkLayer gopacket.NetworkLayer
+	if srcIP.To4() == nil {
+		networkLayer = &layers.IPv6{Version: 6, TrafficClass: trafficClass, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: dstIP}
+	} else {
+		networkLayer = &layers.IPv4{Version: 4, TOS: trafficClass, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP.To4(), DstIP: dstIP.To4()}
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(networkLayer)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, networkLayer.(gopacket.SerializableLayer), udp, gopacket.Payload("ecn")); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+// packetTrafficClass returns the TOS of an IPv4 packet or the traffic class of an IPv6 packet,
+// and false if the IPv4 header checksum is invalid.
+func packetTrafficClass(packet []byte) (uint8, bool) {
+	if packet[0]>>4 == 4 {
+		return packet[1], ipv4HeaderChecksum(packet[:20]) == 0
+	}
+	return packet[0]<<4 | packet[1]>>4, true
+}
+
+// testDscp sends a packet with trafficClass through the NAT and a reply with replyTrafficClass back,
+// and returns the traffic class of the packet sent and of the reply delivered to the client.
+func testDscp(t *testing.T, settings *UserspaceTunSettings, ipv6 bool, trafficClass uint8, replyTrafficClass uint8) (uint8, uint8) {
+	t.Helper()
+	nat := &fakeNat{}
+	publicIPv4, publicIPv6 := testPublicIPv4, testPublicIPv6
+	tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), &publicIPv4, &publicIPv6, settings, nat, func() {})
+	t.Cleanup(func() { tun.Close() })
+	localIP, remoteIP, publicIP := testLocalIPv4, testRemoteIPv4, testPublicIPv4
+	if ipv6 {
+		localIP, remoteIP, publicIP = testLocalIPv6, testRemoteIPv6, testPublicIPv6
+	}
+
+	if _, err := tun.Write([][]byte{trafficClassPacket(t, localIP, 40000, remoteIP, 53, trafficClass)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected 1 packet sent, got %d", len(nat.sent))
+	}
+	sent := nat.sent[0]
+	sentTrafficClass, ok := packetTrafficClass(sent)
+	if !ok || !transportChecksumValid(sent) {
+		t.Fatalf("sent packet has an invalid checksum")
+	}
+	_, _, _, transport, _ := splitPacket(sent)
+	publicPort := int(transport[0])<<8 | int(transport[1])
+
+	nat.receive(trafficClassPacket(t, remoteIP, 53, publicIP, publicPort, replyTrafficClass))
+	received, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	receivedTrafficClass, ok := packetTrafficClass(received)
+	if !ok || !transportChecksumValid(received) {
+		t.Fatalf("received packet has an invalid checksum")
+	}
+	return sentTrafficClass, receivedTrafficClass
+}
+
+func TestUserspaceTunEcnPreserved(t *testing.T) {
+	for _, incremental := range []bool{true, false} {
+		for _, ipv6 := range []bool{false, true} {
+			for _, ecn := range []uint8{ecnEct0, ecnEct1, ecnCe} {
+				t.Run(fmt.Sprintf("incremental=%t/ipv6=%t/ecn=%02b", incremental, ipv6, ecn), func(t *testing.T) {
+					settings := DefaultUserspaceTunSettings()
+					settings.IncrementalChecksums = incremental
+					expected := dscpEf<<2 | ecn
+					sent, received := testDscp(t, settings, ipv6, expected, expected)
+					if sent != expected || received != expected {
+						t.Fatalf("expected traffic class %08b in both directions, got %08b sent and %08b received", expected, sent, received)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestUserspaceTunDscpPolicy(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		for _, incremental := range []bool{true, false} {
+			t.Run(fmt.Sprintf("ipv6=%t/incremental=%t", ipv6, incremental), func(t *testing.T) {
+				settings := DefaultUserspaceTunSettings()
+				settings.IncrementalChecksums = incremental
+
+				// bleach clears the DSCP and keeps the ECN field, and only applies to outbound packets
+				settings.DscpPolicy = DscpBleach
+				sent, received := testDscp(t, settings, ipv6, dscpEf<<2|ecnEct0, dscpEf<<2|ecnCe)
+				if sent != ecnEct0 || received != dscpEf<<2|ecnCe {
+					t.Fatalf("expected %08b sent and %08b received, got %08b and %08b", ecnEct0, dscpEf<<2|ecnCe, sent, received)
+				}
+
+				// remap rewrites the codepoints in the table and keeps the others
+				settings.DscpPolicy = DscpRemap
+				settings.DscpRemap = map[uint8]uint8{dscpEf: 34}
+				if sent, _ := testDscp(t, settings, ipv6, dscpEf<<2|ecnCe, 0); sent != 34<<2|ecnCe {
+					t.Fatalf("expected %08b sent, got %08b", 34<<2|ecnCe, sent)
+				}
+				if sent, _ := testDscp(t, settings, ipv6, 10<<2|ecnEct1, 0); sent != 10<<2|ecnEct1 {
+					t.Fatalf("expected %08b sent, got %08b", 10<<2|ecnEct1, sent)
+				}
+			})
+		}
+	}
+}
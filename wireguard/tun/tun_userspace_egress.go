@@ -0,0 +1,198 @@
+package tun
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+)
+
+// PublicIPSelector picks the public IP of a client from the pool of its address family.
+//
+// A client keeps the public IP picked for its first flow while it has NAT entries on that IP,
+// so all flows of a client share an address whatever the selector.
+// Select is called with the NAT table locked.
+type PublicIPSelector interface {
+	// Select returns the index in publicIPs of the address for clientIP.
+	// entries[i] is the number of NAT entries using publicIPs[i].
+	Select(clientIP net.IP, publicIPs []net.IP, entries []int) int
+}
+
+// PublicIPHash picks the public IP by rendezvous hashing on the client IP, so that a client gets the same address
+// across restarts and only the clients of an address move when it is removed from the pool.
+type PublicIPHash struct{}
+
+func (PublicIPHash) Select(clientIP net.IP, publicIPs []net.IP, entries []int) int {
+	best := 0
+	var bestScore uint64
+	for i, publicIP := range publicIPs {
+		h := fnv.New64a()
+		h.Write(clientIP.To16())
+		h.Write(publicIP.To16())
+		if score := h.Sum64(); i == 0 || bestScore < score {
+			best = i
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// PublicIPRoundRobin picks the public IPs in turn for new clients.
+type PublicIPRoundRobin struct {
+	next int
+}
+
+func (selector *PublicIPRoundRobin) Select(clientIP net.IP, publicIPs []net.IP, entries []int) int {
+	i := selector.next % len(publicIPs)
+	selector.next = i + 1
+	return i
+}
+
+// PublicIPLeastLoaded picks the public IP with the fewest NAT entries for new clients.
+type PublicIPLeastLoaded struct{}
+
+func (PublicIPLeastLoaded) Select(clientIP net.IP, publicIPs []net.IP, entries []int) int {
+	best := 0
+	for i := range publicIPs {
+		if entries[i] < entries[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// natClient is the public IP a client is pinned to, with the number of its NAT entries on that IP.
+type natClient struct {
+	publicIP string
+	entries  int
+}
+
+// publicIPPool is the public IPs of an address family, keyed by their string form as in NATKey.
+type publicIPPool struct {
+	ips  []net.IP
+	keys []string
+}
+
+func newPublicIPPool(ips []net.IP, ipv4 bool) (publicIPPool, error) {
+	var pool publicIPPool
+	for _, ip := range ips {
+		if (ip.To4() != nil) != ipv4 || ip.To16() == nil {
+			return publicIPPool{}, errors.New("public IP pool contains an address of the wrong family")
+		}
+		ip = normalizeIP(ip)
+		if pool.index(ip.String()) < 0 {
+			pool.ips = append(pool.ips, ip)
+			pool.keys = append(pool.keys, ip.String())
+		}
+	}
+	return pool, nil
+}
+
+// index returns the index of the public IP with the given key, or -1 if it is not in the pool.
+func (pool publicIPPool) index(key string) int {
+	for i, k := range pool.keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetPublicIPs replaces the public IPs used to NAT the packets of clients.
+// NAT entries on addresses that are still in a pool are kept. Entries on removed addresses are not used
+// for new packets and expire when idle.
+//
+// Returns an error if an address is not of the family of its pool.
+func (tun *UserspaceTun) SetPublicIPs(publicIPv4s []net.IP, publicIPv6s []net.IP) error {
+	v4, err := newPublicIPPool(publicIPv4s, true)
+	if err != nil {
+		return err
+	}
+	v6, err := newPublicIPPool(publicIPv6s, false)
+	if err != nil {
+		return err
+	}
+	tun.natTableMu.Lock()
+	defer tun.natTableMu.Unlock()
+	tun.publicIPs.v4 = v4
+	tun.publicIPs.v6 = v6
+	return nil
+}
+
+// PublicIPs returns the current public IPs.
+func (tun *UserspaceTun) PublicIPs() (publicIPv4s []net.IP, publicIPv6s []net.IP) {
+	tun.natTableMu.Lock()
+	defer tun.natTableMu.Unlock()
+	return append([]net.IP(nil), tun.publicIPs.v4.ips...), append([]net.IP(nil), tun.publicIPs.v6.ips...)
+}
+
+// publicIPPool returns the pool of the family of clientIP. natTableMu must be held.
+func (tun *UserspaceTun) publicIPPool(clientIP net.IP) publicIPPool {
+	if clientIP.To4() != nil {
+		return tun.publicIPs.v4
+	}
+	return tun.publicIPs.v6
+}
+
+// selectPublicIP returns the index in pool of the public IP for a new flow of clientIP:
+// the address the client is pinned to if it is still in the pool, otherwise the choice of the selector.
+// natTableMu must be held.
+func (tun *UserspaceTun) selectPublicIP(pool publicIPPool, clientKey string, clientIP net.IP) int {
+	if client, found := tun.natClients[clientKey]; found {
+		if i := pool.index(client.publicIP); 0 <= i {
+			return i
+		}
+	}
+	entries := make([]int, len(pool.keys))
+	for i, key := range pool.keys {
+		entries[i] = tun.natPublicIPEntries[key]
+	}
+	return tun.settings.PublicIPSelector.Select(clientIP, pool.ips, entries)
+}
+
+// replyPublicIP returns the source of ICMP errors sent to a client by the TUN itself:
+// the address the client is pinned to, or the first address of the pool.
+// Returns nil if the pool of the family of clientIP is empty.
+func (tun *UserspaceTun) replyPublicIP(clientIP net.IP) net.IP {
+	tun.natTableMu.Lock()
+	defer tun.natTableMu.Unlock()
+	pool := tun.publicIPPool(clientIP)
+	if len(pool.ips) == 0 {
+		return nil
+	}
+	if client, found := tun.natClients[clientIP.String()]; found {
+		if i := pool.index(client.publicIP); 0 <= i {
+			return pool.ips[i]
+		}
+	}
+	return pool.ips[0]
+}
+
+// natAddPublicIPEntry counts a new NAT entry of a client on a public IP, pinning the client to it. natTableMu must be held.
+func (tun *UserspaceTun) natAddPublicIPEntry(clientKey string, publicIP string) {
+	tun.natPublicIPEntries[publicIP] += 1
+	client := tun.natClients[clientKey]
+	if client.publicIP != publicIP {
+		// the previous address was removed from the pool, its entries are no longer counted for the client
+		client = natClient{publicIP: publicIP}
+	}
+	client.entries += 1
+	tun.natClients[clientKey] = client
+}
+
+// natRemovePublicIPEntry uncounts a removed NAT entry, unpinning the client from its public IP
+// once it has no entries left on it. natTableMu must be held.
+func (tun *UserspaceTun) natRemovePublicIPEntry(clientKey string, publicIP string) {
+	if tun.natPublicIPEntries[publicIP] <= 1 {
+		delete(tun.natPublicIPEntries, publicIP)
+	} else {
+		tun.natPublicIPEntries[publicIP] -= 1
+	}
+	if client, found := tun.natClients[clientKey]; found && client.publicIP == publicIP {
+		client.entries -= 1
+		if client.entries <= 0 {
+			delete(tun.natClients, clientKey)
+		} else {
+			tun.natClients[clientKey] = client
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestPublicIPSelectors(t *testing.T) {
+	publicIPs := []net.IP{
+		net.ParseIP("203.0.113.1").To4(),
+		net.ParseIP("203.0.113.2").To4(),
+		net.ParseIP("203.0.113.3").To4(),
+	}
+	clientIPs := []net.IP{}
+	for i := 0; i < 64; i += 1 {
+		clientIPs = append(clientIPs, net.ParseIP(fmt.Sprintf("192.168.90.%d", i)).To4())
+	}
+
+	t.Run("hash", func(t *testing.T) {
+		used := map[int]bool{}
+		for _, clientIP := range clientIPs {
+			i := PublicIPHash{}.Select(clientIP, publicIPs, nil)
+			if j := (PublicIPHash{}).Select(clientIP.To16(), publicIPs, nil); i != j {
+				t.Fatalf("expected the same address for %v, got %d and %d", clientIP, i, j)
+			}
+			used[i] = true
+
+			// removing another address does not move the client
+			for removed := range publicIPs {
+				if removed == i {
+					continue
+				}
+				remaining := append(append([]net.IP{}, publicIPs[:removed]...), publicIPs[removed+1:]...)
+				if k := (PublicIPHash{}).Select(clientIP, remaining, nil); !remaining[k].Equal(publicIPs[i]) {
+					t.Fatalf("expected %v to keep %v after removing %v, got %v", clientIP, publicIPs[i], publicIPs[removed], remaining[k])
+				}
+			}
+		}
+		if len(used) != len(publicIPs) {
+			t.Fatalf("expected the clients to be spread over all addresses, got %v", used)
+		}
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		selector := &PublicIPRoundRobin{}
+		for i := 0; i < 2*len(publicIPs); i += 1 {
+			if j := selector.Select(clientIPs[i], publicIPs, nil); j != i%len(publicIPs) {
+				t.Fatalf("expected address %d, got %d", i%len(publicIPs), j)
+			}
+		}
+	})
+
+	t.Run("least loaded", func(t *testing.T) {
+		if i := (PublicIPLeastLoaded{}).Select(clientIPs[0], publicIPs, []int{3, 1, 2}); i != 1 {
+			t.Fatalf("expected the least loaded address 1, got %d", i)
+		}
+	})
+}
+
+func TestUserspaceTunPublicIPPool(t *testing.T) {
+	otherPublicIPv4 := net.ParseIP("203.0.113.2").To4()
+	otherLocalIPv4 := net.ParseIP("192.168.90.3").To4()
+	settings := DefaultUserspaceTunSettings()
+	settings.PublicIPv4s = []net.IP{otherPublicIPv4}
+	settings.PublicIPSelector = &PublicIPRoundRobin{}
+	tun, nat := newTestTun(t, settings)
+
+	// the flows of a client share an address, the next client gets the next address
+	packets := [][]byte{
+		udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false),
+		udpPacket(t, testLocalIPv4, 40001, testRemoteIPv4, 53, 10, false),
+		udpPacket(t, otherLocalIPv4, 40000, testRemoteIPv4, 53, 10, false),
+	}
+	if _, err := tun.Write(packets, 0); err != nil {
+		t.Fatalf("failed to write packets: %v", err)
+	}
+	for i, publicIP := range []net.IP{testPublicIPv4, testPublicIPv4, otherPublicIPv4} {
+		if srcIP := net.IP(nat.sent[i][12:16]); !srcIP.Equal(publicIP) {
+			t.Fatalf("expected packet %d to be sent from %v, got %v", i, publicIP, srcIP)
+		}
+	}
+	otherPort := sentPort(nat.sent[2])
+
+	// replies are matched on the public IP of the entry
+	go nat.receive(udpPacket(t, testRemoteIPv4, 53, otherPublicIPv4, otherPort, 10, false))
+	received, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if dstIP := net.IP(received[16:20]); !dstIP.Equal(otherLocalIPv4) {
+		t.Fatalf("expected the reply to be delivered to %v, got %v", otherLocalIPv4, dstIP)
+	}
+	if stats := tun.NatStats(); stats.LookupMisses != 0 {
+		t.Fatalf("expected no lookup misses, got %+v", stats)
+	}
+
+	// removing an address keeps the mappings of the remaining address and moves the clients of the removed one
+	if err := tun.SetPublicIPs([]net.IP{otherPublicIPv4}, nil); err != nil {
+		t.Fatalf("failed to set public IPs: %v", err)
+	}
+	if _, err := tun.Write([][]byte{packets[2], packets[0]}, 0); err != nil {
+		t.Fatalf("failed to write packets: %v", err)
+	}
+	if srcIP, port := net.IP(nat.sent[3][12:16]), sentPort(nat.sent[3]); !srcIP.Equal(otherPublicIPv4) || port != otherPort {
+		t.Fatalf("expected the existing mapping %v:%d to be kept, got %v:%d", otherPublicIPv4, otherPort, srcIP, port)
+	}
+	if srcIP := net.IP(nat.sent[4][12:16]); !srcIP.Equal(otherPublicIPv4) {
+		t.Fatalf("expected the flow of the removed address to move to %v, got %v", otherPublicIPv4, srcIP)
+	}
+
+	if err := tun.SetPublicIPs([]net.IP{net.ParseIP("2001:db8::1")}, nil); err == nil {
+		t.Fatalf("expected an error for an IPv6 address in the IPv4 pool")
+	}
+}
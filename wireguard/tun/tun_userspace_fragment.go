@@ -0,0 +1,51 @@
+package tun
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fragmentTimeout is how long the fragments of a datagram sent by a client are kept for reassembly,
+// the same as the reassembly timeout of Linux.
+const fragmentTimeout = 30 * time.Second
+
+var errNoNatEntry = errors.New("no NAT entry found")
+
+// isFragment returns true if an IPv4 packet is a fragment of a larger datagram.
+func isFragment(ipv4 *layers.IPv4) bool {
+	return ipv4.Flags&layers.IPv4MoreFragments != 0 || ipv4.FragOffset != 0
+}
+
+// reassembleIPv4 adds an IPv4 fragment sent by a client to its datagram (RFC 791).
+// It returns the serialized datagram once all of its fragments were added, and nil while fragments are missing.
+//
+// The NAT sends the payload of a datagram on a socket, so it needs the whole datagram:
+// only the first fragment carries the transport header, and the NAT does not track fragments.
+// The datagram is sent through the NAT like an unfragmented packet.
+func (tun *UserspaceTun) reassembleIPv4(packet []byte) ([]byte, error) {
+	// the defragmenter keeps the fragments, so they must not alias the packet buffer
+	decoded := gopacket.NewPacket(append([]byte(nil), packet...), layers.LayerTypeIPv4, gopacket.NoCopy)
+	fragment, ok := decoded.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return nil, errors.New("invalid IPv4 fragment")
+	}
+
+	tun.fragmentsMu.Lock()
+	datagram, err := tun.fragments.DefragIPv4(fragment)
+	tun.fragmentsMu.Unlock()
+	if err != nil || datagram == nil {
+		return nil, err
+	}
+	return serializePacket(datagram, gopacket.Payload(datagram.Payload))
+}
+
+// sweepFragments removes the fragments of datagrams that were not completed within fragmentTimeout at now.
+func (tun *UserspaceTun) sweepFragments(now time.Time) {
+	tun.fragmentsMu.Lock()
+	expired := tun.fragments.DiscardOlderThan(now.Add(-fragmentTimeout))
+	tun.fragmentsMu.Unlock()
+	tun.drops.fragmentsExpired.Add(uint64(expired))
+}
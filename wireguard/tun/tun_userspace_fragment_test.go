@@ -0,0 +1,102 @@
+package tun
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUserspaceTunFragments(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+
+	// a large UDP datagram fragmented by the client, written out of order
+	datagram := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 3000, false)
+	fragments, err := fragmentIPv4(datagram, DefaultMtu)
+	if err != nil || len(fragments) < 3 {
+		t.Fatalf("failed to fragment datagram: %v", err)
+	}
+	slices.Reverse(fragments)
+	n, err := tun.Write(fragments, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 datagram written, got %d: %v", n, err)
+	}
+
+	// the NAT gets the reassembled datagram
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected 1 datagram sent, got %d", len(nat.sent))
+	}
+	sent := nat.sent[0]
+	if len(sent) != len(datagram) {
+		t.Fatalf("expected a datagram of %d bytes, got %d", len(datagram), len(sent))
+	}
+	if srcIP := net.IP(sent[12:16]); !srcIP.Equal(testPublicIPv4) {
+		t.Fatalf("expected datagram from %v, got %v", testPublicIPv4, srcIP)
+	}
+	if flagsAndOffset := sent[6]&0x3f | sent[7]; flagsAndOffset != 0 {
+		t.Fatalf("expected an unfragmented datagram")
+	}
+	if ttl := sent[8]; ttl != 63 {
+		t.Fatalf("expected TTL 63, got %d", ttl)
+	}
+	if ipv4HeaderChecksum(sent[:20]) != 0 || !udpChecksumValid(sent) {
+		t.Fatalf("reassembled datagram has an invalid checksum")
+	}
+	if !bytes.Equal(sent[28:], datagram[28:]) {
+		t.Fatalf("reassembled payload does not match the original")
+	}
+	if drops := tun.DropStats(); drops.WriteOversize != 0 {
+		t.Fatalf("expected no oversize drops, got %+v", drops)
+	}
+
+	// fragments received from the NAT are dropped, the NAT sends whole datagrams
+	reply := udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, sentPort(sent), 1500, false)
+	replyFragments, err := fragmentIPv4(reply, 576)
+	if err != nil {
+		t.Fatalf("failed to fragment datagram: %v", err)
+	}
+	for _, fragment := range replyFragments {
+		nat.receive(fragment)
+	}
+	if len(tun.natRcv) != 0 {
+		t.Fatalf("expected no packets delivered, got %d", len(tun.natRcv))
+	}
+	if drops := tun.DropStats(); drops.UnsupportedTransport != uint64(len(replyFragments)) {
+		t.Fatalf("expected %d unsupported transport drops, got %+v", len(replyFragments), drops)
+	}
+}
+
+func TestUserspaceTunFragmentsExpired(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+
+	datagram := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 3000, false)
+	fragments, err := fragmentIPv4(datagram, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to fragment datagram: %v", err)
+	}
+
+	// the fragments are kept until the first fragment is written or they expire
+	if _, err := tun.Write(fragments[1:], 0); err != nil {
+		t.Fatalf("failed to write fragments: %v", err)
+	}
+	if len(nat.sent) != 0 {
+		t.Fatalf("expected no packets sent, got %d", len(nat.sent))
+	}
+	tun.sweepFragments(time.Now().Add(fragmentTimeout / 2))
+	if drops := tun.DropStats(); drops.FragmentsExpired != 0 {
+		t.Fatalf("expected no expired datagrams, got %+v", drops)
+	}
+	tun.sweepFragments(time.Now().Add(2 * fragmentTimeout))
+	if drops := tun.DropStats(); drops.FragmentsExpired != 1 {
+		t.Fatalf("expected 1 expired datagram, got %+v", drops)
+	}
+
+	// the first fragment of an expired datagram does not complete it
+	if _, err := tun.Write(fragments[:1], 0); err != nil {
+		t.Fatalf("failed to write fragment: %v", err)
+	}
+	if len(nat.sent) != 0 {
+		t.Fatalf("expected no packets sent, got %d", len(nat.sent))
+	}
+}
@@ -0,0 +1,372 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/connect"
+)
+
+// icmpEchoLayers returns the layers to serialize an ICMP or ICMPv6 echo request (or reply),
+// along with its identifier which is used as the NAT key port.
+func icmpEchoLayers(packet *decodedPacket, networkLayer gopacket.NetworkLayer, request bool) ([]gopacket.SerializableLayer, int, bool) {
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+		icmp := icmpLayer.(*layers.ICMPv4)
+		echoType := uint8(layers.ICMPv4TypeEchoReply)
+		if request {
+			echoType = layers.ICMPv4TypeEchoRequest
+		}
+		if icmp.TypeCode.Type() != echoType {
+			return nil, 0, false
+		}
+		return []gopacket.SerializableLayer{icmp, gopacket.Payload(icmp.LayerPayload())}, int(icmp.Id), true
+	}
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv6); icmpLayer != nil {
+		icmp := icmpLayer.(*layers.ICMPv6)
+		echoType := uint8(layers.ICMPv6TypeEchoReply)
+		if request {
+			echoType = layers.ICMPv6TypeEchoRequest
+		}
+		// the identifier and sequence number are the first 4 bytes after the ICMPv6 header
+		payload := icmp.LayerPayload()
+		if icmp.TypeCode.Type() != echoType || len(payload) < 4 {
+			return nil, 0, false
+		}
+		// the identifier is rewritten in place, the decoded packet is not modified
+		payload = append([]byte(nil), payload...)
+		icmp.SetNetworkLayerForChecksum(networkLayer)
+		return []gopacket.SerializableLayer{icmp, gopacket.Payload(payload)}, int(binary.BigEndian.Uint16(payload[0:2])), true
+	}
+	return nil, 0, false
+}
+
+// setIcmpEchoId sets the identifier of an ICMP or ICMPv6 echo request (or reply) returned by icmpEchoLayers.
+func setIcmpEchoId(icmpLayers []gopacket.SerializableLayer, id int) {
+	switch icmp := icmpLayers[0].(type) {
+	case *layers.ICMPv4:
+		icmp.Id = uint16(id)
+	case *layers.ICMPv6:
+		binary.BigEndian.PutUint16(icmpLayers[1].(gopacket.Payload)[0:2], uint16(id))
+	}
+}
+
+// layerProtocol returns the IP protocol of a decoded TCP, UDP, ICMP or ICMPv6 layer, see connect.IpProtocolFromLayer.
+func layerProtocol(layer gopacket.Layer) layers.IPProtocol {
+	protocol, _ := connect.IpProtocolFromLayer(layer).LayersProtocol()
+	return protocol
+}
+
+// icmpErrorLayers returns the layers to serialize an ICMP or ICMPv6 error message (e.g. destination unreachable or time exceeded),
+// along with the packet embedded in the error. The embedded packet is a copy that can be modified in place.
+func icmpErrorLayers(packet *decodedPacket, networkLayer gopacket.NetworkLayer) ([]gopacket.SerializableLayer, []byte, bool) {
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+		icmp := icmpLayer.(*layers.ICMPv4)
+		switch icmp.TypeCode.Type() {
+		case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+		default:
+			return nil, nil, false
+		}
+		embedded := append([]byte(nil), icmp.LayerPayload()...)
+		return []gopacket.SerializableLayer{icmp, gopacket.Payload(embedded)}, embedded, true
+	}
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv6); icmpLayer != nil {
+		icmp := icmpLayer.(*layers.ICMPv6)
+		switch icmp.TypeCode.Type() {
+		case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig, layers.ICMPv6TypeTimeExceeded, layers.ICMPv6TypeParameterProblem:
+		default:
+			return nil, nil, false
+		}
+		// the embedded packet follows 4 bytes of unused space (or the MTU for packet too big)
+		payload := append([]byte(nil), icmp.LayerPayload()...)
+		if len(payload) < 4 {
+			return nil, nil, false
+		}
+		icmp.SetNetworkLayerForChecksum(networkLayer)
+		return []gopacket.SerializableLayer{icmp, gopacket.Payload(payload)}, payload[4:], true
+	}
+	return nil, nil, false
+}
+
+// splitPacket splits a serialized IP packet into its source IP, destination IP, protocol and transport bytes.
+// The transport bytes may be truncated, as in a packet embedded in an ICMP error message or the first fragment of a datagram.
+// The IPv6 extension headers are skipped, and the following fragments of an IPv6 datagram have no transport bytes.
+func splitPacket(packet []byte) (srcIP []byte, dstIP []byte, protocol layers.IPProtocol, transport []byte, ok bool) {
+	if len(packet) == 0 {
+		return nil, nil, 0, nil, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, nil, 0, nil, false
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		if headerLen < 20 || len(packet) < headerLen {
+			return nil, nil, 0, nil, false
+		}
+		return packet[12:16], packet[16:20], layers.IPProtocol(packet[9]), packet[headerLen:], true
+	case 6:
+		if len(packet) < 40 {
+			return nil, nil, 0, nil, false
+		}
+		extensions, ok := parseIPv6Extensions(layers.IPProtocol(packet[6]), packet[40:])
+		if !ok || extensions.fragmentOffset != 0 {
+			return nil, nil, 0, nil, false
+		}
+		return packet[8:24], packet[24:40], extensions.protocol, packet[40+extensions.length:], true
+	default:
+		return nil, nil, 0, nil, false
+	}
+}
+
+// portOffset returns the offset of the source (or destination) port in the transport bytes of a packet.
+// For ICMP echo, this is the offset of the echo identifier, which is the same in both directions.
+func portOffset(protocol layers.IPProtocol, source bool) (int, bool) {
+	switch protocol {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP:
+		if source {
+			return 0, true
+		}
+		return 2, true
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		return 4, true
+	default:
+		return 0, false
+	}
+}
+
+// embeddedNatKey returns the NAT key of the packet embedded in an ICMP error message.
+// The embedded packet was sent through the NAT, so the key is built from its source.
+func embeddedNatKey(embedded []byte) (NATKey, bool) {
+	srcIP, _, protocol, transport, ok := splitPacket(embedded)
+	if !ok || len(transport) < 8 {
+		return NATKey{}, false
+	}
+	srcPortOffset, ok := portOffset(protocol, true)
+	if !ok {
+		return NATKey{}, false
+	}
+	return NATKey{
+		IP:       net.IP(srcIP).String(),
+		Port:     int(binary.BigEndian.Uint16(transport[srcPortOffset : srcPortOffset+2])),
+		Protocol: protocol,
+	}, true
+}
+
+// rewriteEndpoint sets the source (or destination) IP and port of a serialized packet whose transport bytes may be truncated,
+// updating the checksums that cover them if they are part of the packet.
+func rewriteEndpoint(packet []byte, source bool, ip net.IP, port int) bool {
+	srcIP, dstIP, protocol, transport, ok := splitPacket(packet)
+	if !ok {
+		return false
+	}
+	packetIP := dstIP
+	if source {
+		packetIP = srcIP
+	}
+	packetPortOffset, ok := portOffset(protocol, source)
+	if !ok || len(transport) < packetPortOffset+2 {
+		return false
+	}
+	if len(packetIP) == net.IPv4len {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	if ip == nil {
+		return false
+	}
+
+	oldIP := append([]byte(nil), packetIP...)
+	copy(packetIP, ip)
+	packetPort := transport[packetPortOffset : packetPortOffset+2]
+	oldPort := append([]byte(nil), packetPort...)
+	binary.BigEndian.PutUint16(packetPort, uint16(port))
+
+	if packet[0]>>4 == 4 {
+		header := packet[:len(packet)-len(transport)]
+		binary.BigEndian.PutUint16(header[10:12], 0)
+		binary.BigEndian.PutUint16(header[10:12], ipv4HeaderChecksum(header))
+	}
+
+	// transport checksums cover the port, and the IP through the pseudo header (except ICMPv4)
+	checksumOffset := -1
+	coversIP := true
+	switch protocol {
+	case layers.IPProtocolTCP:
+		checksumOffset = 16
+	case layers.IPProtocolUDP:
+		if len(transport) >= 8 && binary.BigEndian.Uint16(transport[6:8]) != 0 {
+			checksumOffset = 6
+		}
+	case layers.IPProtocolICMPv4:
+		checksumOffset = 2
+		coversIP = false
+	case layers.IPProtocolICMPv6:
+		checksumOffset = 2
+	}
+	if 0 <= checksumOffset && checksumOffset+2 <= len(transport) {
+		checksum := binary.BigEndian.Uint16(transport[checksumOffset : checksumOffset+2])
+		if coversIP {
+			checksum = checksumAdjust(checksum, oldIP, ip)
+		}
+		checksum = checksumAdjust(checksum, oldPort, packetPort)
+		if protocol == layers.IPProtocolUDP && checksum == 0 {
+			// a zero UDP checksum means there is none
+			checksum = 0xffff
+		}
+		binary.BigEndian.PutUint16(transport[checksumOffset:checksumOffset+2], checksum)
+	}
+	return true
+}
+
+// checksumAdjust updates an internet checksum after old was replaced by new (RFC 1624).
+// old and new must have the same even length.
+func checksumAdjust(checksum uint16, old []byte, new []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i : i+2]))
+		sum += uint32(binary.BigEndian.Uint16(new[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// icmpTooBig creates an ICMP fragmentation needed (or ICMPv6 packet too big) message for a packet sent by a client
+// that exceeds the MTU. The message is addressed to the client, from the destination of the packet.
+func icmpTooBig(packet []byte, mtu int) ([]byte, error) {
+	return icmpErrorReply(
+		packet,
+		nil,
+		layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+		layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0),
+		// the next-hop MTU
+		uint32(mtu),
+	)
+}
+
+// icmpTimeExceeded creates an ICMP (or ICMPv6) time exceeded message for a packet sent by a client
+// whose TTL (or hop limit) expired. The message is addressed to the client, from srcIP.
+func icmpTimeExceeded(packet []byte, srcIP net.IP) ([]byte, error) {
+	return icmpErrorReply(
+		packet,
+		srcIP,
+		layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded),
+		layers.CreateICMPv6TypeCode(layers.ICMPv6TypeTimeExceeded, layers.ICMPv6CodeHopLimitExceeded),
+		0,
+	)
+}
+
+// icmpProhibited creates an ICMP (or ICMPv6) administratively prohibited message for a packet sent by a client
+// to a denied destination. The message is addressed to the client, from srcIP.
+func icmpProhibited(packet []byte, srcIP net.IP) ([]byte, error) {
+	return icmpErrorReply(
+		packet,
+		srcIP,
+		layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeCommAdminProhibited),
+		layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAdminProhibited),
+		0,
+	)
+}
+
+// errIcmpErrorNotAllowed is returned instead of an ICMP error message for a packet that must not be answered with one.
+var errIcmpErrorNotAllowed = errors.New("no ICMP error is sent for an ICMP error or a following fragment")
+
+// icmpErrorAllowed returns false for packets that must not be answered with an ICMP error message:
+// ICMP error messages and the following fragments of a datagram (RFC 1122 section 3.2.2, RFC 4443 section 2.4 (e)).
+func icmpErrorAllowed(packet []byte) bool {
+	if 20 <= len(packet) && packet[0]>>4 == 4 && binary.BigEndian.Uint16(packet[6:8])&ipv4FragmentOffset != 0 {
+		return false
+	}
+	_, _, protocol, transport, ok := splitPacket(packet)
+	if !ok {
+		// a following fragment of an IPv6 datagram, or a packet that cannot be embedded
+		return false
+	}
+	if len(transport) == 0 {
+		return true
+	}
+	switch protocol {
+	case layers.IPProtocolICMPv4:
+		switch transport[0] {
+		case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeRedirect, layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+			return false
+		}
+	case layers.IPProtocolICMPv6:
+		// types below 128 are error messages (RFC 4443 section 2.1)
+		return 128 <= transport[0]
+	}
+	return true
+}
+
+// icmpErrorReply creates an ICMP (or ICMPv6) error message for a packet sent by a client, embedding the packet.
+// The message is addressed to the client, from srcIP or the destination of the packet if srcIP is nil.
+// restOfHeader is the type specific second word of the ICMP header.
+// Returns errIcmpErrorNotAllowed for packets that must not be answered with an ICMP error, see icmpErrorAllowed.
+func icmpErrorReply(packet []byte, srcIP net.IP, icmpv4TypeCode layers.ICMPv4TypeCode, icmpv6TypeCode layers.ICMPv6TypeCode, restOfHeader uint32) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, errors.New("empty packet")
+	}
+	if !icmpErrorAllowed(packet) {
+		return nil, errIcmpErrorNotAllowed
+	}
+
+	var networkLayer gopacket.SerializableLayer
+	var icmpLayer gopacket.SerializableLayer
+	var embedded []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, errors.New("truncated IPv4 packet")
+		}
+		if srcIP = srcIP.To4(); srcIP == nil {
+			srcIP = net.IP(packet[16:20])
+		}
+		networkLayer = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    srcIP,
+			DstIP:    net.IP(packet[12:16]),
+		}
+		icmpLayer = &layers.ICMPv4{
+			TypeCode: icmpv4TypeCode,
+			Id:       uint16(restOfHeader >> 16),
+			Seq:      uint16(restOfHeader),
+		}
+		// the IP header and the first 8 bytes of the payload (RFC 792)
+		headerLen := int(packet[0]&0x0f) * 4
+		embedded = packet[:min(len(packet), headerLen+8)]
+	case 6:
+		if len(packet) < 40 {
+			return nil, errors.New("truncated IPv6 packet")
+		}
+		if srcIP == nil || srcIP.To4() != nil {
+			srcIP = net.IP(packet[24:40])
+		}
+		ipv6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      srcIP,
+			DstIP:      net.IP(packet[8:24]),
+		}
+		networkLayer = ipv6
+		icmpv6 := &layers.ICMPv6{
+			TypeCode: icmpv6TypeCode,
+		}
+		icmpv6.SetNetworkLayerForChecksum(ipv6)
+		icmpLayer = icmpv6
+		// as much of the packet as fits in the minimum IPv6 MTU (RFC 4443)
+		embedded = binary.BigEndian.AppendUint32(nil, restOfHeader)
+		embedded = append(embedded, packet[:min(len(packet), 1280-40-8)]...)
+	default:
+		return nil, errors.New("packet is neither IPv4 nor IPv6")
+	}
+
+	return serializePacket(networkLayer, icmpLayer, gopacket.Payload(embedded))
+}
@@ -0,0 +1,130 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var errIPv6ExtensionsTruncated = errors.New("IPv6 extension headers truncated")
+
+const (
+	ipv6FragmentOffset    = 0xfff8
+	ipv6FlagMoreFragments = 0x0001
+)
+
+// ipv6Extensions are the extension headers between the IPv6 header and the transport layer (RFC 8200).
+type ipv6Extensions struct {
+	// the protocol of the header that follows the extension headers
+	protocol layers.IPProtocol
+	// the length of the extension headers
+	length int
+	// the offset in bytes of the payload in the datagram, and whether more fragments follow, from the fragment header
+	fragmentOffset int
+	moreFragments  bool
+}
+
+// fragment returns true if the packet is a fragment of a larger datagram.
+// An atomic fragment (RFC 6946) is a complete datagram.
+func (extensions ipv6Extensions) fragment() bool {
+	return extensions.fragmentOffset != 0 || extensions.moreFragments
+}
+
+// parseIPv6Extensions parses the hop-by-hop options, routing, fragment and destination options headers
+// at the start of payload, the first of which is nextHeader. Other headers end the extension headers.
+// Returns false if the extension headers are truncated.
+func parseIPv6Extensions(nextHeader layers.IPProtocol, payload []byte) (ipv6Extensions, bool) {
+	extensions := ipv6Extensions{protocol: nextHeader}
+	for {
+		header := payload[extensions.length:]
+		switch extensions.protocol {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if len(header) < 2 || len(header) < (int(header[1])+1)*8 {
+				return extensions, false
+			}
+			extensions.length += (int(header[1]) + 1) * 8
+		case layers.IPProtocolIPv6Fragment:
+			if len(header) < 8 {
+				return extensions, false
+			}
+			offsetAndFlags := binary.BigEndian.Uint16(header[2:4])
+			extensions.fragmentOffset = int(offsetAndFlags & ipv6FragmentOffset)
+			extensions.moreFragments = offsetAndFlags&ipv6FlagMoreFragments != 0
+			extensions.length += 8
+		default:
+			return extensions, true
+		}
+		extensions.protocol = layers.IPProtocol(header[0])
+	}
+}
+
+// ipv6ExtensionLayer decodes the routing, fragment and destination options headers of an IPv6 packet as one layer,
+// so that the transport layer is decoded after them. The hop-by-hop options are decoded by layers.IPv6.
+// The headers are not modified by the NAT, they are serialized as received, see decodedPacket.networkLayers.
+type ipv6ExtensionLayer struct {
+	layers.BaseLayer
+	ipv6       *layers.IPv6
+	extensions ipv6Extensions
+}
+
+var ipv6ExtensionLayerClass = gopacket.NewLayerClass([]gopacket.LayerType{
+	layers.LayerTypeIPv6Routing,
+	layers.LayerTypeIPv6Fragment,
+	layers.LayerTypeIPv6Destination,
+})
+
+func (l *ipv6ExtensionLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	nextHeader := l.ipv6.NextHeader
+	if l.ipv6.HopByHop != nil {
+		nextHeader = l.ipv6.HopByHop.NextHeader
+	}
+	extensions, ok := parseIPv6Extensions(nextHeader, data)
+	if !ok {
+		df.SetTruncated()
+		return errIPv6ExtensionsTruncated
+	}
+	l.extensions = extensions
+	l.BaseLayer = layers.BaseLayer{Contents: data[:extensions.length], Payload: data[extensions.length:]}
+	return nil
+}
+
+func (l *ipv6ExtensionLayer) CanDecode() gopacket.LayerClass {
+	return ipv6ExtensionLayerClass
+}
+
+func (l *ipv6ExtensionLayer) NextLayerType() gopacket.LayerType {
+	if l.extensions.fragmentOffset != 0 {
+		// only the first fragment carries the transport header
+		return gopacket.LayerTypeFragment
+	}
+	return l.extensions.protocol.LayerType()
+}
+
+// ipv6Extensions returns the extension headers of an IPv6 packet, from the hop-by-hop options to the transport layer.
+func (packet *decodedPacket) ipv6Extensions() ipv6Extensions {
+	// NOTE: the payload of the IPv6 layer starts after the hop-by-hop options
+	extensions, _ := parseIPv6Extensions(packet.ipv6.NextHeader, packet.data[len(packet.ipv6.Contents):])
+	return extensions
+}
+
+// networkLayers returns the layers to serialize the IP header of the packet, after its fields were modified.
+// The IPv6 extension headers follow the IPv6 header unmodified and in order.
+func (packet *decodedPacket) networkLayers() []gopacket.SerializableLayer {
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		return []gopacket.SerializableLayer{ip}
+	case *layers.IPv6:
+		extensions := packet.ipv6Extensions()
+		if extensions.length == 0 {
+			return []gopacket.SerializableLayer{ip}
+		}
+		// NOTE: layers.IPv6 would serialize the decoded hop-by-hop options again, which does not keep their padding
+		ip.HopByHop = nil
+		headerLen := len(ip.Contents)
+		return []gopacket.SerializableLayer{ip, gopacket.Payload(packet.data[headerLen : headerLen+extensions.length])}
+	default:
+		return nil
+	}
+}
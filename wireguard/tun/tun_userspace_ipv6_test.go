@@ -0,0 +1,251 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/userwireguard/logger"
+)
+
+var (
+	testPublicIPv6 = net.ParseIP("2001:db8::1")
+	testLocalIPv6  = net.ParseIP("fd00::2")
+	testRemoteIPv6 = net.ParseIP("2001:db8:1::7")
+)
+
+func newTestTunIPv6(t *testing.T) (*UserspaceTun, *fakeNat) {
+	t.Helper()
+	nat := &fakeNat{}
+	publicIPv6 := testPublicIPv6
+	tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), nil, &publicIPv6, DefaultUserspaceTunSettings(), nat, func() {})
+	t.Cleanup(func() { tun.Close() })
+	return tun, nat
+}
+
+func tcpv6Packet(t testing.TB, srcIP net.IP, srcPort int, dstIP net.IP, dstPort int, setFlags func(tcp *layers.TCP)) []byte {
+	t.Helper()
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolTCP,
+		SrcIP:      srcIP,
+		DstIP:      dstIP,
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Window:  65535,
+	}
+	setFlags(tcp)
+	tcp.SetNetworkLayerForChecksum(ipv6)
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ipv6, tcp); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+// transportChecksumValid verifies the TCP, UDP or ICMPv6 checksum of an IPv6 packet over the pseudo header (RFC 8200).
+func transportChecksumValid(packet []byte) bool {
+	srcIP, dstIP, protocol, transport, ok := splitPacket(packet)
+	if !ok {
+		return false
+	}
+	pseudoHeader := append(append([]byte(nil), srcIP...), dstIP...)
+	pseudoHeader = binary.BigEndian.AppendUint32(pseudoHeader, uint32(len(transport)))
+	pseudoHeader = append(pseudoHeader, 0, 0, 0, byte(protocol))
+	pseudoHeader = append(pseudoHeader, transport...)
+	if len(pseudoHeader)%2 == 1 {
+		pseudoHeader = append(pseudoHeader, 0)
+	}
+	return ipv4HeaderChecksum(pseudoHeader) == 0
+}
+
+// withExtensionHeaders inserts extension headers, the first of which is of type nextHeader,
+// between the IPv6 header of a packet and its transport layer.
+// The last header must have the protocol of the transport layer as its next header.
+func withExtensionHeaders(packet []byte, nextHeader layers.IPProtocol, headers ...[]byte) []byte {
+	extended := append([]byte(nil), packet[:40]...)
+	extended[6] = byte(nextHeader)
+	for _, header := range headers {
+		extended = append(extended, header...)
+	}
+	extended = append(extended, packet[40:]...)
+	binary.BigEndian.PutUint16(extended[4:6], uint16(len(extended)-40))
+	return extended
+}
+
+func TestParseIPv6Extensions(t *testing.T) {
+	hopByHop := []byte{byte(layers.IPProtocolIPv6Destination), 0, 1, 4, 0, 0, 0, 0}
+	destination := []byte{byte(layers.IPProtocolIPv6Fragment), 0, 1, 4, 0, 0, 0, 0}
+	fragment := []byte{byte(layers.IPProtocolUDP), 0, 0x05, 0x01, 0, 0, 0, 1}
+	payload := append(append(append(append([]byte(nil), hopByHop...), destination...), fragment...), 0, 1, 2, 3)
+
+	extensions, ok := parseIPv6Extensions(layers.IPProtocolIPv6HopByHop, payload)
+	if !ok || extensions.protocol != layers.IPProtocolUDP || extensions.length != 24 {
+		t.Fatalf("expected 24 bytes of extension headers before UDP, got %+v", extensions)
+	}
+	if extensions.fragmentOffset != 0x0500 || !extensions.moreFragments || !extensions.fragment() {
+		t.Fatalf("expected a fragment at offset 1280 with more fragments, got %+v", extensions)
+	}
+
+	if _, ok := parseIPv6Extensions(layers.IPProtocolIPv6HopByHop, payload[:12]); ok {
+		t.Fatalf("expected truncated extension headers to fail")
+	}
+	if extensions, ok := parseIPv6Extensions(layers.IPProtocolTCP, payload); !ok || extensions.length != 0 {
+		t.Fatalf("expected no extension headers, got %+v", extensions)
+	}
+}
+
+func TestUserspaceTunNat66(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		request []byte
+		reply   func(publicPort int) []byte
+	}{
+		{
+			"UDP",
+			udpv6Packet(t, testLocalIPv6, 40000, testRemoteIPv6, 53, []byte("query")),
+			func(publicPort int) []byte {
+				return udpv6Packet(t, testRemoteIPv6, 53, testPublicIPv6, publicPort, []byte("reply"))
+			},
+		},
+		{
+			"TCP",
+			tcpv6Packet(t, testLocalIPv6, 40000, testRemoteIPv6, 443, func(tcp *layers.TCP) { tcp.SYN = true }),
+			func(publicPort int) []byte {
+				return tcpv6Packet(t, testRemoteIPv6, 443, testPublicIPv6, publicPort, func(tcp *layers.TCP) { tcp.SYN, tcp.ACK = true, true })
+			},
+		},
+		{
+			// the options are passed through unmodified and in order
+			"extension headers",
+			withExtensionHeaders(
+				udpv6Packet(t, testLocalIPv6, 40000, testRemoteIPv6, 53, []byte("query")),
+				layers.IPProtocolIPv6HopByHop,
+				[]byte{byte(layers.IPProtocolIPv6Destination), 0, 5, 2, 0, 0, 1, 0},
+				[]byte{byte(layers.IPProtocolUDP), 0, 1, 4, 0, 0, 0, 0},
+			),
+			func(publicPort int) []byte {
+				return withExtensionHeaders(
+					udpv6Packet(t, testRemoteIPv6, 53, testPublicIPv6, publicPort, []byte("reply")),
+					layers.IPProtocolIPv6Destination,
+					[]byte{byte(layers.IPProtocolUDP), 0, 1, 4, 0, 0, 0, 0},
+				)
+			},
+		},
+		{
+			// an atomic fragment is a complete datagram (RFC 6946)
+			"atomic fragment",
+			withExtensionHeaders(
+				udpv6Packet(t, testLocalIPv6, 40000, testRemoteIPv6, 53, []byte("query")),
+				layers.IPProtocolIPv6Fragment,
+				[]byte{byte(layers.IPProtocolUDP), 0, 0, 0, 0, 0, 0, 7},
+			),
+			func(publicPort int) []byte {
+				return udpv6Packet(t, testRemoteIPv6, 53, testPublicIPv6, publicPort, []byte("reply"))
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tun, nat := newTestTunIPv6(t)
+			if _, err := tun.Write([][]byte{tt.request}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+			if len(nat.sent) != 1 {
+				t.Fatalf("expected 1 packet to be sent, got %d", len(nat.sent))
+			}
+			sent := nat.sent[0]
+			if srcIP := net.IP(sent[8:24]); !srcIP.Equal(testPublicIPv6) {
+				t.Fatalf("expected source %v, got %v", testPublicIPv6, srcIP)
+			}
+			if sent[7] != tt.request[7]-1 {
+				t.Fatalf("expected hop limit %d, got %d", tt.request[7]-1, sent[7])
+			}
+			// the extension headers are kept as sent by the client
+			requestExtensions, _ := parseIPv6Extensions(layers.IPProtocol(tt.request[6]), tt.request[40:])
+			if sent[6] != tt.request[6] || !bytes.Equal(sent[40:40+requestExtensions.length], tt.request[40:40+requestExtensions.length]) {
+				t.Fatalf("expected the extension headers to be kept:\n%x\n%x", tt.request[:40+requestExtensions.length], sent)
+			}
+			if len(sent) != len(tt.request) || int(binary.BigEndian.Uint16(sent[4:6])) != len(sent)-40 {
+				t.Fatalf("expected the length of the packet to be kept, got %d bytes", len(sent))
+			}
+			if !transportChecksumValid(sent) {
+				t.Fatalf("sent packet has an invalid checksum")
+			}
+
+			_, _, _, transport, _ := splitPacket(sent)
+			nat.receive(tt.reply(int(binary.BigEndian.Uint16(transport[0:2]))))
+			received, err := readPacket(t, tun, DefaultMtu)
+			if err != nil {
+				t.Fatalf("failed to read packet: %v", err)
+			}
+			_, dstIP, _, transport, ok := splitPacket(received)
+			if !ok || !net.IP(dstIP).Equal(testLocalIPv6) || binary.BigEndian.Uint16(transport[2:4]) != 40000 {
+				t.Fatalf("expected the reply to be addressed to [%v]:40000, got %x", testLocalIPv6, received)
+			}
+			if !transportChecksumValid(received) {
+				t.Fatalf("received packet has an invalid checksum")
+			}
+		})
+	}
+}
+
+func TestUserspaceTunNat66HopLimit(t *testing.T) {
+	tun, nat := newTestTunIPv6(t)
+
+	expiring := udpv6Packet(t, testLocalIPv6, 40000, testRemoteIPv6, 53, []byte("query"))
+	expiring[7] = 1
+	if _, err := tun.Write([][]byte{expiring}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if len(nat.sent) != 0 || tun.DropStats().WriteTtlExceeded != 1 {
+		t.Fatalf("expected the expired packet to be dropped, got %+v", tun.DropStats())
+	}
+
+	// the client is told by a time exceeded from the public IP, like for IPv4
+	received, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	icmpType := layers.ICMPv6TypeCode(binary.BigEndian.Uint16(received[40:42])).Type()
+	if layers.IPProtocol(received[6]) != layers.IPProtocolICMPv6 || icmpType != layers.ICMPv6TypeTimeExceeded {
+		t.Fatalf("expected an ICMPv6 time exceeded, got %x", received)
+	}
+	if srcIP, dstIP := net.IP(received[8:24]), net.IP(received[24:40]); !srcIP.Equal(testPublicIPv6) || !dstIP.Equal(testLocalIPv6) {
+		t.Fatalf("expected the time exceeded from %v to %v, got %v to %v", testPublicIPv6, testLocalIPv6, srcIP, dstIP)
+	}
+	if !transportChecksumValid(received) {
+		t.Fatalf("time exceeded has an invalid checksum")
+	}
+}
+
+func TestUserspaceTunNat66Fragments(t *testing.T) {
+	tun, nat := newTestTunIPv6(t)
+
+	// the checksum of a fragmented datagram covers the following fragments, so fragments are not translated
+	first := withExtensionHeaders(
+		udpv6Packet(t, testLocalIPv6, 40000, testRemoteIPv6, 53, []byte("query")),
+		layers.IPProtocolIPv6Fragment,
+		[]byte{byte(layers.IPProtocolUDP), 0, 0, 1, 0, 0, 0, 7},
+	)
+	following := withExtensionHeaders(
+		udpv6Packet(t, testLocalIPv6, 40000, testRemoteIPv6, 53, []byte("query")),
+		layers.IPProtocolIPv6Fragment,
+		[]byte{byte(layers.IPProtocolUDP), 0, 0, 8, 0, 0, 0, 7},
+	)
+	for _, fragment := range [][]byte{first, following} {
+		if _, err := tun.Write([][]byte{fragment}, 0); err == nil {
+			t.Fatalf("expected an error for an IPv6 fragment")
+		}
+	}
+	if len(nat.sent) != 0 || tun.DropStats().UnsupportedTransport != 2 {
+		t.Fatalf("expected the fragments to be dropped, got %+v", tun.DropStats())
+	}
+}
@@ -0,0 +1,174 @@
+package tun
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DefaultNatKeepaliveMaxIdle stops the keepalives of a flow once its client was idle for as long
+// as an established TCP mapping without keepalives.
+const DefaultNatKeepaliveMaxIdle = DefaultTcpIdleTimeout
+
+// flowKeepalive is what a NAT entry needs to send a keepalive for its flow,
+// as seen in the last packet sent by the client.
+type flowKeepalive struct {
+	dstIP   net.IP
+	dstPort int
+	// for TCP, the next sequence number of the client, the sequence number it acknowledged and its window
+	seq    uint32
+	ack    uint32
+	window uint16
+	// last time the client sent a packet and last time a keepalive was sent
+	outbound time.Time
+	sent     time.Time
+}
+
+// newTcpKeepalive returns the keepalive state of a TCP packet sent by a client, if it is part of an established connection.
+func newTcpKeepalive(networkLayer gopacket.NetworkLayer, tcp *layers.TCP) (flowKeepalive, bool) {
+	if !tcp.ACK || tcp.SYN || tcp.RST {
+		return flowKeepalive{}, false
+	}
+	seq := tcp.Seq + uint32(len(tcp.Payload))
+	if tcp.FIN {
+		seq += 1
+	}
+	return flowKeepalive{
+		dstIP:   networkDstIP(networkLayer),
+		dstPort: int(tcp.DstPort),
+		seq:     seq,
+		ack:     tcp.Ack,
+		window:  tcp.Window,
+	}, true
+}
+
+// newUdpKeepalive returns the keepalive state of a UDP datagram sent by a client.
+func newUdpKeepalive(networkLayer gopacket.NetworkLayer, udp *layers.UDP) flowKeepalive {
+	return flowKeepalive{
+		dstIP:   networkDstIP(networkLayer),
+		dstPort: int(udp.DstPort),
+	}
+}
+
+// networkDstIP returns a copy of the destination of a packet, since the layers reference the packet, which the device reuses.
+func networkDstIP(networkLayer gopacket.NetworkLayer) net.IP {
+	var dstIP net.IP
+	switch ip := networkLayer.(type) {
+	case *layers.IPv4:
+		dstIP = ip.DstIP
+	case *layers.IPv6:
+		dstIP = ip.DstIP
+	}
+	return append(net.IP(nil), dstIP...)
+}
+
+// keepaliveDue returns true if a keepalive should be sent for an entry at now: its flow is established,
+// it was idle for NatKeepaliveInterval, and its client was not idle for longer than NatKeepaliveMaxIdle.
+// A flow is established once the remote answered, and a TCP connection stops being established when it closes.
+// natTableMu must be held.
+func (tun *UserspaceTun) keepaliveDue(natKey NATKey, value NATValue, now time.Time) bool {
+	keepalive := value.keepalive
+	if keepalive.dstIP == nil || value.InboundPackets == 0 {
+		return false
+	}
+	switch natKey.Protocol {
+	case layers.IPProtocolTCP:
+		if value.tcpState != 0 {
+			return false
+		}
+	case layers.IPProtocolUDP:
+	default:
+		return false
+	}
+	if tun.settings.NatKeepaliveMaxIdle <= now.Sub(keepalive.outbound) {
+		return false
+	}
+	idleSince := value.LastActivity
+	if idleSince.Before(keepalive.sent) {
+		idleSince = keepalive.sent
+	}
+	return tun.settings.NatKeepaliveInterval <= now.Sub(idleSince)
+}
+
+// sendNatKeepalives sends a keepalive for the idle established flows at now, so that the mappings
+// of the NATs on the way are not removed while the flows are idle.
+//
+// The keepalive of a TCP connection is an ACK with the next sequence number of the client, which keeps the connection
+// of the NAT. The NAT sends TCP keepalives to the remote on its socket, see localUserNatSettings.
+// The keepalive of a UDP flow is an empty datagram, which the NAT sends to the remote on the socket of the flow.
+func (tun *UserspaceTun) sendNatKeepalives(now time.Time) {
+	if tun.settings.NatKeepaliveInterval <= 0 {
+		return
+	}
+
+	var probes [][]byte
+	tun.rangeNatTable(func(natKey NATKey, value NATValue) {
+		if !tun.keepaliveDue(natKey, value, now) {
+			return
+		}
+		probe, err := value.keepalive.probe(natKey)
+		if err != nil {
+			tun.log.Verbosef("NatKeepalive: failed to serialize keepalive: %v", err)
+			return
+		}
+		value.keepalive.sent = now
+		tun.natTable[natKey] = value
+		tun.natStats.Keepalives += 1
+		probes = append(probes, probe)
+	})
+
+	for _, probe := range probes {
+		if !tun.sendWithRetry(probe) {
+			tun.drop(&tun.drops.sendFailed, "NatKeepalive: failed to send keepalive through NAT after %d retries", tun.settings.SendRetries)
+			continue
+		}
+		tun.packets.sent.Add(1)
+	}
+}
+
+// probe serializes the keepalive of the flow of the entry natKey.
+func (keepalive flowKeepalive) probe(natKey NATKey) ([]byte, error) {
+	var transport interface {
+		gopacket.SerializableLayer
+		SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+	}
+	if natKey.Protocol == layers.IPProtocolTCP {
+		transport = &layers.TCP{
+			SrcPort: layers.TCPPort(natKey.Port),
+			DstPort: layers.TCPPort(keepalive.dstPort),
+			Seq:     keepalive.seq,
+			Ack:     keepalive.ack,
+			ACK:     true,
+			Window:  keepalive.window,
+		}
+	} else {
+		transport = &layers.UDP{
+			SrcPort: layers.UDPPort(natKey.Port),
+			DstPort: layers.UDPPort(keepalive.dstPort),
+		}
+	}
+	srcIP := net.ParseIP(natKey.IP)
+	if dstIP := keepalive.dstIP.To4(); dstIP != nil {
+		ipv4 := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Flags:    layers.IPv4DontFragment,
+			Protocol: natKey.Protocol,
+			SrcIP:    srcIP.To4(),
+			DstIP:    dstIP,
+		}
+		transport.SetNetworkLayerForChecksum(ipv4)
+		return serializePacket(ipv4, transport)
+	}
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: natKey.Protocol,
+		SrcIP:      srcIP,
+		DstIP:      keepalive.dstIP,
+	}
+	transport.SetNetworkLayerForChecksum(ipv6)
+	return serializePacket(ipv6, transport)
+}
@@ -0,0 +1,106 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestUserspaceTunNatKeepalive(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.NatKeepaliveInterval = time.Minute
+	settings.NatKeepaliveMaxIdle = 10 * time.Minute
+	tun, nat := newTestTun(t, settings)
+	now := time.Now()
+
+	// an established connection, and a connection reset by the remote
+	for _, clientPort := range []int{40000, 40001} {
+		request := tcpPacket(t, testLocalIPv4, clientPort, testRemoteIPv4, 443, func(tcp *layers.TCP) {
+			tcp.ACK, tcp.Seq, tcp.Ack = true, 1000, 5000
+		})
+		if _, err := tun.Write([][]byte{request}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+		publicPort := sentPort(nat.sent[len(nat.sent)-1])
+		nat.receive(tcpPacket(t, testRemoteIPv4, 443, testPublicIPv4, publicPort, func(tcp *layers.TCP) {
+			tcp.ACK, tcp.RST = true, clientPort == 40001
+		}))
+		if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+			t.Fatalf("failed to read packet: %v", err)
+		}
+	}
+	tcpPort := sentPort(nat.sent[0])
+
+	// a UDP flow answered by the remote, and a UDP flow without answer
+	for _, clientPort := range []int{40002, 40003} {
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, clientPort, testRemoteIPv4, 3478, 20, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	udpPort := sentPort(nat.sent[2])
+	nat.receive(udpPacket(t, testRemoteIPv4, 3478, testPublicIPv4, udpPort, 20, false))
+	if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	nat.sent = nil
+
+	keepalives := func(at time.Duration) int {
+		sent := len(nat.sent)
+		tun.sendNatKeepalives(now.Add(at))
+		return len(nat.sent) - sent
+	}
+	if n := keepalives(30 * time.Second); n != 0 {
+		t.Fatalf("expected no keepalives before the interval, got %d", n)
+	}
+	if n := keepalives(2 * time.Minute); n != 2 {
+		t.Fatalf("expected keepalives for the established connection and the answered UDP flow, got %d", n)
+	}
+
+	for _, keepalive := range nat.sent {
+		srcIP, dstIP, protocol, transport, ok := splitPacket(keepalive)
+		if !ok || !net.IP(srcIP).Equal(testPublicIPv4) || !net.IP(dstIP).Equal(testRemoteIPv4) {
+			t.Fatalf("expected a keepalive from %v to %v, got %x", testPublicIPv4, testRemoteIPv4, keepalive)
+		}
+		if !transportChecksumValid(keepalive) {
+			t.Fatalf("keepalive has an invalid checksum")
+		}
+		srcPort, dstPort := int(binary.BigEndian.Uint16(transport[0:2])), binary.BigEndian.Uint16(transport[2:4])
+		switch protocol {
+		case layers.IPProtocolTCP:
+			if srcPort != tcpPort || dstPort != 443 {
+				t.Fatalf("expected the TCP keepalive from port %d to 443, got %d to %d", tcpPort, srcPort, dstPort)
+			}
+			// an ACK with the next sequence number of the client, which the NAT accepts
+			if seq, ack := binary.BigEndian.Uint32(transport[4:8]), binary.BigEndian.Uint32(transport[8:12]); seq != 1000 || ack != 5000 || transport[13] != 0x10 {
+				t.Fatalf("expected an ACK with seq 1000 and ack 5000, got seq %d ack %d flags %08b", seq, ack, transport[13])
+			}
+		case layers.IPProtocolUDP:
+			if srcPort != udpPort || dstPort != 3478 {
+				t.Fatalf("expected the UDP keepalive from port %d to 3478, got %d to %d", udpPort, srcPort, dstPort)
+			}
+			// an empty datagram
+			if len(transport) != 8 {
+				t.Fatalf("expected an empty datagram, got %d bytes", len(transport))
+			}
+		default:
+			t.Fatalf("unexpected keepalive protocol %v", protocol)
+		}
+	}
+
+	// a keepalive is sent every interval while the flows stay idle, until the max idle of the clients
+	if n := keepalives(2*time.Minute + 30*time.Second); n != 0 {
+		t.Fatalf("expected no keepalive within the interval of the last one, got %d", n)
+	}
+	if n := keepalives(3 * time.Minute); n != 2 {
+		t.Fatalf("expected 2 keepalives after the interval, got %d", n)
+	}
+	if n := keepalives(11 * time.Minute); n != 0 {
+		t.Fatalf("expected no keepalive after the max idle, got %d", n)
+	}
+	if stats := tun.NatStats(); stats.Keepalives != 4 {
+		t.Fatalf("expected 4 keepalives, got %+v", stats)
+	}
+}
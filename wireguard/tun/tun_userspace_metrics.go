@@ -0,0 +1,176 @@
+package tun
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTimingSampleRate times the stages of 1 in 1000 packets, which keeps the cost of the clock negligible.
+const DefaultTimingSampleRate = 1000
+
+// timingStage is a stage of the data path whose duration is sampled.
+type timingStage int
+
+const (
+	// decoding the layers of a packet
+	stageDecode timingStage = iota
+	// creating or looking up the NAT entry of a packet
+	stageNat
+	// serializing a translated packet
+	stageSerialize
+	// sending a translated packet through the NAT, including segmentation
+	stageSend
+	stageCount
+)
+
+var stageNames = [stageCount]string{
+	stageDecode:    "decode",
+	stageNat:       "nat",
+	stageSerialize: "serialize",
+	stageSend:      "send",
+}
+
+// timingBucketCount is the number of buckets of the stage timings.
+const timingBucketCount = 22
+
+// timingBucketBounds are the upper bounds of the buckets of the stage timings, doubling from 250ns to about 250ms.
+// Longer durations are counted in the last bucket.
+var timingBucketBounds = func() (bounds [timingBucketCount - 1]time.Duration) {
+	for i := range bounds {
+		bounds[i] = 250 * time.Nanosecond << i
+	}
+	return
+}()
+
+// timingHistogram counts the sampled durations of a stage by bucket. It is safe for concurrent use.
+type timingHistogram struct {
+	count   atomic.Uint64
+	total   atomic.Uint64 // in nanoseconds
+	buckets [timingBucketCount]atomic.Uint64
+}
+
+func (h *timingHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(timingBucketBounds) && timingBucketBounds[i] < d {
+		i += 1
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.total.Add(uint64(d))
+}
+
+// TimingBucket is the number of sampled durations of at most UpperBound,
+// and longer than the bound of the previous bucket. The last bucket has no upper bound (zero).
+type TimingBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// TimingHistogram are the sampled durations of a stage of the data path.
+type TimingHistogram struct {
+	Count   uint64
+	Total   time.Duration
+	Buckets []TimingBucket
+}
+
+func (h *timingHistogram) snapshot() TimingHistogram {
+	snapshot := TimingHistogram{
+		Count: h.count.Load(),
+		Total: time.Duration(h.total.Load()),
+	}
+	for i := range h.buckets {
+		bucket := TimingBucket{Count: h.buckets[i].Load()}
+		if i < len(timingBucketBounds) {
+			bucket.UpperBound = timingBucketBounds[i]
+		}
+		snapshot.Buckets = append(snapshot.Buckets, bucket)
+	}
+	return snapshot
+}
+
+// Metrics is a snapshot of the counters of the TUN.
+type Metrics struct {
+	// packets passed to Write by the device
+	PacketsWritten uint64
+	// packets sent through the NAT
+	PacketsSent uint64
+	// times a packet was sent again because the NAT did not accept it, see UserspaceTunSettings.SendRetries
+	SendRetries uint64
+	// packets written that exceed the MTU and were split into TCP segments, see UserspaceTunSettings.TcpSegmentation
+	PacketsSegmented uint64
+	// packets received from the NAT (or created by the TUN) and queued for Read
+	PacketsReceived uint64
+	// packets returned by Read to the device
+	PacketsRead uint64
+	// packets queued for Read, and the size of the queue
+	ReceiveQueueLength   int
+	ReceiveQueueCapacity int
+	// bytes of the packets queued for Read, and the limit (0 if unlimited)
+	ReceiveQueueBytes         int64
+	ReceiveQueueBytesCapacity int
+	// highest number of packets and bytes queued for Read since the TUN was created
+	ReceiveQueueHighWater      int64
+	ReceiveQueueBytesHighWater int64
+	Nat                        NatStats
+	Drops                      DropStats
+	// traffic through the NAT by client, see UserspaceTun.FlowAccounting
+	Clients []ClientAccounting
+	// sampled durations of the stages of the data path by name (decode, nat, serialize and send),
+	// see UserspaceTunSettings.TimingSampleRate
+	StageTimings map[string]TimingHistogram
+}
+
+// Metrics returns the current counters of the TUN.
+func (tun *UserspaceTun) Metrics() Metrics {
+	metrics := Metrics{
+		PacketsWritten:             tun.packets.written.Load(),
+		PacketsSent:                tun.packets.sent.Load(),
+		SendRetries:                tun.packets.sendRetries.Load(),
+		PacketsSegmented:           tun.packets.segmented.Load(),
+		PacketsReceived:            tun.packets.received.Load(),
+		PacketsRead:                tun.packets.read.Load(),
+		ReceiveQueueLength:         len(tun.natRcv),
+		ReceiveQueueCapacity:       cap(tun.natRcv),
+		ReceiveQueueBytes:          tun.natRcvBytes.Load(),
+		ReceiveQueueBytesCapacity:  tun.settings.ReceiveQueueBytes,
+		ReceiveQueueHighWater:      tun.natRcvHighWater.Load(),
+		ReceiveQueueBytesHighWater: tun.natRcvBytesHighWater.Load(),
+		Nat:                        tun.NatStats(),
+		Drops:                      tun.DropStats(),
+		Clients:                    tun.FlowAccounting(false).Clients,
+		StageTimings:               map[string]TimingHistogram{},
+	}
+	for stage, name := range stageNames {
+		metrics.StageTimings[name] = tun.stageTimings[stage].snapshot()
+	}
+	return metrics
+}
+
+// Expvar returns a variable with the Metrics of the TUN, to publish with expvar.Publish.
+func (tun *UserspaceTun) Expvar() expvar.Var {
+	return expvar.Func(func() any {
+		return tun.Metrics()
+	})
+}
+
+// sampleTiming returns true if the stages of the next packet are timed, 1 in TimingSampleRate packets.
+func (tun *UserspaceTun) sampleTiming() bool {
+	rate := tun.settings.TimingSampleRate
+	return 0 < rate && tun.timingSamples.Add(1)%uint64(rate) == 0
+}
+
+// startStage returns the start of a stage of a packet, or the zero time if the packet is not timed.
+func startStage(timed bool) time.Time {
+	if !timed {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// observeStage records the duration of a stage that started at start, unless the packet is not timed (zero start).
+func (tun *UserspaceTun) observeStage(stage timingStage, start time.Time) {
+	if !start.IsZero() {
+		tun.stageTimings[stage].observe(time.Since(start))
+	}
+}
@@ -0,0 +1,73 @@
+package tun
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+)
+
+func TestTimingHistogram(t *testing.T) {
+	var h timingHistogram
+	for _, d := range []time.Duration{100 * time.Nanosecond, 250 * time.Nanosecond, 300 * time.Nanosecond, 10 * time.Second} {
+		h.observe(d)
+	}
+	snapshot := h.snapshot()
+	if snapshot.Count != 4 || snapshot.Total != 10*time.Second+650*time.Nanosecond {
+		t.Fatalf("expected 4 samples, got %+v", snapshot)
+	}
+	if len(snapshot.Buckets) != timingBucketCount {
+		t.Fatalf("expected %d buckets, got %d", timingBucketCount, len(snapshot.Buckets))
+	}
+	last := snapshot.Buckets[len(snapshot.Buckets)-1]
+	if snapshot.Buckets[0].Count != 2 || snapshot.Buckets[1].Count != 1 || last.Count != 1 || last.UpperBound != 0 {
+		t.Fatalf("unexpected buckets %+v", snapshot.Buckets)
+	}
+}
+
+func TestUserspaceTunExpvar(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.TimingSampleRate = 1
+	tun, nat := newTestTun(t, settings)
+	expvar.Publish("tun_"+t.Name(), tun.Expvar())
+
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, sentPort(nat.sent[0]), 10, false))
+	if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+
+	var metrics Metrics
+	if err := json.Unmarshal([]byte(expvar.Get("tun_"+t.Name()).String()), &metrics); err != nil {
+		t.Fatalf("failed to decode expvar: %v", err)
+	}
+	if metrics.PacketsWritten != 1 || metrics.PacketsSent != 1 || metrics.PacketsReceived != 1 || metrics.PacketsRead != 1 {
+		t.Fatalf("expected 1 packet in each direction, got %+v", metrics)
+	}
+	if metrics.Nat.Entries != 1 || metrics.ReceiveQueueCapacity != settings.ReceiveQueueSize {
+		t.Fatalf("expected 1 NAT entry and the receive queue size, got %+v", metrics)
+	}
+	// every packet is timed, the send stage is only on the way out
+	for name, count := range map[string]uint64{"decode": 2, "nat": 2, "serialize": 2, "send": 1} {
+		if timings := metrics.StageTimings[name]; timings.Count != count {
+			t.Fatalf("expected %d timings of %s, got %+v", count, name, timings)
+		}
+	}
+}
+
+func TestUserspaceTunTimingSampleRate(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.TimingSampleRate = 4
+	tun, _ := newTestTun(t, settings)
+
+	for i := 0; i < 8; i += 1 {
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	if timings := tun.Metrics().StageTimings["decode"]; timings.Count != 2 {
+		t.Fatalf("expected 1 in 4 packets to be timed, got %+v", timings)
+	}
+}
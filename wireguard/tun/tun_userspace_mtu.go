@@ -0,0 +1,241 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	uwgtun "github.com/urnetwork/userwireguard/tun"
+)
+
+const (
+	minMtu = 68 // minimum MTU of an IPv4 link (RFC 791)
+	maxMtu = 65535
+
+	ipv4FlagDontFragment  = 0x4000
+	ipv4FlagMoreFragments = 0x2000
+	ipv4FragmentOffset    = 0x1fff
+
+	tcpFlagCwr = 0x80
+	tcpFlagPsh = 0x08
+	tcpFlagFin = 0x01
+)
+
+var errCannotFragment = errors.New("packet cannot be fragmented")
+
+func validateMtu(mtu int) error {
+	if mtu < minMtu || maxMtu < mtu {
+		return fmt.Errorf("MTU %d out of range [%d, %d]", mtu, minMtu, maxMtu)
+	}
+	return nil
+}
+
+// SetMTU changes the MTU of the TUN and notifies the device with an EventMTUUpdate.
+// It does not block, see notifyMTUUpdate.
+//
+// Returns an error if the MTU is out of range.
+func (tun *UserspaceTun) SetMTU(mtu int) error {
+	if err := validateMtu(mtu); err != nil {
+		return err
+	}
+	tun.mtu.Store(int32(mtu))
+	tun.notifyMTUUpdate()
+	return nil
+}
+
+// notifyMTUUpdate sends an EventMTUUpdate to the device in the background, so that changing the MTU
+// does not block while the events are not drained. Updates are coalesced: the device reads the current MTU
+// when it handles the event, so an update waiting to be sent covers the changes made before it is sent.
+// At most one update is waiting, behind the one being sent.
+func (tun *UserspaceTun) notifyMTUUpdate() {
+	if tun.mtuUpdatePending.Swap(true) {
+		return
+	}
+	go func() {
+		tun.mtuUpdateMu.Lock()
+		defer tun.mtuUpdateMu.Unlock()
+		// cleared before the send, so that a change after this point is covered by this update or sends another
+		tun.mtuUpdatePending.Store(false)
+		tun.AddEvent(uwgtun.EventMTUUpdate)
+	}()
+}
+
+// replyTooBig sends an ICMP fragmentation needed (or ICMPv6 packet too big) message back to the client
+// for a packet that exceeds the MTU.
+func (tun *UserspaceTun) replyTooBig(packet []byte, mtu int) {
+	reply, err := icmpTooBig(packet, mtu)
+	if errors.Is(err, errIcmpErrorNotAllowed) {
+		return
+	}
+	if err != nil {
+		tun.log.Verbosef("Write: failed to create ICMP packet too big: %v", err)
+		return
+	}
+	tun.deliver(reply)
+}
+
+// deliverFitted delivers a packet received from the NAT to a client. With OversizeFragment, an IPv4 packet
+// that exceeds the MTU is fragmented. Other packets that exceed the MTU are dropped by Read.
+func (tun *UserspaceTun) deliverFitted(packet []byte) {
+	if mtu := tun.MTU(); len(packet) > mtu && tun.settings.OversizePolicy == OversizeFragment {
+		if fragments, err := fragmentIPv4(packet, mtu); err == nil {
+			for _, fragment := range fragments {
+				tun.deliver(fragment)
+			}
+			return
+		}
+	}
+	tun.deliver(packet)
+}
+
+// fragmentIPv4 splits a serialized IPv4 packet into fragments of at most mtu bytes.
+//
+// Options are copied into every fragment. Packets that are already fragments are split further,
+// keeping their offset and more fragments flag.
+// Returns errCannotFragment for non-IPv4 packets and packets with the don't fragment flag set.
+func fragmentIPv4(packet []byte, mtu int) ([][]byte, error) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return nil, errCannotFragment
+	}
+	headerLen := int(packet[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+	if headerLen < 20 || totalLen < headerLen || len(packet) < totalLen {
+		return nil, errCannotFragment
+	}
+	flagsAndOffset := binary.BigEndian.Uint16(packet[6:8])
+	if flagsAndOffset&ipv4FlagDontFragment != 0 {
+		return nil, errCannotFragment
+	}
+	// fragment payloads must be multiples of 8 bytes, except for the last one
+	maxPayloadLen := (mtu - headerLen) &^ 7
+	if maxPayloadLen <= 0 {
+		return nil, errCannotFragment
+	}
+
+	payload := packet[headerLen:totalLen]
+	offset := int(flagsAndOffset&ipv4FragmentOffset) * 8
+	moreFragments := flagsAndOffset&ipv4FlagMoreFragments != 0
+
+	fragments := make([][]byte, 0, (len(payload)+maxPayloadLen-1)/maxPayloadLen)
+	for start := 0; start < len(payload); start += maxPayloadLen {
+		end := min(start+maxPayloadLen, len(payload))
+
+		fragment := make([]byte, headerLen+end-start)
+		copy(fragment, packet[:headerLen])
+		copy(fragment[headerLen:], payload[start:end])
+
+		fragmentFlagsAndOffset := uint16((offset + start) / 8)
+		if end < len(payload) || moreFragments {
+			fragmentFlagsAndOffset |= ipv4FlagMoreFragments
+		}
+		binary.BigEndian.PutUint16(fragment[2:4], uint16(len(fragment)))
+		binary.BigEndian.PutUint16(fragment[6:8], fragmentFlagsAndOffset)
+		binary.BigEndian.PutUint16(fragment[10:12], 0)
+		binary.BigEndian.PutUint16(fragment[10:12], ipv4HeaderChecksum(fragment[:headerLen]))
+
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+// ipv4HeaderChecksum computes the checksum of an IPv4 header. The checksum field must be zero.
+func ipv4HeaderChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// segmentTcp splits a serialized TCP packet into segments of at most mtu bytes, as TCP segmentation offload does.
+// Devices with GSO hand over the segments of a flow coalesced into one packet that exceeds the MTU.
+//
+// The IP and TCP headers, including options and IPv6 extension headers, are copied into every segment.
+// The sequence number advances with the payload of each segment, PSH and FIN are only kept on the last segment
+// and CWR only on the first. IPv4 segments take consecutive identifications.
+// Returns false if the packet is not a TCP packet with payload or its headers leave no room for payload in the MTU.
+func segmentTcp(packet []byte, mtu int) ([][]byte, bool) {
+	if len(packet) == 0 || len(packet) != ipPacketLength(packet) {
+		return nil, false
+	}
+	srcIP, dstIP, protocol, transport, ok := splitPacket(packet)
+	if !ok || protocol != layers.IPProtocolTCP || len(transport) < 20 {
+		return nil, false
+	}
+	ipv4 := packet[0]>>4 == 4
+	if ipv4 && binary.BigEndian.Uint16(packet[6:8])&(ipv4FlagMoreFragments|ipv4FragmentOffset) != 0 {
+		return nil, false
+	}
+	ipHeaderLen := len(packet) - len(transport)
+	tcpHeaderLen := int(transport[12]>>4) * 4
+	if tcpHeaderLen < 20 || len(transport) <= tcpHeaderLen {
+		return nil, false
+	}
+	headerLen := ipHeaderLen + tcpHeaderLen
+	maxPayloadLen := mtu - headerLen
+	if maxPayloadLen <= 0 {
+		return nil, false
+	}
+
+	payload := transport[tcpHeaderLen:]
+	seq := binary.BigEndian.Uint32(transport[4:8])
+	id := binary.BigEndian.Uint16(packet[4:6])
+
+	segments := make([][]byte, 0, (len(payload)+maxPayloadLen-1)/maxPayloadLen)
+	for start := 0; start < len(payload); start += maxPayloadLen {
+		end := min(start+maxPayloadLen, len(payload))
+
+		segment := make([]byte, headerLen+end-start)
+		copy(segment, packet[:headerLen])
+		copy(segment[headerLen:], payload[start:end])
+
+		if ipv4 {
+			binary.BigEndian.PutUint16(segment[2:4], uint16(len(segment)))
+			binary.BigEndian.PutUint16(segment[4:6], id+uint16(len(segments)))
+			binary.BigEndian.PutUint16(segment[10:12], 0)
+			binary.BigEndian.PutUint16(segment[10:12], ipv4HeaderChecksum(segment[:int(segment[0]&0x0f)*4]))
+		} else {
+			binary.BigEndian.PutUint16(segment[4:6], uint16(len(segment)-40))
+		}
+
+		tcp := segment[ipHeaderLen:]
+		binary.BigEndian.PutUint32(tcp[4:8], seq+uint32(start))
+		if 0 < start {
+			tcp[13] &^= tcpFlagCwr
+		}
+		if end < len(payload) {
+			tcp[13] &^= tcpFlagPsh | tcpFlagFin
+		}
+		binary.BigEndian.PutUint16(tcp[16:18], 0)
+		binary.BigEndian.PutUint16(tcp[16:18], transportChecksum(srcIP, dstIP, protocol, tcp))
+
+		segments = append(segments, segment)
+	}
+	return segments, true
+}
+
+// transportChecksum computes the checksum of a TCP or UDP segment over the pseudo header (RFC 9293, RFC 8200).
+// The checksum field must be zero.
+func transportChecksum(srcIP []byte, dstIP []byte, protocol layers.IPProtocol, transport []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(srcIP)
+	add(dstIP)
+	sum += uint32(protocol) + uint32(len(transport))>>16 + uint32(len(transport))&0xffff
+	add(transport)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,539 @@
+package tun
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// DefaultTcpIdleTimeout is the idle timeout of established TCP mappings (RFC 5382 REQ-5).
+	DefaultTcpIdleTimeout = 2*time.Hour + 4*time.Minute
+	// DefaultTcpClosingTimeout is the idle timeout of TCP mappings after a RST or a FIN in both directions,
+	// long enough for the last ACK and retransmissions.
+	DefaultTcpClosingTimeout = 10 * time.Second
+	// DefaultUdpIdleTimeout is the idle timeout of UDP mappings (RFC 4787 REQ-5).
+	DefaultUdpIdleTimeout = 5 * time.Minute
+	// DefaultIcmpIdleTimeout is the idle timeout of ICMP echo mappings (RFC 5508 REQ-1).
+	DefaultIcmpIdleTimeout = 60 * time.Second
+	// DefaultNatSweepInterval is how often idle NAT entries are removed.
+	DefaultNatSweepInterval = 30 * time.Second
+
+	// DefaultNatPortRangeStart and DefaultNatPortRangeEnd are the public ports allocated by the NAT.
+	DefaultNatPortRangeStart = 1024
+	DefaultNatPortRangeEnd   = 65535
+
+	// number of entries checked per critical section when sweeping the NAT table, see rangeNatTable
+	natSweepBatchSize = 1024
+)
+
+// NatPortPolicy specifies how the public port (or ICMP echo identifier) of a new NAT mapping is allocated
+// from the port range.
+type NatPortPolicy int
+
+const (
+	// NatPortSequential allocates the ports round robin, so that a released port is not reused immediately.
+	NatPortSequential NatPortPolicy = iota
+	// NatPortRandom allocates a random free port, which makes the mappings harder to guess.
+	NatPortRandom
+	// NatPortPreserve allocates the source port of the client if it is in the range and free on the public IP,
+	// which suits protocols that expect the port to be kept (e.g. STUN and some games),
+	// and falls back to NatPortSequential otherwise. See NATEntry.PortPreserved.
+	NatPortPreserve
+)
+
+var (
+	errNatPortsExhausted = errors.New("no free NAT port")
+	errNoPublicIP        = errors.New("no public IP address set for the address family of the client")
+)
+
+// natMapping is the local side of a flow, used to find its NAT entry for outbound packets.
+type natMapping struct {
+	IP       string
+	Port     int
+	Protocol layers.IPProtocol
+}
+
+// tcpState is the TCP connection state of a NAT entry, as the flags seen in each direction.
+type tcpState uint8
+
+const (
+	tcpFinOutbound tcpState = 1 << iota
+	tcpFinInbound
+	tcpRst
+)
+
+// update returns the state after a packet with the flags of tcp.
+// A SYN starts a new connection on the entry, e.g. when a client reuses its port.
+func (state tcpState) update(tcp *layers.TCP, outbound bool) tcpState {
+	if tcp.SYN {
+		state = 0
+	}
+	if tcp.FIN {
+		if outbound {
+			state |= tcpFinOutbound
+		} else {
+			state |= tcpFinInbound
+		}
+	}
+	if tcp.RST {
+		state |= tcpRst
+	}
+	return state
+}
+
+// closing returns true once the connection was reset or both sides sent a FIN.
+func (state tcpState) closing() bool {
+	return state&tcpRst != 0 || state&(tcpFinOutbound|tcpFinInbound) == tcpFinOutbound|tcpFinInbound
+}
+
+// NatIdleTimeouts are the idle timeouts of NAT entries by protocol.
+type NatIdleTimeouts struct {
+	// established TCP connections
+	Tcp time.Duration
+	// TCP connections after a RST or a FIN in both directions
+	TcpClosing time.Duration
+	Udp        time.Duration
+	// ICMP and ICMPv6 echo
+	Icmp time.Duration
+}
+
+func (timeouts NatIdleTimeouts) validate() error {
+	if timeouts.Tcp <= 0 || timeouts.TcpClosing <= 0 || timeouts.Udp <= 0 || timeouts.Icmp <= 0 {
+		return errors.New("NAT idle timeouts must be positive")
+	}
+	return nil
+}
+
+// NatStats are counters of the NAT table.
+type NatStats struct {
+	// number of entries in the NAT table
+	Entries int
+	// number of entries created
+	Created uint64
+	// number of packets received from the NAT without a matching entry
+	LookupMisses uint64
+	// number of entries removed because they were idle for longer than their timeout
+	IdleEvictions uint64
+	// number of TCP entries removed after the connection was closed (FIN in both directions or RST)
+	// and the closing timeout expired
+	ClosedEvictions uint64
+	// number of packets received from the NAT that were dropped because the receive queue was full
+	ReceiveQueueDrops uint64
+	// number of packets sent by clients that were dropped by their rate limit, see ClientRateLimitDrops
+	RateLimitDrops uint64
+	// number of keepalives sent for idle flows, see UserspaceTunSettings.NatKeepaliveInterval
+	Keepalives uint64
+}
+
+// NatStats returns the current counters of the NAT table.
+func (tun *UserspaceTun) NatStats() NatStats {
+	tun.natTableMu.Lock()
+	stats := tun.natStats
+	stats.Entries = len(tun.natTable)
+	stats.ReceiveQueueDrops = tun.drops.receiveQueueFull.Load()
+	tun.natTableMu.Unlock()
+
+	tun.rateLimitMu.Lock()
+	stats.RateLimitDrops = tun.rateLimitDrops
+	tun.rateLimitMu.Unlock()
+	return stats
+}
+
+// NATEntry is a snapshot of an entry of the NAT table.
+type NATEntry struct {
+	PublicIP   string
+	PublicPort int
+	Protocol   layers.IPProtocol
+	ClientIP   net.IP
+	ClientPort int
+
+	Created      time.Time
+	LastActivity time.Time
+	FlowId       uint64
+
+	OutboundPackets uint64
+	OutboundBytes   uint64
+	InboundPackets  uint64
+	InboundBytes    uint64
+
+	// the public port is the source port of the client, see NatPortPreserve
+	PortPreserved bool
+}
+
+func (e NATEntry) String() string {
+	preserved := ""
+	if e.PortPreserved {
+		preserved = ", port preserved"
+	}
+	return fmt.Sprintf(
+		"%s %s -> %s (created %s, last activity %s, out %d packets %d bytes, in %d packets %d bytes%s)",
+		e.Protocol,
+		net.JoinHostPort(e.ClientIP.String(), fmt.Sprint(e.ClientPort)),
+		net.JoinHostPort(e.PublicIP, fmt.Sprint(e.PublicPort)),
+		e.Created.Format(time.RFC3339),
+		e.LastActivity.Format(time.RFC3339),
+		e.OutboundPackets,
+		e.OutboundBytes,
+		e.InboundPackets,
+		e.InboundBytes,
+		preserved,
+	)
+}
+
+// NATEntries returns a snapshot of the NAT table, ordered by protocol and public address.
+func (tun *UserspaceTun) NATEntries() []NATEntry {
+	tun.natTableMu.Lock()
+	entries := make([]NATEntry, 0, len(tun.natTable))
+	for natKey, value := range tun.natTable {
+		entries = append(entries, NATEntry{
+			PublicIP:        natKey.IP,
+			PublicPort:      natKey.Port,
+			Protocol:        natKey.Protocol,
+			ClientIP:        value.IP,
+			ClientPort:      value.Port,
+			Created:         value.Created,
+			LastActivity:    value.LastActivity,
+			FlowId:          value.FlowId,
+			OutboundPackets: value.OutboundPackets,
+			OutboundBytes:   value.OutboundBytes,
+			InboundPackets:  value.InboundPackets,
+			InboundBytes:    value.InboundBytes,
+			PortPreserved:   value.PortPreserved,
+		})
+	}
+	tun.natTableMu.Unlock()
+
+	// NOTE: sort outside of the lock
+	slices.SortFunc(entries, func(a NATEntry, b NATEntry) int {
+		return cmp.Or(
+			cmp.Compare(a.Protocol, b.Protocol),
+			strings.Compare(a.PublicIP, b.PublicIP),
+			cmp.Compare(a.PublicPort, b.PublicPort),
+		)
+	})
+	return entries
+}
+
+// natUpdateOutbound finds or adds the NAT entry of a packet sent through the NAT and refreshes it.
+// The returned key has the public IP and port of the flow, and publicIP is the public IP to set as the source.
+// packets is the number of packets of the flow in both directions, including this packet.
+// New flows use the public IP of the client, see PublicIPSelector.
+// tcp is the TCP layer of the packet, if any, which is used to track the connection state.
+// size is the size of the packet in bytes.
+//
+// Returns errNoPublicIP if the pool of the family of the client is empty,
+// and errNatPortsExhausted if the flow is new and all ports of the range are in use.
+func (tun *UserspaceTun) natUpdateOutbound(protocol layers.IPProtocol, localSrc NATValue, tcp *layers.TCP, size int) (natKey NATKey, publicIP net.IP, packets uint64, err error) {
+	tun.natTableMu.Lock()
+	defer tun.natTableMu.Unlock()
+
+	pool := tun.publicIPPool(localSrc.IP)
+	if len(pool.ips) == 0 {
+		return NATKey{}, nil, 0, errNoPublicIP
+	}
+	clientKey := localSrc.IP.String()
+	mapping := natMapping{
+		IP:       clientKey,
+		Port:     localSrc.Port,
+		Protocol: protocol,
+	}
+	now := time.Now()
+	value := localSrc
+	// an existing flow keeps its public IP while it is in the pool
+	i := -1
+	existingKey, found := tun.natMappings[mapping]
+	if found {
+		i = pool.index(existingKey.IP)
+	}
+	if 0 <= i {
+		natKey = existingKey
+		value = tun.natTable[natKey]
+	} else {
+		i = tun.selectPublicIP(pool, clientKey, localSrc.IP)
+		natKey = NATKey{
+			IP:       pool.keys[i],
+			Protocol: protocol,
+		}
+		port, preserved, err := tun.allocateNatPort(natKey, localSrc.Port)
+		if err != nil {
+			return NATKey{}, nil, 0, err
+		}
+		natKey.Port = port
+		value.PortPreserved = preserved
+		tun.natMappings[mapping] = natKey
+		tun.natAddPublicIPEntry(clientKey, natKey.IP)
+		value.IP = normalizeIP(localSrc.IP)
+		value.Created = now
+		tun.natFlowIds += 1
+		value.FlowId = tun.natFlowIds
+		tun.natStats.Created += 1
+	}
+	if localSrc.dnsOriginalDst != nil {
+		value.dnsOriginalDst = localSrc.dnsOriginalDst
+	}
+	if localSrc.keepalive.dstIP != nil {
+		value.keepalive = localSrc.keepalive
+		value.keepalive.outbound = now
+	}
+	value.LastActivity = now
+	value.restored = false
+	value.OutboundPackets += 1
+	value.OutboundBytes += uint64(size)
+	if tcp != nil {
+		value.tcpState = value.tcpState.update(tcp, true)
+	}
+	tun.natTable[natKey] = value
+	return natKey, pool.ips[i], value.OutboundPackets + value.InboundPackets, nil
+}
+
+// allocateNatPort returns a free public port for the IP and protocol of natKey, by the NatPortPolicy,
+// and whether the port is clientPort. natTableMu must be held.
+func (tun *UserspaceTun) allocateNatPort(natKey NATKey, clientPort int) (int, bool, error) {
+	start := tun.settings.NatPortRangeStart
+	size := tun.settings.NatPortRangeEnd - start + 1
+	next := tun.natNextPort
+	switch tun.settings.NatPortPolicy {
+	case NatPortPreserve:
+		if start <= clientPort && clientPort <= tun.settings.NatPortRangeEnd {
+			natKey.Port = clientPort
+			if _, used := tun.natTable[natKey]; !used {
+				return clientPort, true, nil
+			}
+		}
+	case NatPortRandom:
+		next = start + rand.IntN(size)
+	}
+	for i := 0; i < size; i += 1 {
+		natKey.Port = start + (next-start+i)%size
+		if _, used := tun.natTable[natKey]; !used {
+			tun.natNextPort = natKey.Port + 1
+			return natKey.Port, natKey.Port == clientPort, nil
+		}
+	}
+	return 0, false, errNatPortsExhausted
+}
+
+// natLookupInbound finds the NAT entry of a packet received from the NAT and refreshes it.
+// tcp is the TCP layer of the packet, if any, which is used to track the connection state.
+// size is the size of the packet in bytes.
+func (tun *UserspaceTun) natLookupInbound(natKey NATKey, tcp *layers.TCP, size int) (NATValue, bool) {
+	tun.natTableMu.Lock()
+	defer tun.natTableMu.Unlock()
+
+	value, found := tun.natTable[natKey]
+	if !found {
+		tun.natStats.LookupMisses += 1
+		return NATValue{}, false
+	}
+	value.LastActivity = time.Now()
+	value.restored = false
+	value.InboundPackets += 1
+	value.InboundBytes += uint64(size)
+	if tcp != nil {
+		value.tcpState = value.tcpState.update(tcp, false)
+	}
+	tun.natTable[natKey] = value
+	return value, true
+}
+
+// natRemove removes an entry and releases its port. natTableMu must be held.
+func (tun *UserspaceTun) natRemove(natKey NATKey) {
+	value, found := tun.natTable[natKey]
+	if !found {
+		return
+	}
+	delete(tun.natTable, natKey)
+	tun.natAccountExpired(value)
+	mapping := natMapping{
+		IP:       value.IP.String(),
+		Port:     value.Port,
+		Protocol: natKey.Protocol,
+	}
+	if tun.natMappings[mapping] == natKey {
+		delete(tun.natMappings, mapping)
+	}
+	tun.natRemovePublicIPEntry(mapping.IP, natKey.IP)
+}
+
+// SetNatIdleTimeouts changes the idle timeouts of NAT entries.
+// Existing entries are expired with the new timeouts from the next sweep.
+//
+// Returns an error if a timeout is not positive.
+func (tun *UserspaceTun) SetNatIdleTimeouts(timeouts NatIdleTimeouts) error {
+	if err := timeouts.validate(); err != nil {
+		return err
+	}
+	tun.natTableMu.Lock()
+	defer tun.natTableMu.Unlock()
+	tun.natIdleTimeouts = timeouts
+	return nil
+}
+
+// NatIdleTimeouts returns the current idle timeouts of NAT entries.
+func (tun *UserspaceTun) NatIdleTimeouts() NatIdleTimeouts {
+	tun.natTableMu.Lock()
+	defer tun.natTableMu.Unlock()
+	return tun.natIdleTimeouts
+}
+
+// natIdleTimeout returns the idle timeout of an entry by its protocol and, for TCP, its connection state
+// (which is unknown for the entries loaded by LoadNatState).
+// natTableMu must be held.
+func (tun *UserspaceTun) natIdleTimeout(natKey NATKey, value NATValue) time.Duration {
+	switch natKey.Protocol {
+	case layers.IPProtocolTCP:
+		if value.tcpState.closing() {
+			return tun.natIdleTimeouts.TcpClosing
+		}
+		if value.restored {
+			return min(natRestoredTcpIdleTimeout, tun.natIdleTimeouts.Tcp)
+		}
+		return tun.natIdleTimeouts.Tcp
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		return tun.natIdleTimeouts.Icmp
+	default:
+		return tun.natIdleTimeouts.Udp
+	}
+}
+
+// runNatSweeper removes idle NAT entries, the fragments of expired datagrams and the rate limit state of clients without entries,
+// and sends the keepalives of idle flows, every NatSweepInterval until ctx is done.
+func (tun *UserspaceTun) runNatSweeper(ctx context.Context) {
+	ticker := time.NewTicker(tun.settings.NatSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			tun.sweepNatTable(now)
+			tun.sendNatKeepalives(now)
+			tun.sweepFragments(now)
+			tun.sweepRateLimiters()
+		}
+	}
+}
+
+// sweepNatTable removes NAT entries that have been idle for longer than their timeout at now.
+func (tun *UserspaceTun) sweepNatTable(now time.Time) {
+	tun.rangeNatTable(func(natKey NATKey, value NATValue) {
+		if tun.natIdleTimeout(natKey, value) <= now.Sub(value.LastActivity) {
+			tun.natRemove(natKey)
+			if value.tcpState.closing() {
+				tun.natStats.ClosedEvictions += 1
+			} else {
+				tun.natStats.IdleEvictions += 1
+			}
+		}
+	})
+}
+
+// rangeNatTable calls f for each entry of the NAT table, in batches of natSweepBatchSize entries
+// so that natTableMu is only held for short periods. f is called with natTableMu held and may update or remove the entry.
+// As with a range over a map, entries added by others between batches may not be visited.
+func (tun *UserspaceTun) rangeNatTable(f func(natKey NATKey, value NATValue)) {
+	// the iterator resumes the range over the table at the next batch
+	next, stop := iter.Pull2(maps.All(tun.natTable))
+	defer stop()
+	for {
+		tun.natTableMu.Lock()
+		for i := 0; i < natSweepBatchSize; i += 1 {
+			natKey, value, ok := next()
+			if !ok {
+				tun.natTableMu.Unlock()
+				return
+			}
+			f(natKey, value)
+		}
+		tun.natTableMu.Unlock()
+	}
+}
+
+const (
+	// DefaultNatMissLogLimit is how many NAT lookup misses are logged per destination port per minute.
+	DefaultNatMissLogLimit = 3
+	// natMissWindow is the period over which the NAT lookup misses logged per destination port are limited.
+	natMissWindow = time.Minute
+)
+
+// natMissLog limits the NAT lookup misses that are logged, see dropNatMiss.
+type natMissLog struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	ports       map[int]int // misses logged by destination port in the window
+	dumps       int         // misses logged with a dump of the packet
+}
+
+// dropNatMiss drops a packet received from the NAT without a NAT entry, usually an unsolicited packet
+// such as a scan of the public IP. The first NatMissLogLimit misses per destination port per minute are logged,
+// and the first NatMissDumpLimit misses are logged with a dump of the packet to diagnose mapping bugs.
+func (tun *UserspaceTun) dropNatMiss(natKey NATKey, packet []byte) {
+	n := tun.drops.noNatEntry.Add(1)
+	logged, dump := tun.sampleNatMiss(natKey.Port, time.Now())
+	endpoint := net.JoinHostPort(natKey.IP, fmt.Sprint(natKey.Port))
+	switch {
+	case dump:
+		layerType := layers.LayerTypeIPv4
+		if packet[0]>>4 == 6 {
+			layerType = layers.LayerTypeIPv6
+		}
+		tun.log.Verbosef(
+			"NatReceive: no NAT entry found for %s (%d dropped), dump of the packet:\n%s",
+			endpoint,
+			n,
+			gopacket.NewPacket(packet, layerType, gopacket.Default),
+		)
+	case logged:
+		tun.log.Verbosef("NatReceive: no NAT entry found for %s (%d dropped)", endpoint, n)
+	}
+}
+
+// sampleNatMiss returns whether a NAT lookup miss for a destination port at now is logged, and whether with a dump.
+func (tun *UserspaceTun) sampleNatMiss(port int, now time.Time) (logged bool, dump bool) {
+	tun.natMisses.mu.Lock()
+	defer tun.natMisses.mu.Unlock()
+	if tun.natMisses.dumps < tun.settings.NatMissDumpLimit {
+		tun.natMisses.dumps += 1
+		return true, true
+	}
+	if natMissWindow <= now.Sub(tun.natMisses.windowStart) {
+		tun.natMisses.windowStart = now
+		clear(tun.natMisses.ports)
+	}
+	if tun.settings.NatMissLogLimit <= tun.natMisses.ports[port] {
+		return false, false
+	}
+	tun.natMisses.ports[port] += 1
+	return true, false
+}
+
+// logFlow logs a packet of a NAT flow if it is sampled: the first packet of the flow
+// and every FlowLogSampleRate-th packet after it. packets is the number of packets of the flow in both directions,
+// including this packet, and client is the client side of the flow.
+func (tun *UserspaceTun) logFlow(direction string, natKey NATKey, client NATValue, packets uint64) {
+	rate := uint64(tun.settings.FlowLogSampleRate)
+	if rate == 0 || (packets != 1 && packets%rate != 0) {
+		return
+	}
+	tun.log.Verbosef(
+		"NAT: %s packet %d of %s flow %s -> %s",
+		direction,
+		packets,
+		natKey.Protocol,
+		net.JoinHostPort(client.IP.String(), fmt.Sprint(client.Port)),
+		net.JoinHostPort(natKey.IP, fmt.Sprint(natKey.Port)),
+	)
+}
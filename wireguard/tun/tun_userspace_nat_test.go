@@ -0,0 +1,584 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/userwireguard/logger"
+)
+
+// tcpPacket serializes an IPv4 TCP packet with the given flags set.
+func tcpPacket(t testing.TB, srcIP net.IP, srcPort int, dstIP net.IP, dstPort int, setFlags func(tcp *layers.TCP)) []byte {
+	t.Helper()
+	ipv4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Window:  65535,
+	}
+	setFlags(tcp)
+	tcp.SetNetworkLayerForChecksum(ipv4)
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ipv4, tcp); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestUserspaceTunNatIdleExpiry(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.TcpIdleTimeout = time.Hour
+	settings.UdpIdleTimeout = time.Minute
+	tun, nat := newTestTun(t, settings)
+
+	udp := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)
+	tcp := tcpPacket(t, testLocalIPv4, 40001, testRemoteIPv4, 443, func(tcp *layers.TCP) { tcp.SYN = true })
+	if _, err := tun.Write([][]byte{udp, tcp}, 0); err != nil {
+		t.Fatalf("failed to write packets: %v", err)
+	}
+	if stats := tun.NatStats(); stats.Entries != 2 {
+		t.Fatalf("expected 2 NAT entries, got %d", stats.Entries)
+	}
+
+	// nothing is idle yet
+	tun.sweepNatTable(time.Now())
+	if stats := tun.NatStats(); stats.Entries != 2 || stats.IdleEvictions != 0 {
+		t.Fatalf("expected no evictions, got %+v", stats)
+	}
+
+	// the UDP entry expires before the TCP entry
+	tun.sweepNatTable(time.Now().Add(2 * time.Minute))
+	if stats := tun.NatStats(); stats.Entries != 1 || stats.IdleEvictions != 1 {
+		t.Fatalf("expected the UDP entry to be evicted, got %+v", stats)
+	}
+	if _, found := tun.natTable[NATKey{IP: testPublicIPv4.String(), Port: sentPort(nat.sent[1]), Protocol: layers.IPProtocolTCP}]; !found {
+		t.Fatalf("expected the TCP entry to remain")
+	}
+
+	tun.sweepNatTable(time.Now().Add(2 * time.Hour))
+	if stats := tun.NatStats(); stats.Entries != 0 || stats.IdleEvictions != 2 {
+		t.Fatalf("expected the TCP entry to be evicted, got %+v", stats)
+	}
+}
+
+func TestUserspaceTunNatSweepBatches(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.UdpIdleTimeout = time.Minute
+	tun, _ := newTestTun(t, settings)
+
+	flows := 3*natSweepBatchSize + 1
+	for i := 0; i < flows; i += 1 {
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 10000+i, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+
+	// the table is used between the batches of the sweep
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		packet := udpPacket(t, testLocalIPv4, 50000, testRemoteIPv4, 53, 10, false)
+		for i := 0; i < 100; i += 1 {
+			tun.Write([][]byte{packet}, 0)
+		}
+	}()
+	tun.sweepNatTable(time.Now().Add(2 * time.Minute))
+	<-done
+
+	// every idle entry is visited, whatever the batch
+	if stats := tun.NatStats(); stats.IdleEvictions < uint64(flows) || 1 < stats.Entries {
+		t.Fatalf("expected the %d idle entries to be evicted, got %+v", flows, stats)
+	}
+}
+
+func TestUserspaceTunNatProtocolTimeouts(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.TcpIdleTimeout = time.Hour
+	settings.UdpIdleTimeout = 30 * time.Second
+	settings.IcmpIdleTimeout = 5 * time.Second
+	tun, _ := newTestTun(t, settings)
+
+	packets := [][]byte{
+		tcpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 443, func(tcp *layers.TCP) { tcp.SYN = true }),
+		udpPacket(t, testLocalIPv4, 40001, testRemoteIPv4, 53, 10, false),
+		icmpEchoPacket(t, testLocalIPv4, testRemoteIPv4, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), 1234),
+	}
+	if _, err := tun.Write(packets, 0); err != nil {
+		t.Fatalf("failed to write packets: %v", err)
+	}
+	protocols := func() []layers.IPProtocol {
+		tun.natTableMu.Lock()
+		defer tun.natTableMu.Unlock()
+		protocols := []layers.IPProtocol{}
+		for natKey := range tun.natTable {
+			protocols = append(protocols, natKey.Protocol)
+		}
+		slices.Sort(protocols)
+		return protocols
+	}
+
+	now := time.Now()
+	for _, tt := range []struct {
+		idle      time.Duration
+		protocols []layers.IPProtocol
+	}{
+		{4 * time.Second, []layers.IPProtocol{layers.IPProtocolICMPv4, layers.IPProtocolTCP, layers.IPProtocolUDP}},
+		{5 * time.Second, []layers.IPProtocol{layers.IPProtocolTCP, layers.IPProtocolUDP}},
+		{30 * time.Second, []layers.IPProtocol{layers.IPProtocolTCP}},
+	} {
+		tun.sweepNatTable(now.Add(tt.idle))
+		if got := protocols(); !slices.Equal(got, tt.protocols) {
+			t.Fatalf("expected entries %v after %v, got %v", tt.protocols, tt.idle, got)
+		}
+	}
+
+	// existing entries expire with the changed timeouts
+	timeouts := tun.NatIdleTimeouts()
+	timeouts.Tcp = time.Minute
+	if err := tun.SetNatIdleTimeouts(timeouts); err != nil {
+		t.Fatalf("failed to set timeouts: %v", err)
+	}
+	tun.sweepNatTable(now.Add(time.Minute))
+	if stats := tun.NatStats(); stats.Entries != 0 || stats.IdleEvictions != 3 {
+		t.Fatalf("expected all entries to be evicted, got %+v", stats)
+	}
+
+	timeouts.Icmp = 0
+	if err := tun.SetNatIdleTimeouts(timeouts); err == nil {
+		t.Fatalf("expected an error for a zero timeout")
+	}
+}
+
+func TestUserspaceTunNatSweeper(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.UdpIdleTimeout = 20 * time.Millisecond
+	settings.NatSweepInterval = 5 * time.Millisecond
+	tun, _ := newTestTun(t, settings)
+
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for tun.NatStats().Entries != 0 {
+		if deadline.Before(time.Now()) {
+			t.Fatalf("timed out waiting for the NAT entry to expire")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := tun.NatStats(); stats.IdleEvictions != 1 {
+		t.Fatalf("expected 1 idle eviction, got %+v", stats)
+	}
+
+	// Close stops the sweeper
+	tun.Close()
+}
+
+func TestUserspaceTunNatActivityRefresh(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	tun, nat := newTestTun(t, settings)
+
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	publicPort := sentPort(nat.sent[0])
+	natKey := NATKey{IP: testPublicIPv4.String(), Port: publicPort, Protocol: layers.IPProtocolUDP}
+	tun.natTableMu.Lock()
+	entry := tun.natTable[natKey]
+	entry.LastActivity = time.Now().Add(-settings.UdpIdleTimeout + time.Second)
+	tun.natTable[natKey] = entry
+	tun.natTableMu.Unlock()
+
+	// an inbound packet refreshes the entry
+	go nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, 10, false))
+	if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	tun.sweepNatTable(time.Now().Add(time.Second))
+	if stats := tun.NatStats(); stats.Entries != 1 {
+		t.Fatalf("expected the refreshed entry to remain, got %+v", stats)
+	}
+}
+
+func TestUserspaceTunNatTcpClose(t *testing.T) {
+	tests := []struct {
+		name     string
+		outbound []func(tcp *layers.TCP)
+		inbound  []func(tcp *layers.TCP)
+	}{
+		{
+			name:     "FIN in both directions",
+			outbound: []func(tcp *layers.TCP){func(tcp *layers.TCP) { tcp.SYN = true }, func(tcp *layers.TCP) { tcp.FIN, tcp.ACK = true, true }},
+			inbound:  []func(tcp *layers.TCP){func(tcp *layers.TCP) { tcp.FIN, tcp.ACK = true, true }},
+		},
+		{
+			name:     "outbound RST",
+			outbound: []func(tcp *layers.TCP){func(tcp *layers.TCP) { tcp.SYN = true }, func(tcp *layers.TCP) { tcp.RST = true }},
+		},
+		{
+			name:     "inbound RST",
+			outbound: []func(tcp *layers.TCP){func(tcp *layers.TCP) { tcp.SYN = true }},
+			inbound:  []func(tcp *layers.TCP){func(tcp *layers.TCP) { tcp.RST = true }},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+
+			for _, setFlags := range tt.outbound {
+				if _, err := tun.Write([][]byte{tcpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 443, setFlags)}, 0); err != nil {
+					t.Fatalf("failed to write packet: %v", err)
+				}
+			}
+			for _, setFlags := range tt.inbound {
+				go nat.receive(tcpPacket(t, testRemoteIPv4, 443, testPublicIPv4, sentPort(nat.sent[0]), setFlags))
+				// the closing packet is still delivered
+				if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+					t.Fatalf("failed to read packet: %v", err)
+				}
+			}
+
+			// the entry is kept for the last ACK and retransmissions, then expires on the closing timeout
+			now := time.Now()
+			tun.sweepNatTable(now)
+			if stats := tun.NatStats(); stats.Entries != 1 || stats.ClosedEvictions != 0 {
+				t.Fatalf("expected the closed connection to be kept until the closing timeout, got %+v", stats)
+			}
+			tun.sweepNatTable(now.Add(DefaultTcpClosingTimeout))
+			if stats := tun.NatStats(); stats.Entries != 0 || stats.ClosedEvictions != 1 || stats.IdleEvictions != 0 {
+				t.Fatalf("expected the closed connection to be evicted, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestUserspaceTunNatTcpHandshakeTeardown(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.TcpClosingTimeout = time.Minute
+	tun, nat := newTestTun(t, settings)
+
+	write := func(setFlags func(tcp *layers.TCP)) {
+		t.Helper()
+		if _, err := tun.Write([][]byte{tcpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 443, setFlags)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	receive := func(setFlags func(tcp *layers.TCP)) {
+		t.Helper()
+		go nat.receive(tcpPacket(t, testRemoteIPv4, 443, testPublicIPv4, sentPort(nat.sent[0]), setFlags))
+		if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+			t.Fatalf("failed to read packet: %v", err)
+		}
+	}
+	closing := func() bool {
+		t.Helper()
+		tun.natTableMu.Lock()
+		defer tun.natTableMu.Unlock()
+		if len(tun.natTable) != 1 {
+			t.Fatalf("expected 1 NAT entry, got %d", len(tun.natTable))
+		}
+		for _, value := range tun.natTable {
+			return value.tcpState.closing()
+		}
+		return false
+	}
+
+	// handshake and a half close, the connection is established
+	write(func(tcp *layers.TCP) { tcp.SYN = true })
+	receive(func(tcp *layers.TCP) { tcp.SYN, tcp.ACK = true, true })
+	write(func(tcp *layers.TCP) { tcp.ACK = true })
+	write(func(tcp *layers.TCP) { tcp.FIN, tcp.ACK = true, true })
+	receive(func(tcp *layers.TCP) { tcp.ACK = true })
+	if closing() {
+		t.Fatalf("expected a half closed connection to use the idle timeout")
+	}
+	now := time.Now()
+	tun.sweepNatTable(now.Add(settings.TcpClosingTimeout))
+	if stats := tun.NatStats(); stats.Entries != 1 {
+		t.Fatalf("expected the established connection to remain, got %+v", stats)
+	}
+
+	// a RST closes the connection
+	receive(func(tcp *layers.TCP) { tcp.RST = true })
+	if !closing() {
+		t.Fatalf("expected the connection to be closing after a RST")
+	}
+
+	// a SYN on the same port opens a new connection
+	write(func(tcp *layers.TCP) { tcp.SYN = true })
+	if closing() {
+		t.Fatalf("expected a SYN to reopen the connection")
+	}
+
+	// the closing timeout applies from the last packet after the RST
+	receive(func(tcp *layers.TCP) { tcp.RST = true })
+	now = time.Now()
+	tun.sweepNatTable(now.Add(settings.TcpClosingTimeout - time.Second))
+	if stats := tun.NatStats(); stats.Entries != 1 {
+		t.Fatalf("expected the entry to remain before the closing timeout, got %+v", stats)
+	}
+	tun.sweepNatTable(now.Add(settings.TcpClosingTimeout))
+	if stats := tun.NatStats(); stats.Entries != 0 || stats.ClosedEvictions != 1 || stats.IdleEvictions != 0 {
+		t.Fatalf("expected the entry to expire on the closing timeout, got %+v", stats)
+	}
+}
+
+func TestUserspaceTunNapt(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+	otherLocalIPv4 := net.ParseIP("192.168.90.3").To4()
+
+	// two clients use the same source port to the same destination
+	packets := [][]byte{
+		udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false),
+		udpPacket(t, otherLocalIPv4, 40000, testRemoteIPv4, 53, 10, false),
+	}
+	if n, err := tun.Write(packets, 0); err != nil || n != 2 {
+		t.Fatalf("expected 2 packets written, got %d: %v", n, err)
+	}
+	firstPort := sentPort(nat.sent[0])
+	secondPort := sentPort(nat.sent[1])
+	if firstPort == secondPort {
+		t.Fatalf("expected different public ports, got %d for both flows", firstPort)
+	}
+
+	// packets of an existing flow keep their public port
+	if _, err := tun.Write([][]byte{packets[0]}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if port := sentPort(nat.sent[2]); port != firstPort {
+		t.Fatalf("expected public port %d to be reused, got %d", firstPort, port)
+	}
+
+	// replies are delivered to the client that owns the public port
+	for _, tt := range []struct {
+		publicPort int
+		localIP    net.IP
+	}{
+		{secondPort, otherLocalIPv4},
+		{firstPort, testLocalIPv4},
+	} {
+		go nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, tt.publicPort, 10, false))
+		received, err := readPacket(t, tun, DefaultMtu)
+		if err != nil {
+			t.Fatalf("failed to read packet: %v", err)
+		}
+		if dstIP := net.IP(received[16:20]); !dstIP.Equal(tt.localIP) {
+			t.Fatalf("expected reply to port %d for %v, got %v", tt.publicPort, tt.localIP, dstIP)
+		}
+		if dstPort := int(binary.BigEndian.Uint16(received[22:24])); dstPort != 40000 {
+			t.Fatalf("expected destination port 40000, got %d", dstPort)
+		}
+		if !udpChecksumValid(received) {
+			t.Fatalf("received UDP packet has an invalid checksum")
+		}
+	}
+}
+
+func TestUserspaceTunNatPortExhaustion(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.NatPortRangeStart = 2000
+	settings.NatPortRangeEnd = 2001
+	tun, nat := newTestTun(t, settings)
+
+	for port := 40000; port < 40002; port += 1 {
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, port, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	_, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40002, testRemoteIPv4, 53, 10, false)}, 0)
+	if !errors.Is(err, errNatPortsExhausted) {
+		t.Fatalf("expected %v, got %v", errNatPortsExhausted, err)
+	}
+	if len(nat.sent) != 2 {
+		t.Fatalf("expected 2 packets sent, got %d", len(nat.sent))
+	}
+
+	// ports are released when entries expire
+	tun.sweepNatTable(time.Now().Add(settings.UdpIdleTimeout))
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40002, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet after ports were released: %v", err)
+	}
+	if port := sentPort(nat.sent[2]); port < 2000 || 2001 < port {
+		t.Fatalf("expected port in [2000, 2001], got %d", port)
+	}
+}
+
+func TestUserspaceTunNATEntries(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+
+	packet := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)
+	if _, err := tun.Write([][]byte{packet}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	entries := tun.NATEntries()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 NAT entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.PublicIP != testPublicIPv4.String() || entry.PublicPort != sentPort(nat.sent[0]) || entry.Protocol != layers.IPProtocolUDP {
+		t.Fatalf("unexpected public side of entry: %s", entry)
+	}
+	if !entry.ClientIP.Equal(testLocalIPv4) || entry.ClientPort != 40000 {
+		t.Fatalf("unexpected client side of entry: %s", entry)
+	}
+	if entry.Created.IsZero() || entry.OutboundPackets != 1 || entry.OutboundBytes != uint64(len(packet)) || entry.InboundPackets != 0 {
+		t.Fatalf("unexpected counters of entry: %s", entry)
+	}
+
+	// a reply increments the inbound counters, a packet without entry is a miss
+	reply := udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, entry.PublicPort, 20, false)
+	nat.receive(reply)
+	nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, entry.PublicPort+1, 20, false))
+	if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	entry = tun.NATEntries()[0]
+	if entry.InboundPackets != 1 || entry.InboundBytes != uint64(len(reply)) {
+		t.Fatalf("expected inbound counters to be incremented: %s", entry)
+	}
+	if stats := tun.NatStats(); stats.Created != 1 || stats.LookupMisses != 1 {
+		t.Fatalf("expected 1 entry created and 1 lookup miss, got %+v", stats)
+	}
+}
+
+func TestUserspaceTunFlowLogSampled(t *testing.T) {
+	var flowPackets []uint64
+	var lines []string
+	log := &logger.Logger{
+		Verbosef: func(format string, args ...any) {
+			if strings.HasPrefix(format, "NAT:") {
+				flowPackets = append(flowPackets, args[1].(uint64))
+				lines = append(lines, fmt.Sprintf(format, args...))
+			}
+		},
+		Errorf: logger.DiscardLogf,
+	}
+	settings := DefaultUserspaceTunSettings()
+	settings.FlowLogSampleRate = 10
+	nat := &fakeNat{}
+	publicIPv4 := testPublicIPv4
+	tun := newUserspaceTun(log, &publicIPv4, nil, settings, nat, func() {})
+	t.Cleanup(func() { tun.Close() })
+
+	packet := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)
+	for i := 0; i < 100; i += 1 {
+		if _, err := tun.Write([][]byte{packet}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	// the first packet and 1 in 10 packets
+	if expected := []uint64{1, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100}; !slices.Equal(flowPackets, expected) {
+		t.Fatalf("expected packets %v of the flow to be logged, got %v", expected, flowPackets)
+	}
+	// the flow is logged by its NAT tuple, formatted with any logger
+	if expected := fmt.Sprintf("NAT: outbound packet 1 of UDP flow 192.168.90.2:40000 -> 203.0.113.1:%d", sentPort(nat.sent[0])); lines[0] != expected {
+		t.Fatalf("expected the log line %q, got %q", expected, lines[0])
+	}
+
+	// replies count towards the flow
+	nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, sentPort(nat.sent[0]), 10, false))
+	if len(flowPackets) != 11 {
+		t.Fatalf("expected packet 101 not to be logged, got %v", flowPackets)
+	}
+	for i := 0; i < 9; i += 1 {
+		nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, sentPort(nat.sent[0]), 10, false))
+	}
+	if flowPackets[len(flowPackets)-1] != 110 {
+		t.Fatalf("expected the reply of packet 110 to be logged, got %v", flowPackets)
+	}
+}
+
+func TestUserspaceTunNatPortPolicy(t *testing.T) {
+	t.Run("preserve", func(t *testing.T) {
+		settings := DefaultUserspaceTunSettings()
+		settings.NatPortPolicy = NatPortPreserve
+		tun, nat := newTestTun(t, settings)
+
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+		if port := sentPort(nat.sent[0]); port != 40000 {
+			t.Fatalf("expected the client port 40000 to be preserved, got %d", port)
+		}
+
+		// another client with the same port falls back to the allocator
+		otherIPv4 := net.ParseIP("192.168.90.3").To4()
+		if _, err := tun.Write([][]byte{udpPacket(t, otherIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+		if port := sentPort(nat.sent[1]); port == 40000 {
+			t.Fatalf("expected another port for the colliding client, got %d", port)
+		}
+
+		preserved := map[string]bool{}
+		for _, entry := range tun.NATEntries() {
+			preserved[entry.ClientIP.String()] = entry.PortPreserved
+		}
+		if !preserved[testLocalIPv4.String()] || preserved[otherIPv4.String()] {
+			t.Fatalf("expected only the first mapping to be preserved, got %v", preserved)
+		}
+	})
+
+	t.Run("preserve out of range", func(t *testing.T) {
+		settings := DefaultUserspaceTunSettings()
+		settings.NatPortPolicy = NatPortPreserve
+		settings.NatPortRangeStart = 2000
+		settings.NatPortRangeEnd = 2001
+		tun, nat := newTestTun(t, settings)
+
+		for port := 40000; port < 40002; port += 1 {
+			if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, port, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+			if port := sentPort(nat.sent[len(nat.sent)-1]); port < 2000 || 2001 < port {
+				t.Fatalf("expected port in [2000, 2001], got %d", port)
+			}
+		}
+		_, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 2000, testRemoteIPv4, 53, 10, false)}, 0)
+		if !errors.Is(err, errNatPortsExhausted) {
+			t.Fatalf("expected %v, got %v", errNatPortsExhausted, err)
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		settings := DefaultUserspaceTunSettings()
+		settings.NatPortPolicy = NatPortRandom
+		settings.NatPortRangeStart = 2000
+		settings.NatPortRangeEnd = 2003
+		tun, nat := newTestTun(t, settings)
+
+		ports := map[int]bool{}
+		for port := 40000; port < 40004; port += 1 {
+			if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, port, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+			ports[sentPort(nat.sent[len(nat.sent)-1])] = true
+		}
+		for port := 2000; port <= 2003; port += 1 {
+			if !ports[port] {
+				t.Fatalf("expected every port of the range to be allocated, got %v", ports)
+			}
+		}
+		_, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40004, testRemoteIPv4, 53, 10, false)}, 0)
+		if !errors.Is(err, errNatPortsExhausted) {
+			t.Fatalf("expected %v, got %v", errNatPortsExhausted, err)
+		}
+	})
+}
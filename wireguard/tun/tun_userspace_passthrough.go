@@ -0,0 +1,85 @@
+package tun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// NatMode specifies how the addresses of the packets of clients are translated.
+type NatMode int
+
+const (
+	// NatModeSource translates the source of the packets of clients to a public IP and port,
+	// and the destination of the replies back with the NAT table.
+	NatModeSource NatMode = iota
+	// NatModePassthrough forwards the packets unmodified except for the TTL (or hop limit),
+	// for clients with routable addresses or behind an upstream NAT. Replies are delivered to their destination.
+	// There is no NAT table, so DNS redirects do not apply and the public IPs are optional:
+	// they are only the source of the ICMP errors sent by the TUN.
+	NatModePassthrough
+)
+
+// processWritePassthrough forwards a packet sent by a client through the NAT without translation.
+// It returns the number of packets sent and an error if any.
+func (tun *UserspaceTun) processWritePassthrough(packet *decodedPacket) (int, error) {
+	var srcIP, dstIP net.IP
+	var hopLimit uint8
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		srcIP, dstIP, hopLimit = ip.SrcIP, ip.DstIP, ip.TTL
+	case *layers.IPv6:
+		srcIP, dstIP, hopLimit = ip.SrcIP, ip.DstIP, ip.HopLimit
+	default:
+		tun.dropUndecoded(packet, &tun.drops.noIPLayer, "Write: packet has no IPv4/IPv6 layer")
+		return 0, fmt.Errorf("packet has no IPv4/IPv6 layer")
+	}
+	if packet.err != nil {
+		tun.drop(&tun.drops.decodeFailed, "Write: failed to decode packet: %v", packet.err)
+		return 0, nil
+	}
+	if hopLimit <= 1 {
+		tun.dropTtlExceeded(packet.Data(), srcIP)
+		return 0, nil
+	}
+	if tun.dropDenied(packet.Data(), srcIP, dstIP) {
+		return 0, nil
+	}
+	if !tun.allowRateLimit(srcIP, len(packet.Data())) {
+		return 0, nil
+	}
+
+	modifiedPacket := append([]byte(nil), packet.Data()...)
+	decrementHopLimit(modifiedPacket)
+	return tun.sendPacket(packet, modifiedPacket)
+}
+
+// processNatReceivedPassthrough delivers a packet received from the NAT to its destination without translation.
+func (tun *UserspaceTun) processNatReceivedPassthrough(packet *decodedPacket) {
+	if packet.NetworkLayer() == nil {
+		tun.dropUndecoded(packet, &tun.drops.noIPLayer, "NatReceive: packet has no IPv4/IPv6 layer")
+		return
+	}
+	if packet.err != nil {
+		tun.drop(&tun.drops.decodeFailed, "NatReceive: failed to decode packet: %v", packet.err)
+		return
+	}
+	// NOTE: the packet is owned by the NAT, the receive queue holds a copy
+	tun.deliverFitted(append([]byte(nil), packet.Data()...))
+}
+
+// decrementHopLimit decrements the TTL of a serialized IPv4 packet, updating its header checksum,
+// or the hop limit of a serialized IPv6 packet. The header must be valid.
+func decrementHopLimit(packet []byte) {
+	switch packet[0] >> 4 {
+	case 4:
+		packet[8] -= 1
+		header := packet[:int(packet[0]&0x0f)*4]
+		binary.BigEndian.PutUint16(header[10:12], 0)
+		binary.BigEndian.PutUint16(header[10:12], ipv4HeaderChecksum(header))
+	case 6:
+		packet[7] -= 1
+	}
+}
@@ -0,0 +1,89 @@
+package tun
+
+import (
+	"bytes"
+	"github.com/urnetwork/userwireguard/logger"
+	"net"
+	"testing"
+)
+
+func TestUserspaceTunPassthrough(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.NatMode = NatModePassthrough
+	nat := &fakeNat{}
+	// no public IP is needed to forward packets
+	tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), nil, nil, settings, nat, func() {})
+	t.Cleanup(func() { tun.Close() })
+
+	clientIPv4 := net.ParseIP("198.51.100.20").To4()
+	clientIPv6 := net.ParseIP("2001:db8:2::20")
+	remoteIPv6 := net.ParseIP("2001:db8:1::7")
+	for _, tt := range []struct {
+		name     string
+		request  []byte
+		reply    []byte
+		ttlIndex int
+	}{
+		{
+			"IPv4",
+			udpPacket(t, clientIPv4, 40000, testRemoteIPv4, 53, 10, false),
+			udpPacket(t, testRemoteIPv4, 53, clientIPv4, 40000, 10, false),
+			8,
+		},
+		{
+			"IPv6",
+			udpv6Packet(t, clientIPv6, 40000, remoteIPv6, 53, []byte("query")),
+			udpv6Packet(t, remoteIPv6, 53, clientIPv6, 40000, []byte("reply")),
+			7,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			nat.sent = nil
+			if _, err := tun.Write([][]byte{tt.request}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+			if len(nat.sent) != 1 {
+				t.Fatalf("expected 1 packet to be sent, got %d", len(nat.sent))
+			}
+			// only the TTL (and the IPv4 header checksum) changed
+			sent := nat.sent[0]
+			expected := append([]byte(nil), tt.request...)
+			expected[tt.ttlIndex] -= 1
+			if tt.ttlIndex == 8 {
+				// the checksum of a header with a valid checksum is zero
+				if ipv4HeaderChecksum(sent[:20]) != 0 {
+					t.Fatalf("invalid header checksum %x", sent[10:12])
+				}
+				copy(expected[10:12], sent[10:12])
+			}
+			if !bytes.Equal(sent, expected) {
+				t.Fatalf("expected the packet to be forwarded unmodified except the TTL:\n%x\n%x", expected, sent)
+			}
+
+			// the reply is delivered as received
+			nat.receive(tt.reply)
+			received, err := readPacket(t, tun, DefaultMtu)
+			if err != nil {
+				t.Fatalf("failed to read packet: %v", err)
+			}
+			if !bytes.Equal(received, tt.reply) {
+				t.Fatalf("expected the reply to be delivered unmodified:\n%x\n%x", tt.reply, received)
+			}
+		})
+	}
+
+	if stats := tun.NatStats(); stats.Entries != 0 || stats.Created != 0 || stats.LookupMisses != 0 {
+		t.Fatalf("expected the NAT table to be unused, got %+v", stats)
+	}
+
+	// the TTL is still checked
+	expiring := udpPacket(t, clientIPv4, 40000, testRemoteIPv4, 53, 10, false)
+	expiring[8] = 1
+	nat.sent = nil
+	if _, err := tun.Write([][]byte{expiring}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if len(nat.sent) != 0 || tun.DropStats().WriteTtlExceeded != 1 {
+		t.Fatalf("expected the expired packet to be dropped, got %+v", tun.DropStats())
+	}
+}
@@ -0,0 +1,156 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const natStateVersion = 1
+
+// natRestoredTcpIdleTimeout is the idle timeout of TCP entries loaded by LoadNatState until a packet of the connection
+// is seen, since the connection may have been closed while the TUN was stopped.
+// This is the transitory connection idle timeout of RFC 5382 (REQ-5).
+const natRestoredTcpIdleTimeout = 4 * time.Minute
+
+// natState is the content of a NAT state file, see SaveNatState.
+type natState struct {
+	Version int
+	Entries []natStateEntry
+}
+
+type natStateEntry struct {
+	PublicIP       string
+	PublicPort     int
+	Protocol       layers.IPProtocol
+	ClientIP       net.IP
+	ClientPort     int
+	Created        time.Time
+	LastActivity   time.Time
+	PortPreserved  bool
+	DNSOriginalDst net.IP
+}
+
+// SaveNatState writes the entries of the NAT table atomically to path, so that they can be loaded with LoadNatState
+// after a restart and the connections of the clients survive it. It should be called on graceful shutdown,
+// once the device no longer writes packets.
+func (tun *UserspaceTun) SaveNatState(path string) error {
+	state := natState{Version: natStateVersion}
+	tun.natTableMu.Lock()
+	for natKey, value := range tun.natTable {
+		state.Entries = append(state.Entries, natStateEntry{
+			PublicIP:       natKey.IP,
+			PublicPort:     natKey.Port,
+			Protocol:       natKey.Protocol,
+			ClientIP:       value.IP,
+			ClientPort:     value.Port,
+			Created:        value.Created,
+			LastActivity:   value.LastActivity,
+			PortPreserved:  value.PortPreserved,
+			DNSOriginalDst: value.dnsOriginalDst,
+		})
+	}
+	tun.natTableMu.Unlock()
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(state); err != nil {
+		return fmt.Errorf("failed to encode NAT state: %w", err)
+	}
+
+	// write to a temporary file in the same directory and rename it, so that the state file is never partially written
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create NAT state file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if _, err := tmp.Write(content.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write NAT state file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write NAT state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write NAT state file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadNatState adds the entries saved by SaveNatState at path to the NAT table, and returns the number of entries added.
+// It should be called before the device writes packets.
+//
+// Entries that would already be expired, whose public IP is no longer in the pool or whose port is out of the range
+// or in use are skipped. TCP entries expire after natRestoredTcpIdleTimeout until a packet of the connection is seen.
+// Returns an error without adding any entry if the file cannot be read or decoded, in which case the table starts empty.
+func (tun *UserspaceTun) LoadNatState(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var state natState
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&state); err != nil {
+		return 0, fmt.Errorf("invalid NAT state file: %w", err)
+	}
+	if state.Version != natStateVersion {
+		return 0, fmt.Errorf("unsupported NAT state file version %d", state.Version)
+	}
+
+	now := time.Now()
+	tun.natTableMu.Lock()
+	defer tun.natTableMu.Unlock()
+	loaded := 0
+	for _, entry := range state.Entries {
+		if entry.ClientIP.To16() == nil {
+			continue
+		}
+		natKey := NATKey{
+			IP:       entry.PublicIP,
+			Port:     entry.PublicPort,
+			Protocol: entry.Protocol,
+		}
+		clientKey := entry.ClientIP.String()
+		mapping := natMapping{
+			IP:       clientKey,
+			Port:     entry.ClientPort,
+			Protocol: entry.Protocol,
+		}
+		if tun.publicIPPool(entry.ClientIP).index(natKey.IP) < 0 {
+			continue
+		}
+		if natKey.Port < tun.settings.NatPortRangeStart || tun.settings.NatPortRangeEnd < natKey.Port {
+			continue
+		}
+		if _, used := tun.natTable[natKey]; used {
+			continue
+		}
+		if _, used := tun.natMappings[mapping]; used {
+			continue
+		}
+		value := NATValue{
+			IP:             normalizeIP(entry.ClientIP),
+			Port:           entry.ClientPort,
+			Created:        entry.Created,
+			LastActivity:   entry.LastActivity,
+			PortPreserved:  entry.PortPreserved,
+			dnsOriginalDst: entry.DNSOriginalDst,
+			restored:       true,
+		}
+		if tun.natIdleTimeout(natKey, value) <= now.Sub(value.LastActivity) {
+			continue
+		}
+		tun.natFlowIds += 1
+		value.FlowId = tun.natFlowIds
+		tun.natTable[natKey] = value
+		tun.natMappings[mapping] = natKey
+		tun.natAddPublicIPEntry(clientKey, natKey.IP)
+		loaded += 1
+	}
+	return loaded, nil
+}
@@ -0,0 +1,106 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestUserspaceTunNatStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nat.state")
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+	for _, request := range [][]byte{
+		udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false),
+		tcpPacket(t, testLocalIPv4, 40001, testRemoteIPv4, 443, func(tcp *layers.TCP) { tcp.SYN = true }),
+		udpPacket(t, testLocalIPv4, 40002, testRemoteIPv4, 53, 10, false),
+	} {
+		if _, err := tun.Write([][]byte{request}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	udpPort, tcpPort := sentPort(nat.sent[0]), sentPort(nat.sent[1])
+	// an entry idle for longer than its timeout is not loaded
+	tun.natTableMu.Lock()
+	expiredKey := NATKey{IP: testPublicIPv4.String(), Port: sentPort(nat.sent[2]), Protocol: layers.IPProtocolUDP}
+	expired := tun.natTable[expiredKey]
+	expired.LastActivity = time.Now().Add(-DefaultUdpIdleTimeout)
+	tun.natTable[expiredKey] = expired
+	tun.natTableMu.Unlock()
+
+	if err := tun.SaveNatState(path); err != nil {
+		t.Fatalf("failed to save NAT state: %v", err)
+	}
+
+	restarted, restartedNat := newTestTun(t, DefaultUserspaceTunSettings())
+	loaded, err := restarted.LoadNatState(path)
+	if err != nil || loaded != 2 {
+		t.Fatalf("expected 2 entries loaded, got %d: %v", loaded, err)
+	}
+
+	// the reply of a connection opened before the restart is translated
+	restartedNat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, udpPort, 10, false))
+	received, err := readPacket(t, restarted, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if dstIP, dstPort := net.IP(received[16:20]), binary.BigEndian.Uint16(received[22:24]); !dstIP.Equal(testLocalIPv4) || dstPort != 40000 {
+		t.Fatalf("expected the reply to %v:40000, got %v:%d", testLocalIPv4, dstIP, dstPort)
+	}
+	// and the client keeps its public port
+	if _, err := restarted.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if port := sentPort(restartedNat.sent[0]); port != udpPort {
+		t.Fatalf("expected public port %d after the restart, got %d", udpPort, port)
+	}
+
+	// the TCP entry expires early since the connection may be gone
+	restarted.sweepNatTable(time.Now().Add(natRestoredTcpIdleTimeout))
+	for _, entry := range restarted.NATEntries() {
+		if entry.PublicPort == tcpPort {
+			t.Fatalf("expected the restored TCP entry to expire, got %+v", entry)
+		}
+	}
+	if stats := restarted.NatStats(); stats.Entries != 1 {
+		t.Fatalf("expected the UDP entry to be kept, got %+v", stats)
+	}
+}
+
+func TestUserspaceTunNatStateCorrupt(t *testing.T) {
+	tun, _ := newTestTun(t, DefaultUserspaceTunSettings())
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "nat.state")
+	if err := tun.SaveNatState(path); err != nil {
+		t.Fatalf("failed to save NAT state: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read NAT state: %v", err)
+	}
+
+	for name, corrupt := range map[string][]byte{
+		"truncated": content[:len(content)-8],
+		"garbage":   []byte("not a NAT state"),
+		"empty":     nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := os.WriteFile(path, corrupt, 0600); err != nil {
+				t.Fatalf("failed to write NAT state: %v", err)
+			}
+			restarted, _ := newTestTun(t, DefaultUserspaceTunSettings())
+			if loaded, err := restarted.LoadNatState(path); err == nil || loaded != 0 {
+				t.Fatalf("expected an error for a corrupt NAT state, got %d loaded", loaded)
+			}
+			if stats := restarted.NatStats(); stats.Entries != 0 {
+				t.Fatalf("expected an empty NAT table, got %+v", stats)
+			}
+		})
+	}
+}
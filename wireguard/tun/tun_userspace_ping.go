@@ -0,0 +1,292 @@
+package tun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/connect"
+	"github.com/urnetwork/protocol"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pingNat sends the ICMP and ICMPv6 echo requests sent through it on ICMP sockets and delivers their replies,
+// and sends the other packets through nat. connect.LocalUserNat only forwards TCP and UDP.
+//
+// The sockets are unprivileged ICMP sockets, one per public IP and echo identifier, for which the OS
+// replaces the identifier of the requests with its own. The identifier of the replies is restored.
+// Where these sockets are not allowed (on Windows, and on Linux outside of net.ipv4.ping_group_range),
+// echo requests are not accepted.
+type pingNat struct {
+	nat           userNat
+	ctx           context.Context
+	bindSourceIPs bool
+	idleTimeout   time.Duration
+
+	mu              sync.Mutex // mu guards sockets and receiveCallback
+	sockets         map[pingKey]*pingSocket
+	receiveCallback connect.ReceivePacketFunction
+}
+
+// pingKey is the public side of an ICMP echo flow.
+type pingKey struct {
+	ip string
+	id int
+}
+
+// pingSocket is the ICMP socket of an echo flow.
+type pingSocket struct {
+	conn     *icmp.PacketConn
+	lastSend atomic.Int64 // unix nanoseconds
+}
+
+// pingRequest is an ICMP or ICMPv6 echo request sent through a pingNat.
+type pingRequest struct {
+	srcIP net.IP
+	dstIP net.IP
+	id    int
+	seq   int
+	data  []byte
+}
+
+// newPingNat returns a pingNat that sends the other packets through nat. The sockets are closed when ctx is done,
+// or when they did not send a request for idleTimeout. If bindSourceIPs is set, the sockets are bound to the
+// source IP of the requests, see UserspaceTunSettings.BindPublicIPs.
+func newPingNat(ctx context.Context, nat userNat, bindSourceIPs bool, idleTimeout time.Duration) *pingNat {
+	ping := &pingNat{
+		nat:           nat,
+		ctx:           ctx,
+		bindSourceIPs: bindSourceIPs,
+		idleTimeout:   idleTimeout,
+		sockets:       make(map[pingKey]*pingSocket),
+	}
+	go func() {
+		<-ctx.Done()
+		ping.mu.Lock()
+		defer ping.mu.Unlock()
+		for key, socket := range ping.sockets {
+			socket.conn.Close()
+			delete(ping.sockets, key)
+		}
+	}()
+	return ping
+}
+
+func (ping *pingNat) SendPacket(source connect.TransferPath, provideMode protocol.ProvideMode, packet []byte, timeout time.Duration) bool {
+	request, ok := parsePingRequest(packet)
+	if !ok {
+		return ping.nat.SendPacket(source, provideMode, packet, timeout)
+	}
+	return ping.send(request) == nil
+}
+
+func (ping *pingNat) AddReceivePacketCallback(receiveCallback connect.ReceivePacketFunction) func() {
+	ping.mu.Lock()
+	ping.receiveCallback = receiveCallback
+	ping.mu.Unlock()
+	removeCallback := ping.nat.AddReceivePacketCallback(receiveCallback)
+	return func() {
+		ping.mu.Lock()
+		ping.receiveCallback = nil
+		ping.mu.Unlock()
+		removeCallback()
+	}
+}
+
+// parsePingRequest returns the echo request of a packet, if it is an ICMP or ICMPv6 echo request.
+func parsePingRequest(packet []byte) (pingRequest, bool) {
+	// most packets are not ICMP, check the protocol before decoding
+	if len(packet) < 1 {
+		return pingRequest{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 || layers.IPProtocol(packet[9]) != layers.IPProtocolICMPv4 {
+			return pingRequest{}, false
+		}
+		decoded := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		ip, _ := decoded.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		icmp, _ := decoded.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if ip == nil || icmp == nil || icmp.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+			return pingRequest{}, false
+		}
+		return pingRequest{
+			srcIP: ip.SrcIP,
+			dstIP: ip.DstIP,
+			id:    int(icmp.Id),
+			seq:   int(icmp.Seq),
+			data:  icmp.Payload,
+		}, true
+	case 6:
+		if len(packet) < 40 || layers.IPProtocol(packet[6]) != layers.IPProtocolICMPv6 {
+			return pingRequest{}, false
+		}
+		decoded := gopacket.NewPacket(packet, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		ip, _ := decoded.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		icmp, _ := decoded.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+		// the identifier and sequence number are the first 4 bytes after the ICMPv6 header
+		if ip == nil || icmp == nil || icmp.TypeCode.Type() != layers.ICMPv6TypeEchoRequest || len(icmp.Payload) < 4 {
+			return pingRequest{}, false
+		}
+		return pingRequest{
+			srcIP: ip.SrcIP,
+			dstIP: ip.DstIP,
+			id:    int(binary.BigEndian.Uint16(icmp.Payload[0:2])),
+			seq:   int(binary.BigEndian.Uint16(icmp.Payload[2:4])),
+			data:  icmp.Payload[4:],
+		}, true
+	default:
+		return pingRequest{}, false
+	}
+}
+
+// send sends an echo request on the socket of its flow.
+func (ping *pingNat) send(request pingRequest) error {
+	socket, err := ping.socket(pingKey{ip: request.srcIP.String(), id: request.id}, request.srcIP)
+	if err != nil {
+		return err
+	}
+	message := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: request.id, Seq: request.seq, Data: request.data},
+	}
+	if request.srcIP.To4() == nil {
+		// the OS computes the checksum of ICMPv6
+		message.Type = ipv6.ICMPTypeEchoRequest
+	}
+	b, err := message.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	socket.lastSend.Store(time.Now().UnixNano())
+	_, err = socket.conn.WriteTo(b, &net.UDPAddr{IP: request.dstIP})
+	return err
+}
+
+// socket returns the socket of the flow key, opening it for the first request of the flow.
+func (ping *pingNat) socket(key pingKey, srcIP net.IP) (*pingSocket, error) {
+	ping.mu.Lock()
+	defer ping.mu.Unlock()
+	if socket, found := ping.sockets[key]; found {
+		return socket, nil
+	}
+	select {
+	case <-ping.ctx.Done():
+		return nil, errors.New("ping NAT closed")
+	default:
+	}
+
+	network, address := "udp4", "0.0.0.0"
+	if srcIP.To4() == nil {
+		network, address = "udp6", "::"
+	}
+	if ping.bindSourceIPs {
+		address = srcIP.String()
+	}
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	socket := &pingSocket{conn: conn}
+	ping.sockets[key] = socket
+	go ping.receive(key, socket, normalizeIP(srcIP))
+	return socket, nil
+}
+
+// receive delivers the echo replies received by the socket of the flow key to the receive callback,
+// until the socket is closed or did not send a request for idleTimeout.
+func (ping *pingNat) receive(key pingKey, socket *pingSocket, dstIP net.IP) {
+	defer func() {
+		ping.mu.Lock()
+		defer ping.mu.Unlock()
+		if ping.sockets[key] == socket {
+			delete(ping.sockets, key)
+		}
+		socket.conn.Close()
+	}()
+
+	ipProtocol := connect.IpProtocolIcmp
+	icmpProtocol := 1
+	if dstIP.To4() == nil {
+		ipProtocol = connect.IpProtocolIcmpv6
+		icmpProtocol = 58
+	}
+	buffer := make([]byte, 65535)
+	for {
+		socket.conn.SetReadDeadline(time.Now().Add(ping.idleTimeout))
+		n, addr, err := socket.conn.ReadFrom(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, socket.lastSend.Load())) < ping.idleTimeout {
+				continue
+			}
+			return
+		}
+		message, err := icmp.ParseMessage(icmpProtocol, buffer[:n])
+		if err != nil {
+			continue
+		}
+		reply, ok := message.Body.(*icmp.Echo)
+		if !ok || (message.Type != ipv4.ICMPTypeEchoReply && message.Type != ipv6.ICMPTypeEchoReply) {
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		packet, err := echoReplyPacket(normalizeIP(udpAddr.IP), dstIP, key.id, reply)
+		if err != nil {
+			continue
+		}
+
+		ping.mu.Lock()
+		receiveCallback := ping.receiveCallback
+		ping.mu.Unlock()
+		if receiveCallback != nil {
+			receiveCallback(connect.TransferPath{}, ipProtocol, packet)
+		}
+	}
+}
+
+// echoReplyPacket serializes the echo reply from srcIP to the request of the flow dstIP and id.
+func echoReplyPacket(srcIP net.IP, dstIP net.IP, id int, reply *icmp.Echo) ([]byte, error) {
+	if dstIP.To4() != nil {
+		ipv4 := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    srcIP,
+			DstIP:    dstIP,
+		}
+		icmp := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+			Id:       uint16(id),
+			Seq:      uint16(reply.Seq),
+		}
+		return serializePacket(ipv4, icmp, gopacket.Payload(reply.Data))
+	}
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      srcIP,
+		DstIP:      dstIP,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoReply, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(ipv6)
+	payload := make([]byte, 4+len(reply.Data))
+	binary.BigEndian.PutUint16(payload[0:2], uint16(id))
+	binary.BigEndian.PutUint16(payload[2:4], uint16(reply.Seq))
+	copy(payload[4:], reply.Data)
+	return serializePacket(ipv6, icmp, gopacket.Payload(payload))
+}
@@ -0,0 +1,127 @@
+package tun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/connect"
+	"github.com/urnetwork/protocol"
+	"golang.org/x/net/icmp"
+)
+
+// skipWithoutPingSockets skips the test where unprivileged ICMP sockets are not allowed.
+func skipWithoutPingSockets(t *testing.T) {
+	t.Helper()
+	conn, err := icmp.ListenPacket("udp4", "127.0.0.1")
+	if err != nil {
+		t.Skipf("ICMP sockets are not allowed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestPingNatEcho(t *testing.T) {
+	skipWithoutPingSockets(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nat := &fakeNat{}
+	ping := newPingNat(ctx, nat, false, time.Minute)
+	replies := make(chan []byte, 1)
+	ping.AddReceivePacketCallback(func(source connect.TransferPath, ipProtocol connect.IpProtocol, packet []byte) {
+		replies <- append([]byte(nil), packet...)
+	})
+
+	// other packets are sent through the NAT
+	udp := udpPacket(t, testPublicIPv4, 40000, testRemoteIPv4, 53, 10, false)
+	if !ping.SendPacket(connect.TransferPath{}, protocol.ProvideMode_Network, udp, -1) || len(nat.sent) != 1 {
+		t.Fatalf("expected the UDP packet to be sent through the NAT")
+	}
+
+	loopback := net.ParseIP("127.0.0.1").To4()
+	request := icmpEchoPacket(t, testPublicIPv4, loopback, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), 1234)
+	if !ping.SendPacket(connect.TransferPath{}, protocol.ProvideMode_Network, request, -1) {
+		t.Fatalf("expected the echo request to be sent")
+	}
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected the echo request not to be sent through the NAT")
+	}
+
+	select {
+	case reply := <-replies:
+		decoded := gopacket.NewPacket(reply, layers.LayerTypeIPv4, gopacket.Default)
+		ip, _ := decoded.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		icmp, _ := decoded.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if ip == nil || icmp == nil || !ip.SrcIP.Equal(loopback) || !ip.DstIP.Equal(testPublicIPv4) {
+			t.Fatalf("expected an echo reply from %v to %v, got %x", loopback, testPublicIPv4, reply)
+		}
+		// the OS replaced the identifier of the request, which is restored
+		if icmp.TypeCode.Type() != layers.ICMPv4TypeEchoReply || icmp.Id != 1234 || icmp.Seq != 1 || string(icmp.Payload) != "ping" {
+			t.Fatalf("expected the echo reply of id 1234 seq 1, got %v id %d seq %d payload %q", icmp.TypeCode, icmp.Id, icmp.Seq, icmp.Payload)
+		}
+		// the ICMP checksum has no pseudo header
+		if ipv4HeaderChecksum(reply[20:]) != 0 {
+			t.Fatalf("echo reply has an invalid checksum")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no echo reply")
+	}
+}
+
+func TestPingNatIdleTimeout(t *testing.T) {
+	skipWithoutPingSockets(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ping := newPingNat(ctx, &fakeNat{}, false, 100*time.Millisecond)
+
+	loopback := net.ParseIP("127.0.0.1").To4()
+	request := icmpEchoPacket(t, testPublicIPv4, loopback, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), 1234)
+	if !ping.SendPacket(connect.TransferPath{}, protocol.ProvideMode_Network, request, -1) {
+		t.Fatalf("expected the echo request to be sent")
+	}
+	sockets := func() int {
+		ping.mu.Lock()
+		defer ping.mu.Unlock()
+		return len(ping.sockets)
+	}
+	if n := sockets(); n != 1 {
+		t.Fatalf("expected a socket for the flow, got %d", n)
+	}
+
+	// the socket is closed once the flow is idle
+	deadline := time.Now().Add(5 * time.Second)
+	for 0 < sockets() {
+		if deadline.Before(time.Now()) {
+			t.Fatalf("expected the socket of the idle flow to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPingNatEchoReplyIPv6(t *testing.T) {
+	srcIP := net.ParseIP("2001:db8::7")
+	dstIP := net.ParseIP("2001:db8::1")
+	reply, err := echoReplyPacket(srcIP, dstIP, 4321, &icmp.Echo{ID: 9, Seq: 3, Data: []byte("ping")})
+	if err != nil {
+		t.Fatalf("failed to serialize echo reply: %v", err)
+	}
+	request, ok := parsePingRequest(reply)
+	if ok {
+		t.Fatalf("expected the echo reply not to be parsed as a request: %+v", request)
+	}
+	srcIPReply, dstIPReply, protocol, transport, ok := splitPacket(reply)
+	if !ok || protocol != layers.IPProtocolICMPv6 || !net.IP(srcIPReply).Equal(srcIP) || !net.IP(dstIPReply).Equal(dstIP) {
+		t.Fatalf("expected an ICMPv6 packet from %v to %v, got %x", srcIP, dstIP, reply)
+	}
+	// type, code, checksum, then the identifier of the flow and the sequence number of the reply
+	if transport[0] != layers.ICMPv6TypeEchoReply || transport[4] != 0x10 || transport[5] != 0xe1 || transport[7] != 3 || string(transport[8:]) != "ping" {
+		t.Fatalf("unexpected echo reply %x", transport)
+	}
+	if !transportChecksumValid(reply) {
+		t.Fatalf("echo reply has an invalid checksum")
+	}
+}
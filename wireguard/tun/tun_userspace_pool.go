@@ -0,0 +1,161 @@
+package tun
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// serializeBuffers are reused across packets in both NAT directions.
+// A buffer is only used within serializePacket, the bytes handed to the NAT or the receive queue are always a copy.
+var serializeBuffers = sync.Pool{
+	New: func() any {
+		return gopacket.NewSerializeBuffer()
+	},
+}
+
+var serializeOptions = gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+// serializePacket serializes the layers of a modified packet with a pooled buffer.
+// It returns a copy of the bytes that is owned by the caller.
+func serializePacket(packetLayers ...gopacket.SerializableLayer) ([]byte, error) {
+	buffer := serializeBuffers.Get().(gopacket.SerializeBuffer)
+	defer serializeBuffers.Put(buffer)
+	// SerializeLayers clears the buffer before writing the layers
+	if err := gopacket.SerializeLayers(buffer, serializeOptions, packetLayers...); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buffer.Bytes()...), nil
+}
+
+// decodedPacket is an IPv4 or IPv6 packet decoded into preallocated layers.
+// The layers reference the packet bytes, which must not be modified while the packet is in use.
+type decodedPacket struct {
+	data    []byte
+	decoded []gopacket.LayerType
+	// the error that stopped the decoding, the layers decoded before it are kept
+	err error
+	// the stages of the packet are timed, see UserspaceTunSettings.TimingSampleRate
+	timed bool
+	// the packet is a datagram reassembled from the fragments sent by a client, see reassembleIPv4
+	reassembled bool
+
+	ipv4   layers.IPv4
+	ipv6   layers.IPv6
+	tcp    layers.TCP
+	udp    layers.UDP
+	icmpv4 layers.ICMPv4
+	icmpv6 layers.ICMPv6
+	// the IPv6 extension headers after the hop-by-hop options
+	ipv6Extension ipv6ExtensionLayer
+
+	parserIPv4 *gopacket.DecodingLayerParser
+	parserIPv6 *gopacket.DecodingLayerParser
+}
+
+var decodedPackets = sync.Pool{
+	New: func() any {
+		packet := &decodedPacket{
+			decoded: make([]gopacket.LayerType, 0, 4),
+		}
+		packet.ipv6Extension.ipv6 = &packet.ipv6
+		decodingLayers := []gopacket.DecodingLayer{&packet.ipv4, &packet.ipv6, &packet.ipv6Extension, &packet.tcp, &packet.udp, &packet.icmpv4, &packet.icmpv6}
+		packet.parserIPv4 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, decodingLayers...)
+		packet.parserIPv6 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, decodingLayers...)
+		// the payloads of the transport and ICMP layers are not decoded, nor are fragments
+		packet.parserIPv4.IgnoreUnsupported = true
+		packet.parserIPv6.IgnoreUnsupported = true
+		return packet
+	},
+}
+
+// decodePacket decodes an IPv4 or IPv6 packet by its version into a pooled decodedPacket,
+// which must be released once the packet has been processed.
+// As with gopacket.NewPacket, the layers decoded before an error are kept.
+// Unsupported layers (e.g. the payload of a fragment) are not an error,
+// and a packet that is empty or of another version has no layers.
+func decodePacket(data []byte) *decodedPacket {
+	packet := decodedPackets.Get().(*decodedPacket)
+	packet.data = data
+	if len(data) == 0 {
+		return packet
+	}
+	var parser *gopacket.DecodingLayerParser
+	switch data[0] >> 4 {
+	case 4:
+		parser = packet.parserIPv4
+	case 6:
+		parser = packet.parserIPv6
+	default:
+		// NOTE: the IPv4 layer does not check the version, so other versions would be decoded as IPv4
+		return packet
+	}
+	// NOTE: the missing layers are handled by the callers, the error tells why they are missing
+	packet.err = parser.DecodeLayers(data, &packet.decoded)
+	return packet
+}
+
+// release returns the packet to the pool. Neither the packet nor its layers may be used afterwards.
+func (packet *decodedPacket) release() {
+	packet.data = nil
+	packet.err = nil
+	packet.timed = false
+	packet.reassembled = false
+	packet.decoded = packet.decoded[:0]
+	decodedPackets.Put(packet)
+}
+
+func (packet *decodedPacket) Data() []byte {
+	return packet.data
+}
+
+// Layer returns the first decoded layer of a type, or nil.
+func (packet *decodedPacket) Layer(layerType gopacket.LayerType) gopacket.Layer {
+	if !slices.Contains(packet.decoded, layerType) {
+		return nil
+	}
+	switch layerType {
+	case layers.LayerTypeIPv4:
+		return &packet.ipv4
+	case layers.LayerTypeIPv6:
+		return &packet.ipv6
+	case layers.LayerTypeTCP:
+		return &packet.tcp
+	case layers.LayerTypeUDP:
+		return &packet.udp
+	case layers.LayerTypeICMPv4:
+		return &packet.icmpv4
+	case layers.LayerTypeICMPv6:
+		return &packet.icmpv6
+	default:
+		return nil
+	}
+}
+
+// NetworkLayer returns the IPv4 or IPv6 layer, or nil.
+func (packet *decodedPacket) NetworkLayer() gopacket.NetworkLayer {
+	if 0 < len(packet.decoded) {
+		switch packet.decoded[0] {
+		case layers.LayerTypeIPv4:
+			return &packet.ipv4
+		case layers.LayerTypeIPv6:
+			return &packet.ipv6
+		}
+	}
+	return nil
+}
+
+// TransportLayer returns the TCP or UDP layer, or nil.
+func (packet *decodedPacket) TransportLayer() gopacket.TransportLayer {
+	for _, layerType := range packet.decoded {
+		switch layerType {
+		case layers.LayerTypeTCP:
+			return &packet.tcp
+		case layers.LayerTypeUDP:
+			return &packet.udp
+		}
+	}
+	return nil
+}
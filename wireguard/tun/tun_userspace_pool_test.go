@@ -0,0 +1,223 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/connect"
+	"github.com/urnetwork/protocol"
+	"github.com/urnetwork/userwireguard/logger"
+)
+
+func TestUserspaceTunConcurrentSerialize(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.ReceiveQueueSize = 2048
+	tun, nat := newTestTun(t, settings)
+
+	// each client port is a flow with its own payload size, so a reused buffer shows as a mismatched size or checksum
+	const flows = 8
+	const packetsPerFlow = 200
+	for i := 0; i < flows; i += 1 {
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000+i, testRemoteIPv4, 53, 10+i, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	publicPorts := map[int]int{}
+	for i, packet := range nat.sent {
+		publicPorts[40000+i] = sentPort(packet)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < flows; i += 1 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < packetsPerFlow; j += 1 {
+				if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000+i, testRemoteIPv4, 53, 10+i, false)}, 0); err != nil {
+					t.Errorf("failed to write packet: %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < packetsPerFlow; j += 1 {
+				nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPorts[40000+i], 10+i, false))
+			}
+		}()
+	}
+
+	// read while the packets are received
+	bufs := make([][]byte, 16)
+	for i := range bufs {
+		bufs[i] = make([]byte, DefaultMtu)
+	}
+	sizes := make([]int, len(bufs))
+	for read := 0; read < flows*packetsPerFlow; {
+		n, err := tun.Read(bufs, sizes, 0)
+		if err != nil {
+			t.Fatalf("failed to read packets: %v", err)
+		}
+		for k := 0; k < n; k += 1 {
+			received := bufs[k][:sizes[k]]
+			dstPort := int(binary.BigEndian.Uint16(received[22:24]))
+			if len(received) != 28+10+dstPort-40000 || !udpChecksumValid(received) {
+				t.Fatalf("received packet of %d bytes for port %d is corrupted", len(received), dstPort)
+			}
+		}
+		read += n
+	}
+	wg.Wait()
+
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	for _, sent := range nat.sent {
+		publicPort := sentPort(sent)
+		for localPort, port := range publicPorts {
+			if port == publicPort && (len(sent) != 28+10+localPort-40000 || !udpChecksumValid(sent)) {
+				t.Fatalf("sent packet of %d bytes for port %d is corrupted", len(sent), publicPort)
+			}
+		}
+	}
+}
+
+func BenchmarkSerializePacket(b *testing.B) {
+	ipv4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    testPublicIPv4,
+		DstIP:    testRemoteIPv4,
+	}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	payload := gopacket.Payload(make([]byte, 1000))
+
+	b.Run("new buffer", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += 1 {
+			buffer := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buffer, serializeOptions, ipv4, udp, payload); err != nil {
+				b.Fatalf("failed to serialize packet: %v", err)
+			}
+			_ = append([]byte(nil), buffer.Bytes()...)
+		}
+	})
+	b.Run("pooled buffer", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += 1 {
+			if _, err := serializePacket(ipv4, udp, payload); err != nil {
+				b.Fatalf("failed to serialize packet: %v", err)
+			}
+		}
+	})
+}
+
+// discardNat drops sent packets, so that benchmarks only measure the TUN.
+type discardNat struct {
+	fakeNat
+}
+
+func (nat *discardNat) SendPacket(source connect.TransferPath, provideMode protocol.ProvideMode, packet []byte, timeout time.Duration) bool {
+	return true
+}
+
+func BenchmarkUserspaceTunWrite(b *testing.B) {
+	for _, tt := range []struct {
+		name                 string
+		incrementalChecksums bool
+	}{
+		{"incremental checksums", true},
+		{"full checksums", false},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			settings := DefaultUserspaceTunSettings()
+			settings.IncrementalChecksums = tt.incrementalChecksums
+			publicIPv4 := testPublicIPv4
+			tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), &publicIPv4, nil, settings, &discardNat{}, func() {})
+			b.Cleanup(func() { tun.Close() })
+			packet := udpPacket(b, testLocalIPv4, 40000, testRemoteIPv4, 53, 1000, false)
+
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i += 1 {
+				if _, err := tun.Write([][]byte{packet}, 0); err != nil {
+					b.Fatalf("failed to write packet: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodePacket(b *testing.B) {
+	data := tcpPacket(b, testLocalIPv4, 40000, testRemoteIPv4, 443, func(tcp *layers.TCP) { tcp.ACK = true })
+
+	for _, tt := range []struct {
+		name   string
+		decode func()
+	}{
+		{"gopacket.NewPacket", func() {
+			packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+			_ = packet.TransportLayer()
+		}},
+		{"decodePacket", func() {
+			packet := decodePacket(data)
+			_ = packet.TransportLayer()
+			packet.release()
+		}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i += 1 {
+				tt.decode()
+			}
+			b.ReportMetric(testing.AllocsPerRun(100, tt.decode), "allocs/packet")
+		})
+	}
+}
+
+func TestDecodePacket(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		data      []byte
+		firstType gopacket.LayerType
+	}{
+		{"IPv4 TCP", tcpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 443, func(tcp *layers.TCP) { tcp.SYN = true }), layers.LayerTypeIPv4},
+		{"IPv4 UDP", udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false), layers.LayerTypeIPv4},
+		{"IPv6 UDP", udpv6Packet(t, net.ParseIP("fd00::2"), 40000, net.ParseIP("2001:db8:1::7"), 53, []byte("query")), layers.LayerTypeIPv6},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// the pooled decoder finds the same layers as gopacket.NewPacket
+			expected := gopacket.NewPacket(tt.data, tt.firstType, gopacket.Default)
+			packet := decodePacket(tt.data)
+			defer packet.release()
+
+			if !bytes.Equal(packet.NetworkLayer().LayerContents(), expected.NetworkLayer().LayerContents()) {
+				t.Fatalf("expected network layer %v, got %v", expected.NetworkLayer(), packet.NetworkLayer())
+			}
+			expectedTransport := expected.TransportLayer()
+			transport := packet.TransportLayer()
+			if (expectedTransport == nil) != (transport == nil) {
+				t.Fatalf("expected transport layer %v, got %v", expectedTransport, transport)
+			}
+			if transport != nil && (!bytes.Equal(transport.LayerContents(), expectedTransport.LayerContents()) ||
+				!bytes.Equal(transport.LayerPayload(), expectedTransport.LayerPayload())) {
+				t.Fatalf("expected transport layer %v, got %v", expectedTransport, transport)
+			}
+		})
+	}
+
+	// a transport header that failed to decode is not returned
+	packet := decodePacket(udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)[:24])
+	defer packet.release()
+	if packet.NetworkLayer() == nil || packet.TransportLayer() != nil {
+		t.Fatalf("expected only the network layer of a truncated packet, got %v", packet.decoded)
+	}
+}
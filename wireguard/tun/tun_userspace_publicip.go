@@ -0,0 +1,190 @@
+package tun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// addresses used to find the source address of the default route, no packets are sent to them
+	routeProbeIPv4 = "8.8.8.8:53"
+	routeProbeIPv6 = "[2001:4860:4860::8888]:53"
+
+	stunTimeout = 5 * time.Second
+
+	// STUN binding messages and attributes (RFC 5389)
+	stunBindingRequest            = 0x0001
+	stunBindingSuccess            = 0x0101
+	stunMagicCookie               = 0x2112a442
+	stunAttrMappedAddress         = 0x0001
+	stunAttrXorMappedAddress      = 0x0020
+	stunAddressFamilyIPv4    byte = 0x01
+	stunAddressFamilyIPv6    byte = 0x02
+)
+
+// publicIPLookup finds the addresses of the host. It is replaced in tests.
+type publicIPLookup struct {
+	// routeSource returns the source address the host uses to reach addr, i.e. the address of the default-route interface
+	routeSource func(network string, addr string) (net.IP, error)
+	// stun returns the address of the host as seen by a STUN server
+	stun func(network string, server string) (net.IP, error)
+}
+
+var defaultPublicIPLookup = publicIPLookup{
+	routeSource: routeSource,
+	stun:        stunPublicIP,
+}
+
+// DiscoverPublicIPs finds the public IPv4 and IPv6 addresses of the host, to pass to CreateUserspaceTUN.
+//
+// The address of the default-route interface is used if it is public. Otherwise, if stunServer is not empty
+// (e.g. "stun.l.google.com:19302"), the address seen by the STUN server is used.
+// An address is nil if none was found for its family.
+//
+// Returns an error if neither a public IPv4 nor a public IPv6 address was found.
+func DiscoverPublicIPs(stunServer string) (publicIPv4 *net.IP, publicIPv6 *net.IP, err error) {
+	return defaultPublicIPLookup.discover(stunServer)
+}
+
+func (lookup publicIPLookup) discover(stunServer string) (*net.IP, *net.IP, error) {
+	var errs error
+	find := func(network string, probe string) *net.IP {
+		ip, err := lookup.routeSource(network, probe)
+		if err == nil && isPublicIP(ip) {
+			return &ip
+		}
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s default route: %w", network, err))
+		}
+		if stunServer == "" {
+			return nil
+		}
+		ip, err = lookup.stun(network, stunServer)
+		if err == nil && isPublicIP(ip) {
+			return &ip
+		}
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s STUN: %w", network, err))
+		}
+		return nil
+	}
+
+	publicIPv4 := find("udp4", routeProbeIPv4)
+	publicIPv6 := find("udp6", routeProbeIPv6)
+	if publicIPv4 == nil && publicIPv6 == nil {
+		return nil, nil, errors.Join(errors.New("no public IP address found"), errs)
+	}
+	return publicIPv4, publicIPv6, nil
+}
+
+// isPublicIP returns true if ip is a global unicast address outside of the private ranges.
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// routeSource returns the source address of a UDP socket connected to addr.
+// Connecting a UDP socket selects a route without sending any packets.
+func routeSource(network string, addr string) (net.IP, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// stunPublicIP sends a STUN binding request to server and returns the address in the response.
+func stunPublicIP(network string, server string) (net.IP, error) {
+	conn, err := net.DialTimeout(network, server, stunTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(stunTimeout)); err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	if _, err := rand.Read(request[8:20]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, 1500)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return parseStunBindingResponse(response[:n], request[8:20])
+}
+
+// parseStunBindingResponse returns the address in a STUN binding success response,
+// preferring the XOR-MAPPED-ADDRESS attribute over the MAPPED-ADDRESS attribute.
+func parseStunBindingResponse(response []byte, transactionId []byte) (net.IP, error) {
+	if len(response) < 20 ||
+		binary.BigEndian.Uint16(response[0:2]) != stunBindingSuccess ||
+		binary.BigEndian.Uint32(response[4:8]) != stunMagicCookie ||
+		!bytes.Equal(response[8:20], transactionId) {
+		return nil, errors.New("not a STUN binding success response")
+	}
+
+	attrs := response[20:min(len(response), 20+int(binary.BigEndian.Uint16(response[2:4])))]
+	var mappedIP net.IP
+	for 4 <= len(attrs) {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunAttrXorMappedAddress:
+			if ip := stunAddress(value); ip != nil {
+				// the address is xored with the magic cookie followed by the transaction id
+				key := append(binary.BigEndian.AppendUint32(nil, stunMagicCookie), transactionId...)
+				for i := range ip {
+					ip[i] ^= key[i]
+				}
+				return ip, nil
+			}
+		case stunAttrMappedAddress:
+			mappedIP = stunAddress(value)
+		}
+		// attributes are padded to 4 bytes
+		attrs = attrs[min(len(attrs), 4+(attrLen+3)&^3):]
+	}
+	if mappedIP == nil {
+		return nil, errors.New("STUN response has no mapped address")
+	}
+	return mappedIP, nil
+}
+
+// stunAddress returns a copy of the IP of a STUN address attribute value.
+func stunAddress(value []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+	switch value[1] {
+	case stunAddressFamilyIPv4:
+		if len(value) < 4+net.IPv4len {
+			return nil
+		}
+		return append(net.IP(nil), value[4:4+net.IPv4len]...)
+	case stunAddressFamilyIPv6:
+		if len(value) < 4+net.IPv6len {
+			return nil
+		}
+		return append(net.IP(nil), value[4:4+net.IPv6len]...)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,116 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDiscoverPublicIPs(t *testing.T) {
+	errNoRoute := errors.New("network is unreachable")
+	tests := []struct {
+		name        string
+		routeSource map[string]string // network to address, no route if missing
+		stun        map[string]string
+		stunServer  string
+		ipv4        string
+		ipv6        string
+		err         bool
+	}{
+		{
+			name:        "default route",
+			routeSource: map[string]string{"udp4": "203.0.113.1", "udp6": "2001:db8::1"},
+			ipv4:        "203.0.113.1",
+			ipv6:        "2001:db8::1",
+		},
+		{
+			name:        "IPv4 only",
+			routeSource: map[string]string{"udp4": "203.0.113.1"},
+			ipv4:        "203.0.113.1",
+		},
+		{
+			name:        "private address uses STUN",
+			routeSource: map[string]string{"udp4": "192.168.1.10", "udp6": "fd00::10"},
+			stun:        map[string]string{"udp4": "198.51.100.7"},
+			stunServer:  "stun.example.com:3478",
+			ipv4:        "198.51.100.7",
+		},
+		{
+			name:        "private address without STUN",
+			routeSource: map[string]string{"udp4": "192.168.1.10"},
+			stun:        map[string]string{"udp4": "198.51.100.7"},
+			err:         true,
+		},
+		{
+			name: "no route",
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolve := func(addrs map[string]string) func(string, string) (net.IP, error) {
+				return func(network string, addr string) (net.IP, error) {
+					if ip, ok := addrs[network]; ok {
+						return net.ParseIP(ip), nil
+					}
+					return nil, errNoRoute
+				}
+			}
+			lookup := publicIPLookup{
+				routeSource: resolve(test.routeSource),
+				stun:        resolve(test.stun),
+			}
+
+			ipv4, ipv6, err := lookup.discover(test.stunServer)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v %v", ipv4, ipv6)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to discover public IPs: %v", err)
+			}
+			for _, check := range []struct {
+				ip       *net.IP
+				expected string
+			}{{ipv4, test.ipv4}, {ipv6, test.ipv6}} {
+				if check.expected == "" {
+					if check.ip != nil {
+						t.Fatalf("expected no address, got %v", *check.ip)
+					}
+				} else if check.ip == nil || !check.ip.Equal(net.ParseIP(check.expected)) {
+					t.Fatalf("expected address %s, got %v", check.expected, check.ip)
+				}
+			}
+		})
+	}
+}
+
+func TestParseStunBindingResponse(t *testing.T) {
+	transactionId := []byte("0123456789ab")
+	publicIPv4 := net.ParseIP("203.0.113.1").To4()
+
+	response := binary.BigEndian.AppendUint16(nil, stunBindingSuccess)
+	response = binary.BigEndian.AppendUint16(response, 4+4+net.IPv4len)
+	response = binary.BigEndian.AppendUint32(response, stunMagicCookie)
+	response = append(response, transactionId...)
+	response = binary.BigEndian.AppendUint16(response, stunAttrXorMappedAddress)
+	response = binary.BigEndian.AppendUint16(response, 4+net.IPv4len)
+	response = append(response, 0, stunAddressFamilyIPv4)
+	response = binary.BigEndian.AppendUint16(response, 3478^(stunMagicCookie>>16))
+	response = binary.BigEndian.AppendUint32(response, binary.BigEndian.Uint32(publicIPv4)^stunMagicCookie)
+
+	ip, err := parseStunBindingResponse(response, transactionId)
+	if err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if !ip.Equal(publicIPv4) {
+		t.Fatalf("expected %v, got %v", publicIPv4, ip)
+	}
+
+	if _, err := parseStunBindingResponse(response, []byte("ba9876543210")); err == nil {
+		t.Fatalf("expected error for a response to another transaction")
+	}
+}
@@ -0,0 +1,166 @@
+package tun
+
+import (
+	"cmp"
+	"errors"
+	"net"
+	"slices"
+	"time"
+)
+
+// RateLimit is a token bucket limit on the bytes sent by a client through the NAT.
+// The zero value is unlimited.
+type RateLimit struct {
+	// sustained rate in bytes per second, unlimited if 0
+	BytesPerSecond float64
+	// bytes that can be sent at once after being idle, which should be at least the MTU
+	Burst int
+}
+
+func (limit RateLimit) validate() error {
+	if limit.BytesPerSecond < 0 || limit.Burst < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+	if 0 < limit.BytesPerSecond && limit.Burst == 0 {
+		return errors.New("rate limit burst must be positive")
+	}
+	return nil
+}
+
+// ClientRateLimitDrops are the packets of a client dropped by its rate limit.
+type ClientRateLimitDrops struct {
+	ClientIP string
+	Packets  uint64
+	Bytes    uint64
+}
+
+// tokenBucket is the rate limit state of a client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+
+	droppedPackets uint64
+	droppedBytes   uint64
+}
+
+// allow takes size tokens from the bucket, after refilling it for the time since the last packet.
+// Returns false and counts the drop if there are not enough tokens.
+func (bucket *tokenBucket) allow(limit RateLimit, size int, now time.Time) bool {
+	bucket.tokens = min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.BytesPerSecond)
+	bucket.last = now
+	if bucket.tokens < float64(size) {
+		bucket.droppedPackets += 1
+		bucket.droppedBytes += uint64(size)
+		return false
+	}
+	bucket.tokens -= float64(size)
+	return true
+}
+
+// SetRateLimit changes the rate limit of clients without an override. The zero value removes the limit.
+//
+// Returns an error if the limit is invalid.
+func (tun *UserspaceTun) SetRateLimit(limit RateLimit) error {
+	if err := limit.validate(); err != nil {
+		return err
+	}
+	tun.rateLimitMu.Lock()
+	defer tun.rateLimitMu.Unlock()
+	tun.rateLimit = limit
+	return nil
+}
+
+// SetClientRateLimit overrides the rate limit of a client, identified by its IP before NAT.
+// The zero value exempts the client from the rate limit.
+//
+// Returns an error if the limit is invalid.
+func (tun *UserspaceTun) SetClientRateLimit(clientIP net.IP, limit RateLimit) error {
+	if err := limit.validate(); err != nil {
+		return err
+	}
+	tun.rateLimitMu.Lock()
+	defer tun.rateLimitMu.Unlock()
+	tun.clientRateLimits[clientIP.String()] = limit
+	return nil
+}
+
+// RemoveClientRateLimit removes the override of the rate limit of a client.
+func (tun *UserspaceTun) RemoveClientRateLimit(clientIP net.IP) {
+	tun.rateLimitMu.Lock()
+	defer tun.rateLimitMu.Unlock()
+	delete(tun.clientRateLimits, clientIP.String())
+}
+
+// ClientRateLimitDrops returns the drops of the clients with rate limit state, ordered by client IP.
+// The state of a client is removed along with its last NAT entry.
+func (tun *UserspaceTun) ClientRateLimitDrops() []ClientRateLimitDrops {
+	tun.rateLimitMu.Lock()
+	drops := make([]ClientRateLimitDrops, 0, len(tun.rateLimiters))
+	for clientIP, bucket := range tun.rateLimiters {
+		if bucket.droppedPackets == 0 {
+			continue
+		}
+		drops = append(drops, ClientRateLimitDrops{
+			ClientIP: clientIP,
+			Packets:  bucket.droppedPackets,
+			Bytes:    bucket.droppedBytes,
+		})
+	}
+	tun.rateLimitMu.Unlock()
+
+	slices.SortFunc(drops, func(a ClientRateLimitDrops, b ClientRateLimitDrops) int {
+		return cmp.Compare(a.ClientIP, b.ClientIP)
+	})
+	return drops
+}
+
+// allowRateLimit returns true if a packet of size bytes sent by clientIP is within its rate limit.
+func (tun *UserspaceTun) allowRateLimit(clientIP net.IP, size int) bool {
+	tun.rateLimitMu.Lock()
+	defer tun.rateLimitMu.Unlock()
+
+	key := clientIP.String()
+	limit, found := tun.clientRateLimits[key]
+	if !found {
+		limit = tun.rateLimit
+	}
+	if limit.BytesPerSecond <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	bucket, found := tun.rateLimiters[key]
+	if !found {
+		// a new client starts with a full bucket
+		bucket = &tokenBucket{
+			tokens: float64(limit.Burst),
+			last:   now,
+		}
+		tun.rateLimiters[key] = bucket
+	}
+	if !bucket.allow(limit, size, now) {
+		tun.rateLimitDrops += 1
+		return false
+	}
+	return true
+}
+
+// sweepRateLimiters removes the rate limit state of clients without NAT entries.
+// The clients are those counted by natAddPublicIPEntry, so that natTableMu is not held for a scan of the NAT table.
+// A client whose entries are all on a public IP it is no longer pinned to has its state reset.
+func (tun *UserspaceTun) sweepRateLimiters() {
+	tun.natTableMu.Lock()
+	clientIPs := make(map[string]bool, len(tun.natClients))
+	for clientIP := range tun.natClients {
+		clientIPs[clientIP] = true
+	}
+	tun.natTableMu.Unlock()
+
+	tun.rateLimitMu.Lock()
+	defer tun.rateLimitMu.Unlock()
+	for clientIP := range tun.rateLimiters {
+		if !clientIPs[clientIP] {
+			delete(tun.rateLimiters, clientIP)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package tun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := RateLimit{BytesPerSecond: 1000, Burst: 300}
+	now := time.Now()
+	bucket := &tokenBucket{tokens: float64(limit.Burst), last: now}
+
+	// a burst of 100 byte packets, then refill for 100ms
+	var pattern []bool
+	for i := 0; i < 5; i += 1 {
+		pattern = append(pattern, bucket.allow(limit, 100, now))
+	}
+	now = now.Add(100 * time.Millisecond)
+	for i := 0; i < 2; i += 1 {
+		pattern = append(pattern, bucket.allow(limit, 100, now))
+	}
+	expected := []bool{true, true, true, false, false, true, false}
+	for i := range expected {
+		if pattern[i] != expected[i] {
+			t.Fatalf("expected pattern %v, got %v", expected, pattern)
+		}
+	}
+	if bucket.droppedPackets != 3 || bucket.droppedBytes != 300 {
+		t.Fatalf("expected 3 packets and 300 bytes dropped, got %d and %d", bucket.droppedPackets, bucket.droppedBytes)
+	}
+
+	// the bucket does not fill beyond the burst
+	now = now.Add(time.Hour)
+	if !bucket.allow(limit, 300, now) || bucket.allow(limit, 1, now) {
+		t.Fatalf("expected the bucket to refill to the burst")
+	}
+}
+
+func TestUserspaceTunRateLimit(t *testing.T) {
+	packetSize := len(udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 100, false))
+	settings := DefaultUserspaceTunSettings()
+	settings.RateLimit = RateLimit{BytesPerSecond: 1, Burst: 3 * packetSize}
+	tun, nat := newTestTun(t, settings)
+
+	exemptIPv4 := net.ParseIP("192.168.90.3").To4()
+	if err := tun.SetClientRateLimit(exemptIPv4, RateLimit{}); err != nil {
+		t.Fatalf("failed to set client rate limit: %v", err)
+	}
+	if err := tun.SetClientRateLimit(exemptIPv4, RateLimit{BytesPerSecond: 1}); err == nil {
+		t.Fatalf("expected error for a rate limit without burst")
+	}
+
+	for i := 0; i < 5; i += 1 {
+		for _, clientIP := range []net.IP{testLocalIPv4, exemptIPv4} {
+			if _, err := tun.Write([][]byte{udpPacket(t, clientIP, 40000, testRemoteIPv4, 53, 100, false)}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+		}
+	}
+	if len(nat.sent) != 3+5 {
+		t.Fatalf("expected 3 limited and 5 exempt packets sent, got %d", len(nat.sent))
+	}
+	drops := tun.ClientRateLimitDrops()
+	if len(drops) != 1 || drops[0].ClientIP != testLocalIPv4.String() || drops[0].Packets != 2 || drops[0].Bytes != uint64(2*packetSize) {
+		t.Fatalf("expected 2 packets dropped for %v, got %+v", testLocalIPv4, drops)
+	}
+	if stats := tun.NatStats(); stats.RateLimitDrops != 2 {
+		t.Fatalf("expected 2 rate limit drops, got %+v", stats)
+	}
+
+	// the state of a client is removed with its NAT entries
+	tun.sweepNatTable(time.Now().Add(DefaultUdpIdleTimeout))
+	tun.sweepRateLimiters()
+	if drops := tun.ClientRateLimitDrops(); len(drops) != 0 {
+		t.Fatalf("expected the rate limit state to be removed, got %+v", drops)
+	}
+
+	// removing the limit lets packets through
+	if err := tun.SetRateLimit(RateLimit{}); err != nil {
+		t.Fatalf("failed to set rate limit: %v", err)
+	}
+	nat.sent = nil
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 100, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected the packet to be sent without a rate limit")
+	}
+}
@@ -0,0 +1,1689 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/connect"
+	"github.com/urnetwork/protocol"
+	"github.com/urnetwork/userwireguard/conn"
+	"github.com/urnetwork/userwireguard/logger"
+	uwgtun "github.com/urnetwork/userwireguard/tun"
+)
+
+// fakeNat records sent packets and lets tests deliver received packets.
+type fakeNat struct {
+	mu           sync.Mutex
+	sent         [][]byte
+	provideModes []protocol.ProvideMode // of the sent packets
+	callback     connect.ReceivePacketFunction
+}
+
+func (nat *fakeNat) SendPacket(source connect.TransferPath, provideMode protocol.ProvideMode, packet []byte, timeout time.Duration) bool {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	nat.sent = append(nat.sent, append([]byte(nil), packet...))
+	nat.provideModes = append(nat.provideModes, provideMode)
+	return true
+}
+
+func (nat *fakeNat) AddReceivePacketCallback(receiveCallback connect.ReceivePacketFunction) func() {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	nat.callback = receiveCallback
+	return func() {}
+}
+
+func (nat *fakeNat) receive(packet []byte) {
+	nat.mu.Lock()
+	callback := nat.callback
+	nat.mu.Unlock()
+	// the NAT inspects the packets it receives for their protocol
+	_, _, protocol, _, _ := splitPacket(packet)
+	callback(connect.TransferPath{}, connect.IpProtocolFromLayers(protocol), packet)
+}
+
+var (
+	testPublicIPv4 = net.ParseIP("203.0.113.1").To4()
+	testLocalIPv4  = net.ParseIP("192.168.90.2").To4()
+	testRemoteIPv4 = net.ParseIP("198.51.100.7").To4()
+)
+
+func newTestTun(t testing.TB, settings *UserspaceTunSettings) (*UserspaceTun, *fakeNat) {
+	t.Helper()
+	nat := &fakeNat{}
+	publicIPv4 := testPublicIPv4
+	tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), &publicIPv4, nil, settings, nat, func() {})
+	t.Cleanup(func() { tun.Close() })
+	return tun, nat
+}
+
+// udpPacket serializes an IPv4 UDP packet with a payload of payloadLen bytes.
+func udpPacket(t testing.TB, srcIP net.IP, srcPort int, dstIP net.IP, dstPort int, payloadLen int, dontFragment bool) []byte {
+	t.Helper()
+	ipv4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+	if dontFragment {
+		ipv4.Flags = layers.IPv4DontFragment
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(srcPort),
+		DstPort: layers.UDPPort(dstPort),
+	}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	payload := make([]byte, payloadLen)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ipv4, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+// udpv6Packet serializes an IPv6 UDP packet.
+func udpv6Packet(t testing.TB, srcIP net.IP, srcPort int, dstIP net.IP, dstPort int, payload []byte) []byte {
+	t.Helper()
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      srcIP,
+		DstIP:      dstIP,
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(ipv6)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ipv6, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+// sentPort returns the public source port (or ICMP echo identifier) of an IPv4 packet sent through the NAT.
+func sentPort(packet []byte) int {
+	offset := int(packet[0]&0x0f) * 4
+	if layers.IPProtocol(packet[9]) == layers.IPProtocolICMPv4 {
+		offset += 4
+	}
+	return int(binary.BigEndian.Uint16(packet[offset : offset+2]))
+}
+
+// udpChecksumValid verifies the UDP checksum of an IPv4 packet without options.
+func udpChecksumValid(packet []byte) bool {
+	pseudoHeader := make([]byte, 0, 12+len(packet)-20)
+	pseudoHeader = append(pseudoHeader, packet[12:20]...)
+	pseudoHeader = append(pseudoHeader, 0, byte(layers.IPProtocolUDP))
+	pseudoHeader = binary.BigEndian.AppendUint16(pseudoHeader, uint16(len(packet)-20))
+	pseudoHeader = append(pseudoHeader, packet[20:]...)
+	if len(pseudoHeader)%2 == 1 {
+		pseudoHeader = append(pseudoHeader, 0)
+	}
+	return ipv4HeaderChecksum(pseudoHeader) == 0
+}
+
+// readPacket reads one packet from the tun, failing the test after a timeout.
+func readPacket(t *testing.T, tun *UserspaceTun, bufSize int) ([]byte, error) {
+	t.Helper()
+	type result struct {
+		packet []byte
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		bufs := [][]byte{make([]byte, bufSize)}
+		sizes := []int{0}
+		_, err := tun.Read(bufs, sizes, 0)
+		results <- result{bufs[0][:sizes[0]], err}
+	}()
+	select {
+	case r := <-results:
+		return r.packet, r.err
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out reading packet")
+		return nil, nil
+	}
+}
+
+func TestCreateUserspaceTUNWithSettingsInvalidMtu(t *testing.T) {
+	for _, mtu := range []int{0, minMtu - 1, maxMtu + 1} {
+		settings := DefaultUserspaceTunSettings()
+		settings.Mtu = mtu
+		if _, err := CreateUserspaceTUNWithSettings(logger.NewLogger(logger.LogLevelSilent, ""), nil, nil, settings); err == nil {
+			t.Fatalf("expected error for MTU %d", mtu)
+		}
+	}
+}
+
+func TestUserspaceTunLocalUserNatSettings(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	if period := settings.localUserNatSettings().TcpBufferSettings.KeepAlivePeriod; period != 0 {
+		t.Fatalf("expected the default keepalive period of the NAT, got %v", period)
+	}
+	settings.NatKeepaliveInterval = time.Minute
+	if period := settings.localUserNatSettings().TcpBufferSettings.KeepAlivePeriod; period != time.Minute {
+		t.Fatalf("expected a keepalive period of %v, got %v", time.Minute, period)
+	}
+	// idle flows are kept until the max idle of the keepalives
+	if natSettings := settings.localUserNatSettings(); natSettings.TcpBufferSettings.ReadTimeout != settings.NatKeepaliveMaxIdle || natSettings.UdpBufferSettings.ReadTimeout != settings.NatKeepaliveMaxIdle {
+		t.Fatalf("expected the read timeouts of the NAT to be %v", settings.NatKeepaliveMaxIdle)
+	}
+
+	// the NAT sends each flow from its public IP
+	if natSettings := settings.localUserNatSettings(); natSettings.UdpBufferSettings.BindSourceIp || natSettings.TcpBufferSettings.BindSourceIp {
+		t.Fatalf("expected unbound sockets by default")
+	}
+	settings.BindPublicIPs = true
+	if natSettings := settings.localUserNatSettings(); !natSettings.UdpBufferSettings.BindSourceIp || !natSettings.TcpBufferSettings.BindSourceIp {
+		t.Fatalf("expected sockets bound to the public IPs")
+	}
+
+	if natSettings := settings.localUserNatSettings(); !natSettings.UdpBufferSettings.SetTrafficClass || !natSettings.TcpBufferSettings.SetTrafficClass {
+		t.Fatalf("expected sockets marked with the DSCP of each flow")
+	}
+
+	if natSettings := settings.localUserNatSettings(); !natSettings.UdpBufferSettings.ReceiveIcmpErrors {
+		t.Fatalf("expected ICMP errors delivered by the NAT")
+	}
+}
+
+func TestUserspaceTunProvideMode(t *testing.T) {
+	for _, mode := range []protocol.ProvideMode{protocol.ProvideMode_None, protocol.ProvideMode(100)} {
+		settings := DefaultUserspaceTunSettings()
+		settings.ProvideMode = mode
+		if _, err := CreateUserspaceTUNWithSettings(logger.NewLogger(logger.LogLevelSilent, ""), nil, nil, settings); err == nil {
+			t.Fatalf("expected error for provide mode %v", mode)
+		}
+	}
+
+	for _, mode := range []protocol.ProvideMode{protocol.ProvideMode_Network, protocol.ProvideMode_Public} {
+		settings := DefaultUserspaceTunSettings()
+		settings.ProvideMode = mode
+		tun, nat := newTestTun(t, settings)
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+		if len(nat.provideModes) != 1 || nat.provideModes[0] != mode {
+			t.Fatalf("expected the packet to be sent with provide mode %v, got %v", mode, nat.provideModes)
+		}
+	}
+}
+
+func TestUserspaceTunJumboFrame(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.Mtu = 9000
+	tun, nat := newTestTun(t, settings)
+
+	if tun.MTU() != 9000 {
+		t.Fatalf("expected MTU 9000, got %d", tun.MTU())
+	}
+
+	// outgoing jumbo packet is sent whole
+	packet := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 8000, true)
+	n, err := tun.Write([][]byte{packet}, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 packet written, got %d: %v", n, err)
+	}
+	if len(nat.sent) != 1 || len(nat.sent[0]) != len(packet) {
+		t.Fatalf("expected one packet of %d bytes sent, got %d packets", len(packet), len(nat.sent))
+	}
+
+	// incoming jumbo reply is read whole
+	reply := udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, sentPort(nat.sent[0]), 8000, true)
+	go nat.receive(reply)
+	received, err := readPacket(t, tun, 9000)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if len(received) != len(reply) {
+		t.Fatalf("expected packet of %d bytes, got %d", len(reply), len(received))
+	}
+	if dstIP := net.IP(received[16:20]); !dstIP.Equal(testLocalIPv4) {
+		t.Fatalf("expected destination %v, got %v", testLocalIPv4, dstIP)
+	}
+}
+
+func TestUserspaceTunOversizeDrop(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.Mtu = 576
+	tun, nat := newTestTun(t, settings)
+
+	packet := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 1000, false)
+	n, err := tun.Write([][]byte{packet}, 0)
+	if err == nil || n != 0 {
+		t.Fatalf("expected oversize packet to be rejected, got %d written: %v", n, err)
+	}
+	if len(nat.sent) != 0 {
+		t.Fatalf("expected no packets sent, got %d", len(nat.sent))
+	}
+	if drops := tun.DropStats(); drops.WriteOversize != 1 {
+		t.Fatalf("expected 1 oversize drop, got %+v", drops)
+	}
+
+	// the client is told the MTU
+	tooBig, err := readPacket(t, tun, settings.Mtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if dstIP := net.IP(tooBig[16:20]); !dstIP.Equal(testLocalIPv4) {
+		t.Fatalf("expected ICMP to %v, got %v", testLocalIPv4, dstIP)
+	}
+	if typ, code := tooBig[20], tooBig[21]; typ != layers.ICMPv4TypeDestinationUnreachable || code != layers.ICMPv4CodeFragmentationNeeded {
+		t.Fatalf("expected ICMP fragmentation needed, got type %d code %d", typ, code)
+	}
+	if mtu := binary.BigEndian.Uint16(tooBig[26:28]); mtu != 576 {
+		t.Fatalf("expected next-hop MTU 576, got %d", mtu)
+	}
+	if !bytes.Equal(tooBig[28:], packet[:28]) {
+		t.Fatalf("expected the header of the dropped packet to be embedded")
+	}
+
+	// register a NAT entry with a packet that fits
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 100, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+
+	// the oversize reply is dropped and the next one is read
+	go func() {
+		publicPort := sentPort(nat.sent[0])
+		nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, 1000, false))
+		nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, 100, false))
+	}()
+	received, err := readPacket(t, tun, settings.Mtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if len(received) > settings.Mtu {
+		t.Fatalf("expected packet of at most %d bytes, got %d", settings.Mtu, len(received))
+	}
+	if drops := tun.DropStats(); drops.ReadOversize != 1 {
+		t.Fatalf("expected 1 oversize read drop, got %+v", drops)
+	}
+}
+
+func TestUserspaceTunOversizeFragment(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.Mtu = 576
+	settings.OversizePolicy = OversizeFragment
+	tun, nat := newTestTun(t, settings)
+
+	// packets sent by clients are not fragmented, the client is told the MTU
+	packet := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 1500, false)
+	if _, err := tun.Write([][]byte{packet}, 0); err == nil {
+		t.Fatalf("expected error for oversize packet")
+	}
+	if len(nat.sent) != 0 {
+		t.Fatalf("expected no packets sent, got %d", len(nat.sent))
+	}
+	if _, err := readPacket(t, tun, settings.Mtu); err != nil {
+		t.Fatalf("failed to read ICMP fragmentation needed: %v", err)
+	}
+
+	// register a NAT entry with a packet that fits
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 100, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	publicPort := sentPort(nat.sent[0])
+
+	// an oversize reply is fragmented for the client
+	reply := udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, 1500, false)
+	nat.receive(reply)
+	var reassembled []byte
+	for i := 0; ; i++ {
+		fragment, err := readPacket(t, tun, settings.Mtu)
+		if err != nil {
+			t.Fatalf("failed to read packet: %v", err)
+		}
+		if len(fragment) > settings.Mtu {
+			t.Fatalf("fragment %d of %d bytes exceeds the MTU", i, len(fragment))
+		}
+		if ipv4HeaderChecksum(fragment[:20]) != 0 {
+			t.Fatalf("fragment %d has an invalid header checksum", i)
+		}
+		if dstIP := net.IP(fragment[16:20]); !dstIP.Equal(testLocalIPv4) {
+			t.Fatalf("expected fragment %d to %v, got %v", i, testLocalIPv4, dstIP)
+		}
+		flagsAndOffset := binary.BigEndian.Uint16(fragment[6:8])
+		if int(flagsAndOffset&ipv4FragmentOffset)*8 != len(reassembled) {
+			t.Fatalf("fragment %d has offset %d, expected %d", i, int(flagsAndOffset&ipv4FragmentOffset)*8, len(reassembled))
+		}
+		reassembled = append(reassembled, fragment[20:]...)
+		if flagsAndOffset&ipv4FlagMoreFragments == 0 {
+			break
+		}
+	}
+	if !bytes.Equal(reassembled[8:], reply[28:]) { // skip the UDP header, its checksum changed with the destination IP
+		t.Fatalf("reassembled payload does not match the original")
+	}
+
+	// replies with the don't fragment flag set are dropped
+	nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, 1500, true))
+	nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, 100, false))
+	if _, err := readPacket(t, tun, settings.Mtu); err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if drops := tun.DropStats(); drops.ReadOversize != 1 {
+		t.Fatalf("expected 1 oversize read drop, got %+v", drops)
+	}
+}
+
+// coalescedTcpPacket serializes a TCP packet with options and a payload, as a device with GSO hands over
+// the coalesced segments of a flow.
+func coalescedTcpPacket(t testing.TB, ipv6 bool, payload []byte) []byte {
+	t.Helper()
+	var networkLayer gopacket.NetworkLayer = &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Id:       0xfffe,
+		Flags:    layers.IPv4DontFragment,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    testLocalIPv4,
+		DstIP:    testRemoteIPv4,
+	}
+	if ipv6 {
+		networkLayer = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolTCP,
+			SrcIP:      testLocalIPv6,
+			DstIP:      testRemoteIPv6,
+		}
+	}
+	tcp := &layers.TCP{
+		SrcPort: 40000,
+		DstPort: 443,
+		Seq:     0xffffff00, // wraps within the payload
+		Ack:     1,
+		ACK:     true,
+		PSH:     true,
+		FIN:     true,
+		CWR:     true,
+		Window:  65535,
+		Options: []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: []byte{0, 0, 0, 1, 0, 0, 0, 2}},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindNop},
+		},
+	}
+	tcp.SetNetworkLayerForChecksum(networkLayer)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, networkLayer.(gopacket.SerializableLayer), tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestUserspaceTunTcpSegmentation(t *testing.T) {
+	payload := make([]byte, 5000)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	for _, ipv6 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ipv6=%t", ipv6), func(t *testing.T) {
+			settings := DefaultUserspaceTunSettings()
+			settings.Mtu = 1280
+			nat := &fakeNat{}
+			publicIPv4, publicIPv6 := testPublicIPv4, testPublicIPv6
+			tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), &publicIPv4, &publicIPv6, settings, nat, func() {})
+			t.Cleanup(func() { tun.Close() })
+
+			packet := coalescedTcpPacket(t, ipv6, payload)
+			if n, err := tun.Write([][]byte{packet}, 0); err != nil || n != 1 {
+				t.Fatalf("expected 1 packet written, got %d: %v", n, err)
+			}
+			if len(nat.sent) != 5 {
+				t.Fatalf("expected the packet to be split into 5 segments, got %d", len(nat.sent))
+			}
+			if metrics := tun.Metrics(); metrics.PacketsSegmented != 1 || metrics.PacketsSent != 5 {
+				t.Fatalf("expected 1 packet segmented into 5 sent, got %+v", metrics)
+			}
+
+			// reassemble the segments
+			_, _, _, transport, _ := splitPacket(packet)
+			var reassembled []byte
+			for i, segment := range nat.sent {
+				if len(segment) > settings.Mtu || len(segment) != ipPacketLength(segment) {
+					t.Fatalf("segment %d of %d bytes exceeds the MTU or its IP length", i, len(segment))
+				}
+				if !ipv6 {
+					if ipv4HeaderChecksum(segment[:20]) != 0 {
+						t.Fatalf("segment %d has an invalid header checksum", i)
+					}
+					if id := binary.BigEndian.Uint16(segment[4:6]); id != 0xfffe+uint16(i) {
+						t.Fatalf("segment %d has id %d", i, id)
+					}
+				}
+				if !transportChecksumValid(segment) {
+					t.Fatalf("segment %d has an invalid checksum", i)
+				}
+				_, _, _, tcp, _ := splitPacket(segment)
+				if !bytes.Equal(tcp[20:32], transport[20:32]) {
+					t.Fatalf("segment %d does not keep the TCP options", i)
+				}
+				if seq := binary.BigEndian.Uint32(tcp[4:8]); seq != 0xffffff00+uint32(len(reassembled)) {
+					t.Fatalf("segment %d has sequence number %d, expected %d", i, seq, 0xffffff00+uint32(len(reassembled)))
+				}
+				first, last := i == 0, i == len(nat.sent)-1
+				if (tcp[13]&tcpFlagCwr != 0) != first || (tcp[13]&tcpFlagPsh != 0) != last || (tcp[13]&tcpFlagFin != 0) != last {
+					t.Fatalf("segment %d has unexpected flags %08b", i, tcp[13])
+				}
+				reassembled = append(reassembled, tcp[32:]...)
+			}
+			if !bytes.Equal(reassembled, payload) {
+				t.Fatalf("reassembled payload does not match the original")
+			}
+		})
+	}
+
+	// without segmentation, the packet is handled by the oversize policy
+	settings := DefaultUserspaceTunSettings()
+	settings.Mtu = 1280
+	settings.TcpSegmentation = false
+	tun, nat := newTestTun(t, settings)
+	if _, err := tun.Write([][]byte{coalescedTcpPacket(t, false, payload)}, 0); err == nil {
+		t.Fatalf("expected an error for an oversize packet")
+	}
+	if len(nat.sent) != 0 || tun.DropStats().WriteOversize != 1 {
+		t.Fatalf("expected the packet to be dropped, got %+v", tun.DropStats())
+	}
+}
+
+func TestUserspaceTunTtl(t *testing.T) {
+	for _, ttl := range []uint8{0, 1, 2} {
+		t.Run(fmt.Sprintf("ttl=%d", ttl), func(t *testing.T) {
+			tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+
+			packet := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 33434, 32, false)
+			packet[8] = ttl
+			binary.BigEndian.PutUint16(packet[10:12], 0)
+			binary.BigEndian.PutUint16(packet[10:12], ipv4HeaderChecksum(packet[:20]))
+			if _, err := tun.Write([][]byte{packet}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+
+			if 1 < ttl {
+				if len(nat.sent) != 1 {
+					t.Fatalf("expected one packet sent, got %d", len(nat.sent))
+				}
+				if sentTtl := nat.sent[0][8]; sentTtl != ttl-1 {
+					t.Fatalf("expected TTL %d, got %d", ttl-1, sentTtl)
+				}
+				return
+			}
+
+			if len(nat.sent) != 0 {
+				t.Fatalf("expected no packets sent, got %d", len(nat.sent))
+			}
+			if drops := tun.DropStats(); drops.WriteTtlExceeded != 1 {
+				t.Fatalf("expected 1 TTL exceeded drop, got %+v", drops)
+			}
+			timeExceeded, err := readPacket(t, tun, DefaultMtu)
+			if err != nil {
+				t.Fatalf("failed to read packet: %v", err)
+			}
+			if srcIP := net.IP(timeExceeded[12:16]); !srcIP.Equal(testPublicIPv4) {
+				t.Fatalf("expected ICMP from %v, got %v", testPublicIPv4, srcIP)
+			}
+			if dstIP := net.IP(timeExceeded[16:20]); !dstIP.Equal(testLocalIPv4) {
+				t.Fatalf("expected ICMP to %v, got %v", testLocalIPv4, dstIP)
+			}
+			if typ, code := timeExceeded[20], timeExceeded[21]; typ != layers.ICMPv4TypeTimeExceeded || code != layers.ICMPv4CodeTTLExceeded {
+				t.Fatalf("expected ICMP time exceeded, got type %d code %d", typ, code)
+			}
+			if !bytes.Equal(timeExceeded[28:], packet[:28]) {
+				t.Fatalf("expected the header of the dropped packet to be embedded")
+			}
+		})
+	}
+}
+
+func TestUserspaceTunHopLimit(t *testing.T) {
+	for _, hopLimit := range []uint8{0, 1, 2} {
+		t.Run(fmt.Sprintf("hop_limit=%d", hopLimit), func(t *testing.T) {
+			tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+			publicIPv6 := net.ParseIP("2001:db8::1")
+			if err := tun.SetPublicIPs([]net.IP{testPublicIPv4}, []net.IP{publicIPv6}); err != nil {
+				t.Fatalf("failed to set public IPs: %v", err)
+			}
+			localIPv6 := net.ParseIP("fd00::2")
+
+			ipv6 := &layers.IPv6{
+				Version:    6,
+				HopLimit:   hopLimit,
+				NextHeader: layers.IPProtocolUDP,
+				SrcIP:      localIPv6,
+				DstIP:      net.ParseIP("2001:db8:1::7"),
+			}
+			udp := &layers.UDP{SrcPort: 40000, DstPort: 33434}
+			udp.SetNetworkLayerForChecksum(ipv6)
+			buffer := gopacket.NewSerializeBuffer()
+			options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+			if err := gopacket.SerializeLayers(buffer, options, ipv6, udp, gopacket.Payload(make([]byte, 32))); err != nil {
+				t.Fatalf("failed to serialize packet: %v", err)
+			}
+
+			if _, err := tun.processWritePacket(decodePacket(buffer.Bytes())); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+
+			if 1 < hopLimit {
+				if len(nat.sent) != 1 {
+					t.Fatalf("expected one packet sent, got %d", len(nat.sent))
+				}
+				if sentHopLimit := nat.sent[0][7]; sentHopLimit != hopLimit-1 {
+					t.Fatalf("expected hop limit %d, got %d", hopLimit-1, sentHopLimit)
+				}
+				return
+			}
+
+			if len(nat.sent) != 0 {
+				t.Fatalf("expected no packets sent, got %d", len(nat.sent))
+			}
+			if drops := tun.DropStats(); drops.WriteTtlExceeded != 1 {
+				t.Fatalf("expected 1 TTL exceeded drop, got %+v", drops)
+			}
+			received, err := readPacket(t, tun, DefaultMtu)
+			if err != nil {
+				t.Fatalf("failed to read packet: %v", err)
+			}
+			reply := gopacket.NewPacket(received, layers.LayerTypeIPv6, gopacket.Default)
+			replyIPv6 := reply.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+			if !replyIPv6.SrcIP.Equal(publicIPv6) || !replyIPv6.DstIP.Equal(localIPv6) {
+				t.Fatalf("expected ICMPv6 from %v to %v, got %v to %v", publicIPv6, localIPv6, replyIPv6.SrcIP, replyIPv6.DstIP)
+			}
+			icmp, ok := reply.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+			if !ok || icmp.TypeCode.Type() != layers.ICMPv6TypeTimeExceeded || icmp.TypeCode.Code() != layers.ICMPv6CodeHopLimitExceeded {
+				t.Fatalf("expected ICMPv6 hop limit exceeded")
+			}
+		})
+	}
+}
+
+func TestUserspaceTunTtlNoIcmpError(t *testing.T) {
+	withTtl := func(packet []byte, ttl uint8) []byte {
+		packet[8] = ttl
+		binary.BigEndian.PutUint16(packet[10:12], 0)
+		binary.BigEndian.PutUint16(packet[10:12], ipv4HeaderChecksum(packet[:20]))
+		return packet
+	}
+	// an ICMP port unreachable for a datagram the client received
+	unreachable := []byte{layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort, 0, 0, 0, 0, 0, 0}
+	unreachable = append(unreachable, udpPacket(t, testRemoteIPv4, 53, testLocalIPv4, 40000, 0, false)[:28]...)
+
+	for _, tt := range []struct {
+		name   string
+		packet []byte
+		reply  bool
+	}{
+		{name: "echo request", packet: icmpEchoPacket(t, testLocalIPv4, testRemoteIPv4, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), 1), reply: true},
+		{name: "ICMP error", packet: ipv4Packet(t, layers.IPProtocolICMPv4, 0, unreachable)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+			if _, err := tun.Write([][]byte{withTtl(tt.packet, 1)}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+			if len(nat.sent) != 0 {
+				t.Fatalf("expected no packets sent, got %d", len(nat.sent))
+			}
+			if drops := tun.DropStats(); drops.WriteTtlExceeded != 1 {
+				t.Fatalf("expected 1 TTL exceeded drop, got %+v", drops)
+			}
+			if replies := len(tun.natRcv); (replies != 0) != tt.reply {
+				t.Fatalf("expected an ICMP time exceeded %t, got %d replies", tt.reply, replies)
+			}
+		})
+	}
+
+	// the fragments sent by clients are reassembled before the TTL is checked,
+	// but an ICMP error is never created for a following fragment
+	fragment := ipv4Packet(t, layers.IPProtocolUDP, 0, make([]byte, 16))
+	binary.BigEndian.PutUint16(fragment[6:8], 185)
+	if _, err := icmpTimeExceeded(withTtl(fragment, 1), testPublicIPv4); !errors.Is(err, errIcmpErrorNotAllowed) {
+		t.Fatalf("expected no ICMP time exceeded for a following fragment, got %v", err)
+	}
+}
+
+func TestUserspaceTunSetMTU(t *testing.T) {
+	tun, _ := newTestTun(t, DefaultUserspaceTunSettings())
+
+	if err := tun.SetMTU(minMtu - 1); err == nil {
+		t.Fatalf("expected error for MTU %d", minMtu-1)
+	}
+	if err := tun.SetMTU(1280); err != nil {
+		t.Fatalf("failed to set MTU: %v", err)
+	}
+	if tun.MTU() != 1280 {
+		t.Fatalf("expected MTU 1280, got %d", tun.MTU())
+	}
+	select {
+	case event := <-tun.Events():
+		if event != uwgtun.EventMTUUpdate {
+			t.Fatalf("expected MTU update event, got %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected MTU update event")
+	}
+
+	// packets are checked against the new MTU
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 1300, true)}, 0); err == nil {
+		t.Fatalf("expected error for packet exceeding the new MTU")
+	}
+	if drops := tun.DropStats(); drops.WriteOversize != 1 {
+		t.Fatalf("expected 1 oversize drop, got %+v", drops)
+	}
+}
+
+func TestUserspaceTunSetMTUNotBlocking(t *testing.T) {
+	tun, _ := newTestTun(t, DefaultUserspaceTunSettings())
+	// nobody drains the events
+	for len(tun.events) < cap(tun.events) {
+		tun.events <- uwgtun.EventUp
+	}
+
+	for _, mtu := range []int{1280, 1300, 1400} {
+		if err := tun.SetMTU(mtu); err != nil {
+			t.Fatalf("failed to set MTU: %v", err)
+		}
+	}
+
+	for i := 0; i < cap(tun.events); i += 1 {
+		if event := <-tun.Events(); event != uwgtun.EventUp {
+			t.Fatalf("expected the queued events first, got %v", event)
+		}
+	}
+	// the updates made while the events were not drained are coalesced
+	updates := 0
+	timeout := time.After(100 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case event := <-tun.Events():
+			if event != uwgtun.EventMTUUpdate {
+				t.Fatalf("expected MTU update event, got %v", event)
+			}
+			updates += 1
+		case <-timeout:
+			done = true
+		}
+	}
+	if updates < 1 || 2 < updates {
+		t.Fatalf("expected 1 or 2 coalesced MTU update events, got %d", updates)
+	}
+	if tun.MTU() != 1400 {
+		t.Fatalf("expected MTU 1400, got %d", tun.MTU())
+	}
+}
+
+func TestUserspaceTunReceiveQueueFull(t *testing.T) {
+	for name, policy := range map[string]ReceiveQueuePolicy{"drop newest": ReceiveQueueDropNewest, "drop oldest": ReceiveQueueDropOldest} {
+		t.Run(name, func(t *testing.T) {
+			settings := DefaultUserspaceTunSettings()
+			settings.ReceiveQueueSize = 4
+			settings.ReceiveQueuePolicy = policy
+			tun, nat := newTestTun(t, settings)
+
+			if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+			publicPort := sentPort(nat.sent[0])
+
+			// with no reader, the callback returns promptly and drops what does not fit
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for payloadLen := 1; payloadLen <= 10; payloadLen += 1 {
+					nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, payloadLen, false))
+				}
+			}()
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("NAT callback blocked on a full receive queue")
+			}
+			if drops := tun.DropStats(); drops.ReceiveQueueFull != 6 {
+				t.Fatalf("expected 6 receive queue drops, got %+v", drops)
+			}
+			if stats := tun.NatStats(); stats.ReceiveQueueDrops != 6 {
+				t.Fatalf("expected 6 receive queue drops, got %+v", stats)
+			}
+
+			// the queue keeps the first or the last packets
+			firstPayloadLen := 1
+			if policy == ReceiveQueueDropOldest {
+				firstPayloadLen = 7
+			}
+			for i := 0; i < settings.ReceiveQueueSize; i += 1 {
+				received, err := readPacket(t, tun, DefaultMtu)
+				if err != nil {
+					t.Fatalf("failed to read packet: %v", err)
+				}
+				if len(received) != 28+firstPayloadLen+i {
+					t.Fatalf("expected packet %d of %d bytes, got %d", i, 28+firstPayloadLen+i, len(received))
+				}
+			}
+		})
+	}
+}
+
+func TestUserspaceTunReceiveQueueBytes(t *testing.T) {
+	for name, policy := range map[string]ReceiveQueuePolicy{"drop newest": ReceiveQueueDropNewest, "drop oldest": ReceiveQueueDropOldest} {
+		t.Run(name, func(t *testing.T) {
+			settings := DefaultUserspaceTunSettings()
+			settings.ReceiveQueueBytes = maxMtu
+			settings.ReceiveQueuePolicy = policy
+			tun, nat := newTestTun(t, settings)
+
+			if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+			reply := udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, sentPort(nat.sent[0]), 1000, false)
+			// the queue has room for packets but not for their bytes
+			fit := maxMtu / len(reply)
+			for i := 0; i < fit+10; i += 1 {
+				nat.receive(reply)
+			}
+			metrics := tun.Metrics()
+			if metrics.Drops.ReceiveQueueFull != 10 || metrics.ReceiveQueueLength != fit {
+				t.Fatalf("expected %d packets queued and 10 dropped, got %+v", fit, metrics)
+			}
+			if metrics.ReceiveQueueBytes != int64(fit*len(reply)) || metrics.ReceiveQueueBytesCapacity != maxMtu {
+				t.Fatalf("expected %d bytes queued, got %+v", fit*len(reply), metrics)
+			}
+
+			for i := 0; i < fit; i += 1 {
+				if _, err := readPacket(t, tun, DefaultMtu); err != nil {
+					t.Fatalf("failed to read packet: %v", err)
+				}
+			}
+			// the high water marks are kept once the queue is read
+			metrics = tun.Metrics()
+			if metrics.ReceiveQueueLength != 0 || metrics.ReceiveQueueBytes != 0 {
+				t.Fatalf("expected an empty queue, got %+v", metrics)
+			}
+			if metrics.ReceiveQueueHighWater != int64(fit) || metrics.ReceiveQueueBytesHighWater != int64(fit*len(reply)) {
+				t.Fatalf("expected high water marks of %d packets and %d bytes, got %+v", fit, fit*len(reply), metrics)
+			}
+		})
+	}
+}
+
+func TestUserspaceTunClose(t *testing.T) {
+	tun, _ := newTestTun(t, DefaultUserspaceTunSettings())
+	tun.Close()
+	if _, err := readPacket(t, tun, DefaultMtu); err == nil {
+		t.Fatalf("expected error reading from closed tun")
+	}
+}
+
+func TestUserspaceTunCloseConcurrent(t *testing.T) {
+	for i := 0; i < 20; i += 1 {
+		tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+		reply := udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, sentPort(nat.sent[0]), 10, false)
+		request := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)
+
+		var wg sync.WaitGroup
+		run := func(f func() bool) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for f() {
+				}
+			}()
+		}
+		// packets and events are injected and consumed until the tun is closed
+		run(func() bool {
+			nat.receive(reply)
+			_, err := tun.Write([][]byte{request}, 0)
+			return err == nil
+		})
+		run(func() bool {
+			tun.AddEvent(uwgtun.EventMTUUpdate)
+			select {
+			case <-tun.closed:
+				return false
+			default:
+				return true
+			}
+		})
+		run(func() bool {
+			_, ok := <-tun.Events()
+			return ok
+		})
+		run(func() bool {
+			_, err := tun.Read([][]byte{make([]byte, DefaultMtu)}, []int{0}, 0)
+			return err == nil
+		})
+
+		time.Sleep(time.Millisecond)
+		for j := 0; j < 2; j += 1 {
+			run(func() bool {
+				tun.Close()
+				return false
+			})
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("goroutines did not return after close")
+		}
+	}
+}
+
+// echoNat replies to each sent packet after a delay, like a NAT with packets in flight.
+// Replies are lost once the callback was removed.
+type echoNat struct {
+	fakeNat
+	delay time.Duration
+	reply func(packet []byte) []byte
+	wg    sync.WaitGroup
+}
+
+func (nat *echoNat) SendPacket(source connect.TransferPath, provideMode protocol.ProvideMode, packet []byte, timeout time.Duration) bool {
+	nat.fakeNat.SendPacket(source, provideMode, packet, timeout)
+	reply := nat.reply(packet)
+	nat.wg.Add(1)
+	go func() {
+		defer nat.wg.Done()
+		time.Sleep(nat.delay)
+		nat.mu.Lock()
+		callback := nat.callback
+		nat.mu.Unlock()
+		if callback != nil {
+			callback(connect.TransferPath{}, connect.IpProtocolUdp, reply)
+		}
+	}()
+	return true
+}
+
+func (nat *echoNat) AddReceivePacketCallback(receiveCallback connect.ReceivePacketFunction) func() {
+	nat.fakeNat.AddReceivePacketCallback(receiveCallback)
+	return func() {
+		nat.mu.Lock()
+		defer nat.mu.Unlock()
+		nat.callback = nil
+	}
+}
+
+func TestUserspaceTunCloseDrain(t *testing.T) {
+	nat := &echoNat{
+		delay: 5 * time.Millisecond,
+		reply: func(packet []byte) []byte {
+			return udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, sentPort(packet), 10, false)
+		},
+	}
+	publicIPv4 := testPublicIPv4
+	tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), &publicIPv4, nil, DefaultUserspaceTunSettings(), nat, func() {})
+	defer nat.wg.Wait()
+
+	// packets are written right up to close, their replies are still in flight
+	const packets = 50
+	for i := 0; i < packets; i += 1 {
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000+i, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	start := time.Now()
+	tun.Close()
+	if elapsed := time.Since(start); DefaultCloseGracePeriod <= elapsed {
+		t.Fatalf("expected close to return before the grace period, took %v", elapsed)
+	}
+
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != os.ErrClosed {
+		t.Fatalf("expected writes to be refused after close, got %v", err)
+	}
+	bufs := [][]byte{make([]byte, DefaultMtu)}
+	read := 0
+	for {
+		_, err := tun.Read(bufs, []int{0}, 0)
+		if err == os.ErrClosed {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read packet: %v", err)
+		}
+		read += 1
+	}
+	if read != packets {
+		t.Fatalf("expected the %d replies in flight to be read before os.ErrClosed, got %d", packets, read)
+	}
+}
+
+var _ userNat = (*connect.LocalUserNat)(nil)
+
+// icmpEchoPacket serializes an IPv4 ICMP echo request or reply.
+func icmpEchoPacket(t *testing.T, srcIP net.IP, dstIP net.IP, typeCode layers.ICMPv4TypeCode, id uint16) []byte {
+	t.Helper()
+	ipv4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+	icmp := &layers.ICMPv4{
+		TypeCode: typeCode,
+		Id:       id,
+		Seq:      1,
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ipv4, icmp, gopacket.Payload([]byte("ping"))); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestUserspaceTunIcmpEcho(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+
+	request := icmpEchoPacket(t, testLocalIPv4, testRemoteIPv4, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), 1234)
+	n, err := tun.Write([][]byte{request}, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 packet written, got %d: %v", n, err)
+	}
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected one packet sent, got %d", len(nat.sent))
+	}
+	sent := nat.sent[0]
+	if srcIP := net.IP(sent[12:16]); !srcIP.Equal(testPublicIPv4) {
+		t.Fatalf("expected source %v, got %v", testPublicIPv4, srcIP)
+	}
+	if ipv4HeaderChecksum(sent[20:]) != 0 {
+		t.Fatalf("sent ICMP packet has an invalid checksum")
+	}
+
+	reply := icmpEchoPacket(t, testRemoteIPv4, testPublicIPv4, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), uint16(sentPort(sent)))
+	go nat.receive(reply)
+	received, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if dstIP := net.IP(received[16:20]); !dstIP.Equal(testLocalIPv4) {
+		t.Fatalf("expected destination %v, got %v", testLocalIPv4, dstIP)
+	}
+	if ipv4HeaderChecksum(received[20:]) != 0 {
+		t.Fatalf("received ICMP packet has an invalid checksum")
+	}
+	if id := binary.BigEndian.Uint16(received[24:26]); id != 1234 {
+		t.Fatalf("expected echo identifier 1234, got %d", id)
+	}
+	if !bytes.Equal(received[28:], []byte("ping")) {
+		t.Fatalf("expected payload to be preserved, got %q", received[28:])
+	}
+}
+
+func TestUserspaceTunIcmpEchoIPv6(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+	publicIPv6 := net.ParseIP("2001:db8::1")
+	if err := tun.SetPublicIPs([]net.IP{testPublicIPv4}, []net.IP{publicIPv6}); err != nil {
+		t.Fatalf("failed to set public IPs: %v", err)
+	}
+	localIPv6 := net.ParseIP("fd00::2")
+	remoteIPv6 := net.ParseIP("2001:db8:1::7")
+
+	icmpv6Packet := func(srcIP net.IP, dstIP net.IP, echoType uint8, id uint16) []byte {
+		ipv6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      srcIP,
+			DstIP:      dstIP,
+		}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(echoType, 0)}
+		icmp.SetNetworkLayerForChecksum(ipv6)
+		echo := &layers.ICMPv6Echo{Identifier: id, SeqNumber: 1}
+
+		buffer := gopacket.NewSerializeBuffer()
+		options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buffer, options, ipv6, icmp, echo, gopacket.Payload([]byte("ping"))); err != nil {
+			t.Fatalf("failed to serialize packet: %v", err)
+		}
+		return buffer.Bytes()
+	}
+
+	n, err := tun.Write([][]byte{icmpv6Packet(localIPv6, remoteIPv6, layers.ICMPv6TypeEchoRequest, 4321)}, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 packet written, got %d: %v", n, err)
+	}
+
+	publicId := binary.BigEndian.Uint16(nat.sent[0][44:46])
+	go nat.receive(icmpv6Packet(remoteIPv6, publicIPv6, layers.ICMPv6TypeEchoReply, publicId))
+	received, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	packet := gopacket.NewPacket(received, layers.LayerTypeIPv6, gopacket.Default)
+	ipv6 := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ipv6.DstIP.Equal(localIPv6) {
+		t.Fatalf("expected destination %v, got %v", localIPv6, ipv6.DstIP)
+	}
+	echo, ok := packet.Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo)
+	if !ok || echo.Identifier != 4321 {
+		t.Fatalf("expected echo reply with identifier 4321")
+	}
+}
+
+func TestUserspaceTunIPv6Flow(t *testing.T) {
+	nat := &fakeNat{}
+	publicIPv6 := net.ParseIP("2001:db8::1")
+	tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), nil, &publicIPv6, DefaultUserspaceTunSettings(), nat, func() {})
+	t.Cleanup(func() { tun.Close() })
+	localIPv6 := net.ParseIP("fd00::2")
+	remoteIPv6 := net.ParseIP("2001:db8:1::7")
+
+	// the packet is decoded as IPv6 by Write, and the buffer can be reused once written
+	request := udpv6Packet(t, localIPv6, 40000, remoteIPv6, 53, []byte("query"))
+	if n, err := tun.Write([][]byte{request}, 0); err != nil || n != 1 {
+		t.Fatalf("expected 1 packet written, got %d: %v", n, err)
+	}
+	clear(request)
+	if srcIP := net.IP(nat.sent[0][8:24]); !srcIP.Equal(publicIPv6) {
+		t.Fatalf("expected source %v, got %v", publicIPv6, srcIP)
+	}
+	entries := tun.NATEntries()
+	if len(entries) != 1 || len(entries[0].ClientIP) != net.IPv6len || !entries[0].ClientIP.Equal(localIPv6) {
+		t.Fatalf("expected a NAT entry for %v, got %v", localIPv6, entries)
+	}
+
+	// the reply is decoded as IPv6 by the NAT callback and the local source is restored exactly
+	publicPort := int(binary.BigEndian.Uint16(nat.sent[0][40:42]))
+	go nat.receive(udpv6Packet(t, remoteIPv6, 53, publicIPv6, publicPort, []byte("query")))
+	received, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	packet := gopacket.NewPacket(received, layers.LayerTypeIPv6, gopacket.Default)
+	ipv6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok || !bytes.Equal(ipv6.DstIP, localIPv6.To16()) {
+		t.Fatalf("expected destination %v, got %v", localIPv6, ipv6)
+	}
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || udp.DstPort != 40000 {
+		t.Fatalf("expected destination port 40000, got %v", udp)
+	}
+}
+
+func TestUserspaceTunIcmpErrorTranslation(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+
+	// traceroute probe from the client
+	probe := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 33434, 32, false)
+	if _, err := tun.Write([][]byte{probe}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+
+	// a router replies with time exceeded, embedding the header of the probe as it was sent through the NAT
+	routerIPv4 := net.ParseIP("198.51.100.1").To4()
+	ipv4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    routerIPv4,
+		DstIP:    testPublicIPv4,
+	}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded)}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ipv4, icmp, gopacket.Payload(nat.sent[0][:28])); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+
+	go nat.receive(buffer.Bytes())
+	received, err := readPacket(t, tun, DefaultMtu)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if dstIP := net.IP(received[16:20]); !dstIP.Equal(testLocalIPv4) {
+		t.Fatalf("expected destination %v, got %v", testLocalIPv4, dstIP)
+	}
+	if ipv4HeaderChecksum(received[20:]) != 0 {
+		t.Fatalf("received ICMP packet has an invalid checksum")
+	}
+	embedded := received[28:]
+	if srcIP := net.IP(embedded[12:16]); !srcIP.Equal(testLocalIPv4) {
+		t.Fatalf("expected embedded source %v, got %v", testLocalIPv4, srcIP)
+	}
+	if ipv4HeaderChecksum(embedded[:20]) != 0 {
+		t.Fatalf("embedded IPv4 header has an invalid checksum")
+	}
+	if srcPort := binary.BigEndian.Uint16(embedded[20:22]); srcPort != 40000 {
+		t.Fatalf("expected embedded source port 40000, got %d", srcPort)
+	}
+	// the embedded UDP checksum is restored to the one of the probe before NAT
+	if !bytes.Equal(embedded[26:28], probe[26:28]) {
+		t.Fatalf("expected embedded UDP checksum %x, got %x", probe[26:28], embedded[26:28])
+	}
+}
+
+func TestUserspaceTunIcmpErrorTypes(t *testing.T) {
+	publicIPv6 := net.ParseIP("2001:db8::1")
+	localIPv6 := net.ParseIP("fd00::2")
+	remoteIPv6 := net.ParseIP("2001:db8:1::7")
+	routerIPv4 := net.ParseIP("198.51.100.1").To4()
+	routerIPv6 := net.ParseIP("2001:db8:1::1")
+
+	// icmpError serializes an error from a router about the packet sent through the NAT,
+	// embedding embeddedLen bytes of it after the 4 bytes of restOfHeader
+	icmpError := func(t *testing.T, sent []byte, embeddedLen int, v4TypeCode layers.ICMPv4TypeCode, v6TypeCode layers.ICMPv6TypeCode, restOfHeader uint32) []byte {
+		buffer := gopacket.NewSerializeBuffer()
+		options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		var err error
+		if sent[0]>>4 == 4 {
+			ipv4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: routerIPv4, DstIP: testPublicIPv4}
+			icmp := &layers.ICMPv4{TypeCode: v4TypeCode, Id: uint16(restOfHeader >> 16), Seq: uint16(restOfHeader)}
+			err = gopacket.SerializeLayers(buffer, options, ipv4, icmp, gopacket.Payload(sent[:embeddedLen]))
+		} else {
+			ipv6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: routerIPv6, DstIP: publicIPv6}
+			icmp := &layers.ICMPv6{TypeCode: v6TypeCode}
+			icmp.SetNetworkLayerForChecksum(ipv6)
+			payload := binary.BigEndian.AppendUint32(nil, restOfHeader)
+			err = gopacket.SerializeLayers(buffer, options, ipv6, icmp, gopacket.Payload(append(payload, sent[:embeddedLen]...)))
+		}
+		if err != nil {
+			t.Fatalf("failed to serialize packet: %v", err)
+		}
+		return buffer.Bytes()
+	}
+
+	for _, tt := range []struct {
+		name         string
+		request      func(t *testing.T) []byte
+		embeddedLen  int
+		v4TypeCode   layers.ICMPv4TypeCode
+		v6TypeCode   layers.ICMPv6TypeCode
+		restOfHeader uint32
+	}{
+		{
+			"port unreachable",
+			func(t *testing.T) []byte {
+				return udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)
+			},
+			28,
+			layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort),
+			0,
+			0,
+		},
+		{
+			// only 8 bytes of the TCP header are embedded, without the checksum
+			"fragmentation needed",
+			func(t *testing.T) []byte {
+				return tcpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 443, func(tcp *layers.TCP) { tcp.ACK = true })
+			},
+			28,
+			layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+			0,
+			1400,
+		},
+		{
+			"packet too big",
+			func(t *testing.T) []byte {
+				return udpv6Packet(t, localIPv6, 40000, remoteIPv6, 53, make([]byte, 1300))
+			},
+			48,
+			0,
+			layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0),
+			1280,
+		},
+		{
+			"IPv6 address unreachable",
+			func(t *testing.T) []byte {
+				return udpv6Packet(t, localIPv6, 40000, remoteIPv6, 53, []byte("query"))
+			},
+			48,
+			0,
+			layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAddressUnreachable),
+			0,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+			if err := tun.SetPublicIPs([]net.IP{testPublicIPv4}, []net.IP{publicIPv6}); err != nil {
+				t.Fatalf("failed to set public IPs: %v", err)
+			}
+			if _, err := tun.Write([][]byte{tt.request(t)}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+			if len(nat.sent) != 1 {
+				t.Fatalf("expected 1 packet to be sent, got %d", len(nat.sent))
+			}
+
+			nat.receive(icmpError(t, nat.sent[0], tt.embeddedLen, tt.v4TypeCode, tt.v6TypeCode, tt.restOfHeader))
+			received, err := readPacket(t, tun, DefaultMtu)
+			if err != nil {
+				t.Fatalf("failed to read packet: %v", err)
+			}
+
+			var dstIP, embeddedSrcIP net.IP
+			var icmp, embedded []byte
+			if received[0]>>4 == 4 {
+				dstIP, icmp = received[16:20], received[20:]
+				embedded = icmp[8:]
+				embeddedSrcIP = embedded[12:16]
+				if ipv4HeaderChecksum(embedded[:20]) != 0 {
+					t.Fatalf("embedded IPv4 header has an invalid checksum")
+				}
+				if ipv4HeaderChecksum(icmp) != 0 {
+					t.Fatalf("received ICMP packet has an invalid checksum")
+				}
+			} else {
+				dstIP, icmp = received[24:40], received[40:]
+				embedded = icmp[8:]
+				embeddedSrcIP = embedded[8:24]
+				// the checksum covers the pseudo header
+				pseudoHeader := append(append([]byte(nil), received[8:40]...), 0, 0, 0, 0, 0, 0, 0, byte(layers.IPProtocolICMPv6))
+				binary.BigEndian.PutUint16(pseudoHeader[34:36], uint16(len(icmp)))
+				if ipv4HeaderChecksum(append(pseudoHeader, icmp...)) != 0 {
+					t.Fatalf("received ICMPv6 packet has an invalid checksum")
+				}
+			}
+			clientIP := testLocalIPv4
+			if received[0]>>4 == 6 {
+				clientIP = localIPv6
+			}
+			if !dstIP.Equal(clientIP) || !embeddedSrcIP.Equal(clientIP) {
+				t.Fatalf("expected the error and the embedded packet to be addressed to %v, got %v and %v", clientIP, dstIP, embeddedSrcIP)
+			}
+			if srcPort := binary.BigEndian.Uint16(embedded[tt.embeddedLen-8:]); srcPort != 40000 {
+				t.Fatalf("expected embedded source port 40000, got %d", srcPort)
+			}
+			// the next hop MTU is kept for path MTU discovery
+			if restOfHeader := binary.BigEndian.Uint32(icmp[4:8]); restOfHeader != tt.restOfHeader {
+				t.Fatalf("expected rest of header %d, got %d", tt.restOfHeader, restOfHeader)
+			}
+		})
+	}
+}
+
+func TestUserspaceTunReadBatch(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+	if tun.BatchSize() != conn.IdealBatchSize {
+		t.Fatalf("expected batch size %d, got %d", conn.IdealBatchSize, tun.BatchSize())
+	}
+
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	publicPort := sentPort(nat.sent[0])
+	for payloadLen := 1; payloadLen <= 3; payloadLen += 1 {
+		nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, payloadLen, false))
+	}
+
+	bufs := make([][]byte, 8)
+	for i := range bufs {
+		bufs[i] = make([]byte, DefaultMtu)
+	}
+	sizes := make([]int, len(bufs))
+	n, err := tun.Read(bufs, sizes, 0)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 packets read, got %d: %v", n, err)
+	}
+	for i := 0; i < n; i += 1 {
+		if sizes[i] != 28+i+1 {
+			t.Fatalf("expected packet %d of %d bytes, got %d", i, 28+i+1, sizes[i])
+		}
+	}
+}
+
+func TestUserspaceTunReadBufferTooSmall(t *testing.T) {
+	tun, nat := newTestTun(t, DefaultUserspaceTunSettings())
+
+	if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	publicPort := sentPort(nat.sent[0])
+
+	// the first packet does not fit the buffer, the second one does
+	nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, 200, false))
+	nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, publicPort, 50, false))
+
+	received, err := readPacket(t, tun, 100)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if len(received) != 28+50 {
+		t.Fatalf("expected the packet that fits of %d bytes, got %d bytes", 28+50, len(received))
+	}
+	if drops := tun.DropStats(); drops.ReadBufferTooSmall != 1 {
+		t.Fatalf("expected 1 buffer too small drop, got %+v", drops)
+	}
+}
+
+// flakyNat fails to send the first failures packets, as if its send queue was full.
+type flakyNat struct {
+	fakeNat
+	failures int
+}
+
+func (nat *flakyNat) SendPacket(source connect.TransferPath, provideMode protocol.ProvideMode, packet []byte, timeout time.Duration) bool {
+	nat.mu.Lock()
+	if 0 < nat.failures {
+		nat.failures -= 1
+		nat.mu.Unlock()
+		return false
+	}
+	nat.mu.Unlock()
+	return nat.fakeNat.SendPacket(source, provideMode, packet, timeout)
+}
+
+// ipv4Packet serializes an IPv4 packet of a protocol other than TCP, UDP and ICMP.
+func ipv4Packet(t testing.TB, protocol layers.IPProtocol, flags layers.IPv4Flag, payload []byte) []byte {
+	t.Helper()
+	ipv4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: protocol,
+		Flags:    flags,
+		SrcIP:    testLocalIPv4,
+		DstIP:    testRemoteIPv4,
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, serializeOptions, ipv4, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestUserspaceTunDropReasons(t *testing.T) {
+	truncated := udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)[:24]
+	gre := ipv4Packet(t, layers.IPProtocolGRE, 0, make([]byte, 16))
+	// a valid IPv4 header with version 5
+	unknownVersion := append([]byte(nil), gre...)
+	unknownVersion[0] = 5<<4 | unknownVersion[0]&0x0f
+
+	for _, tt := range []struct {
+		name      string
+		configure func(settings *UserspaceTunSettings)
+		trigger   func(t *testing.T, tun *UserspaceTun, nat *fakeNat)
+		counter   func(drops DropStats) uint64
+	}{
+		{"write decode failed", nil, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			tun.Write([][]byte{truncated}, 0)
+		}, func(drops DropStats) uint64 { return drops.DecodeFailed }},
+		{"receive decode failed", nil, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			nat.receive(truncated)
+		}, func(drops DropStats) uint64 { return drops.DecodeFailed }},
+		{"write no IP layer", nil, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			if _, err := tun.Write([][]byte{unknownVersion}, 0); err == nil {
+				t.Fatalf("expected an error for an unknown IP version")
+			}
+		}, func(drops DropStats) uint64 { return drops.NoIPLayer }},
+		{"receive no IP layer", nil, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			nat.receive(unknownVersion)
+		}, func(drops DropStats) uint64 { return drops.NoIPLayer }},
+		{"write no transport", nil, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			tun.Write([][]byte{gre}, 0)
+		}, func(drops DropStats) uint64 { return drops.NoTransport }},
+		{"receive no transport", nil, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			nat.receive(gre)
+		}, func(drops DropStats) uint64 { return drops.NoTransport }},
+		{"unsupported transport", nil, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			nat.receive(ipv4Packet(t, layers.IPProtocolUDP, layers.IPv4MoreFragments, make([]byte, 16)))
+		}, func(drops DropStats) uint64 { return drops.UnsupportedTransport }},
+		{"no public IP", nil, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			packet := udpv6Packet(t, net.ParseIP("fd00::2"), 40000, net.ParseIP("2001:db8:1::7"), 53, []byte("query"))
+			if _, err := tun.Write([][]byte{packet}, 0); err == nil {
+				t.Fatalf("expected an error without an IPv6 public IP")
+			}
+		}, func(drops DropStats) uint64 { return drops.NoPublicIP }},
+		{"NAT ports exhausted", func(settings *UserspaceTunSettings) {
+			settings.NatPortRangeEnd = settings.NatPortRangeStart
+		}, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+			if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40001, testRemoteIPv4, 53, 10, false)}, 0); err == nil {
+				t.Fatalf("expected an error when the NAT ports are exhausted")
+			}
+		}, func(drops DropStats) uint64 { return drops.NatPortsExhausted }},
+		{"no NAT entry", nil, func(t *testing.T, tun *UserspaceTun, nat *fakeNat) {
+			nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, 40000, 10, false))
+		}, func(drops DropStats) uint64 { return drops.NoNatEntry }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := DefaultUserspaceTunSettings()
+			if tt.configure != nil {
+				tt.configure(settings)
+			}
+			tun, nat := newTestTun(t, settings)
+			tt.trigger(t, tun, nat)
+			if n := tt.counter(tun.DropStats()); n != 1 {
+				t.Fatalf("expected 1 drop, got %+v", tun.DropStats())
+			}
+			if len(tun.natRcv) != 0 {
+				t.Fatalf("expected no packet to be delivered")
+			}
+		})
+	}
+
+	t.Run("send failed", func(t *testing.T) {
+		nat := &flakyNat{failures: DefaultSendRetries + 1}
+		publicIPv4 := testPublicIPv4
+		tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), &publicIPv4, nil, DefaultUserspaceTunSettings(), nat, func() {})
+		t.Cleanup(func() { tun.Close() })
+		// the packet is dropped without failing the batch
+		if _, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+		if drops := tun.DropStats(); drops.SendFailed != 1 {
+			t.Fatalf("expected 1 send failure, got %+v", drops)
+		}
+		if retries := tun.Metrics().SendRetries; retries != DefaultSendRetries {
+			t.Fatalf("expected %d retries, got %d", DefaultSendRetries, retries)
+		}
+	})
+}
+
+func TestUserspaceTunSendRetry(t *testing.T) {
+	nat := &flakyNat{failures: 1}
+	publicIPv4 := testPublicIPv4
+	tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), &publicIPv4, nil, DefaultUserspaceTunSettings(), nat, func() {})
+	t.Cleanup(func() { tun.Close() })
+
+	n, err := tun.Write([][]byte{udpPacket(t, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected the packet to be written, got %d, %v", n, err)
+	}
+	if len(nat.sent) != 1 {
+		t.Fatalf("expected the retry to send the packet, got %d packets", len(nat.sent))
+	}
+	if metrics := tun.Metrics(); metrics.SendRetries != 1 || metrics.PacketsSent != 1 || metrics.Drops.SendFailed != 0 {
+		t.Fatalf("expected 1 retry and no drop, got %+v", metrics)
+	}
+}
+
+func TestUserspaceTunDropLogSampled(t *testing.T) {
+	var lines []string
+	log := &logger.Logger{
+		Verbosef: func(format string, args ...any) { lines = append(lines, fmt.Sprintf(format, args...)) },
+		Errorf:   logger.DiscardLogf,
+	}
+	nat := &fakeNat{}
+	publicIPv4 := testPublicIPv4
+	tun := newUserspaceTun(log, &publicIPv4, nil, DefaultUserspaceTunSettings(), nat, func() {})
+	t.Cleanup(func() { tun.Close() })
+
+	packet := ipv4Packet(t, layers.IPProtocolGRE, 0, make([]byte, 16))
+	for i := 0; i < 2*dropLogSampleRate+1; i += 1 {
+		nat.receive(packet)
+	}
+	if drops := tun.DropStats(); drops.NoTransport != 2*dropLogSampleRate+1 {
+		t.Fatalf("expected %d drops, got %+v", 2*dropLogSampleRate+1, drops)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 sampled log lines, got %q", lines)
+	}
+	// the count is formatted with any logger, not only the slog adapter
+	if !strings.HasSuffix(lines[2], fmt.Sprintf("(%d dropped)", 2*dropLogSampleRate+1)) || strings.Contains(lines[2], "%!") {
+		t.Fatalf("expected the log line to end with the number of drops, got %q", lines[2])
+	}
+}
+
+func TestUserspaceTunNatMissLogSampled(t *testing.T) {
+	var lines, dumps int
+	var line string
+	log := &logger.Logger{
+		Verbosef: func(format string, args ...any) {
+			lines += 1
+			line = fmt.Sprintf(format, args...)
+			if strings.Contains(format, "dump of the packet") {
+				dumps += 1
+			}
+		},
+		Errorf: logger.DiscardLogf,
+	}
+	settings := DefaultUserspaceTunSettings()
+	settings.NatMissLogLimit = 2
+	nat := &fakeNat{}
+	publicIPv4 := testPublicIPv4
+	tun := newUserspaceTun(log, &publicIPv4, nil, settings, nat, func() {})
+	t.Cleanup(func() { tun.Close() })
+
+	// unsolicited packets to two ports are logged up to the limit per port
+	for _, port := range []int{40000, 40001} {
+		for i := 0; i < 10; i += 1 {
+			nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, port, 10, false))
+		}
+	}
+	if drops := tun.DropStats(); drops.NoNatEntry != 20 {
+		t.Fatalf("expected 20 drops, got %+v", drops)
+	}
+	if stats := tun.NatStats(); stats.LookupMisses != 20 {
+		t.Fatalf("expected 20 lookup misses, got %+v", stats)
+	}
+	if lines != 4 || dumps != 0 {
+		t.Fatalf("expected 4 sampled log lines, got %d with %d dumps", lines, dumps)
+	}
+	// the endpoint is formatted with any logger
+	if expected := "NatReceive: no NAT entry found for 203.0.113.1:40001 (12 dropped)"; line != expected {
+		t.Fatalf("expected the log line %q, got %q", expected, line)
+	}
+
+	// the limit resets after a minute
+	if logged, _ := tun.sampleNatMiss(40000, time.Now()); logged {
+		t.Fatalf("expected the miss not to be logged within the minute")
+	}
+	if logged, _ := tun.sampleNatMiss(40000, time.Now().Add(natMissWindow)); !logged {
+		t.Fatalf("expected the miss to be logged after a minute")
+	}
+
+	// the first misses are dumped regardless of the limit
+	tun.settings.NatMissDumpLimit = 1
+	lines = 0
+	for i := 0; i < 3; i += 1 {
+		nat.receive(udpPacket(t, testRemoteIPv4, 53, testPublicIPv4, 40000, 10, false))
+	}
+	if lines != 2 || dumps != 1 {
+		t.Fatalf("expected 2 log lines with 1 dump, got %d with %d dumps", lines, dumps)
+	}
+}
+
+func BenchmarkUserspaceTunReceive(b *testing.B) {
+	for _, batchSize := range []int{1, conn.IdealBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			tun, nat := newTestTun(b, DefaultUserspaceTunSettings())
+			if _, err := tun.Write([][]byte{udpPacket(b, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+				b.Fatalf("failed to write packet: %v", err)
+			}
+			reply := udpPacket(b, testRemoteIPv4, 53, testPublicIPv4, sentPort(nat.sent[0]), 1000, false)
+
+			bufs := make([][]byte, batchSize)
+			for i := range bufs {
+				bufs[i] = make([]byte, DefaultMtu)
+			}
+			sizes := make([]int, batchSize)
+
+			b.SetBytes(int64(len(reply)))
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i += 1 {
+					// NOTE: a dropped packet would never be read
+					for len(tun.natRcv) == cap(tun.natRcv) {
+						runtime.Gosched()
+					}
+					nat.receive(reply)
+				}
+			}()
+			for read := 0; read < b.N; {
+				n, err := tun.Read(bufs, sizes, 0)
+				if err != nil {
+					b.Fatalf("failed to read packets: %v", err)
+				}
+				read += n
+			}
+		})
+	}
+}
+
+// BenchmarkUserspaceTunReceiveBursty delivers bursts of packets while the device does not read,
+// as during a transient stall of the encrypt loop of a WireGuard device, and reports the share of the packets read.
+func BenchmarkUserspaceTunReceiveBursty(b *testing.B) {
+	const burstSize = 256
+	for _, queueSize := range []int{1, 64, DefaultReceiveQueueSize} {
+		b.Run(fmt.Sprintf("queue=%d", queueSize), func(b *testing.B) {
+			settings := DefaultUserspaceTunSettings()
+			settings.ReceiveQueueSize = queueSize
+			tun, nat := newTestTun(b, settings)
+			if _, err := tun.Write([][]byte{udpPacket(b, testLocalIPv4, 40000, testRemoteIPv4, 53, 10, false)}, 0); err != nil {
+				b.Fatalf("failed to write packet: %v", err)
+			}
+			reply := udpPacket(b, testRemoteIPv4, 53, testPublicIPv4, sentPort(nat.sent[0]), 1000, false)
+
+			bufs := make([][]byte, conn.IdealBatchSize)
+			for i := range bufs {
+				bufs[i] = make([]byte, DefaultMtu)
+			}
+			sizes := make([]int, conn.IdealBatchSize)
+
+			b.SetBytes(int64(len(reply)))
+			b.ResetTimer()
+			read := 0
+			for delivered := 0; delivered < b.N; {
+				burst := min(burstSize, b.N-delivered)
+				for i := 0; i < burst; i += 1 {
+					nat.receive(reply)
+				}
+				delivered += burst
+				// the device reads the queued packets once it resumes
+				for 0 < len(tun.natRcv) {
+					n, err := tun.Read(bufs, sizes, 0)
+					if err != nil {
+						b.Fatalf("failed to read packets: %v", err)
+					}
+					read += n
+				}
+			}
+			b.ReportMetric(100*float64(read)/float64(b.N), "%read")
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/urnetwork/connect"
+)
+
+// DefaultWriteWorkers processes the packets of a batch sequentially.
+// Servers with spare cores can use a few workers (e.g. 4), the NAT table is shared by all workers.
+// The workers are started with the TUN, see runWriteWorker.
+const DefaultWriteWorkers = 1
+
+const (
+	// a packet the NAT did not accept is sent again up to twice, after 5ms then 10ms
+	DefaultSendRetries      = 2
+	DefaultSendRetryBackoff = 5 * time.Millisecond
+	// each attempt waits up to sendTimeout for the NAT to accept the packet
+	sendTimeout = 1 * time.Second
+)
+
+// sendWithRetry sends a packet through the NAT. The NAT refuses packets when its send queue stays full
+// for sendTimeout, which is usually transient backpressure, so the packet is sent again
+// up to SendRetries times with a doubling backoff. It does not retry once the TUN is closing.
+// Returns false if the NAT did not accept the packet.
+func (tun *UserspaceTun) sendWithRetry(packet []byte) bool {
+	backoff := tun.settings.SendRetryBackoff
+	for retry := 0; ; retry += 1 {
+		if tun.nat.SendPacket(connect.TransferPath{}, tun.provideMode, packet, sendTimeout) {
+			return true
+		}
+		if tun.settings.SendRetries <= retry {
+			return false
+		}
+		tun.packets.sendRetries.Add(1)
+		select {
+		case <-tun.closing:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// writeJob is a shard of a batch passed to Write, processed by a write worker.
+type writeJob struct {
+	bufs   [][]byte
+	offset int
+	shard  []int
+}
+
+// runWriteWorker processes the jobs of writeParallel until the TUN is closing.
+// The TUN runs WriteWorkers-1 write workers, the goroutine calling Write is the last worker.
+func (tun *UserspaceTun) runWriteWorker() {
+	for {
+		select {
+		case <-tun.closing:
+			return
+		case job := <-tun.writeJobs:
+			tun.writeShard(job.bufs, job.offset, job.shard)
+			tun.writeWg.Done()
+		}
+	}
+}
+
+// writeShard processes the packets of bufs at the indexes of shard, in order.
+func (tun *UserspaceTun) writeShard(bufs [][]byte, offset int, shard []int) {
+	for _, i := range shard {
+		tun.writeCounts[i], tun.writeErrs[i] = tun.writePacket(bufs[i][offset:])
+	}
+}
+
+// writeParallel processes the packets of a batch with workers of the write workers, including the calling goroutine.
+// The results are the same as processing the packets in order: the total count and the errors joined in packet order.
+// writeOpMu must be held.
+func (tun *UserspaceTun) writeParallel(bufs [][]byte, offset int, workers int) (int, error) {
+	for len(tun.writeShards) < workers {
+		tun.writeShards = append(tun.writeShards, nil)
+	}
+	shards := tun.writeShards[:workers]
+	for i := range shards {
+		shards[i] = shards[i][:0]
+	}
+	for i := range bufs {
+		shard := flowHash(bufs[i][offset:]) % uint32(workers)
+		shards[shard] = append(shards[shard], i)
+	}
+	tun.writeCounts = slices.Grow(tun.writeCounts[:0], len(bufs))[:len(bufs)]
+	tun.writeErrs = slices.Grow(tun.writeErrs[:0], len(bufs))[:len(bufs)]
+
+	for _, shard := range shards[1:] {
+		if len(shard) == 0 {
+			continue
+		}
+		tun.writeWg.Add(1)
+		select {
+		case tun.writeJobs <- writeJob{bufs: bufs, offset: offset, shard: shard}:
+		case <-tun.closing:
+			// the workers may have stopped
+			tun.writeShard(bufs, offset, shard)
+			tun.writeWg.Done()
+		}
+	}
+	tun.writeShard(bufs, offset, shards[0])
+	tun.writeWg.Wait()
+
+	var (
+		errs  error
+		total int
+	)
+	for i := range bufs {
+		if tun.writeErrs[i] != nil {
+			errs = errors.Join(errs, tun.writeErrs[i])
+		}
+		total += tun.writeCounts[i]
+	}
+	clear(tun.writeErrs)
+	return total, errs
+}
+
+// flowHash returns a hash of the flow of a serialized packet, from its addresses, protocol and ports
+// (or ICMP echo identifier). The fragments of an IPv4 datagram hash on their identification instead,
+// so that they are reassembled in the order they were written.
+func flowHash(packet []byte) uint32 {
+	srcIP, dstIP, protocol, transport, ok := splitPacket(packet)
+	if !ok {
+		return 0
+	}
+	h := fnv1a(fnv1aOffset, srcIP)
+	h = fnv1a(h, dstIP)
+	h = fnv1a(h, []byte{byte(protocol)})
+	if len(srcIP) == 4 && binary.BigEndian.Uint16(packet[6:8])&(ipv4FlagMoreFragments|ipv4FragmentOffset) != 0 {
+		return fnv1a(h, packet[4:6])
+	}
+	switch protocol {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP:
+		if 4 <= len(transport) {
+			h = fnv1a(h, transport[0:4])
+		}
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		if 6 <= len(transport) {
+			h = fnv1a(h, transport[4:6])
+		}
+	}
+	return h
+}
+
+const (
+	fnv1aOffset = 2166136261
+	fnv1aPrime  = 16777619
+)
+
+// fnv1a adds b to the 32-bit FNV-1a hash h, without the allocation of hash/fnv.
+func fnv1a(h uint32, b []byte) uint32 {
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= fnv1aPrime
+	}
+	return h
+}
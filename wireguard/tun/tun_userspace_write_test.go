@@ -0,0 +1,107 @@
+package tun
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/urnetwork/userwireguard/logger"
+)
+
+func TestUserspaceTunWriteWorkers(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.WriteWorkers = 4
+	tun, nat := newTestTun(t, settings)
+
+	// the packets of each flow have increasing sizes, interleaved with the other flows
+	const flows = 16
+	const packetsPerFlow = 8
+	bufs := [][]byte{}
+	for j := 0; j < packetsPerFlow; j += 1 {
+		for i := 0; i < flows; i += 1 {
+			bufs = append(bufs, udpPacket(t, testLocalIPv4, 40000+i, testRemoteIPv4, 53, 10+j, false))
+		}
+	}
+	// an unsupported packet is reported like with a single worker
+	bufs = append(bufs, []byte{0x45})
+
+	n, err := tun.Write(bufs, 0)
+	if n != flows*packetsPerFlow {
+		t.Fatalf("expected %d packets written, got %d", flows*packetsPerFlow, n)
+	}
+	if err == nil {
+		t.Fatalf("expected an error for the unsupported packet")
+	}
+
+	sizes := map[int][]int{}
+	for _, sent := range nat.sent {
+		port := sentPort(sent)
+		sizes[port] = append(sizes[port], len(sent))
+	}
+	if len(sizes) != flows {
+		t.Fatalf("expected %d flows, got %d", flows, len(sizes))
+	}
+	for port, flowSizes := range sizes {
+		for j, size := range flowSizes {
+			if size != 28+10+j {
+				t.Fatalf("expected the packets of port %d in order, got sizes %v", port, flowSizes)
+			}
+		}
+	}
+}
+
+func TestUserspaceTunWriteWorkersClosing(t *testing.T) {
+	settings := DefaultUserspaceTunSettings()
+	settings.WriteWorkers = 4
+	tun, nat := newTestTun(t, settings)
+
+	bufs := [][]byte{}
+	for i := 0; i < 16; i += 1 {
+		bufs = append(bufs, udpPacket(t, testLocalIPv4, 40000+i, testRemoteIPv4, 53, 10, false))
+	}
+
+	// a batch written while the TUN is closing is processed once the workers stopped
+	tun.Close()
+	done := make(chan int)
+	go func() {
+		tun.writeOpMu.Lock()
+		defer tun.writeOpMu.Unlock()
+		n, _ := tun.writeParallel(bufs, 0, settings.WriteWorkers)
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n != len(bufs) || len(nat.sent) != len(bufs) {
+			t.Fatalf("expected %d packets written, got %d and %d sent", len(bufs), n, len(nat.sent))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("write blocked on the stopped workers")
+	}
+}
+
+func BenchmarkUserspaceTunWriteWorkers(b *testing.B) {
+	// a batch of 64 flows
+	bufs := make([][]byte, 128)
+	for i := range bufs {
+		bufs[i] = udpPacket(b, testLocalIPv4, 40000+i%64, testRemoteIPv4, 53, 1000, false)
+	}
+
+	for _, workers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			settings := DefaultUserspaceTunSettings()
+			settings.WriteWorkers = workers
+			publicIPv4 := testPublicIPv4
+			tun := newUserspaceTun(logger.NewLogger(logger.LogLevelSilent, ""), &publicIPv4, nil, settings, &discardNat{}, func() {})
+			b.Cleanup(func() { tun.Close() })
+
+			b.SetBytes(int64(len(bufs) * len(bufs[0])))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i += 1 {
+				if _, err := tun.Write(bufs, 0); err != nil {
+					b.Fatalf("failed to write packets: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/urnetwork/connect/wireguard/tun"
+)
+
+// parseDscp parses the -dscp flag: preserve, bleach, or a remap list of codepoints such as 46=34,26=0.
+func parseDscp(value string) (tun.DscpPolicy, map[uint8]uint8, error) {
+	switch value {
+	case "preserve":
+		return tun.DscpPreserve, nil, nil
+	case "bleach":
+		return tun.DscpBleach, nil, nil
+	}
+	remap := map[uint8]uint8{}
+	for _, pair := range strings.Split(value, ",") {
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown DSCP policy %q", value)
+		}
+		dscp, err := strconv.ParseUint(strings.TrimSpace(from), 10, 6)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid DSCP %q: %w", from, err)
+		}
+		mark, err := strconv.ParseUint(strings.TrimSpace(to), 10, 6)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid DSCP %q: %w", to, err)
+		}
+		remap[uint8(dscp)] = uint8(mark)
+	}
+	return tun.DscpRemap, remap, nil
+}
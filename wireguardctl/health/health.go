@@ -0,0 +1,368 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+	"time"
+
+	"github.com/urnetwork/connect/wireguard/logging"
+	"github.com/urnetwork/connect/wireguard/tun"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// maximum time a probe waits for the device to answer before it is considered stuck
+const DefaultProbeTimeout = 2 * time.Second
+
+// a handshake is recent if it happened within this time (WireGuard rekeys every 2 minutes while there is traffic)
+const RecentHandshakeTimeout = 3 * time.Minute
+
+// Methods needed from a WireGuard device to report health
+type Device interface {
+	IpcGet() (*wgtypes.Device, error)
+}
+
+// Methods needed to get and change the log level at runtime
+type LogLevel interface {
+	Level() int
+	SetLevel(level int)
+}
+
+// Methods needed from the userspace TUN to report NAT metrics and dump the NAT table
+type Nat interface {
+	NatStats() tun.NatStats
+	DropStats() tun.DropStats
+	NATEntries() []tun.NATEntry
+}
+
+// DeviceHealth is a snapshot of the state of a device.
+type DeviceHealth struct {
+	BindOpen        bool `json:"bind_open"`        // the device listens on a port
+	Up              bool `json:"up"`               // the device was brought up (see SetReady)
+	PrivateKeySet   bool `json:"private_key_set"`  // the device has a private key
+	RecentHandshake bool `json:"recent_handshake"` // at least one peer completed a handshake within RecentHandshakeTimeout
+}
+
+// Ready returns true if the device is up, configured and at least one peer is connected.
+func (h DeviceHealth) Ready() bool {
+	return h.BindOpen && h.Up && h.PrivateKeySet && h.RecentHandshake
+}
+
+type Status struct {
+	Health        DeviceHealth `json:"health"`
+	Ready         bool         `json:"ready"`
+	Peers         int          `json:"peers"`
+	ReceiveBytes  int64        `json:"rx_bytes"`
+	TransmitBytes int64        `json:"tx_bytes"`
+	UptimeSeconds float64      `json:"uptime_seconds"`
+	Nat           *NatStatus   `json:"nat,omitempty"`
+	Drops         *DropStatus  `json:"drops,omitempty"`
+}
+
+// NatStatus are the counters of the NAT table (see tun.NatStats).
+type NatStatus struct {
+	Entries         int    `json:"entries"`
+	Created         uint64 `json:"created"`
+	IdleEvictions   uint64 `json:"idle_evictions"`
+	ClosedEvictions uint64 `json:"closed_evictions"`
+	LookupMisses    uint64 `json:"lookup_misses"`
+	// packets received from the NAT dropped because the device did not read them fast enough
+	ReceiveQueueDrops uint64 `json:"receive_queue_drops"`
+	// packets sent by clients dropped by their rate limit
+	RateLimitDrops uint64 `json:"rate_limit_drops"`
+	// keepalives sent for idle flows
+	Keepalives uint64 `json:"keepalives"`
+}
+
+// DropStatus are the counters of packets dropped by the TUN, by reason (see tun.DropStats).
+type DropStatus struct {
+	DecodeFailed         uint64 `json:"decode_failed"`
+	NoIPLayer            uint64 `json:"no_ip_layer"`
+	NoTransport          uint64 `json:"no_transport"`
+	UnsupportedTransport uint64 `json:"unsupported_transport"`
+	NoPublicIP           uint64 `json:"no_public_ip"`
+	NatPortsExhausted    uint64 `json:"nat_ports_exhausted"`
+	NoNatEntry           uint64 `json:"no_nat_entry"`
+	SerializeFailed      uint64 `json:"serialize_failed"`
+	SendFailed           uint64 `json:"send_failed"`
+	WriteOversize        uint64 `json:"write_oversize"`
+	WriteTtlExceeded     uint64 `json:"write_ttl_exceeded"`
+	FragmentsExpired     uint64 `json:"fragments_expired"`
+	ReadOversize         uint64 `json:"read_oversize"`
+	ReadBufferTooSmall   uint64 `json:"read_buffer_too_small"`
+	ReceiveQueueFull     uint64 `json:"receive_queue_full"`
+}
+
+// Server serves liveness (/healthz), readiness (/readyz) and status (/status) endpoints for a device.
+// Optional endpoints are enabled with SetLogLevel, SetNat and SetDebug.
+//
+// The device is live as long as it answers IpcGet within the probe timeout.
+// The device is ready once SetReady(true) has been called (i.e. the config was applied and the device is up)
+// and the bind is open (the device reports a listen port).
+type Server struct {
+	server       *http.Server
+	device       Device
+	startTime    time.Time
+	ready        atomic.Bool
+	logLevel     atomic.Pointer[LogLevel]
+	nat          atomic.Pointer[Nat]
+	debug        atomic.Bool
+	ProbeTimeout time.Duration
+}
+
+func NewServer(addr string, device Device) *Server {
+	s := &Server{
+		device:       device,
+		startTime:    time.Now(),
+		ProbeTimeout: DefaultProbeTimeout,
+	}
+	s.server = &http.Server{
+		Addr:    addr,
+		Handler: s.Handler(),
+	}
+	return s
+}
+
+// SetReady marks the device as (not) ready to receive traffic.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// SetLogLevel enables the /loglevel endpoint.
+// GET returns the current level, POST changes it to the level in the request body (e.g. "verbose").
+func (s *Server) SetLogLevel(logLevel LogLevel) {
+	s.logLevel.Store(&logLevel)
+}
+
+// SetNat adds the NAT counters to /status and enables the /debug/nat endpoint, which dumps the NAT table.
+func (s *Server) SetNat(nat Nat) {
+	s.nat.Store(&nat)
+}
+
+// SetDebug enables (or disables) the /debug/pprof/ endpoints of net/http/pprof
+// and the /debug/vars endpoint, which serves the variables published with expvar.
+func (s *Server) SetDebug(enabled bool) {
+	s.debug.Store(enabled)
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/status", s.status)
+	mux.HandleFunc("/loglevel", s.loglevel)
+	mux.HandleFunc("/debug/nat", s.debugNat)
+	mux.HandleFunc("/debug/pprof/", s.debugOnly(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", s.debugOnly(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", s.debugOnly(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", s.debugOnly(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", s.debugOnly(pprof.Trace))
+	mux.HandleFunc("/debug/vars", s.debugOnly(expvar.Handler().ServeHTTP))
+	return mux
+}
+
+// debugOnly serves a debug endpoint if enabled with SetDebug.
+func (s *Server) debugOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.debug.Load() {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Start serves the endpoints in a goroutine. errorCallback is called if the server fails.
+func (s *Server) Start(errorCallback func(err error)) {
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errorCallback(err)
+		}
+	}()
+}
+
+// Stop tries to shutdown the server gracefully (waits max 5 secs to finish pending requests).
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("health server forced to shutdown: %w", err)
+	}
+	return nil
+}
+
+// Health returns the health of the device.
+//
+// An error is returned if the device could not be queried within the probe timeout.
+func (s *Server) Health() (DeviceHealth, error) {
+	device, err := s.deviceState()
+	if err != nil {
+		return DeviceHealth{}, err
+	}
+	return s.deviceHealth(device), nil
+}
+
+func (s *Server) deviceHealth(device *wgtypes.Device) DeviceHealth {
+	health := DeviceHealth{
+		BindOpen:      device.ListenPort != 0,
+		Up:            s.ready.Load(),
+		PrivateKeySet: device.PrivateKey != (wgtypes.Key{}),
+	}
+	now := time.Now()
+	for _, peer := range device.Peers {
+		if !peer.LastHandshakeTime.IsZero() && now.Sub(peer.LastHandshakeTime) < RecentHandshakeTimeout {
+			health.RecentHandshake = true
+			break
+		}
+	}
+	return health
+}
+
+// deviceState gets the state of the device, failing if the device does not answer within the probe timeout.
+func (s *Server) deviceState() (*wgtypes.Device, error) {
+	type result struct {
+		device *wgtypes.Device
+		err    error
+	}
+	// buffered so that the goroutine can exit if the probe timed out
+	results := make(chan result, 1)
+	go func() {
+		device, err := s.device.IpcGet()
+		results <- result{device: device, err: err}
+	}()
+	select {
+	case r := <-results:
+		return r.device, r.err
+	case <-time.After(s.ProbeTimeout):
+		return nil, errors.New("device did not respond in time")
+	}
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.deviceState(); err != nil {
+		http.Error(w, fmt.Sprintf("not live: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	// NOTE: a recent handshake is not required, since peers cannot connect to a server that is not ready
+	health, err := s.Health()
+	switch {
+	case err != nil:
+		http.Error(w, fmt.Sprintf("not ready: %v", err), http.StatusServiceUnavailable)
+	case !health.Up:
+		http.Error(w, "not ready: device is not up", http.StatusServiceUnavailable)
+	case !health.BindOpen:
+		http.Error(w, "not ready: bind is not open", http.StatusServiceUnavailable)
+	case !health.PrivateKeySet:
+		http.Error(w, "not ready: private key is not set", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	device, err := s.deviceState()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	health := s.deviceHealth(device)
+	status := Status{
+		Health:        health,
+		Ready:         health.Up && health.BindOpen && health.PrivateKeySet,
+		Peers:         len(device.Peers),
+		UptimeSeconds: time.Since(s.startTime).Seconds(),
+	}
+	for _, peer := range device.Peers {
+		status.ReceiveBytes += peer.ReceiveBytes
+		status.TransmitBytes += peer.TransmitBytes
+	}
+	if natPtr := s.nat.Load(); natPtr != nil {
+		natStats := (*natPtr).NatStats()
+		status.Nat = &NatStatus{
+			Entries:           natStats.Entries,
+			Created:           natStats.Created,
+			IdleEvictions:     natStats.IdleEvictions,
+			ClosedEvictions:   natStats.ClosedEvictions,
+			LookupMisses:      natStats.LookupMisses,
+			ReceiveQueueDrops: natStats.ReceiveQueueDrops,
+			RateLimitDrops:    natStats.RateLimitDrops,
+			Keepalives:        natStats.Keepalives,
+		}
+		dropStats := (*natPtr).DropStats()
+		status.Drops = &DropStatus{
+			DecodeFailed:         dropStats.DecodeFailed,
+			NoIPLayer:            dropStats.NoIPLayer,
+			NoTransport:          dropStats.NoTransport,
+			UnsupportedTransport: dropStats.UnsupportedTransport,
+			NoPublicIP:           dropStats.NoPublicIP,
+			NatPortsExhausted:    dropStats.NatPortsExhausted,
+			NoNatEntry:           dropStats.NoNatEntry,
+			SerializeFailed:      dropStats.SerializeFailed,
+			SendFailed:           dropStats.SendFailed,
+			WriteOversize:        dropStats.WriteOversize,
+			WriteTtlExceeded:     dropStats.WriteTtlExceeded,
+			FragmentsExpired:     dropStats.FragmentsExpired,
+			ReadOversize:         dropStats.ReadOversize,
+			ReadBufferTooSmall:   dropStats.ReadBufferTooSmall,
+			ReceiveQueueFull:     dropStats.ReceiveQueueFull,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *Server) loglevel(w http.ResponseWriter, r *http.Request) {
+	logLevelPtr := s.logLevel.Load()
+	if logLevelPtr == nil {
+		http.NotFound(w, r)
+		return
+	}
+	logLevel := *logLevelPtr
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level, err := logging.ParseLevel(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logLevel.SetLevel(level)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, logging.LevelString(logLevel.Level()))
+}
+
+func (s *Server) debugNat(w http.ResponseWriter, r *http.Request) {
+	natPtr := s.nat.Load()
+	if natPtr == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	entries := (*natPtr).NATEntries()
+	fmt.Fprintf(w, "%d entries\n", len(entries))
+	for _, entry := range entries {
+		fmt.Fprintln(w, entry)
+	}
+}
@@ -0,0 +1,257 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urnetwork/connect/wireguard/logging"
+	"github.com/urnetwork/connect/wireguard/tun"
+	"github.com/urnetwork/userwireguard/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type stubDevice struct {
+	device *wgtypes.Device
+	err    error
+	block  chan struct{}
+}
+
+func (d *stubDevice) IpcGet() (*wgtypes.Device, error) {
+	if d.block != nil {
+		<-d.block
+	}
+	return d.device, d.err
+}
+
+type stubNat struct {
+	stats   tun.NatStats
+	drops   tun.DropStats
+	entries []tun.NATEntry
+}
+
+func (n *stubNat) NatStats() tun.NatStats {
+	return n.stats
+}
+
+func (n *stubNat) DropStats() tun.DropStats {
+	return n.drops
+}
+
+func (n *stubNat) NATEntries() []tun.NATEntry {
+	return n.entries
+}
+
+func get(t *testing.T, s *Server, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestHealthz(t *testing.T) {
+	d := &stubDevice{device: &wgtypes.Device{}}
+	s := NewServer("", d)
+	if w := get(t, s, "/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("healthz = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	d.err = errors.New("ipc error")
+	if w := get(t, s, "/healthz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("healthz with ipc error = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHealthzStuckDevice(t *testing.T) {
+	d := &stubDevice{device: &wgtypes.Device{}, block: make(chan struct{})}
+	defer close(d.block)
+	s := NewServer("", d)
+	s.ProbeTimeout = 10 * time.Millisecond
+	if w := get(t, s, "/healthz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("healthz with stuck device = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	d := &stubDevice{device: &wgtypes.Device{}}
+	s := NewServer("", d)
+
+	if w := get(t, s, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before SetReady = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	s.SetReady(true)
+	if w := get(t, s, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz without listen port = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	d.device.ListenPort = 51820
+	if w := get(t, s, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz without private key = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	d.device.PrivateKey[0] = 1
+	if w := get(t, s, "/readyz"); w.Code != http.StatusOK {
+		t.Fatalf("readyz = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	s.SetReady(false)
+	if w := get(t, s, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz after SetReady(false) = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	d := &stubDevice{device: &wgtypes.Device{
+		ListenPort: 51820,
+		PrivateKey: wgtypes.Key{1},
+		Peers: []wgtypes.Peer{
+			{ReceiveBytes: 10, TransmitBytes: 20},
+			{ReceiveBytes: 1, TransmitBytes: 2},
+		},
+	}}
+	s := NewServer("", d)
+	s.SetReady(true)
+
+	w := get(t, s, "/status")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var status Status
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if !status.Ready || status.Peers != 2 || status.ReceiveBytes != 11 || status.TransmitBytes != 22 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if status.UptimeSeconds < 0 {
+		t.Fatalf("negative uptime %v", status.UptimeSeconds)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	s := NewServer("", &stubDevice{device: &wgtypes.Device{}})
+	if w := get(t, s, "/loglevel"); w.Code != http.StatusNotFound {
+		t.Fatalf("loglevel without SetLogLevel = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	level := logging.NewLevel(logger.LogLevelError)
+	s.SetLogLevel(level)
+	if w := get(t, s, "/loglevel"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "error" {
+		t.Fatalf("loglevel = %d %q, want %d %q", w.Code, w.Body.String(), http.StatusOK, "error")
+	}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/loglevel", strings.NewReader(body)))
+		return w
+	}
+	if w := post("verbose"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "verbose" {
+		t.Fatalf("post loglevel = %d %q", w.Code, w.Body.String())
+	}
+	if level.Level() != logger.LogLevelVerbose {
+		t.Fatalf("level = %d, want %d", level.Level(), logger.LogLevelVerbose)
+	}
+	if w := post("loud"); w.Code != http.StatusBadRequest {
+		t.Fatalf("post unknown loglevel = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if level.Level() != logger.LogLevelVerbose {
+		t.Fatalf("level changed by an invalid request")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	d := &stubDevice{device: &wgtypes.Device{}}
+	s := NewServer("", d)
+
+	health, err := s.Health()
+	if err != nil {
+		t.Fatalf("Health() error = %v", err)
+	}
+	if health != (DeviceHealth{}) || health.Ready() {
+		t.Fatalf("unconfigured device health = %+v, want not ready", health)
+	}
+
+	// configuration
+	d.device.ListenPort = 51820
+	d.device.PrivateKey = wgtypes.Key{1}
+	d.device.Peers = []wgtypes.Peer{{PublicKey: wgtypes.Key{2}}}
+	s.SetReady(true)
+	health, _ = s.Health()
+	if !health.BindOpen || !health.Up || !health.PrivateKeySet || health.RecentHandshake || health.Ready() {
+		t.Fatalf("configured device health = %+v, want ready except for the handshake", health)
+	}
+
+	// stale handshake
+	d.device.Peers[0].LastHandshakeTime = time.Now().Add(-2 * RecentHandshakeTimeout)
+	if health, _ = s.Health(); health.RecentHandshake {
+		t.Fatalf("stale handshake should not count as recent")
+	}
+
+	// handshake
+	d.device.Peers[0].LastHandshakeTime = time.Now()
+	if health, _ = s.Health(); !health.Ready() {
+		t.Fatalf("device health after handshake = %+v, want ready", health)
+	}
+}
+
+func TestNat(t *testing.T) {
+	s := NewServer("", &stubDevice{device: &wgtypes.Device{}})
+	if w := get(t, s, "/debug/nat"); w.Code != http.StatusNotFound {
+		t.Fatalf("debug/nat without nat = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	s.SetNat(&stubNat{
+		stats: tun.NatStats{Entries: 1, Created: 3, IdleEvictions: 2, LookupMisses: 5, ReceiveQueueDrops: 7},
+		drops: tun.DropStats{NoNatEntry: 5, DecodeFailed: 2, ReceiveQueueFull: 7},
+		entries: []tun.NATEntry{
+			{PublicIP: "203.0.113.1", PublicPort: 1024, ClientIP: net.ParseIP("192.168.90.2"), ClientPort: 40000},
+		},
+	})
+
+	w := get(t, s, "/status")
+	var status Status
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	want := NatStatus{Entries: 1, Created: 3, IdleEvictions: 2, LookupMisses: 5, ReceiveQueueDrops: 7}
+	if status.Nat == nil || *status.Nat != want {
+		t.Fatalf("status nat = %+v, want %+v", status.Nat, want)
+	}
+	wantDrops := DropStatus{NoNatEntry: 5, DecodeFailed: 2, ReceiveQueueFull: 7}
+	if status.Drops == nil || *status.Drops != wantDrops {
+		t.Fatalf("status drops = %+v, want %+v", status.Drops, wantDrops)
+	}
+
+	w = get(t, s, "/debug/nat")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "192.168.90.2:40000 -> 203.0.113.1:1024") {
+		t.Fatalf("debug/nat = %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestDebug(t *testing.T) {
+	s := NewServer("", &stubDevice{device: &wgtypes.Device{}})
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		if w := get(t, s, path); w.Code != http.StatusNotFound {
+			t.Fatalf("%s without debug = %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+
+	s.SetDebug(true)
+	if w := get(t, s, "/debug/pprof/"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Fatalf("debug/pprof = %d %q", w.Code, w.Body.String())
+	}
+	w := get(t, s, "/debug/vars")
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vars["memstats"]; !ok {
+		t.Fatalf("debug/vars = %q, want memstats", w.Body.String())
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/urnetwork/connect/wireguard/logging"
+	"github.com/urnetwork/userwireguard/logger"
+)
+
+// loggedLevel is a log level that logs a single line whenever it changes,
+// so that the transition is visible in the logs themselves.
+type loggedLevel struct {
+	level *logging.Level
+	log   *logger.Logger
+}
+
+func (l loggedLevel) Level() int {
+	return l.level.Level()
+}
+
+func (l loggedLevel) SetLevel(level int) {
+	// clamp first, so that setting a level past either end is not logged as a change
+	level = min(max(level, logger.LogLevelSilent), logger.LogLevelVerbose)
+	previous := l.level.Level()
+	if level == previous {
+		return
+	}
+	// log at error level so that the line is visible unless logging is (or was) silent
+	if level == logger.LogLevelSilent {
+		l.log.Errorf("Log level changed from %s to %s", logging.LevelString(previous), logging.LevelString(level))
+		l.level.SetLevel(level)
+	} else {
+		l.level.SetLevel(level)
+		l.log.Errorf("Log level changed from %s to %s", logging.LevelString(previous), logging.LevelString(level))
+	}
+}
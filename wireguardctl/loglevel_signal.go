@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleLogLevelSignals raises the log level on SIGUSR1 and lowers it on SIGUSR2.
+func handleLogLevelSignals(logLevel loggedLevel) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				logLevel.SetLevel(logLevel.Level() + 1)
+			case syscall.SIGUSR2:
+				logLevel.SetLevel(logLevel.Level() - 1)
+			}
+		}
+	}()
+}
@@ -0,0 +1,7 @@
+//go:build windows
+
+package main
+
+// handleLogLevelSignals is a no-op since windows has no SIGUSR1/SIGUSR2.
+// The log level can still be changed through the health endpoint.
+func handleLogLevelSignals(logLevel loggedLevel) {}
@@ -6,12 +6,21 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/urnetwork/connect/wireguard/logging"
 	"github.com/urnetwork/connect/wireguard/tun"
+	"github.com/urnetwork/connect/wireguardctl/health"
+	"github.com/urnetwork/connect/wireguardctl/sdnotify"
+	"github.com/urnetwork/connect/wireguardctl/state"
 	"github.com/urnetwork/userwireguard/conn"
 	"github.com/urnetwork/userwireguard/device"
 	"github.com/urnetwork/userwireguard/logger"
@@ -20,30 +29,147 @@ import (
 )
 
 func main() {
-	// set logger to wanted log level (available - LogLevelVerbose, LogLevelError, LogLevelSilent)
-	logLevel := logger.LogLevelVerbose // verbose/debug logging
-	logger := logger.NewLogger(logLevel, "")
+	healthListen := flag.String("health-listen", "", "address to serve /healthz, /readyz, /status, /debug/nat and the debug endpoints on, e.g. :8080 (disabled if empty)")
+	stateFile := flag.String("state-file", "", "file to save the device configuration to and restore it from on startup (disabled if empty)")
+	natStateFile := flag.String("nat-state-file", "", "file to save the NAT mappings to on shutdown and restore them from on startup, so that client connections survive a restart (disabled if empty)")
+	privateKeyFile := flag.String("private-key-file", "", "file with the server private key (referenced by the state file)")
+	presharedKeyDir := flag.String("preshared-key-dir", "", "directory to save the preshared keys of the peers to, one key file per peer referenced by the state file (preshared keys are not saved if empty)")
+	publicIPv4Flag := flag.String("public-ipv4", "", "public IPv4 address of the server (discovered if both public addresses are empty)")
+	publicIPv6Flag := flag.String("public-ipv6", "", "public IPv6 address of the server (discovered if both public addresses are empty)")
+	logFormat := flag.String("log-format", "text", "log format, text or json (one object per line with level, time, prefix and msg)")
+	stunServer := flag.String("stun-server", "", "STUN server used to discover the public addresses if the default route has a private address, e.g. stun.l.google.com:19302")
+	debugEndpoints := flag.Bool("debug-endpoints", false, "serve /debug/pprof/ and /debug/vars (expvar, with the TUN metrics) on the health listener")
+	natMode := flag.String("nat-mode", "source", "source to NAT the clients to the public addresses, or passthrough to forward their packets unmodified (the public addresses are then optional)")
+	natPortPolicy := flag.String("nat-port-policy", "sequential", "allocation of the public ports of the NAT, sequential, random or preserve (the client port if free, see /debug/nat)")
+	flowLogSampleRate := flag.Int("flow-log-sample-rate", 0, "log the first packet of each NAT flow and then 1 in this many packets of the flow (0 disables the flow log)")
+	natKeepalive := flag.Duration("nat-keepalive", 0, "send a keepalive for established TCP connections and UDP flows idle for this interval, so that upstream NAT mappings are kept (0 disables keepalives)")
+	logUnsolicited := flag.Int("log-unsolicited", 0, "log the first N packets received without a NAT entry with a dump of the packet, to diagnose NAT mapping bugs")
+	dscp := flag.String("dscp", "preserve", "DSCP of the packets sent by clients, preserve, bleach (clear), or a remap list such as 46=34,26=0 (other codepoints are kept). The DSCP of the first packet of a flow marks the whole flow, ECN is set by the OS")
+	timingSampleRate := flag.Int("timing-sample-rate", tun.DefaultTimingSampleRate, "time the data path stages of 1 in this many packets, reported in /debug/vars (0 disables)")
+	flag.Parse()
 
-	// public IP addresses (change these to server's public IP addresses)
-	var publicIPv4 net.IP = net.IPv4(1, 2, 3, 4)
-	var publicIPv6 net.IP = nil
+	// set logger to wanted log level (available - LogLevelVerbose, LogLevelError, LogLevelSilent)
+	// the level can be changed at runtime with SIGUSR1 (up), SIGUSR2 (down) or POST /loglevel on the health server
+	logLevel := logging.NewLevel(logger.LogLevelVerbose) // verbose/debug logging
+	var logger *logger.Logger
+	switch *logFormat {
+	case "text":
+		logger = logging.NewLoggerWithLevel(logLevel, "")
+	case "json":
+		logger = logging.NewJSONLoggerWithLevel(logLevel, "")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown log format %q\n", *logFormat)
+		os.Exit(2)
+	}
+	runtimeLogLevel := loggedLevel{level: logLevel, log: logger}
+	handleLogLevelSignals(runtimeLogLevel)
 
 	// tun device
-	utun, err := tun.CreateUserspaceTUN(logger, &publicIPv4, &publicIPv6)
+	tunSettings := tun.DefaultUserspaceTunSettings()
+	switch *natMode {
+	case "source":
+		tunSettings.NatMode = tun.NatModeSource
+	case "passthrough":
+		tunSettings.NatMode = tun.NatModePassthrough
+	default:
+		fmt.Fprintf(os.Stderr, "unknown NAT mode %q\n", *natMode)
+		os.Exit(2)
+	}
+	switch *natPortPolicy {
+	case "sequential":
+		tunSettings.NatPortPolicy = tun.NatPortSequential
+	case "random":
+		tunSettings.NatPortPolicy = tun.NatPortRandom
+	case "preserve":
+		tunSettings.NatPortPolicy = tun.NatPortPreserve
+	default:
+		fmt.Fprintf(os.Stderr, "unknown NAT port policy %q\n", *natPortPolicy)
+		os.Exit(2)
+	}
+	dscpPolicy, dscpRemap, err := parseDscp(*dscp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	tunSettings.DscpPolicy = dscpPolicy
+	tunSettings.DscpRemap = dscpRemap
+
+	// public IP addresses, not discovered in passthrough mode
+	var publicIPv4, publicIPv6 *net.IP
+	if tunSettings.NatMode == tun.NatModeSource || *publicIPv4Flag != "" || *publicIPv6Flag != "" {
+		publicIPv4, publicIPv6, err = publicIPs(*publicIPv4Flag, *publicIPv6Flag, *stunServer)
+		if err != nil {
+			logger.Errorf("Failed to get public IP addresses: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	tunSettings.TimingSampleRate = *timingSampleRate
+	tunSettings.FlowLogSampleRate = *flowLogSampleRate
+	tunSettings.NatMissDumpLimit = *logUnsolicited
+	tunSettings.NatKeepaliveInterval = *natKeepalive
+	utun, err := tun.CreateUserspaceTUNWithSettings(logger, publicIPv4, publicIPv6, tunSettings)
 	if err != nil {
 		logger.Errorf("Failed to create TUN device: %v", err)
 		os.Exit(1)
 	}
+	userspaceTun, _ := utun.(*tun.UserspaceTun)
+
+	// restore the NAT mappings before the device sends packets, a corrupt file starts with an empty NAT table
+	if *natStateFile != "" && userspaceTun != nil {
+		loaded, err := userspaceTun.LoadNatState(*natStateFile)
+		if err == nil {
+			logger.Verbosef("Restored %d NAT mappings from %s", loaded, *natStateFile)
+		} else if !os.IsNotExist(err) {
+			logger.Errorf("Failed to load NAT state file: %v", err)
+		}
+	}
 
 	// wireguard device
 	device := device.NewDevice(utun, conn.NewDefaultBind(), logger)
 	logger.Verbosef("Device started")
 
+	term := make(chan os.Signal, 1) // channel for termination
+
+	// health endpoints
+	var healthServer *health.Server
+	if *healthListen != "" {
+		healthServer = health.NewServer(*healthListen, device)
+		healthServer.SetLogLevel(runtimeLogLevel)
+		if userspaceTun != nil {
+			healthServer.SetNat(userspaceTun)
+			expvar.Publish("tun", userspaceTun.Expvar())
+		}
+		healthServer.SetDebug(*debugEndpoints)
+		healthServer.Start(func(err error) {
+			logger.Errorf("Health server failed: %v", err)
+			// a pending signal already stops the device
+			select {
+			case term <- syscall.SIGTERM:
+			default:
+			}
+		})
+		logger.Verbosef("Health server listening on %s", *healthListen)
+	}
+
+	// save the configuration after every change if a state file is used
+	var configDevice state.Device = device
+	var persistentDevice *state.PersistentDevice
+	if *stateFile != "" {
+		persistentDevice = state.NewPersistentDevice(device, *stateFile, *privateKeyFile, *presharedKeyDir, 1*time.Second, logger)
+		configDevice = persistentDevice
+	}
+
 	// keys (change these)
 	privateKeyServer := "__PLACEHOLDER__"
 	publicKeyPeer := "__PLACEHOLDER__"
 
-	privServer, err := wgtypes.ParseKey(privateKeyServer)
+	var privServer wgtypes.Key
+	if *privateKeyFile != "" {
+		privServer, err = state.ReadKeyFile(*privateKeyFile)
+	} else {
+		privServer, err = wgtypes.ParseKey(privateKeyServer)
+	}
 	if err != nil {
 		logger.Errorf("Invalid server private key provided: %w", err)
 		os.Exit(1)
@@ -76,14 +202,47 @@ func main() {
 		},
 	}
 
-	if err := device.IpcSet(&config); err != nil {
+	// restore the previous configuration if there is one
+	if *stateFile != "" {
+		savedConfig, err := state.Load(*stateFile)
+		if err == nil {
+			logger.Verbosef("Restoring configuration from %s", *stateFile)
+			if savedConfig.PrivateKey == nil {
+				savedConfig.PrivateKey = &privServer
+			}
+			config = *savedConfig
+		} else if !os.IsNotExist(err) {
+			logger.Errorf("Failed to load state file: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := configDevice.IpcSet(&config); err != nil {
 		logger.Errorf("Failed to Set Config: %v", err)
 		os.Exit(1)
 	}
 
-	term := make(chan os.Signal, 1) // channel for termination
-
 	device.AddEvent(uwgtun.EventUp) // start up the device
+	if healthServer != nil {
+		healthServer.SetReady(true)
+	}
+
+	// systemd notifications (no-op if not run as a Type=notify service)
+	notifier := sdnotify.New()
+	notifyStatus := func() bool {
+		wgDevice, err := device.IpcGet()
+		if err != nil {
+			return false
+		}
+		notifier.Status(fmt.Sprintf("%d peers", len(wgDevice.Peers)))
+		return true
+	}
+	if err := notifier.Ready(); err != nil {
+		logger.Errorf("Failed to notify systemd: %v", err)
+	}
+	notifyStatus()
+	watchdogCtx, watchdogCancel := context.WithCancel(context.Background())
+	go notifier.RunWatchdog(watchdogCtx, notifyStatus)
 
 	// wait for program to terminate
 	signal.Notify(term, syscall.SIGTERM)
@@ -95,5 +254,23 @@ func main() {
 	}
 
 	// clean up
+	notifier.Stopping()
+	watchdogCancel()
+	if persistentDevice != nil {
+		if err := persistentDevice.Stop(); err != nil {
+			logger.Errorf("Failed to save state file: %v", err)
+		}
+	}
+	if healthServer != nil {
+		healthServer.SetReady(false)
+		if err := healthServer.Stop(); err != nil {
+			logger.Errorf("Failed to stop health server: %v", err)
+		}
+	}
+	if *natStateFile != "" && userspaceTun != nil {
+		if err := userspaceTun.SaveNatState(*natStateFile); err != nil {
+			logger.Errorf("Failed to save NAT state file: %v", err)
+		}
+	}
 	device.Close()
 }
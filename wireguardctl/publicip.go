@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/urnetwork/connect/wireguard/tun"
+)
+
+// publicIPs parses the public addresses given on the command line,
+// or discovers them from the host if both are empty.
+func publicIPs(publicIPv4 string, publicIPv6 string, stunServer string) (*net.IP, *net.IP, error) {
+	if publicIPv4 == "" && publicIPv6 == "" {
+		return tun.DiscoverPublicIPs(stunServer)
+	}
+	parse := func(s string, ipv4 bool) (*net.IP, error) {
+		if s == "" {
+			return nil, nil
+		}
+		ip := net.ParseIP(s)
+		if ip == nil || (ip.To4() != nil) != ipv4 {
+			return nil, fmt.Errorf("invalid public IP address %q", s)
+		}
+		return &ip, nil
+	}
+	ipv4, err := parse(publicIPv4, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipv6, err := parse(publicIPv6, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ipv4, ipv6, nil
+}
@@ -0,0 +1,105 @@
+// Package sdnotify implements the systemd notify protocol (sd_notify) without cgo.
+//
+// A notification is a single datagram sent to the unix socket in $NOTIFY_SOCKET.
+// When $NOTIFY_SOCKET is not set (i.e. the service is not run with Type=notify) every call is a no-op.
+package sdnotify
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	StateReady    = "READY=1"
+	StateStopping = "STOPPING=1"
+	StateWatchdog = "WATCHDOG=1"
+)
+
+type Notifier struct {
+	socketAddr       *net.UnixAddr // nil if notifications are disabled
+	watchdogInterval time.Duration // 0 if the watchdog is disabled
+}
+
+// New creates a Notifier from the environment ($NOTIFY_SOCKET, $WATCHDOG_USEC and $WATCHDOG_PID).
+func New() *Notifier {
+	n := &Notifier{}
+
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return n
+	}
+	// NOTE: a leading "@" (abstract socket) is handled by the net package
+	n.socketAddr = &net.UnixAddr{Name: socket, Net: "unixgram"}
+
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		// the watchdog is meant for another process
+		return n
+	}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && 0 < usec {
+		// pet the watchdog twice per timeout as recommended by sd_watchdog_enabled(3)
+		n.watchdogInterval = time.Duration(usec) * time.Microsecond / 2
+	}
+	return n
+}
+
+// Enabled returns true if notifications are sent to systemd.
+func (n *Notifier) Enabled() bool {
+	return n.socketAddr != nil
+}
+
+// WatchdogInterval returns the interval at which the watchdog must be notified, or 0 if the watchdog is disabled.
+func (n *Notifier) WatchdogInterval() time.Duration {
+	return n.watchdogInterval
+}
+
+// Notify sends a newline separated list of state assignments (e.g. "READY=1") to systemd.
+func (n *Notifier) Notify(state string) error {
+	if n.socketAddr == nil {
+		return nil
+	}
+	conn, err := net.DialUnix(n.socketAddr.Net, nil, n.socketAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func (n *Notifier) Ready() error {
+	return n.Notify(StateReady)
+}
+
+func (n *Notifier) Stopping() error {
+	return n.Notify(StateStopping)
+}
+
+// Status sends a free-form status line that is shown by `systemctl status`.
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+// RunWatchdog notifies the watchdog at WatchdogInterval() while healthy returns true, until ctx is done.
+//
+// If the watchdog is disabled, RunWatchdog returns immediately.
+func (n *Notifier) RunWatchdog(ctx context.Context, healthy func() bool) {
+	if n.socketAddr == nil || n.watchdogInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(n.watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// an unhealthy device does not pet the watchdog so that systemd restarts the service
+			if healthy() {
+				n.Notify(StateWatchdog)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package sdnotify
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen creates a unix datagram socket and points $NOTIFY_SOCKET at it.
+func listen(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to receive notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifyDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	t.Setenv("WATCHDOG_USEC", "1000")
+	n := New()
+	if n.Enabled() {
+		t.Fatalf("notifier should be disabled without NOTIFY_SOCKET")
+	}
+	if n.WatchdogInterval() != 0 {
+		t.Fatalf("watchdog should be disabled without NOTIFY_SOCKET")
+	}
+	if err := n.Ready(); err != nil {
+		t.Fatalf("Ready() should be a no-op, got %v", err)
+	}
+	// returns immediately
+	n.RunWatchdog(context.Background(), func() bool { return true })
+}
+
+func TestNotify(t *testing.T) {
+	conn := listen(t)
+	n := New()
+	if !n.Enabled() {
+		t.Fatalf("notifier should be enabled")
+	}
+
+	if err := n.Ready(); err != nil {
+		t.Fatalf("Ready() error = %v", err)
+	}
+	if got := receive(t, conn); got != StateReady {
+		t.Fatalf("got %q, want %q", got, StateReady)
+	}
+
+	if err := n.Status("peers=2"); err != nil {
+		t.Fatalf("Status() error = %v", err)
+	}
+	if got := receive(t, conn); got != "STATUS=peers=2" {
+		t.Fatalf("got %q, want %q", got, "STATUS=peers=2")
+	}
+
+	if err := n.Stopping(); err != nil {
+		t.Fatalf("Stopping() error = %v", err)
+	}
+	if got := receive(t, conn); got != StateStopping {
+		t.Fatalf("got %q, want %q", got, StateStopping)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	conn := listen(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	n := New()
+	if n.WatchdogInterval() != 10*time.Millisecond {
+		t.Fatalf("WatchdogInterval() = %v, want %v", n.WatchdogInterval(), 10*time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.RunWatchdog(ctx, func() bool { return true })
+	}()
+	for i := 0; i < 2; i++ {
+		if got := receive(t, conn); got != StateWatchdog {
+			t.Fatalf("got %q, want %q", got, StateWatchdog)
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestWatchdogOtherPid(t *testing.T) {
+	listen(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if n := New(); n.WatchdogInterval() != 0 {
+		t.Fatalf("watchdog should be disabled for another pid")
+	}
+}
@@ -0,0 +1,352 @@
+// Package state persists the configuration of a WireGuard device to a state file,
+// so that a server can come back with the same peers after a restart.
+//
+// The keys of the device are never written to the state file, so that it can be copied and backed up.
+// Instead, the state file references the key file the private key is read from,
+// and the key files the preshared keys of the peers are written to (see Save).
+package state
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urnetwork/userwireguard/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const stateFileVersion = 1
+
+// Methods needed from a WireGuard device to export and apply its configuration
+type Device interface {
+	IpcSet(deviceConfig *wgtypes.Config) error
+	IpcGet() (*wgtypes.Device, error)
+}
+
+type stateFile struct {
+	Version        int         `json:"version"`
+	PrivateKeyFile string      `json:"private_key_file,omitempty"`
+	ListenPort     int         `json:"listen_port,omitempty"`
+	FirewallMark   int         `json:"firewall_mark,omitempty"`
+	Peers          []statePeer `json:"peers"`
+}
+
+type statePeer struct {
+	PublicKey           string   `json:"public_key"`
+	PresharedKeyFile    string   `json:"preshared_key_file,omitempty"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	PersistentKeepalive string   `json:"persistent_keepalive,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+}
+
+// ExportConfig captures the current configuration of the device (without the private key),
+// such that applying it replaces all peers of a device with the current ones.
+func ExportConfig(device Device) (*wgtypes.Config, error) {
+	wgDevice, err := device.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	listenPort := wgDevice.ListenPort
+	firewallMark := wgDevice.FirewallMark
+	cfg := &wgtypes.Config{
+		ListenPort:   &listenPort,
+		FirewallMark: &firewallMark,
+		ReplacePeers: true,
+		Peers:        make([]wgtypes.PeerConfig, 0, len(wgDevice.Peers)),
+	}
+	for _, peer := range wgDevice.Peers {
+		peerConfig := wgtypes.PeerConfig{
+			PublicKey:         peer.PublicKey,
+			Endpoint:          peer.Endpoint,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        peer.AllowedIPs,
+		}
+		if peer.PresharedKey != (wgtypes.Key{}) {
+			presharedKey := peer.PresharedKey
+			peerConfig.PresharedKey = &presharedKey
+		}
+		if peer.PersistentKeepaliveInterval != 0 {
+			interval := peer.PersistentKeepaliveInterval
+			peerConfig.PersistentKeepaliveInterval = &interval
+		}
+		cfg.Peers = append(cfg.Peers, peerConfig)
+	}
+	return cfg, nil
+}
+
+// presharedKeyExt is the extension of the preshared key files written by Save.
+const presharedKeyExt = ".psk"
+
+// Save writes the configuration atomically to path. Any private key in the configuration is ignored,
+// privateKeyFile is stored in its place.
+//
+// The preshared keys of the peers are written to a key file per peer in presharedKeyDir, which the state file references,
+// and the key files of peers that are gone are removed. If presharedKeyDir is empty, the preshared keys are not saved,
+// and the peers with a preshared key have to be configured again after a restart.
+func Save(path string, cfg *wgtypes.Config, privateKeyFile string, presharedKeyDir string) error {
+	state := stateFile{
+		Version:        stateFileVersion,
+		PrivateKeyFile: privateKeyFile,
+		Peers:          make([]statePeer, 0, len(cfg.Peers)),
+	}
+	if cfg.ListenPort != nil {
+		state.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		state.FirewallMark = *cfg.FirewallMark
+	}
+	if presharedKeyDir != "" {
+		if err := os.MkdirAll(presharedKeyDir, 0700); err != nil {
+			return fmt.Errorf("failed to create preshared key directory: %w", err)
+		}
+	}
+	for _, peer := range cfg.Peers {
+		p := statePeer{
+			PublicKey:  peer.PublicKey.String(),
+			AllowedIPs: make([]string, 0, len(peer.AllowedIPs)),
+		}
+		if peer.PresharedKey != nil && presharedKeyDir != "" {
+			p.PresharedKeyFile = filepath.Join(presharedKeyDir, presharedKeyFileName(peer.PublicKey))
+			if err := writeFileAtomic(p.PresharedKeyFile, []byte(peer.PresharedKey.String()+"\n")); err != nil {
+				return fmt.Errorf("failed to write preshared key of peer %s: %w", peer.PublicKey, err)
+			}
+		}
+		if peer.Endpoint != nil {
+			p.Endpoint = peer.Endpoint.String()
+		}
+		if peer.PersistentKeepaliveInterval != nil {
+			p.PersistentKeepalive = peer.PersistentKeepaliveInterval.String()
+		}
+		for _, allowedIP := range peer.AllowedIPs {
+			p.AllowedIPs = append(p.AllowedIPs, allowedIP.String())
+		}
+		state.Peers = append(state.Peers, p)
+	}
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, content); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if presharedKeyDir != "" {
+		return removeStalePresharedKeys(presharedKeyDir, state.Peers)
+	}
+	return nil
+}
+
+// presharedKeyFileName is the name of the preshared key file of a peer.
+func presharedKeyFileName(publicKey wgtypes.Key) string {
+	// hex rather than base64, which is not safe in file names
+	return hex.EncodeToString(publicKey[:]) + presharedKeyExt
+}
+
+// removeStalePresharedKeys removes the preshared key files in dir that are not referenced by peers,
+// such as the key files of removed peers. Other files in dir are kept.
+func removeStalePresharedKeys(dir string, peers []statePeer) error {
+	referenced := map[string]bool{}
+	for _, p := range peers {
+		if p.PresharedKeyFile != "" {
+			referenced[filepath.Base(p.PresharedKeyFile)] = true
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list preshared keys: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		publicKey, ok := strings.CutSuffix(name, presharedKeyExt)
+		if !ok || referenced[name] {
+			continue
+		}
+		if _, err := hex.DecodeString(publicKey); err != nil || len(publicKey) != 2*wgtypes.KeyLen {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to remove preshared key: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes content to a file readable only by the owner.
+// The content is written to a temporary file in the same directory which is renamed, so that the file is never partially written.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads the configuration from the state file at path, including the private and preshared keys from the referenced key files.
+// The returned configuration replaces all peers when applied.
+func Load(path string) (*wgtypes.Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state stateFile
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file: %w", err)
+	}
+	if state.Version != stateFileVersion {
+		return nil, fmt.Errorf("unsupported state file version %d", state.Version)
+	}
+
+	cfg := &wgtypes.Config{
+		ListenPort:   &state.ListenPort,
+		FirewallMark: &state.FirewallMark,
+		ReplacePeers: true,
+		Peers:        make([]wgtypes.PeerConfig, 0, len(state.Peers)),
+	}
+	if state.PrivateKeyFile != "" {
+		privateKey, err := ReadKeyFile(state.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.PrivateKey = &privateKey
+	}
+	for _, p := range state.Peers {
+		publicKey, err := wgtypes.ParseKey(p.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer public key: %w", err)
+		}
+		peer := wgtypes.PeerConfig{
+			PublicKey:         publicKey,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        make([]net.IPNet, 0, len(p.AllowedIPs)),
+		}
+		if p.PresharedKeyFile != "" {
+			presharedKey, err := ReadKeyFile(p.PresharedKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer %s preshared key: %w", p.PublicKey, err)
+			}
+			peer.PresharedKey = &presharedKey
+		}
+		if p.Endpoint != "" {
+			peer.Endpoint, err = net.ResolveUDPAddr("udp", p.Endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer %s endpoint: %w", p.PublicKey, err)
+			}
+		}
+		if p.PersistentKeepalive != "" {
+			interval, err := time.ParseDuration(p.PersistentKeepalive)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer %s persistent keepalive: %w", p.PublicKey, err)
+			}
+			peer.PersistentKeepaliveInterval = &interval
+		}
+		for _, allowedIP := range p.AllowedIPs {
+			_, ipnet, err := net.ParseCIDR(allowedIP)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer %s allowed ip: %w", p.PublicKey, err)
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, *ipnet)
+		}
+		cfg.Peers = append(cfg.Peers, peer)
+	}
+	return cfg, nil
+}
+
+// ReadKeyFile reads a base64 encoded key (as generated by `wg genkey`) from a file.
+func ReadKeyFile(path string) (wgtypes.Key, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("failed to read key file: %w", err)
+	}
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(content)))
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("invalid key in %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// PersistentDevice saves the configuration of a device to a state file after every successful IpcSet.
+//
+// Saves are debounced, so that a burst of IpcSet calls results in a single write.
+type PersistentDevice struct {
+	Device
+	path            string
+	privateKeyFile  string
+	presharedKeyDir string
+	delay           time.Duration
+	log             *logger.Logger
+
+	stateLock sync.Mutex
+	timer     *time.Timer
+}
+
+// NewPersistentDevice saves the configuration of device to the state file at path, see Save for the key files.
+func NewPersistentDevice(device Device, path string, privateKeyFile string, presharedKeyDir string, delay time.Duration, log *logger.Logger) *PersistentDevice {
+	return &PersistentDevice{
+		Device:          device,
+		path:            path,
+		privateKeyFile:  privateKeyFile,
+		presharedKeyDir: presharedKeyDir,
+		delay:           delay,
+		log:             log,
+	}
+}
+
+func (d *PersistentDevice) IpcSet(deviceConfig *wgtypes.Config) error {
+	if err := d.Device.IpcSet(deviceConfig); err != nil {
+		return err
+	}
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	if d.timer == nil {
+		d.timer = time.AfterFunc(d.delay, func() {
+			if err := d.Flush(); err != nil {
+				d.log.Errorf("Failed to save state file: %v", err)
+			}
+		})
+	} else {
+		d.timer.Reset(d.delay)
+	}
+	return nil
+}
+
+// Flush saves the current configuration immediately.
+func (d *PersistentDevice) Flush() error {
+	cfg, err := ExportConfig(d.Device)
+	if err != nil {
+		return err
+	}
+	return Save(d.path, cfg, d.privateKeyFile, d.presharedKeyDir)
+}
+
+// Stop stops any pending save and saves the current configuration.
+func (d *PersistentDevice) Stop() error {
+	d.stateLock.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.stateLock.Unlock()
+	return d.Flush()
+}
@@ -0,0 +1,274 @@
+package state
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urnetwork/userwireguard/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeDevice applies configs to an in-memory wgtypes.Device like the userspace device does.
+type fakeDevice struct {
+	mu       sync.Mutex
+	device   wgtypes.Device
+	setCalls int
+}
+
+func (d *fakeDevice) IpcSet(cfg *wgtypes.Config) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.setCalls += 1
+	if cfg.PrivateKey != nil {
+		d.device.PrivateKey = *cfg.PrivateKey
+		d.device.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ListenPort != nil {
+		d.device.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		d.device.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		d.device.Peers = nil
+	}
+	for _, peerConfig := range cfg.Peers {
+		i := 0
+		for ; i < len(d.device.Peers); i++ {
+			if d.device.Peers[i].PublicKey == peerConfig.PublicKey {
+				break
+			}
+		}
+		if i == len(d.device.Peers) {
+			d.device.Peers = append(d.device.Peers, wgtypes.Peer{PublicKey: peerConfig.PublicKey})
+		}
+		peer := &d.device.Peers[i]
+		if peerConfig.PresharedKey != nil {
+			peer.PresharedKey = *peerConfig.PresharedKey
+		}
+		if peerConfig.Endpoint != nil {
+			peer.Endpoint = peerConfig.Endpoint
+		}
+		if peerConfig.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *peerConfig.PersistentKeepaliveInterval
+		}
+		if peerConfig.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, peerConfig.AllowedIPs...)
+	}
+	return nil
+}
+
+func (d *fakeDevice) IpcGet() (*wgtypes.Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	device := d.device
+	device.Peers = append([]wgtypes.Peer(nil), d.device.Peers...)
+	return &device, nil
+}
+
+func mustKey(t *testing.T) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func mustCIDR(s string) net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *ipnet
+}
+
+func testConfig(t *testing.T, privateKey wgtypes.Key) *wgtypes.Config {
+	port := 51820
+	mark := 7
+	keepalive := 25 * time.Second
+	presharedKey := mustKey(t)
+	return &wgtypes.Config{
+		PrivateKey:   &privateKey,
+		ListenPort:   &port,
+		FirewallMark: &mark,
+		ReplacePeers: true,
+		Peers: []wgtypes.PeerConfig{
+			{
+				PublicKey:                   mustKey(t).PublicKey(),
+				PresharedKey:                &presharedKey,
+				Endpoint:                    &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820},
+				PersistentKeepaliveInterval: &keepalive,
+				ReplaceAllowedIPs:           true,
+				AllowedIPs:                  []net.IPNet{mustCIDR("192.168.90.2/32"), mustCIDR("fd00::2/128")},
+			},
+			{
+				PublicKey:         mustKey(t).PublicKey(),
+				ReplaceAllowedIPs: true,
+				AllowedIPs:        []net.IPNet{mustCIDR("192.168.90.3/32")},
+			},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	privateKey := mustKey(t)
+	keyFile := filepath.Join(dir, "private.key")
+	if err := os.WriteFile(keyFile, []byte(privateKey.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(dir, "state.json")
+	presharedKeyDir := filepath.Join(dir, "psk")
+
+	// configure
+	device := &fakeDevice{}
+	if err := device.IpcSet(testConfig(t, privateKey)); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := device.IpcGet()
+
+	// export
+	cfg, err := ExportConfig(device)
+	if err != nil {
+		t.Fatalf("ExportConfig() error = %v", err)
+	}
+	if cfg.PrivateKey != nil {
+		t.Fatalf("exported config should not contain the private key")
+	}
+	if err := Save(statePath, cfg, keyFile, presharedKeyDir); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	content, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), privateKey.String()) {
+		t.Fatalf("state file contains the private key")
+	}
+	presharedKey := want.Peers[0].PresharedKey
+	if strings.Contains(string(content), presharedKey.String()) {
+		t.Fatalf("state file contains the preshared key")
+	}
+	presharedKeyFile := filepath.Join(presharedKeyDir, presharedKeyFileName(want.Peers[0].PublicKey))
+	if info, err := os.Stat(presharedKeyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected a preshared key file readable only by the owner, got %v", err)
+	}
+
+	// wipe and restore
+	restored := &fakeDevice{}
+	loaded, err := Load(statePath)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err := restored.IpcSet(loaded); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := restored.IpcGet()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored device = %+v, want %+v", got, want)
+	}
+}
+
+func TestSavePresharedKeys(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	presharedKeyDir := filepath.Join(dir, "psk")
+	cfg := testConfig(t, mustKey(t))
+	peer := cfg.Peers[0]
+
+	// without a preshared key directory, the preshared keys are not saved
+	if err := Save(statePath, cfg, "", ""); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	loaded, err := Load(statePath)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if loaded.Peers[0].PresharedKey != nil {
+		t.Fatalf("expected no preshared key without a preshared key directory")
+	}
+
+	// the key files of removed peers are removed, other files are kept
+	if err := Save(statePath, cfg, "", presharedKeyDir); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	other := filepath.Join(presharedKeyDir, "README")
+	if err := os.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Peers = cfg.Peers[1:]
+	if err := Save(statePath, cfg, "", presharedKeyDir); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(presharedKeyDir, presharedKeyFileName(peer.PublicKey))); !os.IsNotExist(err) {
+		t.Fatalf("expected the preshared key file of the removed peer to be removed, got %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("expected other files to be kept, got %v", err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Fatalf("Load() should fail for a missing file")
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(corrupt, []byte("{"), 0600)
+	if _, err := Load(corrupt); err == nil {
+		t.Fatalf("Load() should fail for a corrupt file")
+	}
+
+	missingKey := filepath.Join(dir, "missing-key.json")
+	os.WriteFile(missingKey, []byte(`{"version": 1, "private_key_file": "/nonexistent/key", "peers": []}`), 0600)
+	if _, err := Load(missingKey); err == nil {
+		t.Fatalf("Load() should fail for a missing key file")
+	}
+}
+
+func TestPersistentDeviceDebounce(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	device := NewPersistentDevice(&fakeDevice{}, statePath, "", "", 100*time.Millisecond, logger.NewLogger(logger.LogLevelSilent, ""))
+
+	cfg := testConfig(t, mustKey(t))
+	for i := 0; i < 5; i++ {
+		if err := device.IpcSet(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("state file should not be written before the debounce delay")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(statePath); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state file was not written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	loaded, err := Load(statePath)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(loaded.Peers) != 2 {
+		t.Fatalf("got %d peers, want 2", len(loaded.Peers))
+	}
+
+	if err := device.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+}